@@ -0,0 +1,196 @@
+// Package capture reads SIP messages from pcap and pcapng files.
+//
+// Frames are decoded down to UDP or TCP in pure Go, fragmented IPv4 and
+// IPv6 packets are reassembled, and the payloads sent to or from the
+// configured ports, or that look like SIP when no ports are set, are
+// parsed with siprocket. TCP streams are put back in order and split into
+// messages by a Reassembler, which together with a Decoder can also be
+// fed with frames read from a live raw socket.
+package capture
+
+import (
+	"bytes"
+	"io"
+	"net/netip"
+	"time"
+
+	"github.com/nullboundary/siprocket"
+)
+
+// Fragments not completed within this time are dropped
+const FRAGMENT_TIMEOUT = 30 * time.Second
+
+// Packet is a UDP datagram or TCP segment
+type Packet struct {
+	Time    time.Time
+	Tuple   siprocket.FiveTuple
+	Payload []byte
+
+	// TCP only
+	Seq   uint32
+	Ack   uint32
+	Flags uint8
+}
+
+// Message is a parsed SIP message and where it was seen
+type Message struct {
+	Time  time.Time
+	Tuple siprocket.FiveTuple
+	Msg   siprocket.SipMsg
+	Raw   []byte // The message as captured
+}
+
+// Decoder turns link layer frames into packets, it keeps the fragments
+// of incomplete IP packets so must be fed every frame of a capture
+type Decoder struct {
+	defrag *defragmenter
+}
+
+func NewDecoder() *Decoder {
+	return &Decoder{defrag: newDefragmenter(FRAGMENT_TIMEOUT)}
+}
+
+// Decode returns the UDP or TCP packet in the frame. The bool is false
+// when the frame holds a fragment that does not complete a packet yet or
+// a protocol other than UDP and TCP.
+func (d *Decoder) Decode(at time.Time, linkType uint32, frame []byte) (Packet, bool, error) {
+	var pkt Packet
+	b, err := linkPayload(linkType, frame)
+	if err != nil {
+		return pkt, false, err
+	}
+	ip, err := decodeIP(b)
+	if err != nil {
+		return pkt, false, err
+	}
+	if ip.fragment {
+		var ok bool
+		if ip, ok = d.defrag.add(at, ip); !ok {
+			return pkt, false, nil
+		}
+	}
+	t, err := decodeTransport(ip.proto, ip.payload)
+	if err == errProto {
+		return pkt, false, nil
+	} else if err != nil {
+		return pkt, false, err
+	}
+
+	pkt.Time = at
+	pkt.Tuple = siprocket.FiveTuple{
+		Proto: t.proto,
+		Src:   netip.AddrPortFrom(ip.src, t.srcPort),
+		Dst:   netip.AddrPortFrom(ip.dst, t.dstPort),
+	}
+	pkt.Payload = t.payload
+	pkt.Seq, pkt.Ack, pkt.Flags = t.seq, t.ack, t.flags
+	return pkt, true, nil
+}
+
+// Reader reads the SIP messages of a capture file
+type Reader struct {
+	Ports []uint16 // SIP ports, when empty any payload that looks like SIP is parsed
+
+	frames  FrameReader
+	decoder *Decoder
+	tcp     *Reassembler
+	queue   []Message
+	expired time.Time
+	eof     bool
+}
+
+// NewReader reads a pcap or pcapng file
+func NewReader(r io.Reader) (*Reader, error) {
+	frames, err := NewFrameReader(r)
+	if err != nil {
+		return nil, err
+	}
+	return &Reader{frames: frames, decoder: NewDecoder(), tcp: NewReassembler()}, nil
+}
+
+// NextPacket returns the next UDP or TCP packet of the file, frames that
+// cannot be decoded are skipped
+func (r *Reader) NextPacket() (Packet, error) {
+	for {
+		f, err := r.frames.Next()
+		if err != nil {
+			return Packet{}, err
+		}
+		if pkt, ok, err := r.decoder.Decode(f.Time, f.LinkType, f.Data); ok && err == nil {
+			return pkt, nil
+		}
+	}
+}
+
+// Next returns the next SIP message of the file, or io.EOF at its end.
+// Each UDP datagram is parsed as one message while TCP streams are
+// reassembled first, keepalives are skipped.
+func (r *Reader) Next() (Message, error) {
+	for {
+		if len(r.queue) > 0 {
+			m := r.queue[0]
+			r.queue = r.queue[1:]
+			return m, nil
+		}
+		if r.eof {
+			return Message{}, io.EOF
+		}
+
+		pkt, err := r.NextPacket()
+		if err == io.EOF {
+			r.eof = true
+			r.queue = r.tcp.Flush()
+			continue
+		} else if err != nil {
+			return Message{}, err
+		}
+
+		if pkt.Time.Sub(r.expired) > r.tcp.GapTimeout {
+			r.queue = append(r.queue, r.tcp.Expire(pkt.Time)...)
+			r.expired = pkt.Time
+		}
+		if pkt.Tuple.Proto == "tcp" {
+			if r.wantedTcp(&pkt) {
+				r.queue = append(r.queue, r.tcp.Add(&pkt)...)
+			}
+			continue
+		}
+		if r.wanted(&pkt) {
+			r.queue = append(r.queue, Message{Time: pkt.Time, Tuple: pkt.Tuple, Msg: siprocket.Parse(pkt.Payload), Raw: pkt.Payload})
+		}
+	}
+}
+
+// wantedTcp tells if the segment belongs to a SIP connection, without
+// ports a connection is followed from its first segment that looks like SIP
+func (r *Reader) wantedTcp(pkt *Packet) bool {
+	if len(r.Ports) > 0 {
+		return MatchPorts(r.Ports, pkt.Tuple)
+	}
+	return r.tcp.Tracking(pkt.Tuple) || IsSip(pkt.Payload)
+}
+
+func (r *Reader) wanted(pkt *Packet) bool {
+	if len(r.Ports) == 0 {
+		return IsSip(pkt.Payload)
+	}
+	if !MatchPorts(r.Ports, pkt.Tuple) {
+		return false
+	}
+	return len(bytes.TrimSpace(pkt.Payload)) > 0
+}
+
+// MatchPorts tells if either end of the tuple uses one of the ports
+func MatchPorts(ports []uint16, t siprocket.FiveTuple) bool {
+	for _, p := range ports {
+		if t.Src.Port() == p || t.Dst.Port() == p {
+			return true
+		}
+	}
+	return false
+}
+
+// IsSip tells if the payload starts with a SIP request or status line
+func IsSip(payload []byte) bool {
+	return siprocket.IsSipStart(payload)
+}
@@ -0,0 +1,258 @@
+package capture
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net/netip"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/nullboundary/siprocket"
+)
+
+const testInvite = "INVITE sip:bob@10.0.0.2 SIP/2.0\r\n" +
+	"Via: SIP/2.0/UDP 10.0.0.1:5060;branch=z9hG4bK1\r\n" +
+	"From: <sip:alice@10.0.0.1>;tag=a1\r\n" +
+	"To: <sip:bob@10.0.0.2>\r\n" +
+	"Call-ID: cap-1\r\n" +
+	"CSeq: 1 INVITE\r\n" +
+	"Content-Length: 0\r\n\r\n"
+
+const testOk = "SIP/2.0 200 OK\r\n" +
+	"Via: SIP/2.0/UDP 10.0.0.1:5060;branch=z9hG4bK1\r\n" +
+	"Call-ID: cap-1\r\n" +
+	"CSeq: 1 INVITE\r\n" +
+	"Content-Length: 0\r\n\r\n"
+
+func udp(sport, dport uint16, payload []byte) []byte {
+	b := binary.BigEndian.AppendUint16(nil, sport)
+	b = binary.BigEndian.AppendUint16(b, dport)
+	b = binary.BigEndian.AppendUint16(b, uint16(8+len(payload)))
+	b = append(b, 0, 0)
+	return append(b, payload...)
+}
+
+func tcp(sport, dport uint16, seq uint32, flags uint8, payload []byte) []byte {
+	b := binary.BigEndian.AppendUint16(nil, sport)
+	b = binary.BigEndian.AppendUint16(b, dport)
+	b = binary.BigEndian.AppendUint32(b, seq)
+	b = binary.BigEndian.AppendUint32(b, 0)
+	b = append(b, 5<<4, flags, 0xff, 0xff, 0, 0, 0, 0)
+	return append(b, payload...)
+}
+
+// ipv4 builds an IPv4 header, offset is in bytes
+func ipv4(src, dst string, proto uint8, id uint16, offset int, more bool, payload []byte) []byte {
+	b := []byte{0x45, 0}
+	b = binary.BigEndian.AppendUint16(b, uint16(20+len(payload)))
+	b = binary.BigEndian.AppendUint16(b, id)
+	frag := uint16(offset / 8)
+	if more {
+		frag |= 0x2000
+	}
+	b = binary.BigEndian.AppendUint16(b, frag)
+	b = append(b, 64, proto, 0, 0)
+	b = append(b, netip.MustParseAddr(src).AsSlice()...)
+	b = append(b, netip.MustParseAddr(dst).AsSlice()...)
+	return append(b, payload...)
+}
+
+// ipv6 builds an IPv6 header with a destination options header and, when
+// frag is set, a fragment header
+func ipv6(src, dst string, proto uint8, frag *[2]int, payload []byte) []byte {
+	var ext []byte
+	// Destination options with a PadN of 6 bytes
+	next := uint8(60)
+	ext = append(ext, 0, 0, 1, 4, 0, 0, 0, 0)
+	if frag != nil {
+		ext[0] = 44
+		f := uint16(frag[0]) | uint16(frag[1])
+		ext = append(ext, proto, 0)
+		ext = binary.BigEndian.AppendUint16(ext, f)
+		ext = binary.BigEndian.AppendUint32(ext, 99)
+	} else {
+		ext[0] = proto
+	}
+
+	b := []byte{0x60, 0, 0, 0}
+	b = binary.BigEndian.AppendUint16(b, uint16(len(ext)+len(payload)))
+	b = append(b, next, 64)
+	b = append(b, netip.MustParseAddr(src).AsSlice()...)
+	b = append(b, netip.MustParseAddr(dst).AsSlice()...)
+	b = append(b, ext...)
+	return append(b, payload...)
+}
+
+// ether wraps an IP packet in Ethernet with the given VLAN tags
+func ether(ip []byte, vlans ...uint16) []byte {
+	b := make([]byte, 12)
+	for _, v := range vlans {
+		b = binary.BigEndian.AppendUint16(b, etherTypeVlan)
+		b = binary.BigEndian.AppendUint16(b, v)
+	}
+	etherType := uint16(etherTypeIPv4)
+	if ip[0]>>4 == 6 {
+		etherType = etherTypeIPv6
+	}
+	b = binary.BigEndian.AppendUint16(b, etherType)
+	return append(b, ip...)
+}
+
+func sll(ip []byte) []byte {
+	b := make([]byte, 14)
+	etherType := uint16(etherTypeIPv4)
+	if ip[0]>>4 == 6 {
+		etherType = etherTypeIPv6
+	}
+	b = binary.BigEndian.AppendUint16(b, etherType)
+	return append(b, ip...)
+}
+
+func Test_capture_Decode(t *testing.T) {
+
+	at := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+	payload := []byte("hello")
+	tests := []struct {
+		name     string
+		linkType uint32
+		frame    []byte
+		exp      Packet
+	}{
+		{"vlan", LINKTYPE_ETHERNET, ether(ipv4("10.0.0.1", "10.0.0.2", protoUDP, 1, 0, false, udp(5060, 5080, payload)), 10, 20),
+			Packet{Time: at, Tuple: siprocket.NewFiveTuple("udp", "10.0.0.1:5060", "10.0.0.2:5080"), Payload: payload}},
+		{"sll", LINKTYPE_LINUX_SLL, sll(ipv4("10.0.0.1", "10.0.0.2", protoTCP, 1, 0, false, tcp(5060, 40000, 1000, TCP_PSH|TCP_ACK, payload))),
+			Packet{Time: at, Tuple: siprocket.NewFiveTuple("tcp", "10.0.0.1:5060", "10.0.0.2:40000"), Payload: payload, Seq: 1000, Flags: TCP_PSH | TCP_ACK}},
+		{"ipv6", LINKTYPE_RAW, ipv6("2001:db8::1", "2001:db8::2", protoUDP, nil, udp(5060, 5060, payload)),
+			Packet{Time: at, Tuple: siprocket.NewFiveTuple("udp", "[2001:db8::1]:5060", "[2001:db8::2]:5060"), Payload: payload}},
+	}
+
+	for _, tc := range tests {
+		d := NewDecoder()
+		got, ok, err := d.Decode(at, tc.linkType, tc.frame)
+		if !ok || err != nil {
+			t.Errorf("%s: ok %v err %v", tc.name, ok, err)
+			continue
+		}
+		if !reflect.DeepEqual(tc.exp, got) {
+			t.Errorf("Mismatch %s:\nExpected:\n%+v\nGot:\n%+v", tc.name, tc.exp, got)
+		}
+	}
+
+	// ARP is not IP
+	arp := append(make([]byte, 12), 0x08, 0x06, 0, 1)
+	if _, ok, err := NewDecoder().Decode(at, LINKTYPE_ETHERNET, arp); ok || err != ErrNotIP {
+		t.Errorf("ARP decoded, ok %v err %v", ok, err)
+	}
+}
+
+func Test_capture_Fragments(t *testing.T) {
+
+	at := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+	dgram := udp(5060, 5060, []byte(testInvite))
+
+	// IPv4 in three fragments, the last arrives first
+	d := NewDecoder()
+	frags := [][]byte{
+		ipv4("10.0.0.1", "10.0.0.2", protoUDP, 7, 80, false, dgram[80:]),
+		ipv4("10.0.0.1", "10.0.0.2", protoUDP, 7, 0, true, dgram[:40]),
+		ipv4("10.0.0.1", "10.0.0.2", protoUDP, 7, 40, true, dgram[40:80]),
+	}
+	for i, f := range frags {
+		pkt, ok, err := d.Decode(at, LINKTYPE_RAW, f)
+		if err != nil {
+			t.Fatalf("Fragment %d: %v", i, err)
+		}
+		if ok != (i == 2) {
+			t.Fatalf("Fragment %d completed %v", i, ok)
+		}
+		if ok && string(pkt.Payload) != testInvite {
+			t.Errorf("Mismatch:\nExpected:\n%q\nGot:\n%q", testInvite, pkt.Payload)
+		}
+	}
+
+	// IPv6 in two fragments
+	first := ipv6("2001:db8::1", "2001:db8::2", protoUDP, &[2]int{0, 1}, dgram[:64])
+	second := ipv6("2001:db8::1", "2001:db8::2", protoUDP, &[2]int{64, 0}, dgram[64:])
+	if _, ok, _ := d.Decode(at, LINKTYPE_RAW, first); ok {
+		t.Fatalf("First IPv6 fragment completed")
+	}
+	pkt, ok, err := d.Decode(at, LINKTYPE_RAW, second)
+	if !ok || err != nil || string(pkt.Payload) != testInvite {
+		t.Errorf("IPv6 reassembly ok %v err %v payload %q", ok, err, pkt.Payload)
+	}
+
+	// An incomplete packet is dropped after the timeout
+	d.Decode(at, LINKTYPE_RAW, frags[1])
+	if _, ok, _ := d.Decode(at.Add(time.Minute), LINKTYPE_RAW, frags[0]); ok {
+		t.Errorf("Expired fragment reassembled")
+	}
+}
+
+func Test_capture_Reader(t *testing.T) {
+
+	at := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+	times := []time.Time{at, at.Add(time.Millisecond), at.Add(2 * time.Millisecond), at.Add(3 * time.Millisecond)}
+	frames := [][]byte{
+		ether(ipv4("10.0.0.1", "10.0.0.2", protoUDP, 1, 0, false, udp(5060, 5060, []byte(testInvite)))),
+		// A keepalive and some RTP
+		ether(ipv4("10.0.0.1", "10.0.0.2", protoUDP, 2, 0, false, udp(5060, 5060, []byte("\r\n\r\n")))),
+		ether(ipv4("10.0.0.1", "10.0.0.2", protoUDP, 3, 0, false, udp(10000, 20000, make([]byte, 172)))),
+		ether(ipv4("10.0.0.2", "10.0.0.1", protoTCP, 4, 0, false, tcp(5062, 5060, 1, TCP_PSH|TCP_ACK, []byte(testOk)))),
+	}
+	file := pcapFile(binary.LittleEndian, false, LINKTYPE_ETHERNET, times, frames...)
+
+	read := func(ports ...uint16) []Message {
+		r, err := NewReader(bytes.NewReader(file))
+		if err != nil {
+			t.Fatalf("NewReader: %v", err)
+		}
+		r.Ports = ports
+		var out []Message
+		for {
+			m, err := r.Next()
+			if err == io.EOF {
+				return out
+			}
+			if err != nil {
+				t.Fatalf("Next: %v", err)
+			}
+			out = append(out, m)
+		}
+	}
+
+	exp := []Message{
+		{Time: times[0], Tuple: siprocket.NewFiveTuple("udp", "10.0.0.1:5060", "10.0.0.2:5060"), Msg: siprocket.Parse([]byte(testInvite)), Raw: []byte(testInvite)},
+		{Time: times[3], Tuple: siprocket.NewFiveTuple("tcp", "10.0.0.2:5062", "10.0.0.1:5060"), Msg: siprocket.Parse([]byte(testOk)), Raw: []byte(testOk)},
+	}
+	// By heuristic
+	if got := read(); !reflect.DeepEqual(exp, got) {
+		t.Errorf("Mismatch:\nExpected:\n%+v\nGot:\n%+v", exp, got)
+	}
+	// By port, the other end of the TCP connection is not 5062
+	if got := read(5060); !reflect.DeepEqual(exp, got) {
+		t.Errorf("Mismatch:\nExpected:\n%+v\nGot:\n%+v", exp, got)
+	}
+	if got := read(5062); !reflect.DeepEqual(exp[1:], got) {
+		t.Errorf("Mismatch:\nExpected:\n%+v\nGot:\n%+v", exp[1:], got)
+	}
+}
+
+func Test_capture_IsSip(t *testing.T) {
+
+	tests := map[string]bool{
+		testInvite:                        true,
+		testOk:                            true,
+		"OPTIONS sip:a@b SIP/2.0\n":       true,
+		"SIP/2.0 1x0 Odd\r\n":             false,
+		"GET / HTTP/1.1\r\n":              false,
+		"\r\n\r\n":                        false,
+		"invite sip:bob@10.0.0.2 SIP/2.0": false,
+	}
+	for payload, exp := range tests {
+		if got := IsSip([]byte(payload)); got != exp {
+			t.Errorf("IsSip(%q) = %v", payload, got)
+		}
+	}
+}
@@ -0,0 +1,273 @@
+package capture
+
+/*
+ Link layers
+
+   Ethernet     dst(6) src(6) [0x8100/0x88a8 tci(2)]... ethertype(2)
+   Linux SLL    packet type(2) ARPHRD(2) addr len(2) addr(8) protocol(2)
+   Linux SLL2   protocol(2) reserved(2) ifindex(4) ARPHRD(2) packet type(1)
+                addr len(1) addr(8)
+   Null         address family(4) in the byte order of the capturing host
+   Raw          the IP header itself
+
+ RFC 791 - https://datatracker.ietf.org/doc/html/rfc791#section-3.1
+
+    0                   1                   2                   3
+    0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1
+   +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+   |Version|  IHL  |Type of Service|          Total Length         |
+   +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+   |         Identification        |Flags|      Fragment Offset    |
+   +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+   |  Time to Live |    Protocol   |         Header Checksum       |
+   +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+
+ RFC 8200 - https://datatracker.ietf.org/doc/html/rfc8200#section-4
+
+   Extension headers are chained by their Next Header field, the fragment
+   header (44) carries the offset, M flag and a 32 bit identification.
+
+*/
+
+import (
+	"encoding/binary"
+	"errors"
+	"net/netip"
+)
+
+// Link types from the tcpdump.org registry
+const (
+	LINKTYPE_NULL       = 0
+	LINKTYPE_ETHERNET   = 1
+	LINKTYPE_RAW        = 101
+	LINKTYPE_LOOP       = 108
+	LINKTYPE_LINUX_SLL  = 113
+	LINKTYPE_IPV4       = 228
+	LINKTYPE_IPV6       = 229
+	LINKTYPE_LINUX_SLL2 = 276
+)
+
+const (
+	etherTypeIPv4  = 0x0800
+	etherTypeIPv6  = 0x86dd
+	etherTypeVlan  = 0x8100
+	etherTypeQinQ  = 0x88a8
+	etherTypeVlan2 = 0x9100
+
+	protoTCP = 6
+	protoUDP = 17
+)
+
+var (
+	ErrShort    = errors.New("capture: packet truncated")
+	ErrLinkType = errors.New("capture: unsupported link type")
+	ErrNotIP    = errors.New("capture: not an IP packet")
+	errProto    = errors.New("capture: not UDP or TCP")
+)
+
+// ipPacket is an IP packet or one fragment of it
+type ipPacket struct {
+	src, dst netip.Addr
+	proto    uint8
+	payload  []byte
+
+	// Fragmentation
+	fragment bool
+	id       uint32
+	offset   int
+	more     bool
+}
+
+// linkPayload strips the link layer and returns the IP packet inside
+func linkPayload(linkType uint32, b []byte) ([]byte, error) {
+	switch linkType {
+	case LINKTYPE_ETHERNET:
+		if len(b) < 14 {
+			return nil, ErrShort
+		}
+		etherType := binary.BigEndian.Uint16(b[12:14])
+		b = b[14:]
+		for etherType == etherTypeVlan || etherType == etherTypeQinQ || etherType == etherTypeVlan2 {
+			if len(b) < 4 {
+				return nil, ErrShort
+			}
+			etherType = binary.BigEndian.Uint16(b[2:4])
+			b = b[4:]
+		}
+		return ipOnly(etherType, b)
+	case LINKTYPE_LINUX_SLL:
+		if len(b) < 16 {
+			return nil, ErrShort
+		}
+		return ipOnly(binary.BigEndian.Uint16(b[14:16]), b[16:])
+	case LINKTYPE_LINUX_SLL2:
+		if len(b) < 20 {
+			return nil, ErrShort
+		}
+		return ipOnly(binary.BigEndian.Uint16(b[0:2]), b[20:])
+	case LINKTYPE_NULL, LINKTYPE_LOOP:
+		// The address family tells IPv4 from IPv6, the version nibble
+		// does the same without knowing the byte order
+		if len(b) < 4 {
+			return nil, ErrShort
+		}
+		return b[4:], nil
+	case LINKTYPE_RAW, LINKTYPE_IPV4, LINKTYPE_IPV6:
+		return b, nil
+	}
+	return nil, ErrLinkType
+}
+
+func ipOnly(etherType uint16, b []byte) ([]byte, error) {
+	if etherType != etherTypeIPv4 && etherType != etherTypeIPv6 {
+		return nil, ErrNotIP
+	}
+	return b, nil
+}
+
+// decodeIP decodes an IPv4 or IPv6 header
+func decodeIP(b []byte) (ipPacket, error) {
+	var p ipPacket
+	if len(b) < 1 {
+		return p, ErrShort
+	}
+	switch b[0] >> 4 {
+	case 4:
+		return decodeIPv4(b)
+	case 6:
+		return decodeIPv6(b)
+	}
+	return p, ErrNotIP
+}
+
+func decodeIPv4(b []byte) (ipPacket, error) {
+	var p ipPacket
+	if len(b) < 20 {
+		return p, ErrShort
+	}
+	ihl := int(b[0]&0x0f) * 4
+	total := int(binary.BigEndian.Uint16(b[2:4]))
+	if ihl < 20 || total < ihl || len(b) < ihl {
+		return p, ErrShort
+	}
+	// Trim Ethernet padding, a total of zero is left by TSO
+	if total > 0 && total < len(b) {
+		b = b[:total]
+	}
+
+	p.src = netip.AddrFrom4([4]byte(b[12:16]))
+	p.dst = netip.AddrFrom4([4]byte(b[16:20]))
+	p.proto = b[9]
+	p.payload = b[ihl:]
+
+	flags := binary.BigEndian.Uint16(b[6:8])
+	p.more = flags&0x2000 != 0
+	p.offset = int(flags&0x1fff) * 8
+	p.id = uint32(binary.BigEndian.Uint16(b[4:6]))
+	p.fragment = p.more || p.offset > 0
+	return p, nil
+}
+
+func decodeIPv6(b []byte) (ipPacket, error) {
+	var p ipPacket
+	if len(b) < 40 {
+		return p, ErrShort
+	}
+	plen := int(binary.BigEndian.Uint16(b[4:6]))
+	if 40+plen < len(b) && plen > 0 {
+		b = b[:40+plen]
+	}
+	p.src = netip.AddrFrom16([16]byte(b[8:24]))
+	p.dst = netip.AddrFrom16([16]byte(b[24:40]))
+
+	next := b[6]
+	b = b[40:]
+	for {
+		switch next {
+		case 0, 43, 60:
+			// Hop-by-hop, routing and destination options
+			if len(b) < 8 {
+				return p, ErrShort
+			}
+			size := (int(b[1]) + 1) * 8
+			if len(b) < size {
+				return p, ErrShort
+			}
+			next = b[0]
+			b = b[size:]
+		case 44:
+			if len(b) < 8 {
+				return p, ErrShort
+			}
+			frag := binary.BigEndian.Uint16(b[2:4])
+			p.fragment = true
+			p.offset = int(frag &^ 7)
+			p.more = frag&1 != 0
+			p.id = binary.BigEndian.Uint32(b[4:8])
+			next = b[0]
+			b = b[8:]
+		default:
+			p.proto = next
+			p.payload = b
+			return p, nil
+		}
+	}
+}
+
+// transport is the UDP or TCP part of a packet
+type transport struct {
+	proto   string
+	srcPort uint16
+	dstPort uint16
+	payload []byte
+
+	// TCP only
+	seq   uint32
+	ack   uint32
+	flags uint8
+}
+
+// TCP flags
+const (
+	TCP_FIN = 0x01
+	TCP_SYN = 0x02
+	TCP_RST = 0x04
+	TCP_PSH = 0x08
+	TCP_ACK = 0x10
+)
+
+func decodeTransport(proto uint8, b []byte) (transport, error) {
+	var t transport
+	switch proto {
+	case protoUDP:
+		if len(b) < 8 {
+			return t, ErrShort
+		}
+		t.proto = "udp"
+		t.srcPort = binary.BigEndian.Uint16(b[0:2])
+		t.dstPort = binary.BigEndian.Uint16(b[2:4])
+		ulen := int(binary.BigEndian.Uint16(b[4:6]))
+		if ulen >= 8 && ulen < len(b) {
+			b = b[:ulen]
+		}
+		t.payload = b[8:]
+	case protoTCP:
+		if len(b) < 20 {
+			return t, ErrShort
+		}
+		t.proto = "tcp"
+		t.srcPort = binary.BigEndian.Uint16(b[0:2])
+		t.dstPort = binary.BigEndian.Uint16(b[2:4])
+		t.seq = binary.BigEndian.Uint32(b[4:8])
+		t.ack = binary.BigEndian.Uint32(b[8:12])
+		off := int(b[12]>>4) * 4
+		t.flags = b[13]
+		if off < 20 || len(b) < off {
+			return t, ErrShort
+		}
+		t.payload = b[off:]
+	default:
+		return t, errProto
+	}
+	return t, nil
+}
@@ -0,0 +1,96 @@
+package capture
+
+import (
+	"net/netip"
+	"sort"
+	"time"
+)
+
+// Reassembled packets larger than this are dropped
+const maxDatagram = 65535
+
+type fragKey struct {
+	src, dst netip.Addr
+	id       uint32
+	proto    uint8
+}
+
+type fragPart struct {
+	offset int
+	data   []byte
+}
+
+type fragBuf struct {
+	parts []fragPart
+	total int // Length of the whole payload, -1 until the last fragment arrives
+	first time.Time
+}
+
+// defragmenter reassembles IPv4 and IPv6 fragments, fragments that do not
+// complete within the timeout are dropped
+type defragmenter struct {
+	bufs    map[fragKey]*fragBuf
+	timeout time.Duration
+}
+
+func newDefragmenter(timeout time.Duration) *defragmenter {
+	return &defragmenter{bufs: make(map[fragKey]*fragBuf), timeout: timeout}
+}
+
+// add stores a fragment and returns the whole packet once every fragment
+// of it has arrived
+func (d *defragmenter) add(at time.Time, p ipPacket) (ipPacket, bool) {
+	d.expire(at)
+
+	key := fragKey{p.src, p.dst, p.id, p.proto}
+	buf, ok := d.bufs[key]
+	if !ok {
+		buf = &fragBuf{total: -1, first: at}
+		d.bufs[key] = buf
+	}
+	if !p.more {
+		buf.total = p.offset + len(p.payload)
+	}
+	if p.offset+len(p.payload) > maxDatagram {
+		delete(d.bufs, key)
+		return p, false
+	}
+	// The fragment data points into a packet buffer that may be reused
+	buf.parts = append(buf.parts, fragPart{p.offset, append([]byte(nil), p.payload...)})
+
+	if buf.total < 0 {
+		return p, false
+	}
+	sort.SliceStable(buf.parts, func(i, j int) bool { return buf.parts[i].offset < buf.parts[j].offset })
+
+	// Check the fragments cover the whole payload, overlaps keep the first
+	// copy of the data
+	whole := make([]byte, 0, buf.total)
+	for _, part := range buf.parts {
+		if part.offset > len(whole) {
+			return p, false
+		}
+		end := part.offset + len(part.data)
+		if end > len(whole) {
+			whole = append(whole, part.data[len(whole)-part.offset:]...)
+		}
+	}
+	if len(whole) < buf.total {
+		return p, false
+	}
+
+	delete(d.bufs, key)
+	p.payload = whole[:buf.total]
+	p.fragment = false
+	p.offset = 0
+	p.more = false
+	return p, true
+}
+
+func (d *defragmenter) expire(now time.Time) {
+	for key, buf := range d.bufs {
+		if now.Sub(buf.first) > d.timeout {
+			delete(d.bufs, key)
+		}
+	}
+}
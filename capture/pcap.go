@@ -0,0 +1,334 @@
+package capture
+
+/*
+ pcap - https://datatracker.ietf.org/doc/html/draft-ietf-opsawg-pcap
+
+   File header: magic(4) major(2) minor(2) reserved(4) reserved(4)
+                snaplen(4) linktype(4)
+   Record:      seconds(4) micro or nanoseconds(4) captured length(4)
+                original length(4) data
+
+   The magic 0xA1B2C3D4 has microsecond timestamps and 0xA1B23C4D
+   nanosecond ones, either read byte swapped gives the byte order.
+
+ pcapng - https://datatracker.ietf.org/doc/html/draft-ietf-opsawg-pcapng
+
+   Every block is type(4) length(4) body length(4). The Section Header
+   Block, type 0x0A0D0D0A, holds the byte order magic 0x1A2B3C4D. Each
+   Interface Description Block gives the link type and the timestamp
+   resolution (option if_tsresol) of the packets captured on it, which
+   come in Enhanced Packet Blocks or Simple Packet Blocks.
+
+*/
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/bits"
+	"time"
+)
+
+const (
+	magicMicro     = 0xa1b2c3d4
+	magicNano      = 0xa1b23c4d
+	magicMicroSwap = 0xd4c3b2a1
+	magicNanoSwap  = 0x4d3cb2a1
+
+	blockSHB  = 0x0a0d0d0a
+	blockIDB  = 0x00000001
+	blockPB   = 0x00000002
+	blockSPB  = 0x00000003
+	blockEPB  = 0x00000006
+	bomPcapng = 0x1a2b3c4d
+
+	optEnd      = 0
+	optTsresol  = 9
+	maxBlockLen = 16 << 20
+)
+
+var ErrFormat = errors.New("capture: not a pcap or pcapng file")
+
+// Frame is one captured link layer frame
+type Frame struct {
+	Time      time.Time
+	LinkType  uint32
+	Interface int    // Interface index, always 0 for pcap
+	Data      []byte // Captured bytes, possibly truncated by the snap length
+	OrigLen   int    // Length of the frame on the wire
+}
+
+// FrameReader reads the frames of a capture file
+type FrameReader interface {
+	// Next returns the next frame, or io.EOF at the end of the file
+	Next() (Frame, error)
+}
+
+// NewFrameReader detects whether the file is pcap or pcapng
+func NewFrameReader(r io.Reader) (FrameReader, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(4)
+	if err != nil {
+		return nil, ErrFormat
+	}
+	if binary.LittleEndian.Uint32(magic) == blockSHB {
+		return NewPcapngReader(br)
+	}
+	return NewPcapReader(br)
+}
+
+// PcapReader reads classic pcap files
+type PcapReader struct {
+	r        io.Reader
+	order    binary.ByteOrder
+	nano     bool
+	linkType uint32
+	snaplen  uint32
+	hdr      [16]byte
+}
+
+func NewPcapReader(r io.Reader) (*PcapReader, error) {
+	var hdr [24]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, ErrFormat
+	}
+
+	p := &PcapReader{r: r}
+	switch binary.LittleEndian.Uint32(hdr[0:4]) {
+	case magicMicro:
+		p.order = binary.LittleEndian
+	case magicNano:
+		p.order, p.nano = binary.LittleEndian, true
+	case magicMicroSwap:
+		p.order = binary.BigEndian
+	case magicNanoSwap:
+		p.order, p.nano = binary.BigEndian, true
+	default:
+		return nil, ErrFormat
+	}
+	p.snaplen = p.order.Uint32(hdr[16:20])
+	// The upper bits may hold the FCS length
+	p.linkType = p.order.Uint32(hdr[20:24]) & 0x0fffffff
+	return p, nil
+}
+
+// LinkType returns the link type of every frame in the file
+func (p *PcapReader) LinkType() uint32 {
+	return p.linkType
+}
+
+func (p *PcapReader) Next() (Frame, error) {
+	var f Frame
+	if _, err := io.ReadFull(p.r, p.hdr[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return f, ErrShort
+		}
+		return f, err
+	}
+	sec := p.order.Uint32(p.hdr[0:4])
+	frac := p.order.Uint32(p.hdr[4:8])
+	caplen := p.order.Uint32(p.hdr[8:12])
+	if caplen > maxBlockLen {
+		return f, fmt.Errorf("capture: record of %d bytes", caplen)
+	}
+
+	f.Data = make([]byte, caplen)
+	if _, err := io.ReadFull(p.r, f.Data); err != nil {
+		return f, ErrShort
+	}
+	if !p.nano {
+		frac *= 1000
+	}
+	f.Time = time.Unix(int64(sec), int64(frac)).UTC()
+	f.LinkType = p.linkType
+	f.OrigLen = int(p.order.Uint32(p.hdr[12:16]))
+	return f, nil
+}
+
+type pcapngIface struct {
+	linkType uint32
+	snaplen  uint32
+	// Timestamp units per second and the divisor to nanoseconds
+	tsUnits uint64
+}
+
+// PcapngReader reads pcapng files, including those with several sections
+type PcapngReader struct {
+	r      io.Reader
+	order  binary.ByteOrder
+	ifaces []pcapngIface
+}
+
+func NewPcapngReader(r io.Reader) (*PcapngReader, error) {
+	p := &PcapngReader{r: r}
+	if typ, _, err := p.block(); err != nil || typ != blockSHB {
+		return nil, ErrFormat
+	}
+	return p, nil
+}
+
+// block reads the next block and returns its type and body
+func (p *PcapngReader) block() (uint32, []byte, error) {
+	var hdr [12]byte
+	if _, err := io.ReadFull(p.r, hdr[:8]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return 0, nil, ErrShort
+		}
+		return 0, nil, err
+	}
+
+	typ := binary.LittleEndian.Uint32(hdr[0:4])
+	if typ == blockSHB {
+		// A new section, which may change the byte order
+		if _, err := io.ReadFull(p.r, hdr[8:12]); err != nil {
+			return 0, nil, ErrShort
+		}
+		switch binary.LittleEndian.Uint32(hdr[8:12]) {
+		case bomPcapng:
+			p.order = binary.LittleEndian
+		case 0x4d3c2b1a:
+			p.order = binary.BigEndian
+		default:
+			return 0, nil, ErrFormat
+		}
+		p.ifaces = p.ifaces[:0]
+	} else if p.order == nil {
+		return 0, nil, ErrFormat
+	} else {
+		typ = p.order.Uint32(hdr[0:4])
+	}
+
+	total := p.order.Uint32(hdr[4:8])
+	if total < 12 || total%4 != 0 || total > maxBlockLen {
+		return 0, nil, fmt.Errorf("capture: invalid pcapng block length %d", total)
+	}
+	read := uint32(8)
+	if typ == blockSHB {
+		read = 12
+	}
+	rest := make([]byte, total-read)
+	if _, err := io.ReadFull(p.r, rest); err != nil {
+		return 0, nil, ErrShort
+	}
+	// Drop the trailing length
+	body := rest[:len(rest)-4]
+	return typ, body, nil
+}
+
+func (p *PcapngReader) Next() (Frame, error) {
+	for {
+		typ, body, err := p.block()
+		if err != nil {
+			return Frame{}, err
+		}
+		switch typ {
+		case blockIDB:
+			if len(body) < 8 {
+				return Frame{}, ErrShort
+			}
+			iface := pcapngIface{
+				linkType: uint32(p.order.Uint16(body[0:2])),
+				snaplen:  p.order.Uint32(body[4:8]),
+				tsUnits:  1e6,
+			}
+			p.options(body[8:], func(code uint16, val []byte) {
+				if code == optTsresol && len(val) == 1 {
+					iface.tsUnits = tsUnits(val[0])
+				}
+			})
+			p.ifaces = append(p.ifaces, iface)
+		case blockEPB:
+			if len(body) < 20 {
+				return Frame{}, ErrShort
+			}
+			id := int(p.order.Uint32(body[0:4]))
+			ts := uint64(p.order.Uint32(body[4:8]))<<32 | uint64(p.order.Uint32(body[8:12]))
+			caplen := int(p.order.Uint32(body[12:16]))
+			if len(body) < 20+caplen {
+				return Frame{}, ErrShort
+			}
+			return p.frame(id, ts, body[20:20+caplen], int(p.order.Uint32(body[16:20])))
+		case blockPB:
+			if len(body) < 20 {
+				return Frame{}, ErrShort
+			}
+			id := int(p.order.Uint16(body[0:2]))
+			ts := uint64(p.order.Uint32(body[4:8]))<<32 | uint64(p.order.Uint32(body[8:12]))
+			caplen := int(p.order.Uint32(body[12:16]))
+			if len(body) < 20+caplen {
+				return Frame{}, ErrShort
+			}
+			return p.frame(id, ts, body[20:20+caplen], int(p.order.Uint32(body[16:20])))
+		case blockSPB:
+			if len(body) < 4 || len(p.ifaces) == 0 {
+				return Frame{}, ErrShort
+			}
+			origLen := int(p.order.Uint32(body[0:4]))
+			caplen := origLen
+			if snap := int(p.ifaces[0].snaplen); snap > 0 && snap < caplen {
+				caplen = snap
+			}
+			if len(body) < 4+caplen {
+				return Frame{}, ErrShort
+			}
+			// Simple packets carry no timestamp
+			f := Frame{LinkType: p.ifaces[0].linkType, Data: body[4 : 4+caplen], OrigLen: origLen}
+			return f, nil
+		}
+		// Other blocks such as statistics and name resolution are skipped
+	}
+}
+
+func (p *PcapngReader) frame(id int, ts uint64, data []byte, origLen int) (Frame, error) {
+	if id >= len(p.ifaces) {
+		return Frame{}, fmt.Errorf("capture: packet for unknown interface %d", id)
+	}
+	iface := &p.ifaces[id]
+	// The fraction is scaled in 128 bits, it overflows 64 for resolutions
+	// finer than about 10^-10
+	sec := ts / iface.tsUnits
+	hi, lo := bits.Mul64(ts%iface.tsUnits, 1e9)
+	nsec, _ := bits.Div64(hi, lo, iface.tsUnits)
+	return Frame{
+		Time:      time.Unix(int64(sec), int64(nsec)).UTC(),
+		LinkType:  iface.linkType,
+		Interface: id,
+		Data:      data,
+		OrigLen:   origLen,
+	}, nil
+}
+
+// options walks the options of a block
+func (p *PcapngReader) options(b []byte, f func(code uint16, val []byte)) {
+	for len(b) >= 4 {
+		code := p.order.Uint16(b[0:2])
+		size := int(p.order.Uint16(b[2:4]))
+		if code == optEnd || len(b) < 4+size {
+			return
+		}
+		f(code, b[4:4+size])
+		if next := 4 + (size+3)&^3; next < len(b) {
+			b = b[next:]
+		} else {
+			return
+		}
+	}
+}
+
+// tsUnits decodes if_tsresol, a power of ten or with the top bit set a
+// power of two
+func tsUnits(v byte) uint64 {
+	exp := float64(v & 0x7f)
+	base := 10.0
+	if v&0x80 != 0 {
+		base = 2
+	}
+	units := math.Pow(base, exp)
+	if units < 1 || units > 1e18 {
+		return 1e6
+	}
+	return uint64(units)
+}
@@ -0,0 +1,162 @@
+package capture
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// pcapFile builds a classic pcap file
+func pcapFile(order binary.ByteOrder, nano bool, linkType uint32, at []time.Time, frames ...[]byte) []byte {
+	var b bytes.Buffer
+	magic := uint32(magicMicro)
+	if nano {
+		magic = magicNano
+	}
+	binary.Write(&b, order, []uint32{magic})
+	binary.Write(&b, order, []uint16{2, 4})
+	binary.Write(&b, order, []uint32{0, 0, 65535, linkType})
+	for i, f := range frames {
+		frac := uint32(at[i].Nanosecond())
+		if !nano {
+			frac /= 1000
+		}
+		binary.Write(&b, order, []uint32{uint32(at[i].Unix()), frac, uint32(len(f)), uint32(len(f))})
+		b.Write(f)
+	}
+	return b.Bytes()
+}
+
+// pcapngBlock builds a block with its body padded to 32 bits
+func pcapngBlock(order binary.ByteOrder, typ uint32, body []byte) []byte {
+	for len(body)%4 != 0 {
+		body = append(body, 0)
+	}
+	total := uint32(len(body) + 12)
+	var b bytes.Buffer
+	binary.Write(&b, order, []uint32{typ, total})
+	b.Write(body)
+	binary.Write(&b, order, total)
+	return b.Bytes()
+}
+
+func pcapngSHB(order binary.ByteOrder) []byte {
+	var body bytes.Buffer
+	binary.Write(&body, order, uint32(bomPcapng))
+	binary.Write(&body, order, []uint16{1, 0})
+	binary.Write(&body, order, int64(-1))
+	return pcapngBlock(order, blockSHB, body.Bytes())
+}
+
+func pcapngIDB(order binary.ByteOrder, linkType uint16, tsresol byte) []byte {
+	var body bytes.Buffer
+	binary.Write(&body, order, []uint16{linkType, 0})
+	binary.Write(&body, order, uint32(0))
+	if tsresol != 0 {
+		binary.Write(&body, order, []uint16{optTsresol, 1})
+		body.Write([]byte{tsresol, 0, 0, 0})
+		binary.Write(&body, order, []uint16{optEnd, 0})
+	}
+	return pcapngBlock(order, blockIDB, body.Bytes())
+}
+
+func pcapngEPB(order binary.ByteOrder, iface uint32, ts uint64, frame []byte) []byte {
+	var body bytes.Buffer
+	binary.Write(&body, order, []uint32{iface, uint32(ts >> 32), uint32(ts), uint32(len(frame)), uint32(len(frame))})
+	body.Write(frame)
+	return pcapngBlock(order, blockEPB, body.Bytes())
+}
+
+func readFrames(t *testing.T, file []byte) []Frame {
+	t.Helper()
+	r, err := NewFrameReader(bytes.NewReader(file))
+	if err != nil {
+		t.Fatalf("NewFrameReader: %v", err)
+	}
+	var out []Frame
+	for {
+		f, err := r.Next()
+		if err == io.EOF {
+			return out
+		}
+		if err != nil {
+			t.Fatalf("Next: %v", err)
+		}
+		out = append(out, f)
+	}
+}
+
+func Test_pcap_ByteOrderAndResolution(t *testing.T) {
+
+	at := []time.Time{
+		time.Date(2024, 3, 1, 10, 0, 0, 123456000, time.UTC),
+		time.Date(2024, 3, 1, 10, 0, 1, 5000, time.UTC),
+	}
+	frames := [][]byte{[]byte("first"), []byte("second")}
+	exp := []Frame{
+		{Time: at[0], LinkType: LINKTYPE_RAW, Data: frames[0], OrigLen: 5},
+		{Time: at[1], LinkType: LINKTYPE_RAW, Data: frames[1], OrigLen: 6},
+	}
+
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		for _, nano := range []bool{false, true} {
+			got := readFrames(t, pcapFile(order, nano, LINKTYPE_RAW, at, frames...))
+			if !reflect.DeepEqual(exp, got) {
+				t.Errorf("Mismatch %v nano %v:\nExpected:\n%+v\nGot:\n%+v", order, nano, exp, got)
+			}
+		}
+	}
+}
+
+func Test_pcapng_Interfaces(t *testing.T) {
+
+	at := time.Date(2024, 3, 1, 10, 0, 0, 250000000, time.UTC)
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		var file []byte
+		file = append(file, pcapngSHB(order)...)
+		file = append(file, pcapngIDB(order, LINKTYPE_ETHERNET, 0)...)
+		// Nanosecond resolution on the second interface
+		file = append(file, pcapngIDB(order, LINKTYPE_LINUX_SLL, 9)...)
+		file = append(file, pcapngEPB(order, 0, uint64(at.UnixMicro()), []byte("eth"))...)
+		// An unknown block is skipped
+		file = append(file, pcapngBlock(order, 0x0bad, []byte{1, 2, 3, 4})...)
+		file = append(file, pcapngEPB(order, 1, uint64(at.UnixNano()+7), []byte("sll1"))...)
+		// Picosecond resolution on the third
+		file = append(file, pcapngIDB(order, LINKTYPE_RAW, 12)...)
+		file = append(file, pcapngEPB(order, 2, 5_250_000_007_000, []byte("raw"))...)
+
+		exp := []Frame{
+			{Time: at, LinkType: LINKTYPE_ETHERNET, Interface: 0, Data: []byte("eth"), OrigLen: 3},
+			{Time: at.Add(7), LinkType: LINKTYPE_LINUX_SLL, Interface: 1, Data: []byte("sll1"), OrigLen: 4},
+			{Time: time.Unix(5, 250000007).UTC(), LinkType: LINKTYPE_RAW, Interface: 2, Data: []byte("raw"), OrigLen: 3},
+		}
+		got := readFrames(t, file)
+		if !reflect.DeepEqual(exp, got) {
+			t.Errorf("Mismatch %v:\nExpected:\n%+v\nGot:\n%+v", order, exp, got)
+		}
+	}
+}
+
+func Test_pcap_Errors(t *testing.T) {
+
+	if _, err := NewFrameReader(bytes.NewReader([]byte("not a capture file"))); err != ErrFormat {
+		t.Errorf("Expected ErrFormat, got %v", err)
+	}
+
+	// A record cut short
+	file := pcapFile(binary.LittleEndian, false, LINKTYPE_RAW, []time.Time{time.Unix(0, 0)}, []byte("frame"))
+	r, err := NewFrameReader(bytes.NewReader(file[:len(file)-2]))
+	if err != nil {
+		t.Fatalf("NewFrameReader: %v", err)
+	}
+	if _, err := r.Next(); err != ErrShort {
+		t.Errorf("Expected ErrShort, got %v", err)
+	}
+
+	if got := tsUnits(0x80 | 10); got != 1024 {
+		t.Errorf("Power of two resolution: %d", got)
+	}
+}
@@ -0,0 +1,256 @@
+package capture
+
+/*
+ RFC 9293 - https://datatracker.ietf.org/doc/html/rfc9293#section-3.4
+
+   Each direction of a connection is a byte stream numbered from the
+   initial sequence number of its SYN, which itself takes one number as
+   does the FIN. Segments may arrive out of order, be retransmitted with
+   the same or overlapping data, or be lost, in which case the stream is
+   resumed after the gap and the SIP framer resynchronises on the next
+   start line.
+
+*/
+
+import (
+	"sort"
+	"time"
+
+	"github.com/nullboundary/siprocket"
+)
+
+// Defaults for a Reassembler
+const (
+	TCP_IDLE_TIMEOUT = 5 * time.Minute
+	TCP_GAP_TIMEOUT  = 2 * time.Second
+	TCP_MAX_BUFFERED = 1 << 20
+)
+
+type tcpSegment struct {
+	seq  uint32
+	at   time.Time
+	data []byte
+	fin  bool
+}
+
+// tcpFlow is one direction of a connection
+type tcpFlow struct {
+	tuple    siprocket.FiveTuple
+	next     uint32       // Sequence number of the next byte expected
+	pending  []tcpSegment // Segments after a gap, ordered by sequence
+	buffered int
+	gapSince time.Time
+	last     time.Time
+	framer   *siprocket.SipFramer
+}
+
+// Reassembler orders the TCP segments of each flow, drops retransmitted
+// data and frames the resulting streams into SIP messages. It is fed with
+// packets from a capture or from a live raw socket through a Decoder.
+type Reassembler struct {
+	IdleTimeout time.Duration // Flows without packets for this long are dropped
+	GapTimeout  time.Duration // How long to wait for a missing segment before skipping it
+	MaxBuffered int           // Out of order bytes kept per flow before skipping the gap
+
+	flows map[siprocket.FiveTuple]*tcpFlow
+}
+
+func NewReassembler() *Reassembler {
+	return &Reassembler{
+		IdleTimeout: TCP_IDLE_TIMEOUT,
+		GapTimeout:  TCP_GAP_TIMEOUT,
+		MaxBuffered: TCP_MAX_BUFFERED,
+		flows:       make(map[siprocket.FiveTuple]*tcpFlow),
+	}
+}
+
+// Tracking tells if packets of the tuple have been seen
+func (r *Reassembler) Tracking(t siprocket.FiveTuple) bool {
+	_, ok := r.flows[t]
+	return ok
+}
+
+// Len returns the number of flows tracked
+func (r *Reassembler) Len() int {
+	return len(r.flows)
+}
+
+// Add processes a TCP packet and returns the messages it completes, each
+// with the time of its first byte
+func (r *Reassembler) Add(pkt *Packet) []Message {
+	if pkt.Tuple.Proto != "tcp" {
+		return nil
+	}
+	var out []Message
+
+	flow, ok := r.flows[pkt.Tuple]
+	if pkt.Flags&TCP_RST != 0 {
+		if ok {
+			delete(r.flows, pkt.Tuple)
+		}
+		return nil
+	}
+	if !ok {
+		flow = &tcpFlow{tuple: pkt.Tuple, next: pkt.Seq, framer: siprocket.NewSipFramer()}
+		if pkt.Flags&TCP_SYN != 0 {
+			flow.next++
+		}
+		r.flows[pkt.Tuple] = flow
+	} else if pkt.Flags&TCP_SYN != 0 {
+		// A new connection reusing the ports
+		flow.next = pkt.Seq + 1
+		flow.pending = nil
+		flow.buffered = 0
+		flow.framer.Reset()
+	}
+	flow.last = pkt.Time
+
+	seq := pkt.Seq
+	if pkt.Flags&TCP_SYN != 0 {
+		seq++
+	}
+	seg := tcpSegment{seq: seq, at: pkt.Time, data: pkt.Payload, fin: pkt.Flags&TCP_FIN != 0}
+	if closed := r.segment(flow, seg, &out); closed {
+		return out
+	}
+
+	// Give up on a gap that has lasted too long or holds too much behind it
+	if len(flow.pending) > 0 && (flow.buffered > r.MaxBuffered || pkt.Time.Sub(flow.gapSince) > r.GapTimeout) {
+		r.skipGap(flow, &out)
+	}
+	return out
+}
+
+// segment delivers or stores a segment, it returns true once the flow is
+// closed by an in order FIN
+func (r *Reassembler) segment(flow *tcpFlow, seg tcpSegment, out *[]Message) bool {
+	diff := int32(seg.seq - flow.next)
+	if diff > 0 {
+		if len(seg.data) == 0 && !seg.fin {
+			return false
+		}
+		if len(flow.pending) == 0 {
+			flow.gapSince = seg.at
+		}
+		// The payload points into a packet buffer that may be reused
+		seg.data = append([]byte(nil), seg.data...)
+		i := sort.Search(len(flow.pending), func(i int) bool {
+			return int32(flow.pending[i].seq-seg.seq) >= 0
+		})
+		flow.pending = append(flow.pending, tcpSegment{})
+		copy(flow.pending[i+1:], flow.pending[i:])
+		flow.pending[i] = seg
+		flow.buffered += len(seg.data)
+		return false
+	}
+
+	// Trim the data already received
+	if int(-diff) >= len(seg.data) {
+		seg.data = nil
+	} else {
+		seg.data = seg.data[-diff:]
+	}
+	if r.deliver(flow, seg, out) {
+		return true
+	}
+	return r.drain(flow, out)
+}
+
+// deliver appends in order data to the stream
+func (r *Reassembler) deliver(flow *tcpFlow, seg tcpSegment, out *[]Message) bool {
+	if len(seg.data) > 0 {
+		flow.next += uint32(len(seg.data))
+		flow.framer.Write(seg.at, seg.data)
+		r.frame(flow, out)
+	}
+	if seg.fin {
+		delete(r.flows, flow.tuple)
+		return true
+	}
+	return false
+}
+
+// drain delivers the stored segments that are now in order
+func (r *Reassembler) drain(flow *tcpFlow, out *[]Message) bool {
+	for len(flow.pending) > 0 {
+		seg := flow.pending[0]
+		diff := int32(seg.seq - flow.next)
+		if diff > 0 {
+			return false
+		}
+		flow.pending = flow.pending[1:]
+		flow.buffered -= len(seg.data)
+		if int(-diff) >= len(seg.data) {
+			seg.data = nil
+		} else {
+			seg.data = seg.data[-diff:]
+		}
+		if r.deliver(flow, seg, out) {
+			return true
+		}
+	}
+	return false
+}
+
+// skipGap drops the partial message in front of a gap and resumes the
+// stream at the first stored segment
+func (r *Reassembler) skipGap(flow *tcpFlow, out *[]Message) {
+	for len(flow.pending) > 0 {
+		flow.framer.Reset()
+		flow.next = flow.pending[0].seq
+		flow.gapSince = flow.pending[0].at
+		if r.drain(flow, out) {
+			return
+		}
+	}
+}
+
+func (r *Reassembler) frame(flow *tcpFlow, out *[]Message) {
+	for {
+		msg, at, ok := flow.framer.Next()
+		if !ok {
+			return
+		}
+		*out = append(*out, Message{Time: at, Tuple: flow.tuple, Msg: siprocket.Parse(msg), Raw: msg})
+	}
+}
+
+// Expire drops the flows idle since before now less the IdleTimeout,
+// data stored behind a gap in them is framed first
+func (r *Reassembler) Expire(now time.Time) []Message {
+	var out []Message
+	for _, flow := range r.sortedFlows() {
+		if now.Sub(flow.last) < r.IdleTimeout {
+			continue
+		}
+		r.skipGap(flow, &out)
+		delete(r.flows, flow.tuple)
+	}
+	return out
+}
+
+// Flush frames the data stored behind gaps in every flow, used at the end
+// of a capture
+func (r *Reassembler) Flush() []Message {
+	var out []Message
+	for _, flow := range r.sortedFlows() {
+		r.skipGap(flow, &out)
+	}
+	return out
+}
+
+// sortedFlows gives the flows in the order of their last packet so the
+// messages flushed from them are ordered too
+func (r *Reassembler) sortedFlows() []*tcpFlow {
+	flows := make([]*tcpFlow, 0, len(r.flows))
+	for _, flow := range r.flows {
+		flows = append(flows, flow)
+	}
+	sort.Slice(flows, func(i, j int) bool {
+		if !flows[i].last.Equal(flows[j].last) {
+			return flows[i].last.Before(flows[j].last)
+		}
+		return flows[i].tuple.String() < flows[j].tuple.String()
+	})
+	return flows
+}
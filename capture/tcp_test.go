@@ -0,0 +1,167 @@
+package capture
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/nullboundary/siprocket"
+)
+
+type tcpTest struct {
+	start time.Time
+	tuple siprocket.FiveTuple
+	r     *Reassembler
+}
+
+func newTcpTest() *tcpTest {
+	return &tcpTest{
+		start: time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC),
+		tuple: siprocket.NewFiveTuple("tcp", "10.0.0.1:40000", "10.0.0.2:5060"),
+		r:     NewReassembler(),
+	}
+}
+
+// add feeds a segment ms milliseconds from the start, seq is relative to
+// an initial sequence number close to wrapping
+func (tt *tcpTest) add(ms int, seq uint32, flags uint8, data string) []string {
+	pkt := Packet{
+		Time:    tt.start.Add(time.Duration(ms) * time.Millisecond),
+		Tuple:   tt.tuple,
+		Payload: []byte(data),
+		Seq:     0xfffffff0 + seq,
+		Flags:   flags,
+	}
+	var out []string
+	for _, m := range tt.r.Add(&pkt) {
+		out = append(out, string(m.Msg.CallId.Value)+"@"+m.Time.Sub(tt.start).String())
+	}
+	return out
+}
+
+func Test_tcp_Reorder(t *testing.T) {
+
+	tt := newTcpTest()
+	first := testInvite
+	second := bytes.Replace([]byte(testOk), []byte("cap-1"), []byte("cap-2"), 1)
+	stream := first + string(second)
+
+	if got := tt.add(0, 0, TCP_SYN, ""); got != nil {
+		t.Errorf("SYN gave %v", got)
+	}
+	// The stream in four segments, the second arrives last, a retransmit
+	// of the first overlaps the second
+	split := []int{1, 50, 100, len(first) + 20, len(stream) + 1}
+	seg := func(i int) (uint32, string) {
+		return uint32(split[i]), stream[split[i]-1 : split[i+1]-1]
+	}
+
+	s, d := seg(0)
+	tt.add(10, s, TCP_ACK, d)
+	s, d = seg(2)
+	tt.add(20, s, TCP_ACK|TCP_PSH, d)
+	s, d = seg(3)
+	tt.add(30, s, TCP_ACK|TCP_PSH, d)
+	if tt.r.flows[tt.tuple].buffered == 0 {
+		t.Errorf("Out of order segments not stored")
+	}
+
+	// Retransmit covering the first two segments completes the first message
+	got := tt.add(40, uint32(split[0]), TCP_ACK, stream[:split[2]-1])
+	exp := []string{"cap-1@10ms", "cap-2@20ms"}
+	if !reflect.DeepEqual(exp, got) {
+		t.Errorf("Mismatch:\nExpected:\n%v\nGot:\n%v", exp, got)
+	}
+
+	// A duplicate of old data gives nothing
+	if got := tt.add(50, uint32(split[1]), TCP_ACK, stream[split[1]-1:split[2]-1]); got != nil {
+		t.Errorf("Duplicate gave %v", got)
+	}
+
+	// FIN closes the flow
+	tt.add(60, uint32(len(stream)+1), TCP_FIN|TCP_ACK, "")
+	if tt.r.Len() != 0 {
+		t.Errorf("Flow not closed")
+	}
+}
+
+func Test_tcp_Gap(t *testing.T) {
+
+	tt := newTcpTest()
+	second := string(bytes.Replace([]byte(testOk), []byte("cap-1"), []byte("cap-2"), 1))
+	third := string(bytes.Replace([]byte(testOk), []byte("cap-1"), []byte("cap-3"), 1))
+
+	// Joined part way, the first message loses its middle
+	tt.add(0, 0, TCP_ACK, testInvite[:30])
+	lost := uint32(len(testInvite[:60]))
+	if got := tt.add(10, lost, TCP_ACK, testInvite[60:]+second); got != nil {
+		t.Errorf("Gap skipped early %v", got)
+	}
+
+	// The gap is skipped once it is too old, the partial INVITE is dropped
+	got := tt.add(3000, lost+uint32(len(testInvite)-60+len(second)), TCP_ACK, third)
+	exp := []string{"cap-2@10ms", "cap-3@3s"}
+	if !reflect.DeepEqual(exp, got) {
+		t.Errorf("Mismatch:\nExpected:\n%v\nGot:\n%v", exp, got)
+	}
+
+	// Data behind a gap is framed when the flow expires
+	next := lost + uint32(len(testInvite)-60+len(second)+len(third))
+	tt.add(4000, next+10, TCP_ACK, testInvite)
+	if got := tt.r.Expire(tt.start.Add(time.Minute)); len(got) != 0 {
+		t.Errorf("Expired early %d", len(got))
+	}
+	msgs := tt.r.Expire(tt.start.Add(10 * time.Minute))
+	if len(msgs) != 1 || string(msgs[0].Msg.CallId.Value) != "cap-1" || tt.r.Len() != 0 {
+		t.Errorf("Expire gave %d messages, %d flows left", len(msgs), tt.r.Len())
+	}
+
+	// RST drops the flow
+	tt.add(5000, 0, TCP_ACK, testInvite[:10])
+	tt.add(5001, 10, TCP_RST, "")
+	if tt.r.Len() != 0 {
+		t.Errorf("Flow not reset")
+	}
+}
+
+func Test_tcp_Reader(t *testing.T) {
+
+	at := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+	seg := func(seq uint32, flags uint8, data string) []byte {
+		return ether(ipv4("10.0.0.1", "10.0.0.2", protoTCP, 1, 0, false, tcp(40000, 5060, seq, flags, []byte(data))))
+	}
+	stream := testInvite + testInvite
+	times := []time.Time{at, at.Add(time.Millisecond), at.Add(2 * time.Millisecond), at.Add(3 * time.Millisecond)}
+	frames := [][]byte{
+		seg(100, TCP_SYN, ""),
+		seg(101, TCP_ACK, stream[:40]),
+		seg(141, TCP_ACK, stream[40:len(testInvite)+5]),
+		seg(uint32(101+len(testInvite)+5), TCP_ACK, stream[len(testInvite)+5:]),
+	}
+	file := pcapFile(binary.BigEndian, true, LINKTYPE_ETHERNET, times, frames...)
+
+	for _, ports := range [][]uint16{nil, {5060}} {
+		r, err := NewReader(bytes.NewReader(file))
+		if err != nil {
+			t.Fatalf("NewReader: %v", err)
+		}
+		r.Ports = ports
+		var got []time.Time
+		for {
+			m, err := r.Next()
+			if err != nil {
+				break
+			}
+			got = append(got, m.Time)
+			if string(m.Msg.CallId.Value) != "cap-1" {
+				t.Errorf("Call-ID %q", m.Msg.CallId.Value)
+			}
+		}
+		exp := []time.Time{times[1], times[2]}
+		if !reflect.DeepEqual(exp, got) {
+			t.Errorf("Mismatch ports %v:\nExpected:\n%v\nGot:\n%v", ports, exp, got)
+		}
+	}
+}
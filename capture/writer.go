@@ -0,0 +1,293 @@
+package capture
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/fnv"
+	"io"
+	"net/netip"
+	"time"
+
+	"github.com/nullboundary/siprocket"
+)
+
+// Largest TCP segment written, longer messages are split
+const TCP_MSS = 1460
+
+// Snap length given in the file headers
+const writerSnaplen = 262144
+
+var ErrTooLarge = errors.New("capture: payload too large for one UDP datagram")
+
+// Writer writes packets as a pcap or pcapng file with Ethernet framing.
+// IP, UDP and TCP headers are made up from the 5-tuple, each TCP
+// connection gets a handshake and sequence numbers that follow on.
+type Writer struct {
+	w    io.Writer
+	ng   bool
+	ipId uint16
+	tcp  map[siprocket.FiveTuple]uint32 // Next sequence number of each direction
+}
+
+// NewPcapWriter writes the header of a pcap file with nanosecond timestamps
+func NewPcapWriter(w io.Writer) (*Writer, error) {
+	hdr := binary.LittleEndian.AppendUint32(nil, magicNano)
+	hdr = binary.LittleEndian.AppendUint16(hdr, 2)
+	hdr = binary.LittleEndian.AppendUint16(hdr, 4)
+	hdr = binary.LittleEndian.AppendUint32(hdr, 0)
+	hdr = binary.LittleEndian.AppendUint32(hdr, 0)
+	hdr = binary.LittleEndian.AppendUint32(hdr, writerSnaplen)
+	hdr = binary.LittleEndian.AppendUint32(hdr, LINKTYPE_ETHERNET)
+	if _, err := w.Write(hdr); err != nil {
+		return nil, err
+	}
+	return newWriter(w, false), nil
+}
+
+// NewPcapngWriter writes the section header and one Ethernet interface
+// with nanosecond timestamps
+func NewPcapngWriter(w io.Writer) (*Writer, error) {
+	shb := binary.LittleEndian.AppendUint32(nil, bomPcapng)
+	shb = binary.LittleEndian.AppendUint16(shb, 1)
+	shb = binary.LittleEndian.AppendUint16(shb, 0)
+	shb = binary.LittleEndian.AppendUint64(shb, 0xffffffffffffffff)
+
+	idb := binary.LittleEndian.AppendUint16(nil, LINKTYPE_ETHERNET)
+	idb = binary.LittleEndian.AppendUint16(idb, 0)
+	idb = binary.LittleEndian.AppendUint32(idb, writerSnaplen)
+	idb = binary.LittleEndian.AppendUint16(idb, optTsresol)
+	idb = binary.LittleEndian.AppendUint16(idb, 1)
+	idb = append(idb, 9, 0, 0, 0)
+	idb = binary.LittleEndian.AppendUint32(idb, optEnd)
+
+	b := appendBlock(nil, blockSHB, shb)
+	b = appendBlock(b, blockIDB, idb)
+	if _, err := w.Write(b); err != nil {
+		return nil, err
+	}
+	return newWriter(w, true), nil
+}
+
+func newWriter(w io.Writer, ng bool) *Writer {
+	return &Writer{w: w, ng: ng, tcp: make(map[siprocket.FiveTuple]uint32)}
+}
+
+// WriteFrame writes an Ethernet frame as it is
+func (w *Writer) WriteFrame(at time.Time, frame []byte) error {
+	var b []byte
+	if w.ng {
+		ts := uint64(at.UnixNano())
+		body := binary.LittleEndian.AppendUint32(nil, 0)
+		body = binary.LittleEndian.AppendUint32(body, uint32(ts>>32))
+		body = binary.LittleEndian.AppendUint32(body, uint32(ts))
+		body = binary.LittleEndian.AppendUint32(body, uint32(len(frame)))
+		body = binary.LittleEndian.AppendUint32(body, uint32(len(frame)))
+		body = append(body, frame...)
+		b = appendBlock(nil, blockEPB, body)
+	} else {
+		b = binary.LittleEndian.AppendUint32(nil, uint32(at.Unix()))
+		b = binary.LittleEndian.AppendUint32(b, uint32(at.Nanosecond()))
+		b = binary.LittleEndian.AppendUint32(b, uint32(len(frame)))
+		b = binary.LittleEndian.AppendUint32(b, uint32(len(frame)))
+		b = append(b, frame...)
+	}
+	_, err := w.w.Write(b)
+	return err
+}
+
+// WritePacket writes a payload sent over UDP or TCP as given by the tuple
+func (w *Writer) WritePacket(at time.Time, tuple siprocket.FiveTuple, payload []byte) error {
+	// IPv4 mapped addresses are written as IPv4
+	tuple.Src = netip.AddrPortFrom(tuple.Src.Addr().Unmap(), tuple.Src.Port())
+	tuple.Dst = netip.AddrPortFrom(tuple.Dst.Addr().Unmap(), tuple.Dst.Port())
+	if tuple.Proto != "tcp" {
+		if len(payload) > 65507 {
+			return ErrTooLarge
+		}
+		return w.WriteFrame(at, w.frame(tuple, protoUDP, w.udpHeader(tuple, payload)))
+	}
+
+	seq, ok := w.tcp[tuple]
+	if !ok {
+		if err := w.handshake(at, tuple); err != nil {
+			return err
+		}
+		seq = w.tcp[tuple]
+	}
+	for len(payload) > 0 {
+		n := min(len(payload), TCP_MSS)
+		seg := w.tcpHeader(tuple, seq, w.tcp[tuple.Reverse()], TCP_PSH|TCP_ACK, payload[:n])
+		if err := w.WriteFrame(at, w.frame(tuple, protoTCP, seg)); err != nil {
+			return err
+		}
+		seq += uint32(n)
+		payload = payload[n:]
+	}
+	w.tcp[tuple] = seq
+	return nil
+}
+
+// WriteMessage writes a SIP message, Marshal is used to get its bytes
+func (w *Writer) WriteMessage(at time.Time, tuple siprocket.FiveTuple, msg *siprocket.SipMsg) error {
+	return w.WritePacket(at, tuple, []byte(siprocket.Marshal(msg)))
+}
+
+// handshake writes the SYN, SYN ACK and ACK of a connection first seen
+// sending from tuple.Src
+func (w *Writer) handshake(at time.Time, tuple siprocket.FiveTuple) error {
+	rev := tuple.Reverse()
+	if _, ok := w.tcp[rev]; ok {
+		// The other side opened it
+		w.tcp[tuple] = isn(tuple)
+		return nil
+	}
+	a, b := isn(tuple), isn(rev)
+	segs := []struct {
+		t     siprocket.FiveTuple
+		seq   uint32
+		ack   uint32
+		flags uint8
+	}{
+		{tuple, a, 0, TCP_SYN},
+		{rev, b, a + 1, TCP_SYN | TCP_ACK},
+		{tuple, a + 1, b + 1, TCP_ACK},
+	}
+	for _, s := range segs {
+		if err := w.WriteFrame(at, w.frame(s.t, protoTCP, w.tcpHeader(s.t, s.seq, s.ack, s.flags, nil))); err != nil {
+			return err
+		}
+	}
+	w.tcp[tuple], w.tcp[rev] = a+1, b+1
+	return nil
+}
+
+// frame puts the Ethernet and IP headers in front of a UDP or TCP packet
+func (w *Writer) frame(tuple siprocket.FiveTuple, proto uint8, l4 []byte) []byte {
+	src, dst := tuple.Src.Addr(), tuple.Dst.Addr()
+	b := make([]byte, 0, 14+40+len(l4))
+	b = append(b, mac(dst)...)
+	b = append(b, mac(src)...)
+
+	if src.Is4() {
+		b = binary.BigEndian.AppendUint16(b, etherTypeIPv4)
+		w.ipId++
+		ip := []byte{0x45, 0}
+		ip = binary.BigEndian.AppendUint16(ip, uint16(20+len(l4)))
+		ip = binary.BigEndian.AppendUint16(ip, w.ipId)
+		ip = append(ip, 0x40, 0, 64, proto, 0, 0) // Don't fragment
+		ip = append(ip, src.AsSlice()...)
+		ip = append(ip, dst.AsSlice()...)
+		binary.BigEndian.PutUint16(ip[10:12], ^fold(checksum(0, ip)))
+		b = append(b, ip...)
+	} else {
+		b = binary.BigEndian.AppendUint16(b, etherTypeIPv6)
+		b = append(b, 0x60, 0, 0, 0)
+		b = binary.BigEndian.AppendUint16(b, uint16(len(l4)))
+		b = append(b, proto, 64)
+		b = append(b, src.AsSlice()...)
+		b = append(b, dst.AsSlice()...)
+	}
+	return append(b, l4...)
+}
+
+func (w *Writer) udpHeader(tuple siprocket.FiveTuple, payload []byte) []byte {
+	b := binary.BigEndian.AppendUint16(nil, tuple.Src.Port())
+	b = binary.BigEndian.AppendUint16(b, tuple.Dst.Port())
+	b = binary.BigEndian.AppendUint16(b, uint16(8+len(payload)))
+	b = append(b, 0, 0)
+	b = append(b, payload...)
+	sum := ^fold(checksum(pseudoHeader(tuple, protoUDP, len(b)), b))
+	if sum == 0 {
+		sum = 0xffff
+	}
+	binary.BigEndian.PutUint16(b[6:8], sum)
+	return b
+}
+
+func (w *Writer) tcpHeader(tuple siprocket.FiveTuple, seq, ack uint32, flags uint8, payload []byte) []byte {
+	b := binary.BigEndian.AppendUint16(nil, tuple.Src.Port())
+	b = binary.BigEndian.AppendUint16(b, tuple.Dst.Port())
+	b = binary.BigEndian.AppendUint32(b, seq)
+	b = binary.BigEndian.AppendUint32(b, ack)
+	b = append(b, 5<<4, flags, 0xff, 0xff, 0, 0, 0, 0)
+	b = append(b, payload...)
+	binary.BigEndian.PutUint16(b[16:18], ^fold(checksum(pseudoHeader(tuple, protoTCP, len(b)), b)))
+	return b
+}
+
+// pseudoHeader sums the addresses, protocol and length for the UDP and
+// TCP checksums
+func pseudoHeader(tuple siprocket.FiveTuple, proto uint8, length int) uint32 {
+	sum := checksum(0, tuple.Src.Addr().AsSlice())
+	sum = checksum(sum, tuple.Dst.Addr().AsSlice())
+	return sum + uint32(proto) + uint32(length)
+}
+
+// checksum adds b as 16 bit words to the one's complement sum
+func checksum(sum uint32, b []byte) uint32 {
+	for len(b) >= 2 {
+		sum += uint32(binary.BigEndian.Uint16(b))
+		b = b[2:]
+	}
+	if len(b) == 1 {
+		sum += uint32(b[0]) << 8
+	}
+	return sum
+}
+
+func fold(sum uint32) uint16 {
+	for sum > 0xffff {
+		sum = sum&0xffff + sum>>16
+	}
+	return uint16(sum)
+}
+
+// mac makes up a locally administered address for an IP address
+func mac(addr netip.Addr) []byte {
+	h := fnv.New32a()
+	h.Write(addr.AsSlice())
+	return binary.BigEndian.AppendUint32([]byte{0x02, 0x00}, h.Sum32())
+}
+
+// isn gives each direction of a connection its own initial sequence number
+func isn(tuple siprocket.FiveTuple) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(tuple.String()))
+	return h.Sum32()
+}
+
+func appendBlock(b []byte, typ uint32, body []byte) []byte {
+	for len(body)%4 != 0 {
+		body = append(body, 0)
+	}
+	total := uint32(len(body) + 12)
+	b = binary.LittleEndian.AppendUint32(b, typ)
+	b = binary.LittleEndian.AppendUint32(b, total)
+	b = append(b, body...)
+	return binary.LittleEndian.AppendUint32(b, total)
+}
+
+// Export copies the messages of the given calls read from r to w and
+// returns how many were written. The messages are written as captured.
+func Export(w *Writer, r *Reader, callIds ...string) (int, error) {
+	want := make(map[string]bool, len(callIds))
+	for _, id := range callIds {
+		want[id] = true
+	}
+	n := 0
+	for {
+		m, err := r.Next()
+		if err == io.EOF {
+			return n, nil
+		} else if err != nil {
+			return n, err
+		}
+		if !want[string(m.Msg.CallId.Value)] {
+			continue
+		}
+		if err := w.WritePacket(m.Time, m.Tuple, m.Raw); err != nil {
+			return n, err
+		}
+		n++
+	}
+}
@@ -0,0 +1,136 @@
+package capture
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nullboundary/siprocket"
+)
+
+func readAll(t *testing.T, file []byte) []Message {
+	t.Helper()
+	r, err := NewReader(bytes.NewReader(file))
+	if err != nil {
+		t.Fatalf("NewReader: %v", err)
+	}
+	var out []Message
+	for {
+		m, err := r.Next()
+		if err == io.EOF {
+			return out
+		}
+		if err != nil {
+			t.Fatalf("Next: %v", err)
+		}
+		out = append(out, m)
+	}
+}
+
+func Test_writer_RoundTrip(t *testing.T) {
+
+	at := time.Date(2024, 3, 1, 10, 0, 0, 123456789, time.UTC)
+	// A message spanning several TCP segments
+	big := strings.Replace(testInvite, "Content-Length: 0\r\n\r\n", "Content-Length: 4000\r\n\r\n", 1) + strings.Repeat("x", 4000)
+	in := []Message{
+		{Time: at, Tuple: siprocket.NewFiveTuple("udp", "10.0.0.1:5060", "10.0.0.2:5060"), Raw: []byte(testInvite)},
+		{Time: at.Add(time.Millisecond), Tuple: siprocket.NewFiveTuple("tcp", "10.0.0.1:40000", "10.0.0.2:5060"), Raw: []byte(big)},
+		{Time: at.Add(2 * time.Millisecond), Tuple: siprocket.NewFiveTuple("tcp", "10.0.0.2:5060", "10.0.0.1:40000"), Raw: []byte(testOk)},
+		{Time: at.Add(3 * time.Millisecond), Tuple: siprocket.NewFiveTuple("tcp", "10.0.0.1:40000", "10.0.0.2:5060"), Raw: []byte(testInvite)},
+		{Time: at.Add(4 * time.Millisecond), Tuple: siprocket.NewFiveTuple("udp", "[2001:db8::1]:5060", "[2001:db8::2]:5060"), Raw: []byte(testOk)},
+	}
+	for i := range in {
+		in[i].Msg = siprocket.Parse(in[i].Raw)
+	}
+
+	for _, ng := range []bool{false, true} {
+		var buf bytes.Buffer
+		var w *Writer
+		var err error
+		if ng {
+			w, err = NewPcapngWriter(&buf)
+		} else {
+			w, err = NewPcapWriter(&buf)
+		}
+		if err != nil {
+			t.Fatalf("New writer: %v", err)
+		}
+		for _, m := range in {
+			if err := w.WritePacket(m.Time, m.Tuple, m.Raw); err != nil {
+				t.Fatalf("WritePacket: %v", err)
+			}
+		}
+
+		got := readAll(t, buf.Bytes())
+		if !reflect.DeepEqual(in, got) {
+			t.Errorf("Mismatch pcapng %v:\nExpected:\n%+v\nGot:\n%+v", ng, in, got)
+		}
+
+		// Handshake, checksums and sequence numbers
+		r, _ := NewReader(bytes.NewReader(buf.Bytes()))
+		var flags []uint8
+		next := map[siprocket.FiveTuple]uint32{}
+		for {
+			f, err := r.frames.Next()
+			if err != nil {
+				break
+			}
+			ip, _ := linkPayload(f.LinkType, f.Data)
+			if ip[0]>>4 == 4 && fold(checksum(0, ip[:20])) != 0xffff {
+				t.Errorf("Bad IPv4 checksum")
+			}
+			pkt, _, _ := r.decoder.Decode(f.Time, f.LinkType, f.Data)
+			if pkt.Tuple.Proto != "tcp" {
+				continue
+			}
+			flags = append(flags, pkt.Flags)
+			if seq, ok := next[pkt.Tuple]; ok && seq != pkt.Seq {
+				t.Errorf("Sequence %d, expected %d", pkt.Seq, seq)
+			}
+			next[pkt.Tuple] = pkt.Seq + uint32(len(pkt.Payload))
+			if pkt.Flags&TCP_SYN != 0 {
+				next[pkt.Tuple]++
+			}
+		}
+		expFlags := []uint8{TCP_SYN, TCP_SYN | TCP_ACK, TCP_ACK, 0x18, 0x18, 0x18, 0x18, 0x18}
+		if !reflect.DeepEqual(expFlags, flags) {
+			t.Errorf("Mismatch:\nExpected:\n%v\nGot:\n%v", expFlags, flags)
+		}
+	}
+
+	var buf bytes.Buffer
+	w, _ := NewPcapWriter(&buf)
+	if err := w.WritePacket(at, in[0].Tuple, make([]byte, 70000)); err != ErrTooLarge {
+		t.Errorf("Expected ErrTooLarge, got %v", err)
+	}
+}
+
+func Test_writer_Export(t *testing.T) {
+
+	at := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+	other := strings.ReplaceAll(testInvite, "cap-1", "cap-2")
+	tuple := siprocket.NewFiveTuple("udp", "10.0.0.1:5060", "10.0.0.2:5060")
+
+	var src bytes.Buffer
+	w, _ := NewPcapngWriter(&src)
+	w.WritePacket(at, tuple, []byte(testInvite))
+	w.WritePacket(at.Add(time.Millisecond), tuple, []byte(other))
+	msg := siprocket.Parse([]byte(testOk))
+	w.WriteMessage(at.Add(2*time.Millisecond), tuple.Reverse(), &msg)
+
+	r, _ := NewReader(bytes.NewReader(src.Bytes()))
+	var dst bytes.Buffer
+	out, _ := NewPcapWriter(&dst)
+	n, err := Export(out, r, "cap-1")
+	if err != nil || n != 2 {
+		t.Fatalf("Export wrote %d: %v", n, err)
+	}
+
+	got := readAll(t, dst.Bytes())
+	if len(got) != 2 || string(got[0].Raw) != testInvite || !got[1].Time.Equal(at.Add(2*time.Millisecond)) || string(got[1].Msg.Req.StatusCode) != "200" {
+		t.Errorf("Exported %+v", got)
+	}
+}
@@ -0,0 +1,326 @@
+// Package cdr builds call detail records from the SIP messages of calls
+// as seen by a monitoring probe.
+package cdr
+
+/*
+ RFC 6076 - https://datatracker.ietf.org/doc/html/rfc6076#section-4
+
+ 4.3 Session Request Delay, better known as post dial delay, is the time
+ from the INVITE to the first provisional response other than 100 Trying,
+ or to the final response when no such provisional response is sent.
+
+ The ring time runs from that first ringing response to the answer or the
+ end of an unanswered call, and the duration from the answer to the BYE.
+
+*/
+
+import (
+	"bytes"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nullboundary/siprocket"
+	"github.com/nullboundary/siprocket/rtp"
+)
+
+// Who ended the call
+const (
+	PARTY_CALLER = "caller"
+	PARTY_CALLEE = "callee"
+	PARTY_SYSTEM = "system"
+)
+
+// How the call ended
+const (
+	END_BYE     = "BYE"
+	END_CANCEL  = "CANCEL"
+	END_FAILURE = "failure"
+	END_TIMEOUT = "timeout"
+)
+
+// Record is the call detail record of one call
+type Record struct {
+	CallId        string
+	Caller        string // user@host of the From
+	Callee        string // user@host of the To
+	Dialled       string // User part of the Request-URI
+	CallerUa      string // User-Agent of the caller
+	CalleeUa      string // User-Agent or Server of the callee
+	Start         time.Time
+	Ringing       time.Time // First provisional response other than 100
+	Answer        time.Time
+	End           time.Time
+	PostDialDelay time.Duration
+	RingTime      time.Duration
+	Duration      time.Duration // Answer to end, zero for unanswered calls
+	Status        int           // Final status of the INVITE
+	Reason        string        // Reason phrase of the final status
+	EndCause      string        // One of the END_ constants
+	Disconnect    string        // One of the PARTY_ constants
+	Codecs        []string      // Payload formats in the answer, first preferred
+	CallerMedia   string        // Address the caller receives audio on
+	CalleeMedia   string        // Address the callee receives audio on
+}
+
+// Answered tells if the call was answered
+func (r *Record) Answered() bool {
+	return !r.Answer.IsZero()
+}
+
+type call struct {
+	rec       Record
+	callerTag []byte
+	inviteSeq []byte
+	cancelled bool
+	pending   bool // A 401 or 407 that may be followed by a new INVITE
+	updated   time.Time
+}
+
+// Engine correlates messages into records. It is safe for concurrent use.
+type Engine struct {
+	mu    sync.Mutex
+	calls map[string]*call
+
+	// IdleTimeout is how long a call may go without a message before
+	// Expire ends it
+	IdleTimeout time.Duration
+
+	// OnRecord is called with each finished record, without the engine
+	// locked
+	OnRecord func(r Record)
+}
+
+func NewEngine() *Engine {
+	return &Engine{
+		calls:       make(map[string]*call),
+		IdleTimeout: 4 * time.Hour,
+	}
+}
+
+// Process accounts for a message seen at the given time
+func (e *Engine) Process(at time.Time, msg *siprocket.SipMsg) {
+	e.mu.Lock()
+	rec, done := e.process(at, msg)
+	e.mu.Unlock()
+
+	if done && e.OnRecord != nil {
+		e.OnRecord(rec)
+	}
+}
+
+func (e *Engine) process(at time.Time, msg *siprocket.SipMsg) (Record, bool) {
+	callId := string(msg.CallId.Value)
+	if callId == "" {
+		return Record{}, false
+	}
+	c := e.calls[callId]
+
+	if len(msg.Req.StatusCode) == 0 {
+		method := strings.ToUpper(string(msg.Req.Method))
+		if c == nil {
+			// Only an initial INVITE starts a call
+			if method != "INVITE" || len(msg.To.Tag) > 0 {
+				return Record{}, false
+			}
+			c = &call{rec: Record{
+				CallId:   callId,
+				Caller:   userHost(msg.From.User, msg.From.Host),
+				Callee:   userHost(msg.To.User, msg.To.Host),
+				Dialled:  string(msg.Req.User),
+				CallerUa: string(msg.Ua.Value),
+				Start:    at,
+			}, callerTag: msg.From.Tag}
+			e.calls[callId] = c
+		}
+		c.updated = at
+		return e.request(at, c, method, msg)
+	}
+
+	if c == nil {
+		return Record{}, false
+	}
+	c.updated = at
+	return e.response(at, c, msg)
+}
+
+func (e *Engine) request(at time.Time, c *call, method string, msg *siprocket.SipMsg) (Record, bool) {
+	switch method {
+	case "INVITE":
+		if len(msg.To.Tag) == 0 {
+			// The first INVITE or one sent again with credentials
+			c.pending = false
+			c.inviteSeq = bytes.Clone(msg.Cseq.Id)
+		}
+		if media := audioAddr(&msg.Sdp); media != "" && c.rec.Answer.IsZero() {
+			c.rec.CallerMedia = media
+		}
+	case "ACK":
+		// A late offer is answered in the ACK
+		if media := audioAddr(&msg.Sdp); media != "" && c.rec.CallerMedia == "" {
+			c.rec.CallerMedia = media
+		}
+	case "CANCEL":
+		c.cancelled = true
+	case "BYE":
+		c.rec.EndCause = END_BYE
+		c.rec.Disconnect = PARTY_CALLEE
+		if bytes.Equal(msg.From.Tag, c.callerTag) {
+			c.rec.Disconnect = PARTY_CALLER
+		}
+		return e.finish(c, at), true
+	}
+	return Record{}, false
+}
+
+func (e *Engine) response(at time.Time, c *call, msg *siprocket.SipMsg) (Record, bool) {
+	// Only the responses to the initial INVITE shape the record
+	if !strings.EqualFold(string(msg.Cseq.Method), "INVITE") || !bytes.Equal(msg.Cseq.Id, c.inviteSeq) || !c.rec.Answer.IsZero() {
+		return Record{}, false
+	}
+	code, _ := strconv.Atoi(string(msg.Req.StatusCode))
+
+	if ua := msg.Server.Value; len(ua) > 0 {
+		c.rec.CalleeUa = string(ua)
+	} else if ua = msg.Ua.Value; len(ua) > 0 {
+		c.rec.CalleeUa = string(ua)
+	}
+	if media := audioAddr(&msg.Sdp); media != "" {
+		c.rec.CalleeMedia = media
+		c.rec.Codecs = answerCodecs(&msg.Sdp)
+	}
+
+	switch {
+	case code > 100 && code < 200:
+		if c.rec.Ringing.IsZero() {
+			c.rec.Ringing = at
+		}
+	case code >= 200 && code < 300:
+		c.rec.Answer = at
+		c.rec.Status = code
+		c.rec.Reason = string(msg.Req.StatusDesc)
+	case code == 401 || code == 407:
+		// Usually followed by the INVITE again with credentials
+		c.rec.Status = code
+		c.rec.Reason = string(msg.Req.StatusDesc)
+		c.pending = true
+	case code >= 300:
+		c.rec.Status = code
+		c.rec.Reason = string(msg.Req.StatusDesc)
+		c.rec.EndCause = END_FAILURE
+		c.rec.Disconnect = PARTY_CALLEE
+		if c.cancelled {
+			c.rec.EndCause = END_CANCEL
+			c.rec.Disconnect = PARTY_CALLER
+		}
+		return e.finish(c, at), true
+	}
+	return Record{}, false
+}
+
+// finish completes the record of a call and forgets the call
+func (e *Engine) finish(c *call, at time.Time) Record {
+	delete(e.calls, c.rec.CallId)
+
+	r := c.rec
+	r.End = at
+	switch {
+	case !r.Ringing.IsZero():
+		r.PostDialDelay = r.Ringing.Sub(r.Start)
+		if r.Answered() {
+			r.RingTime = r.Answer.Sub(r.Ringing)
+		} else {
+			r.RingTime = r.End.Sub(r.Ringing)
+		}
+	case r.Answered():
+		r.PostDialDelay = r.Answer.Sub(r.Start)
+	case r.Status >= 300:
+		r.PostDialDelay = r.End.Sub(r.Start)
+	}
+	if r.Answered() {
+		r.Duration = r.End.Sub(r.Answer)
+	}
+	return r
+}
+
+// Expire ends the calls that have been idle for longer than IdleTimeout,
+// such as calls whose BYE was not captured, and returns their records
+func (e *Engine) Expire(now time.Time) []Record {
+	var out []Record
+
+	e.mu.Lock()
+	for _, c := range e.calls {
+		if now.Sub(c.updated) <= e.IdleTimeout {
+			continue
+		}
+		if c.rec.EndCause == "" {
+			c.rec.EndCause = END_TIMEOUT
+			if c.pending {
+				c.rec.EndCause = END_FAILURE
+			}
+		}
+		if c.rec.Disconnect == "" {
+			c.rec.Disconnect = PARTY_SYSTEM
+		}
+		out = append(out, e.finish(c, c.updated))
+	}
+	e.mu.Unlock()
+
+	if e.OnRecord != nil {
+		for _, r := range out {
+			e.OnRecord(r)
+		}
+	}
+	return out
+}
+
+// Active returns the number of calls in progress
+func (e *Engine) Active() int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return len(e.calls)
+}
+
+func userHost(user, host []byte) string {
+	if len(user) == 0 {
+		return string(host)
+	}
+	return string(user) + "@" + string(host)
+}
+
+// audioAddr returns the address of the first audio stream that is not
+// rejected
+func audioAddr(sdp *siprocket.SdpMsg) string {
+	for _, s := range sdp.Streams() {
+		if s.MediaType == "audio" && !s.Rejected && s.ConnAddr != "" {
+			return net.JoinHostPort(s.ConnAddr, strconv.Itoa(s.Port))
+		}
+	}
+	return ""
+}
+
+// answerCodecs returns the formats of the first audio stream by name
+func answerCodecs(sdp *siprocket.SdpMsg) []string {
+	for _, s := range sdp.Streams() {
+		if s.MediaType != "audio" || s.Rejected || s.Index >= len(sdp.Media) {
+			continue
+		}
+		codecs := rtp.Codecs(&sdp.Media[s.Index])
+		var out []string
+		for _, f := range s.Fmt {
+			pt, err := strconv.ParseUint(f, 10, 7)
+			if err != nil {
+				continue
+			}
+			if codec, ok := codecs[uint8(pt)]; ok {
+				out = append(out, codec.Name)
+			} else {
+				out = append(out, f)
+			}
+		}
+		return out
+	}
+	return nil
+}
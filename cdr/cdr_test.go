@@ -0,0 +1,134 @@
+package cdr
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/nullboundary/siprocket"
+)
+
+var testStart = time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+type timed struct {
+	at  time.Duration
+	msg string
+}
+
+func run(e *Engine, msgs []timed) {
+	for _, m := range msgs {
+		parsed := siprocket.Parse([]byte(m.msg))
+		e.Process(testStart.Add(m.at), &parsed)
+	}
+}
+
+const (
+	hdrsReq = "From: \"Alice\" <sip:alice@atlanta.com>;tag=1928301774\r\n" +
+		"To: <sip:bob@biloxi.com>\r\n" +
+		"Call-ID: call-1\r\n"
+	hdrsResp = "From: \"Alice\" <sip:alice@atlanta.com>;tag=1928301774\r\n" +
+		"To: <sip:bob@biloxi.com>;tag=a6c85cf\r\n" +
+		"Call-ID: call-1\r\n"
+)
+
+var answeredCall = []timed{
+	{0, "INVITE sip:1001@biloxi.com SIP/2.0\r\n" + hdrsReq +
+		"CSeq: 1 INVITE\r\n" +
+		"User-Agent: Softphone 1.0\r\n" +
+		"Content-Type: application/sdp\r\n" +
+		"\r\n" +
+		"v=0\r\n" +
+		"c=IN IP4 10.0.0.2\r\n" +
+		"m=audio 4000 RTP/AVP 0 8 101\r\n" +
+		"a=rtpmap:101 telephone-event/8000\r\n"},
+	{50 * time.Millisecond, "SIP/2.0 100 Trying\r\n" + hdrsReq + "CSeq: 1 INVITE\r\n\r\n"},
+	{1500 * time.Millisecond, "SIP/2.0 180 Ringing\r\n" + hdrsResp + "CSeq: 1 INVITE\r\n\r\n"},
+	{6500 * time.Millisecond, "SIP/2.0 200 OK\r\n" + hdrsResp +
+		"CSeq: 1 INVITE\r\n" +
+		"Server: PBX 2.3\r\n" +
+		"Content-Type: application/sdp\r\n" +
+		"\r\n" +
+		"v=0\r\n" +
+		"c=IN IP4 10.0.0.1\r\n" +
+		"m=audio 6000 RTP/AVP 8 101\r\n" +
+		"a=rtpmap:101 telephone-event/8000\r\n"},
+	{6600 * time.Millisecond, "ACK sip:bob@10.0.0.1 SIP/2.0\r\n" + hdrsResp + "CSeq: 1 ACK\r\n\r\n"},
+	{66500 * time.Millisecond, "BYE sip:alice@10.0.0.2 SIP/2.0\r\n" +
+		"From: <sip:bob@biloxi.com>;tag=a6c85cf\r\n" +
+		"To: \"Alice\" <sip:alice@atlanta.com>;tag=1928301774\r\n" +
+		"Call-ID: call-1\r\n" +
+		"CSeq: 1 BYE\r\n\r\n"},
+}
+
+func Test_cdrEngine_Answered(t *testing.T) {
+
+	e := NewEngine()
+	var records []Record
+	e.OnRecord = func(r Record) { records = append(records, r) }
+	run(e, answeredCall)
+
+	exp := Record{
+		CallId:        "call-1",
+		Caller:        "alice@atlanta.com",
+		Callee:        "bob@biloxi.com",
+		Dialled:       "1001",
+		CallerUa:      "Softphone 1.0",
+		CalleeUa:      "PBX 2.3",
+		Start:         testStart,
+		Ringing:       testStart.Add(1500 * time.Millisecond),
+		Answer:        testStart.Add(6500 * time.Millisecond),
+		End:           testStart.Add(66500 * time.Millisecond),
+		PostDialDelay: 1500 * time.Millisecond,
+		RingTime:      5 * time.Second,
+		Duration:      time.Minute,
+		Status:        200,
+		Reason:        "OK",
+		EndCause:      END_BYE,
+		Disconnect:    PARTY_CALLEE,
+		Codecs:        []string{"PCMA", "telephone-event"},
+		CallerMedia:   "10.0.0.2:4000",
+		CalleeMedia:   "10.0.0.1:6000",
+	}
+	if len(records) != 1 || !reflect.DeepEqual(records[0], exp) {
+		t.Errorf("Mismatch:\nExpected:\n%+v\nGot:\n%+v", exp, records)
+	}
+	if e.Active() != 0 {
+		t.Errorf("Active %d", e.Active())
+	}
+}
+
+func Test_cdrEngine_Unanswered(t *testing.T) {
+
+	e := NewEngine()
+	var records []Record
+	e.OnRecord = func(r Record) { records = append(records, r) }
+
+	// Challenged, sent again with credentials, then cancelled by the caller
+	run(e, []timed{
+		{0, "INVITE sip:1001@biloxi.com SIP/2.0\r\n" + hdrsReq + "CSeq: 1 INVITE\r\n\r\n"},
+		{100 * time.Millisecond, "SIP/2.0 407 Proxy Authentication Required\r\n" + hdrsResp + "CSeq: 1 INVITE\r\n\r\n"},
+		{200 * time.Millisecond, "INVITE sip:1001@biloxi.com SIP/2.0\r\n" + hdrsReq + "CSeq: 2 INVITE\r\n\r\n"},
+		{3200 * time.Millisecond, "SIP/2.0 180 Ringing\r\n" + hdrsResp + "CSeq: 2 INVITE\r\n\r\n"},
+		{9200 * time.Millisecond, "CANCEL sip:1001@biloxi.com SIP/2.0\r\n" + hdrsReq + "CSeq: 2 CANCEL\r\n\r\n"},
+		{9300 * time.Millisecond, "SIP/2.0 487 Request Terminated\r\n" + hdrsResp + "CSeq: 2 INVITE\r\n\r\n"},
+	})
+	if len(records) != 1 {
+		t.Fatalf("Records %d", len(records))
+	}
+	r := records[0]
+	if r.Status != 487 || r.EndCause != END_CANCEL || r.Disconnect != PARTY_CALLER || r.Answered() ||
+		r.PostDialDelay != 3200*time.Millisecond || r.RingTime != 6100*time.Millisecond || r.Duration != 0 {
+		t.Errorf("Mismatch: %+v", r)
+	}
+
+	// No BYE was captured
+	run(e, answeredCall[:5])
+	if out := e.Expire(testStart.Add(time.Hour)); len(out) != 0 {
+		t.Errorf("Expired too early")
+	}
+	out := e.Expire(testStart.Add(5 * time.Hour))
+	if len(out) != 1 || out[0].EndCause != END_TIMEOUT || out[0].Disconnect != PARTY_SYSTEM ||
+		!out[0].End.Equal(testStart.Add(6600*time.Millisecond)) || len(records) != 2 {
+		t.Errorf("Mismatch: %+v", out)
+	}
+}
@@ -0,0 +1,121 @@
+package cdr
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The CSV columns, also the JSON field names
+var Columns = []string{
+	"call_id", "caller", "callee", "dialled", "caller_ua", "callee_ua",
+	"start", "ringing", "answer", "end",
+	"post_dial_delay_ms", "ring_time_ms", "duration_ms",
+	"status", "reason", "end_cause", "disconnect", "codecs",
+	"caller_media", "callee_media",
+}
+
+// Times are written as RFC 3339 in UTC with milliseconds
+const timeLayout = "2006-01-02T15:04:05.000Z07:00"
+
+// jsonRecord is the exported form of a record, times that are not set are
+// left out
+type jsonRecord struct {
+	CallId        string   `json:"call_id"`
+	Caller        string   `json:"caller"`
+	Callee        string   `json:"callee"`
+	Dialled       string   `json:"dialled,omitempty"`
+	CallerUa      string   `json:"caller_ua,omitempty"`
+	CalleeUa      string   `json:"callee_ua,omitempty"`
+	Start         string   `json:"start"`
+	Ringing       string   `json:"ringing,omitempty"`
+	Answer        string   `json:"answer,omitempty"`
+	End           string   `json:"end"`
+	PostDialDelay int64    `json:"post_dial_delay_ms"`
+	RingTime      int64    `json:"ring_time_ms"`
+	Duration      int64    `json:"duration_ms"`
+	Status        int      `json:"status"`
+	Reason        string   `json:"reason,omitempty"`
+	EndCause      string   `json:"end_cause"`
+	Disconnect    string   `json:"disconnect"`
+	Codecs        []string `json:"codecs,omitempty"`
+	CallerMedia   string   `json:"caller_media,omitempty"`
+	CalleeMedia   string   `json:"callee_media,omitempty"`
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(timeLayout)
+}
+
+// MarshalJSON writes the record with snake case names, durations in
+// milliseconds and times in RFC 3339
+func (r Record) MarshalJSON() ([]byte, error) {
+	return json.Marshal(jsonRecord{
+		CallId:        r.CallId,
+		Caller:        r.Caller,
+		Callee:        r.Callee,
+		Dialled:       r.Dialled,
+		CallerUa:      r.CallerUa,
+		CalleeUa:      r.CalleeUa,
+		Start:         formatTime(r.Start),
+		Ringing:       formatTime(r.Ringing),
+		Answer:        formatTime(r.Answer),
+		End:           formatTime(r.End),
+		PostDialDelay: r.PostDialDelay.Milliseconds(),
+		RingTime:      r.RingTime.Milliseconds(),
+		Duration:      r.Duration.Milliseconds(),
+		Status:        r.Status,
+		Reason:        r.Reason,
+		EndCause:      r.EndCause,
+		Disconnect:    r.Disconnect,
+		Codecs:        r.Codecs,
+		CallerMedia:   r.CallerMedia,
+		CalleeMedia:   r.CalleeMedia,
+	})
+}
+
+// CsvRow returns the record as strings in the order of Columns
+func (r *Record) CsvRow() []string {
+	return []string{
+		r.CallId, r.Caller, r.Callee, r.Dialled, r.CallerUa, r.CalleeUa,
+		formatTime(r.Start), formatTime(r.Ringing), formatTime(r.Answer), formatTime(r.End),
+		strconv.FormatInt(r.PostDialDelay.Milliseconds(), 10),
+		strconv.FormatInt(r.RingTime.Milliseconds(), 10),
+		strconv.FormatInt(r.Duration.Milliseconds(), 10),
+		strconv.Itoa(r.Status), r.Reason, r.EndCause, r.Disconnect,
+		strings.Join(r.Codecs, " "),
+		r.CallerMedia, r.CalleeMedia,
+	}
+}
+
+// WriteJSON writes the records as JSON lines, one object per line
+func WriteJSON(w io.Writer, records []Record) error {
+	enc := json.NewEncoder(w)
+	for i := range records {
+		if err := enc.Encode(records[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteCSV writes the records as CSV with a header row
+func WriteCSV(w io.Writer, records []Record) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(Columns); err != nil {
+		return err
+	}
+	for i := range records {
+		if err := cw.Write(records[i].CsvRow()); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
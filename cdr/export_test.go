@@ -0,0 +1,48 @@
+package cdr
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func Test_cdrExport_JsonCsv(t *testing.T) {
+
+	r := Record{
+		CallId:        "call-1",
+		Caller:        "alice@atlanta.com",
+		Callee:        "bob@biloxi.com",
+		Start:         testStart,
+		End:           testStart.Add(2 * time.Second),
+		PostDialDelay: 2 * time.Second,
+		Status:        486,
+		Reason:        "Busy Here",
+		EndCause:      END_FAILURE,
+		Disconnect:    PARTY_CALLEE,
+		Codecs:        []string{"PCMU", "PCMA"},
+	}
+
+	var b bytes.Buffer
+	if err := WriteJSON(&b, []Record{r}); err != nil {
+		t.Fatal(err)
+	}
+	exp := `{"call_id":"call-1","caller":"alice@atlanta.com","callee":"bob@biloxi.com",` +
+		`"start":"2024-01-01T12:00:00.000Z","end":"2024-01-01T12:00:02.000Z",` +
+		`"post_dial_delay_ms":2000,"ring_time_ms":0,"duration_ms":0,"status":486,"reason":"Busy Here",` +
+		`"end_cause":"failure","disconnect":"callee","codecs":["PCMU","PCMA"]}` + "\n"
+	if b.String() != exp {
+		t.Errorf("Mismatch:\nExpected:\n%s\nGot:\n%s", exp, b.String())
+	}
+
+	b.Reset()
+	if err := WriteCSV(&b, []Record{r}); err != nil {
+		t.Fatal(err)
+	}
+	exp = "call_id,caller,callee,dialled,caller_ua,callee_ua,start,ringing,answer,end," +
+		"post_dial_delay_ms,ring_time_ms,duration_ms,status,reason,end_cause,disconnect,codecs,caller_media,callee_media\n" +
+		"call-1,alice@atlanta.com,bob@biloxi.com,,,,2024-01-01T12:00:00.000Z,,,2024-01-01T12:00:02.000Z," +
+		"2000,0,0,486,Busy Here,failure,callee,PCMU PCMA,,\n"
+	if b.String() != exp {
+		t.Errorf("Mismatch:\nExpected:\n%s\nGot:\n%s", exp, b.String())
+	}
+}
@@ -0,0 +1,193 @@
+package dtmf
+
+import (
+	"bytes"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nullboundary/siprocket"
+	"github.com/nullboundary/siprocket/rtp"
+)
+
+// Where a digit was detected
+const (
+	SOURCE_RFC4733 = "rfc4733"
+	SOURCE_INFO    = "info"
+	SOURCE_KPML    = "kpml"
+)
+
+// Event is one digit pressed during a call
+type Event struct {
+	CallId   string        // Call-ID of the dialog
+	Digit    byte          // 0-9, *, #, A-D or F for flash
+	Time     time.Time     // Arrival of the first packet or the request
+	Duration time.Duration // Length of the tone, zero when not signalled
+	Source   string        // One of the SOURCE_ constants
+	Volume   int           // Power level in dBm0, RTP events only
+	SSRC     uint32        // Synchronization source, RTP events only
+	Ended    bool          // The end of an RTP event was seen
+}
+
+type rtpKey struct {
+	callId string
+	ssrc   uint32
+}
+
+type rtpState struct {
+	timestamp uint32
+	idx       int // Position of the event in the call's list
+}
+
+// Detector collects the digits of many calls. It is safe for concurrent
+// use.
+type Detector struct {
+	mu    sync.Mutex
+	calls map[string][]Event
+	rtp   map[rtpKey]*rtpState
+}
+
+func NewDetector() *Detector {
+	return &Detector{
+		calls: make(map[string][]Event),
+		rtp:   make(map[rtpKey]*rtpState),
+	}
+}
+
+// AddRtp accounts for an RTP packet of a stream found by rtp.Matcher. It
+// returns true when the packet starts a new digit. Packets that are not
+// telephone events as negotiated in SDP are ignored.
+func (d *Detector) AddRtp(at time.Time, s rtp.Stream, p *rtp.Packet) bool {
+	codec, ok := s.Codecs[p.PayloadType]
+	if !ok || !strings.EqualFold(codec.Name, "telephone-event") {
+		return false
+	}
+	payload, err := ParsePayload(p.Payload)
+	if err != nil {
+		return false
+	}
+	digit := Digit(payload.Event)
+	if digit == 0 {
+		return false
+	}
+	clockRate := codec.ClockRate
+	if clockRate == 0 {
+		clockRate = 8000
+	}
+	duration := time.Duration(payload.Duration) * time.Second / time.Duration(clockRate)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	key := rtpKey{s.CallId, p.SSRC}
+	if st, ok := d.rtp[key]; ok && st.timestamp == p.Timestamp {
+		// A later packet or a retransmission of the same event
+		ev := &d.calls[s.CallId][st.idx]
+		if duration > ev.Duration {
+			ev.Duration = duration
+		}
+		ev.Ended = ev.Ended || payload.End
+		return false
+	}
+
+	d.rtp[key] = &rtpState{timestamp: p.Timestamp, idx: len(d.calls[s.CallId])}
+	d.calls[s.CallId] = append(d.calls[s.CallId], Event{
+		CallId:   s.CallId,
+		Digit:    digit,
+		Time:     at,
+		Duration: duration,
+		Source:   SOURCE_RFC4733,
+		Volume:   -int(payload.Volume),
+		SSRC:     p.SSRC,
+		Ended:    payload.End,
+	})
+	return true
+}
+
+// AddSip accounts for a SIP message, INFO requests with a dtmf-relay or
+// dtmf body and NOTIFY requests with a KPML response add digits. It
+// returns the number of digits added.
+func (d *Detector) AddSip(at time.Time, msg *siprocket.SipMsg) int {
+	if len(msg.Req.StatusCode) > 0 || len(msg.Body) == 0 {
+		return 0
+	}
+
+	ctype := msg.ContType.Value
+	if pos := bytes.IndexByte(ctype, ';'); pos >= 0 {
+		ctype = ctype[:pos]
+	}
+	ctype = bytes.TrimSpace(ctype)
+
+	var events []Event
+	method := string(msg.Req.Method)
+	switch {
+	case strings.EqualFold(method, "INFO") && bytes.EqualFold(ctype, []byte(CONTENT_DTMF_RELAY)):
+		digit, duration, err := ParseRelay(msg.Body)
+		if err != nil {
+			return 0
+		}
+		events = append(events, Event{Digit: digit, Duration: duration, Source: SOURCE_INFO})
+	case strings.EqualFold(method, "INFO") && bytes.EqualFold(ctype, []byte(CONTENT_DTMF)):
+		digit, duration, err := ParseDtmf(msg.Body)
+		if err != nil {
+			return 0
+		}
+		events = append(events, Event{Digit: digit, Duration: duration, Source: SOURCE_INFO})
+	case strings.EqualFold(method, "NOTIFY") && bytes.EqualFold(ctype, []byte(CONTENT_KPML)):
+		digits, err := ParseKpml(msg.Body)
+		if err != nil {
+			return 0
+		}
+		for i := 0; i < len(digits); i++ {
+			events = append(events, Event{Digit: digits[i], Source: SOURCE_KPML})
+		}
+	}
+
+	if len(events) == 0 {
+		return 0
+	}
+
+	callId := string(msg.CallId.Value)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, ev := range events {
+		ev.CallId = callId
+		ev.Time = at
+		d.calls[callId] = append(d.calls[callId], ev)
+	}
+	return len(events)
+}
+
+// Events returns the digits of a call ordered by time
+func (d *Detector) Events(callId string) []Event {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	out := append([]Event(nil), d.calls[callId]...)
+	sort.SliceStable(out, func(i, j int) bool { return out[i].Time.Before(out[j].Time) })
+	return out
+}
+
+// Digits returns the digits of a call as a string, eg for matching a PIN
+func (d *Detector) Digits(callId string) string {
+	events := d.Events(callId)
+	out := make([]byte, len(events))
+	for i := range events {
+		out[i] = events[i].Digit
+	}
+	return string(out)
+}
+
+// Remove forgets the digits of a call
+func (d *Detector) Remove(callId string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	delete(d.calls, callId)
+	for key := range d.rtp {
+		if key.callId == callId {
+			delete(d.rtp, key)
+		}
+	}
+}
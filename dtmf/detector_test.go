@@ -0,0 +1,91 @@
+package dtmf
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nullboundary/siprocket"
+	"github.com/nullboundary/siprocket/rtp"
+)
+
+func Test_dtmfDetector_Unified(t *testing.T) {
+
+	stream := rtp.Stream{
+		CallId: "call-1",
+		Codecs: map[uint8]rtp.Codec{
+			0:   {PayloadType: 0, Name: "PCMU", ClockRate: 8000, Channels: 1},
+			101: {PayloadType: 101, Name: "telephone-event", ClockRate: 8000, Channels: 1},
+		},
+	}
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	d := NewDetector()
+
+	// Digit 1 over RTP, the end packet is sent three times
+	for i, dur := range []uint16{160, 320, 640, 800, 800, 800} {
+		p := rtp.Packet{
+			Header:  rtp.Header{Version: 2, PayloadType: 101, Sequence: uint16(i), Timestamp: 8000, SSRC: 7},
+			Payload: MarshalPayload(&Payload{Event: 1, End: i >= 3, Volume: 10, Duration: dur}),
+		}
+		added := d.AddRtp(start.Add(time.Duration(i)*20*time.Millisecond), stream, &p)
+		if added != (i == 0) {
+			t.Errorf("Packet %d added %v", i, added)
+		}
+	}
+
+	// Voice is ignored
+	voice := rtp.Packet{Header: rtp.Header{Version: 2, PayloadType: 0, Timestamp: 9000, SSRC: 7}, Payload: make([]byte, 160)}
+	if d.AddRtp(start.Add(200*time.Millisecond), stream, &voice) {
+		t.Errorf("Voice added as a digit")
+	}
+
+	// Digit 2 over SIP INFO, received before the KPML NOTIFY but added later
+	kpml := siprocket.Parse([]byte("NOTIFY sip:alice@10.0.0.1 SIP/2.0\r\n" +
+		"Call-ID: call-1\r\n" +
+		"CSeq: 3 NOTIFY\r\n" +
+		"Content-Type: application/kpml-response+xml\r\n" +
+		"\r\n" +
+		`<kpml-response version="1.0" code="200" text="OK" digits="34"/>`))
+	if n := d.AddSip(start.Add(2*time.Second), &kpml); n != 2 {
+		t.Errorf("KPML added %d digits", n)
+	}
+	info := siprocket.Parse([]byte("INFO sip:alice@10.0.0.1 SIP/2.0\r\n" +
+		"Call-ID: call-1\r\n" +
+		"CSeq: 2 INFO\r\n" +
+		"Content-Type: application/dtmf-relay\r\n" +
+		"Content-Length: 26\r\n" +
+		"\r\n" +
+		"Signal=2\r\nDuration=250\r\n"))
+	if n := d.AddSip(start.Add(time.Second), &info); n != 1 {
+		t.Errorf("INFO added %d digits", n)
+	}
+	ok := siprocket.Parse([]byte("SIP/2.0 200 OK\r\n" +
+		"Call-ID: call-1\r\n" +
+		"CSeq: 2 INFO\r\n" +
+		"Content-Type: application/dtmf-relay\r\n" +
+		"\r\n" +
+		"Signal=9\r\n"))
+	if n := d.AddSip(start.Add(time.Second), &ok); n != 0 {
+		t.Errorf("Response added %d digits", n)
+	}
+
+	events := d.Events("call-1")
+	if len(events) != 4 || d.Digits("call-1") != "1234" {
+		t.Fatalf("Mismatch: %q %+v", d.Digits("call-1"), events)
+	}
+	exp := Event{CallId: "call-1", Digit: '1', Time: start, Duration: 100 * time.Millisecond,
+		Source: SOURCE_RFC4733, Volume: -10, SSRC: 7, Ended: true}
+	if events[0] != exp {
+		t.Errorf("Mismatch:\nExpected:\n%+v\nGot:\n%+v", exp, events[0])
+	}
+	if events[1].Source != SOURCE_INFO || events[1].Duration != 250*time.Millisecond || !events[1].Time.Equal(start.Add(time.Second)) {
+		t.Errorf("Mismatch: %+v", events[1])
+	}
+	if events[2].Source != SOURCE_KPML || events[3].Digit != '4' {
+		t.Errorf("Mismatch: %+v", events[2:])
+	}
+
+	d.Remove("call-1")
+	if len(d.Events("call-1")) != 0 {
+		t.Errorf("Events left after Remove")
+	}
+}
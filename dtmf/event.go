@@ -0,0 +1,91 @@
+// Package dtmf detects the digits dialled during a call, whether they are
+// sent in the media as RFC 4733 telephone events or in the signalling as
+// SIP INFO or KPML NOTIFY requests.
+package dtmf
+
+/*
+ RFC 4733 - https://datatracker.ietf.org/doc/html/rfc4733#section-2.3
+
+ 2.3 Payload Format
+
+    0                   1                   2                   3
+    0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1
+   +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+   |     event     |E|R| volume    |          duration             |
+   +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+
+ Every packet of one event carries the RTP timestamp of its start, the
+ duration grows with each packet and the last packet, which has the E bit
+ set, is usually sent three times.
+
+ 3.2 DTMF Events
+
+   0-9 the digits, 10 *, 11 #, 12-15 A to D and 16 flash
+
+*/
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+const payloadLen = 4
+
+var ErrShort = errors.New("dtmf: telephone event too short")
+
+// Event codes 0 to 16 in order
+const digits = "0123456789*#ABCDF"
+
+// Payload is one RFC 4733 telephone event payload
+type Payload struct {
+	Event    uint8  // Event code
+	End      bool   // Last packet of the event
+	Volume   uint8  // Power level in -dBm0
+	Duration uint16 // Duration so far in timestamp units
+}
+
+// ParsePayload decodes a telephone event payload, only the first event is
+// decoded when several are packed together
+func ParsePayload(b []byte) (Payload, error) {
+	var p Payload
+	if len(b) < payloadLen {
+		return p, ErrShort
+	}
+	p.Event = b[0]
+	p.End = b[1]&0x80 != 0
+	p.Volume = b[1] & 0x3f
+	p.Duration = binary.BigEndian.Uint16(b[2:4])
+	return p, nil
+}
+
+// MarshalPayload encodes a telephone event payload
+func MarshalPayload(p *Payload) []byte {
+	b := make([]byte, payloadLen)
+	b[0] = p.Event
+	b[1] = p.Volume & 0x3f
+	if p.End {
+		b[1] |= 0x80
+	}
+	binary.BigEndian.PutUint16(b[2:], p.Duration)
+	return b
+}
+
+// Digit returns the DTMF character of an event code, or 0 for events that
+// are not DTMF such as the line tones
+func Digit(event uint8) byte {
+	if int(event) >= len(digits) {
+		return 0
+	}
+	return digits[event]
+}
+
+// EventCode returns the event code of a DTMF character
+func EventCode(digit byte) (uint8, bool) {
+	digit = upper(digit)
+	for i := 0; i < len(digits); i++ {
+		if digits[i] == digit {
+			return uint8(i), true
+		}
+	}
+	return 0, false
+}
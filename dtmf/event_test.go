@@ -0,0 +1,56 @@
+package dtmf
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func Test_dtmfParsePayload_RoundTrip(t *testing.T) {
+
+	exp := Payload{Event: 11, End: true, Volume: 10, Duration: 1280}
+	b := MarshalPayload(&exp)
+	if !reflect.DeepEqual(b, []byte{11, 0x8a, 0x05, 0x00}) {
+		t.Fatalf("Mismatch: % x", b)
+	}
+	out, err := ParsePayload(b)
+	if err != nil || out != exp {
+		t.Errorf("Mismatch:\nExpected:\n%+v\nGot:\n%+v %v", exp, out, err)
+	}
+	if Digit(out.Event) != '#' || Digit(16) != 'F' || Digit(40) != 0 {
+		t.Errorf("Mismatch: digits")
+	}
+	if _, err := ParsePayload([]byte{1, 2}); err != ErrShort {
+		t.Errorf("Expected ErrShort, got %v", err)
+	}
+}
+
+func Test_dtmfParseSip_Bodies(t *testing.T) {
+
+	digit, dur, err := ParseRelay([]byte("Signal=5\r\nDuration=160\r\n"))
+	if err != nil || digit != '5' || dur != 160*time.Millisecond {
+		t.Errorf("Mismatch: %c %v %v", digit, dur, err)
+	}
+	digit, _, err = ParseRelay([]byte("Signal= 11\r\nDuration=100\r\n"))
+	if err != nil || digit != '#' {
+		t.Errorf("Mismatch: %c %v", digit, err)
+	}
+	if _, _, err = ParseRelay([]byte("Duration=100\r\n")); err == nil {
+		t.Errorf("Expected an error without Signal")
+	}
+
+	digit, _, err = ParseDtmf([]byte("*\r\n"))
+	if err != nil || digit != '*' {
+		t.Errorf("Mismatch: %c %v", digit, err)
+	}
+
+	digits, err := ParseKpml([]byte(`<?xml version="1.0" encoding="UTF-8"?>` +
+		`<kpml-response version="1.0" code="200" text="OK" digits="12a#" tag="dial"/>`))
+	if err != nil || digits != "12A#" {
+		t.Errorf("Mismatch: %q %v", digits, err)
+	}
+	digits, err = ParseKpml([]byte(`<kpml-response version="1.0" code="423" text="Timer Expired"/>`))
+	if err != nil || digits != "" {
+		t.Errorf("Mismatch: %q %v", digits, err)
+	}
+}
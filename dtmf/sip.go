@@ -0,0 +1,117 @@
+package dtmf
+
+/*
+ application/dtmf-relay, as sent in SIP INFO by most equipment
+
+   Signal=5
+   Duration=160
+
+ The duration is in milliseconds. application/dtmf carries just the digit.
+
+ RFC 4730 - https://datatracker.ietf.org/doc/html/rfc4730#section-5.4
+
+ 5.4 KPML Response
+
+   <?xml version="1.0" encoding="UTF-8"?>
+   <kpml-response version="1.0" code="200" text="OK" digits="1234" tag="dial"/>
+
+*/
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"strconv"
+	"time"
+)
+
+const (
+	CONTENT_DTMF_RELAY = "application/dtmf-relay"
+	CONTENT_DTMF       = "application/dtmf"
+	CONTENT_KPML       = "application/kpml-response+xml"
+)
+
+// ParseRelay parses an application/dtmf-relay body. Signal may be given as
+// the digit itself or as its event code, eg 11 for #.
+func ParseRelay(body []byte) (digit byte, duration time.Duration, err error) {
+	for _, line := range bytes.Split(body, []byte("\n")) {
+		pos := bytes.IndexByte(line, '=')
+		if pos < 0 {
+			continue
+		}
+		key := bytes.TrimSpace(line[:pos])
+		val := bytes.TrimSpace(line[pos+1:])
+		switch {
+		case bytes.EqualFold(key, []byte("signal")):
+			digit = parseSignal(val)
+		case bytes.EqualFold(key, []byte("duration")):
+			if ms, err := strconv.Atoi(string(val)); err == nil && ms > 0 {
+				duration = time.Duration(ms) * time.Millisecond
+			}
+		}
+	}
+	if digit == 0 {
+		return 0, 0, errors.New("dtmf: no valid Signal in dtmf-relay body")
+	}
+	return digit, duration, nil
+}
+
+// parseSignal returns the digit of a Signal value
+func parseSignal(v []byte) byte {
+	if len(v) == 1 {
+		if _, ok := EventCode(v[0]); ok {
+			return upper(v[0])
+		}
+		return 0
+	}
+	if code, err := strconv.ParseUint(string(v), 10, 8); err == nil {
+		return Digit(uint8(code))
+	}
+	return 0
+}
+
+// ParseDtmf parses an application/dtmf body, which is the digit alone.
+// Bodies written in the dtmf-relay form are accepted as well.
+func ParseDtmf(body []byte) (digit byte, duration time.Duration, err error) {
+	body = bytes.TrimSpace(body)
+	if bytes.IndexByte(body, '=') >= 0 {
+		return ParseRelay(body)
+	}
+	if digit = parseSignal(body); digit == 0 {
+		return 0, 0, errors.New("dtmf: invalid application/dtmf body")
+	}
+	return digit, 0, nil
+}
+
+type kpmlResponse struct {
+	Code   int    `xml:"code,attr"`
+	Text   string `xml:"text,attr"`
+	Digits string `xml:"digits,attr"`
+	Tag    string `xml:"tag,attr"`
+}
+
+// ParseKpml returns the digits reported by a KPML response. Responses
+// other than 200, such as a 423 timeout, report no digits.
+func ParseKpml(body []byte) (string, error) {
+	var resp kpmlResponse
+	if err := xml.Unmarshal(body, &resp); err != nil {
+		return "", err
+	}
+	if resp.Code != 200 {
+		return "", nil
+	}
+	out := make([]byte, 0, len(resp.Digits))
+	for i := 0; i < len(resp.Digits); i++ {
+		if _, ok := EventCode(resp.Digits[i]); ok {
+			out = append(out, upper(resp.Digits[i]))
+		}
+	}
+	return string(out), nil
+}
+
+func upper(c byte) byte {
+	if c >= 'a' && c <= 'z' {
+		return c - ('a' - 'A')
+	}
+	return c
+}
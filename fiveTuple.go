@@ -0,0 +1,30 @@
+package siprocket
+
+import (
+	"net/netip"
+	"strings"
+)
+
+// FiveTuple identifies the flow a packet was carried on. Proto uses the
+// same lower case names as SipVia.Trans, eg udp, tcp
+type FiveTuple struct {
+	Proto string         // Transport protocol
+	Src   netip.AddrPort // Source address and port
+	Dst   netip.AddrPort // Destination address and port
+}
+
+func NewFiveTuple(proto, src, dst string) FiveTuple {
+	t := FiveTuple{Proto: strings.ToLower(proto)}
+	t.Src, _ = netip.ParseAddrPort(src)
+	t.Dst, _ = netip.ParseAddrPort(dst)
+	return t
+}
+
+// Reverse returns the tuple of the opposite direction of the flow
+func (t FiveTuple) Reverse() FiveTuple {
+	return FiveTuple{Proto: t.Proto, Src: t.Dst, Dst: t.Src}
+}
+
+func (t FiveTuple) String() string {
+	return t.Proto + " " + t.Src.String() + " -> " + t.Dst.String()
+}
@@ -0,0 +1,143 @@
+package hep
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/nullboundary/siprocket"
+)
+
+// Largest HEP packet read by a Collector
+const MAX_PACKET_SIZE = 65535
+
+// Collector receives HEP packets on a UDP socket
+type Collector struct {
+	AuthKey  string                         // When set, packets with another key are dropped
+	OnPacket func(p Packet, from net.Addr)  // Called for each packet, from the serving goroutine
+	OnError  func(err error, from net.Addr) // Called for packets that cannot be decoded
+
+	conn   net.PacketConn
+	mu     sync.Mutex
+	closed bool
+}
+
+func NewCollector(conn net.PacketConn) *Collector {
+	return &Collector{conn: conn}
+}
+
+// Listen opens a UDP socket for a Collector, eg ":9060"
+func Listen(addr string) (*Collector, error) {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return NewCollector(conn), nil
+}
+
+// Addr returns the address the collector is listening on
+func (c *Collector) Addr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+// Serve reads packets until the collector is closed, it then returns nil
+func (c *Collector) Serve() error {
+	buf := make([]byte, MAX_PACKET_SIZE)
+	for {
+		n, from, err := c.conn.ReadFrom(buf)
+		if err != nil {
+			c.mu.Lock()
+			closed := c.closed
+			c.mu.Unlock()
+			if closed || errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+
+		// The payload of the packet is handed on so cannot share the buffer
+		p, err := Decode(append([]byte(nil), buf[:n]...))
+		if err != nil {
+			if c.OnError != nil {
+				c.OnError(err, from)
+			}
+			continue
+		}
+		if c.AuthKey != "" && p.AuthKey != c.AuthKey {
+			continue
+		}
+		if c.OnPacket != nil {
+			c.OnPacket(p, from)
+		}
+	}
+}
+
+// Close stops Serve
+func (c *Collector) Close() error {
+	c.mu.Lock()
+	c.closed = true
+	c.mu.Unlock()
+	return c.conn.Close()
+}
+
+// Forwarder sends HEPv3 packets to a collector
+type Forwarder struct {
+	NodeId   uint32 // Capture agent ID put in packets without one
+	NodeName string // Capture agent name put in packets without one
+	AuthKey  string // Authentication key put in packets without one
+
+	conn net.Conn
+}
+
+func NewForwarder(conn net.Conn) *Forwarder {
+	return &Forwarder{conn: conn}
+}
+
+// Dial connects a Forwarder to the UDP address of a collector
+func Dial(addr string) (*Forwarder, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return NewForwarder(conn), nil
+}
+
+// Send encodes and sends a packet
+func (f *Forwarder) Send(p Packet) error {
+	f.fill(&p)
+	b, err := Encode(&p)
+	if err != nil {
+		return err
+	}
+	_, err = f.conn.Write(b)
+	return err
+}
+
+// SendSip sends a SIP message seen at the given time on the given flow
+func (f *Forwarder) SendSip(at time.Time, tuple siprocket.FiveTuple, msg *siprocket.SipMsg) error {
+	p := Packet{Version: 3, Tuple: tuple, Time: at}
+	f.fill(&p)
+	b, err := EncodeSip(p, msg)
+	if err != nil {
+		return err
+	}
+	_, err = f.conn.Write(b)
+	return err
+}
+
+func (f *Forwarder) fill(p *Packet) {
+	if p.NodeId == 0 {
+		p.NodeId = f.NodeId
+	}
+	if p.NodeName == "" {
+		p.NodeName = f.NodeName
+	}
+	if p.AuthKey == "" {
+		p.AuthKey = f.AuthKey
+	}
+}
+
+func (f *Forwarder) Close() error {
+	return f.conn.Close()
+}
@@ -0,0 +1,77 @@
+package hep
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/nullboundary/siprocket"
+)
+
+func Test_hep_Collector(t *testing.T) {
+
+	c, err := Listen("127.0.0.1:0")
+	if err != nil {
+		t.Skipf("No UDP socket: %v", err)
+	}
+	c.AuthKey = "secret"
+	packets := make(chan Packet, 4)
+	errs := make(chan error, 4)
+	c.OnPacket = func(p Packet, from net.Addr) { packets <- p }
+	c.OnError = func(err error, from net.Addr) { errs <- err }
+	done := make(chan error)
+	go func() { done <- c.Serve() }()
+
+	f, err := Dial(c.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer f.Close()
+	f.NodeId = 12
+	f.NodeName = "edge-1"
+
+	at := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+	tuple := siprocket.NewFiveTuple("udp", "10.0.0.1:5060", "10.0.0.2:5060")
+	msg := siprocket.Parse([]byte(testOptions))
+
+	// Without the key it is dropped, garbage is reported
+	if err := f.SendSip(at, tuple, &msg); err != nil {
+		t.Fatalf("SendSip: %v", err)
+	}
+	f.conn.Write([]byte("garbage"))
+	f.AuthKey = "secret"
+	if err := f.SendSip(at, tuple, &msg); err != nil {
+		t.Fatalf("SendSip: %v", err)
+	}
+
+	select {
+	case err := <-errs:
+		if err != ErrVersion {
+			t.Errorf("Expected ErrVersion, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("No error reported")
+	}
+	select {
+	case p := <-packets:
+		got := p.Sip()
+		if p.NodeId != 12 || p.NodeName != "edge-1" || p.CorrelationId != "hep-1" || p.Tuple != tuple || !p.Time.Equal(at) {
+			t.Errorf("Packet %+v", p)
+		}
+		if string(got.CallId.Value) != "hep-1" || string(got.Req.Method) != "OPTIONS" {
+			t.Errorf("Message %q %q", got.CallId.Value, got.Req.Method)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("No packet received")
+	}
+	select {
+	case p := <-packets:
+		t.Errorf("Unexpected packet %+v", p)
+	default:
+	}
+
+	c.Close()
+	if err := <-done; err != nil {
+		t.Errorf("Serve: %v", err)
+	}
+}
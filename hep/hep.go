@@ -0,0 +1,352 @@
+// Package hep encodes and decodes the Homer Encapsulation Protocol used by
+// capture agents to ship SIP to a collector.
+package hep
+
+/*
+ HEPv3 - https://github.com/sipcapture/HEP/blob/master/docs/HEP3_Network_Protocol_Specification_REV_36.pdf
+
+   Header   "HEP3"(4) total length(2)
+   Chunk    vendor id(2) type id(2) length(2) payload
+
+   The chunk length includes its own 6 byte header, every number is in
+   network byte order. The generic chunks of vendor 0 are
+
+     1  IP protocol family     uint8    9  timestamp seconds      uint32
+     2  IP protocol ID         uint8   10  timestamp microseconds uint32
+     3  IPv4 source address           11  protocol type          uint8
+     4  IPv4 destination address      12  capture agent ID       uint32
+     5  IPv6 source address           13  keep alive timer       uint16
+     6  IPv6 destination address      14  authentication key     string
+     7  source port            uint16  15  payload
+     8  destination port       uint16  17  correlation ID         string
+                                       18  VLAN ID                uint16
+                                       19  capture agent name     string
+
+ HEPv1 and HEPv2
+
+   version(1) header length(1) family(1) protocol(1) source port(2)
+   destination port(2) source address destination address
+
+   The header length covers the fields above, the addresses are 4 or 16
+   bytes. HEPv2 follows them with seconds(4) microseconds(4) capture
+   id(2) in the byte order of the agent, which is little endian in
+   practice, and both end with the payload.
+
+*/
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"net/netip"
+	"time"
+
+	"github.com/nullboundary/siprocket"
+)
+
+// Generic chunk types
+const (
+	CHUNK_IP_FAMILY      = 1
+	CHUNK_IP_PROTO       = 2
+	CHUNK_IPV4_SRC       = 3
+	CHUNK_IPV4_DST       = 4
+	CHUNK_IPV6_SRC       = 5
+	CHUNK_IPV6_DST       = 6
+	CHUNK_SRC_PORT       = 7
+	CHUNK_DST_PORT       = 8
+	CHUNK_TIME_SEC       = 9
+	CHUNK_TIME_USEC      = 10
+	CHUNK_PROTO_TYPE     = 11
+	CHUNK_NODE_ID        = 12
+	CHUNK_KEEP_ALIVE     = 13
+	CHUNK_AUTH_KEY       = 14
+	CHUNK_PAYLOAD        = 15
+	CHUNK_CORRELATION_ID = 17
+	CHUNK_VLAN_ID        = 18
+	CHUNK_NODE_NAME      = 19
+)
+
+// Protocol types of the payload
+const (
+	PROTO_SIP  = 1
+	PROTO_RTCP = 5
+	PROTO_LOG  = 100
+)
+
+// Address families as sent by agents
+const (
+	FAMILY_IPV4 = 2
+	FAMILY_IPV6 = 10
+)
+
+const (
+	ipProtoTCP  = 6
+	ipProtoUDP  = 17
+	ipProtoSCTP = 132
+)
+
+var (
+	ErrShort   = errors.New("hep: packet truncated")
+	ErrVersion = errors.New("hep: unknown version")
+	ErrLarge   = errors.New("hep: packet larger than 65535 bytes")
+)
+
+// Packet is a decoded HEP packet
+type Packet struct {
+	Version       int // 1, 2 or 3
+	Tuple         siprocket.FiveTuple
+	Time          time.Time
+	ProtoType     uint8  // Type of the payload, PROTO_SIP for SIP
+	NodeId        uint32 // Capture agent ID
+	NodeName      string // Capture agent name
+	AuthKey       string
+	CorrelationId string
+	Vlan          uint16
+	Payload       []byte
+}
+
+// Sip parses the payload as a SIP message
+func (p *Packet) Sip() siprocket.SipMsg {
+	return siprocket.Parse(p.Payload)
+}
+
+// Decode decodes a HEPv1, HEPv2 or HEPv3 packet, the payload points into b
+func Decode(b []byte) (Packet, error) {
+	if len(b) >= 4 && string(b[:4]) == "HEP3" {
+		return decodeV3(b)
+	}
+	if len(b) >= 1 && (b[0] == 1 || b[0] == 2) {
+		return decodeV2(b)
+	}
+	return Packet{}, ErrVersion
+}
+
+// DecodeSip decodes a packet and parses its SIP payload
+func DecodeSip(b []byte) (Packet, siprocket.SipMsg, error) {
+	p, err := Decode(b)
+	if err != nil {
+		return p, siprocket.SipMsg{}, err
+	}
+	return p, p.Sip(), nil
+}
+
+func decodeV3(b []byte) (Packet, error) {
+	p := Packet{Version: 3}
+	if len(b) < 6 {
+		return p, ErrShort
+	}
+	total := int(binary.BigEndian.Uint16(b[4:6]))
+	if total < 6 || total > len(b) {
+		return p, ErrShort
+	}
+	b = b[6:total]
+
+	var src, dst netip.Addr
+	var sport, dport uint16
+	var proto uint8
+	var sec, usec uint32
+	for len(b) > 0 {
+		if len(b) < 6 {
+			return p, ErrShort
+		}
+		vendor := binary.BigEndian.Uint16(b[0:2])
+		typ := binary.BigEndian.Uint16(b[2:4])
+		size := int(binary.BigEndian.Uint16(b[4:6]))
+		if size < 6 || size > len(b) {
+			return p, ErrShort
+		}
+		val := b[6:size]
+		b = b[size:]
+		if vendor != 0 {
+			continue
+		}
+
+		switch typ {
+		case CHUNK_IP_PROTO:
+			proto = chunkUint8(val)
+		case CHUNK_IPV4_SRC, CHUNK_IPV6_SRC:
+			src, _ = netip.AddrFromSlice(val)
+		case CHUNK_IPV4_DST, CHUNK_IPV6_DST:
+			dst, _ = netip.AddrFromSlice(val)
+		case CHUNK_SRC_PORT:
+			sport = chunkUint16(val)
+		case CHUNK_DST_PORT:
+			dport = chunkUint16(val)
+		case CHUNK_TIME_SEC:
+			sec = chunkUint32(val)
+		case CHUNK_TIME_USEC:
+			usec = chunkUint32(val)
+		case CHUNK_PROTO_TYPE:
+			p.ProtoType = chunkUint8(val)
+		case CHUNK_NODE_ID:
+			p.NodeId = chunkUint32(val)
+		case CHUNK_AUTH_KEY:
+			p.AuthKey = string(val)
+		case CHUNK_PAYLOAD:
+			p.Payload = val
+		case CHUNK_CORRELATION_ID:
+			p.CorrelationId = string(val)
+		case CHUNK_VLAN_ID:
+			p.Vlan = chunkUint16(val)
+		case CHUNK_NODE_NAME:
+			p.NodeName = string(val)
+		}
+	}
+
+	p.Tuple = tuple(proto, src, sport, dst, dport)
+	p.Time = time.Unix(int64(sec), int64(usec)*1000).UTC()
+	return p, nil
+}
+
+func decodeV2(b []byte) (Packet, error) {
+	p := Packet{Version: int(b[0]), ProtoType: PROTO_SIP}
+	if len(b) < 8 {
+		return p, ErrShort
+	}
+	hlen := int(b[1])
+	family := b[2]
+	proto := b[3]
+	sport := binary.BigEndian.Uint16(b[4:6])
+	dport := binary.BigEndian.Uint16(b[6:8])
+
+	size := 4
+	if family == FAMILY_IPV6 {
+		size = 16
+	}
+	if hlen < 8+2*size || len(b) < hlen {
+		return p, ErrShort
+	}
+	src, _ := netip.AddrFromSlice(b[8 : 8+size])
+	dst, _ := netip.AddrFromSlice(b[8+size : 8+2*size])
+	p.Tuple = tuple(proto, src, sport, dst, dport)
+	b = b[hlen:]
+
+	if p.Version == 2 {
+		if len(b) < 10 {
+			return p, ErrShort
+		}
+		sec := binary.LittleEndian.Uint32(b[0:4])
+		usec := binary.LittleEndian.Uint32(b[4:8])
+		p.NodeId = uint32(binary.LittleEndian.Uint16(b[8:10]))
+		p.Time = time.Unix(int64(sec), int64(usec)*1000).UTC()
+		b = b[10:]
+	}
+	p.Payload = b
+	return p, nil
+}
+
+// Encode writes the packet as HEPv3, whatever its Version. A zero
+// ProtoType is sent as PROTO_SIP. ErrLarge is returned when the packet does
+// not fit the 16 bit lengths of HEPv3.
+func Encode(p *Packet) ([]byte, error) {
+	b := make([]byte, 6, 128+len(p.Payload))
+	copy(b, "HEP3")
+
+	src, dst := p.Tuple.Src.Addr(), p.Tuple.Dst.Addr()
+	if src.Is4() || src.Is4In6() {
+		b = appendChunk(b, CHUNK_IP_FAMILY, FAMILY_IPV4)
+		b = appendChunk(b, CHUNK_IP_PROTO, ipProto(p.Tuple.Proto))
+		b = appendChunk(b, CHUNK_IPV4_SRC, src.Unmap().AsSlice()...)
+		b = appendChunk(b, CHUNK_IPV4_DST, dst.Unmap().AsSlice()...)
+	} else {
+		b = appendChunk(b, CHUNK_IP_FAMILY, FAMILY_IPV6)
+		b = appendChunk(b, CHUNK_IP_PROTO, ipProto(p.Tuple.Proto))
+		src16, dst16 := src.As16(), dst.As16()
+		b = appendChunk(b, CHUNK_IPV6_SRC, src16[:]...)
+		b = appendChunk(b, CHUNK_IPV6_DST, dst16[:]...)
+	}
+	b = appendChunk(b, CHUNK_SRC_PORT, binary.BigEndian.AppendUint16(nil, p.Tuple.Src.Port())...)
+	b = appendChunk(b, CHUNK_DST_PORT, binary.BigEndian.AppendUint16(nil, p.Tuple.Dst.Port())...)
+	b = appendChunk(b, CHUNK_TIME_SEC, binary.BigEndian.AppendUint32(nil, uint32(p.Time.Unix()))...)
+	b = appendChunk(b, CHUNK_TIME_USEC, binary.BigEndian.AppendUint32(nil, uint32(p.Time.Nanosecond()/1000))...)
+	protoType := p.ProtoType
+	if protoType == 0 {
+		protoType = PROTO_SIP
+	}
+	b = appendChunk(b, CHUNK_PROTO_TYPE, protoType)
+	b = appendChunk(b, CHUNK_NODE_ID, binary.BigEndian.AppendUint32(nil, p.NodeId)...)
+	if p.AuthKey != "" {
+		b = appendChunk(b, CHUNK_AUTH_KEY, []byte(p.AuthKey)...)
+	}
+	if p.CorrelationId != "" {
+		b = appendChunk(b, CHUNK_CORRELATION_ID, []byte(p.CorrelationId)...)
+	}
+	if p.Vlan != 0 {
+		b = appendChunk(b, CHUNK_VLAN_ID, binary.BigEndian.AppendUint16(nil, p.Vlan)...)
+	}
+	if p.NodeName != "" {
+		b = appendChunk(b, CHUNK_NODE_NAME, []byte(p.NodeName)...)
+	}
+	if len(b)+6+len(p.Payload) > math.MaxUint16 {
+		return nil, ErrLarge
+	}
+	b = appendChunk(b, CHUNK_PAYLOAD, p.Payload...)
+
+	binary.BigEndian.PutUint16(b[4:6], uint16(len(b)))
+	return b, nil
+}
+
+// EncodeSip writes the SIP message with the metadata of p as HEPv3, the
+// Call-ID is used as correlation ID when p has none
+func EncodeSip(p Packet, msg *siprocket.SipMsg) ([]byte, error) {
+	p.Payload = []byte(siprocket.Marshal(msg))
+	p.ProtoType = PROTO_SIP
+	if p.CorrelationId == "" {
+		p.CorrelationId = string(msg.CallId.Value)
+	}
+	return Encode(&p)
+}
+
+func appendChunk(b []byte, typ uint16, val ...byte) []byte {
+	b = binary.BigEndian.AppendUint16(b, 0)
+	b = binary.BigEndian.AppendUint16(b, typ)
+	b = binary.BigEndian.AppendUint16(b, uint16(6+len(val)))
+	return append(b, val...)
+}
+
+func tuple(proto uint8, src netip.Addr, sport uint16, dst netip.Addr, dport uint16) siprocket.FiveTuple {
+	t := siprocket.FiveTuple{
+		Src: netip.AddrPortFrom(src, sport),
+		Dst: netip.AddrPortFrom(dst, dport),
+	}
+	switch proto {
+	case ipProtoTCP:
+		t.Proto = "tcp"
+	case ipProtoUDP:
+		t.Proto = "udp"
+	case ipProtoSCTP:
+		t.Proto = "sctp"
+	}
+	return t
+}
+
+func ipProto(proto string) byte {
+	switch proto {
+	case "tcp", "tls", "ws", "wss":
+		return ipProtoTCP
+	case "sctp":
+		return ipProtoSCTP
+	}
+	return ipProtoUDP
+}
+
+func chunkUint8(v []byte) uint8 {
+	if len(v) < 1 {
+		return 0
+	}
+	return v[0]
+}
+
+func chunkUint16(v []byte) uint16 {
+	if len(v) < 2 {
+		return 0
+	}
+	return binary.BigEndian.Uint16(v)
+}
+
+func chunkUint32(v []byte) uint32 {
+	if len(v) < 4 {
+		return 0
+	}
+	return binary.BigEndian.Uint32(v)
+}
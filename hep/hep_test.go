@@ -0,0 +1,148 @@
+package hep
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/nullboundary/siprocket"
+)
+
+const testOptions = "OPTIONS sip:bob@10.0.0.2 SIP/2.0\r\n" +
+	"Via: SIP/2.0/UDP 10.0.0.1:5060;branch=z9hG4bK1\r\n" +
+	"Call-ID: hep-1\r\n" +
+	"CSeq: 1 OPTIONS\r\n" +
+	"Content-Length: 0\r\n\r\n"
+
+func Test_hep_RoundTrip(t *testing.T) {
+
+	tests := []Packet{
+		{
+			Version:       3,
+			Tuple:         siprocket.NewFiveTuple("udp", "10.0.0.1:5060", "10.0.0.2:5080"),
+			Time:          time.Date(2024, 3, 1, 10, 0, 0, 123456000, time.UTC),
+			ProtoType:     PROTO_SIP,
+			NodeId:        2001,
+			NodeName:      "edge-1",
+			AuthKey:       "secret",
+			CorrelationId: "hep-1",
+			Vlan:          42,
+			Payload:       []byte(testOptions),
+		},
+		{
+			Version:   3,
+			Tuple:     siprocket.NewFiveTuple("tcp", "[2001:db8::1]:5060", "[2001:db8::2]:40000"),
+			Time:      time.Date(2024, 3, 1, 10, 0, 1, 0, time.UTC),
+			ProtoType: PROTO_SIP,
+			Payload:   []byte(testOptions),
+		},
+	}
+
+	for _, exp := range tests {
+		b, _ := Encode(&exp)
+		got, err := Decode(b)
+		if err != nil {
+			t.Fatalf("Decode: %v", err)
+		}
+		if !reflect.DeepEqual(exp, got) {
+			t.Errorf("Mismatch:\nExpected:\n%+v\nGot:\n%+v", exp, got)
+		}
+	}
+}
+
+func Test_hep_Chunks(t *testing.T) {
+
+	// Chunks of another vendor are skipped
+	p := Packet{Tuple: siprocket.NewFiveTuple("udp", "10.0.0.1:5060", "10.0.0.2:5060"), Payload: []byte(testOptions)}
+	b, _ := Encode(&p)
+	b = appendChunk(b, 1, 'x')
+	binary.BigEndian.PutUint16(b[len(b)-7:], 0x0bad)
+	binary.BigEndian.PutUint16(b[4:6], uint16(len(b)))
+	got, msg, err := DecodeSip(b)
+	if err != nil {
+		t.Fatalf("DecodeSip: %v", err)
+	}
+	if got.ProtoType != PROTO_SIP || string(msg.CallId.Value) != "hep-1" {
+		t.Errorf("Proto type %d Call-ID %q", got.ProtoType, msg.CallId.Value)
+	}
+
+	// Truncated
+	if _, err := Decode(b[:len(b)-1]); err != ErrShort {
+		t.Errorf("Expected ErrShort, got %v", err)
+	}
+	if _, err := Decode([]byte("HEP4")); err != ErrVersion {
+		t.Errorf("Expected ErrVersion, got %v", err)
+	}
+}
+
+// hepV2 builds a HEPv2 packet the way agents send it
+func hepV2(family uint8, src, dst netip.Addr, sec, usec uint32, captId uint16, payload string) []byte {
+	hdr := []byte{2, 0, family, 17}
+	hdr = binary.BigEndian.AppendUint16(hdr, 5060)
+	hdr = binary.BigEndian.AppendUint16(hdr, 5080)
+	hdr = append(hdr, src.AsSlice()...)
+	hdr = append(hdr, dst.AsSlice()...)
+	hdr[1] = byte(len(hdr))
+	hdr = binary.LittleEndian.AppendUint32(hdr, sec)
+	hdr = binary.LittleEndian.AppendUint32(hdr, usec)
+	hdr = binary.LittleEndian.AppendUint16(hdr, captId)
+	return append(hdr, payload...)
+}
+
+func Test_hep_Large(t *testing.T) {
+
+	p := Packet{Tuple: siprocket.NewFiveTuple("tcp", "10.0.0.1:5060", "10.0.0.2:5060"), Payload: make([]byte, 65535)}
+	if _, err := Encode(&p); err != ErrLarge {
+		t.Errorf("Expected ErrLarge, got %v", err)
+	}
+
+	// The largest payload that fits
+	b, _ := Encode(&Packet{Tuple: p.Tuple})
+	p.Payload = make([]byte, 65535-len(b))
+	if b, err := Encode(&p); err != nil || len(b) != 65535 {
+		t.Errorf("Mismatch: %d bytes, %v", len(b), err)
+	}
+}
+
+func Test_hep_V2(t *testing.T) {
+
+	at := time.Date(2024, 3, 1, 10, 0, 0, 500000000, time.UTC)
+	tests := []struct {
+		family uint8
+		src    string
+		dst    string
+	}{
+		{FAMILY_IPV4, "10.0.0.1", "10.0.0.2"},
+		{FAMILY_IPV6, "2001:db8::1", "2001:db8::2"},
+	}
+	for _, tc := range tests {
+		src, dst := netip.MustParseAddr(tc.src), netip.MustParseAddr(tc.dst)
+		b := hepV2(tc.family, src, dst, uint32(at.Unix()), 500000, 7, testOptions)
+
+		exp := Packet{
+			Version:   2,
+			Tuple:     siprocket.FiveTuple{Proto: "udp", Src: netip.AddrPortFrom(src, 5060), Dst: netip.AddrPortFrom(dst, 5080)},
+			Time:      at,
+			ProtoType: PROTO_SIP,
+			NodeId:    7,
+			Payload:   []byte(testOptions),
+		}
+		got, err := Decode(b)
+		if err != nil {
+			t.Fatalf("Decode: %v", err)
+		}
+		if !reflect.DeepEqual(exp, got) {
+			t.Errorf("Mismatch:\nExpected:\n%+v\nGot:\n%+v", exp, got)
+		}
+
+		// Re-encoded as HEPv3
+		exp.Version = 3
+		b, _ = Encode(&got)
+		got, _ = Decode(b)
+		if !reflect.DeepEqual(exp, got) {
+			t.Errorf("Mismatch:\nExpected:\n%+v\nGot:\n%+v", exp, got)
+		}
+	}
+}
@@ -0,0 +1,540 @@
+package proxy
+
+/*
+ RFC 3261 - https://www.ietf.org/rfc/rfc3261.txt - 16.7 Response Processing
+
+   A stateful proxy MUST NOT immediately forward any other responses.  In
+   particular, a stateful proxy MUST NOT forward any 100 (Trying)
+   response.  Those responses that are candidates for forwarding later
+   as the "best" response have been gathered as described in step "Add
+   Response to Context".
+
+   Any response chosen for immediate forwarding MUST be processed as
+   described in steps "Aggregate Authorization Header Field Values"
+   through "Record-Route".
+
+   If no final response has been forwarded after every client
+   transaction associated with the response context has been terminated,
+   the proxy must choose and forward the "best" response from those it
+   has seen so far.
+
+   A proxy MUST choose a 6xx response if one is available.  If no 6xx
+   responses are present, the proxy SHOULD choose from the lowest
+   response class stored in the response context.  The proxy MAY select
+   any response within that chosen class.  The proxy SHOULD give
+   preference to responses that provide information affecting
+   resubmission of this request, such as 401, 407, 415, 420, and 484 if
+   the 4xx class is chosen.
+
+   If the selected response is a 503 (Service Unavailable), the proxy
+   MUST generate a 500 (Server Internal Error) response.
+
+   If the selected response is a 401 (Unauthorized) or 407 (Proxy
+   Authentication Required), the proxy MUST collect any WWW-Authenticate
+   and Proxy-Authenticate header field values from all other 401
+   (Unauthorized) and 407 (Proxy Authentication Required) responses
+   received so far in this response context and add them to this
+   response without modification before forwarding.
+
+ 16.8 Processing Timer C
+
+   If the client transaction has received a provisional response, the
+   proxy MUST generate a CANCEL request matching that transaction.  If
+   the client transaction has not received a provisional response, the
+   proxy MUST behave as if the transaction received a 408 (Request
+   Timeout) response.
+
+*/
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/nullboundary/siprocket"
+	"github.com/nullboundary/siprocket/transaction"
+)
+
+// forkContext is the response context of section 16 that ties a server
+// transaction to the client transactions of its branches. Calls into
+// transactions are queued while mu is held and run once it is released.
+type forkContext struct {
+	s      *Stateful
+	srv    *transaction.Server
+	key    transaction.Key
+	req    *siprocket.SipMsg // The request as received and validated
+	invite bool
+
+	mu        sync.Mutex
+	groups    [][]Target // Targets not tried yet, a group at a time
+	seen      map[string]bool
+	branches  []*forkBranch
+	responses []*siprocket.SipMsg // Final responses, ready to go upstream
+	final     bool                // A final response went upstream
+	cancelled bool                // No new branch is started
+	queued    []func()
+}
+
+// forkBranch is a copy of the request sent to one target
+type forkBranch struct {
+	ctx         *forkContext
+	req         *siprocket.SipMsg
+	hop         Hop
+	client      *transaction.Client
+	provisional bool // A provisional response arrived, a CANCEL may be sent
+	cancel      bool // Cancel once a provisional response arrives
+	cancelSent  bool
+	done        bool
+	timerC      transaction.Timer
+}
+
+func newForkContext(s *Stateful, srv *transaction.Server, req *siprocket.SipMsg) *forkContext {
+	return &forkContext{
+		s:      s,
+		srv:    srv,
+		key:    srv.Key(),
+		req:    req,
+		invite: strings.EqualFold(string(req.Req.Method), "INVITE"),
+		seen:   make(map[string]bool),
+	}
+}
+
+// run starts the branches of the targets. Without targets the request is
+// sent where the Route header or the Router of the proxy says.
+func (ctx *forkContext) run(targets []Target) {
+	ctx.mu.Lock()
+	defer ctx.unlock()
+
+	if len(targets) == 0 {
+		ctx.startBranch(Target{})
+		return
+	}
+	ctx.addTargets(targets)
+	ctx.next()
+}
+
+// addTargets queues new targets, ignoring the ones already tried
+func (ctx *forkContext) addTargets(targets []Target) int {
+	var fresh []Target
+	for _, t := range targets {
+		if ctx.seen[t.Uri] {
+			continue
+		}
+		ctx.seen[t.Uri] = true
+		fresh = append(fresh, t)
+	}
+	if ctx.s.Fork == FORK_SERIAL {
+		ctx.groups = append(ctx.groups, groupByQ(fresh)...)
+	} else if len(fresh) > 0 {
+		ctx.groups = append(ctx.groups, fresh)
+	}
+	return len(fresh)
+}
+
+// next starts the next group of targets, it tells if there was one
+func (ctx *forkContext) next() bool {
+	if ctx.cancelled || len(ctx.groups) == 0 {
+		return false
+	}
+	group := ctx.groups[0]
+	ctx.groups = ctx.groups[1:]
+	for _, t := range group {
+		ctx.startBranch(t)
+	}
+	return true
+}
+
+// startBranch copies the request for a target and starts its client
+// transaction. A copy that can not be routed gets a response of its own.
+func (ctx *forkContext) startBranch(t Target) {
+	s := ctx.s
+	b := &forkBranch{ctx: ctx}
+	ctx.branches = append(ctx.branches, b)
+
+	req := siprocket.ParseLossless(siprocket.AppendMarshalLossless(nil, ctx.req))
+	b.req = &req
+	router := s.Router
+	if t.Uri != "" {
+		if err := req.SetRequestUri(t.Uri); err != nil {
+			ctx.fail(b, &StatusError{Code: 400, Reason: "Bad Target"})
+			return
+		}
+		router = RouterFunc(NextHop)
+	}
+
+	b.hop = t.Hop
+	if b.hop == (Hop{}) {
+		var err error
+		if b.hop, err = s.route(&req, router); err != nil {
+			ctx.fail(b, err)
+			return
+		}
+	}
+	s.stamp(&req, b.hop, siprocket.NewBranch())
+
+	c, err := transaction.NewClient(&req, s.clientConfig(b.hop), transaction.ClientHandler{
+		Response:       b.response,
+		Timeout:        b.timeout,
+		TransportError: b.transportError,
+	})
+	if err != nil {
+		ctx.fail(b, err)
+		return
+	}
+	b.client = c
+	s.table.AddClient(c)
+	if ctx.invite {
+		b.resetTimerC()
+	}
+	ctx.later(c.Start)
+}
+
+// response handles a response passed on by the client transaction of b
+func (b *forkBranch) response(resp *siprocket.SipMsg) {
+	ctx := b.ctx
+	ctx.mu.Lock()
+	defer ctx.unlock()
+
+	code := statusCode(resp)
+	if len(resp.Via) < 2 {
+		return
+	}
+	resp.RemoveTopVia()
+
+	switch {
+	case code < 200:
+		if b.done {
+			return
+		}
+		b.provisional = true
+		if b.cancel {
+			ctx.sendCancel(b)
+		}
+		if ctx.invite {
+			b.resetTimerC()
+		}
+		if code > 100 && !ctx.final {
+			ctx.later(func() { ctx.s.error(ctx.srv.Respond(resp)) })
+		}
+	case code < 300:
+		b.finish()
+		if ctx.final && !ctx.invite {
+			return
+		}
+		ctx.final = true
+		ctx.later(func() { ctx.forward2xx(resp) })
+		ctx.cancelAll()
+	default:
+		if b.done {
+			return
+		}
+		b.finish()
+		if code < 400 && ctx.s.Recurse && !ctx.final && ctx.recurse(resp) > 0 {
+			// Tried in place of the 3xx, section 16.7 step 4
+		} else {
+			ctx.responses = append(ctx.responses, resp)
+		}
+		if code >= 600 {
+			ctx.cancelAll()
+		}
+		ctx.check()
+	}
+}
+
+// timeout is timer B or F of the client transaction of b
+func (b *forkBranch) timeout() {
+	b.ctx.mu.Lock()
+	defer b.ctx.unlock()
+	b.ctx.fail(b, &StatusError{Code: 408})
+}
+
+// transportError means the request of b could not be sent
+func (b *forkBranch) transportError(err error) {
+	b.ctx.mu.Lock()
+	defer b.ctx.unlock()
+	b.ctx.s.error(err)
+	b.ctx.fail(b, &StatusError{Code: 503})
+}
+
+// timerCFired applies section 16.8
+func (b *forkBranch) timerCFired() {
+	ctx := b.ctx
+	ctx.mu.Lock()
+	defer ctx.unlock()
+	if b.done {
+		return
+	}
+	if b.provisional {
+		ctx.sendCancel(b)
+	}
+	ctx.fail(b, &StatusError{Code: 408})
+}
+
+// resetTimerC starts timer C of b again
+func (b *forkBranch) resetTimerC() {
+	if b.timerC != nil {
+		b.timerC.Stop()
+	}
+	b.timerC = b.ctx.s.clock().AfterFunc(b.ctx.s.timerC(), b.timerCFired)
+}
+
+// finish marks b as having its final response
+func (b *forkBranch) finish() {
+	b.done = true
+	if b.timerC != nil {
+		b.timerC.Stop()
+		b.timerC = nil
+	}
+}
+
+// fail ends b with a response of the proxy, as if it came from the branch
+func (ctx *forkContext) fail(b *forkBranch, err error) {
+	if b.done {
+		return
+	}
+	b.finish()
+
+	status := &StatusError{Code: 500}
+	if !errors.As(err, &status) {
+		ctx.s.error(err)
+	}
+	if resp, err := siprocket.NewResponse(ctx.req, status.Code, status.Reason).Build(); err == nil {
+		ctx.responses = append(ctx.responses, &resp)
+	}
+	ctx.check()
+}
+
+// check starts the next targets or sends the best response upstream once
+// every branch has its final response
+func (ctx *forkContext) check() {
+	if ctx.final {
+		return
+	}
+	for _, b := range ctx.branches {
+		if !b.done {
+			return
+		}
+	}
+	if ctx.next() {
+		return
+	}
+
+	ctx.final = true
+	resp := bestResponse(ctx.responses)
+	switch {
+	case resp == nil:
+		resp = ctx.generate(408)
+	case statusCode(resp) == 503:
+		resp = ctx.generate(500)
+	case statusCode(resp) == 401 || statusCode(resp) == 407:
+		aggregateChallenges(resp, ctx.responses)
+	}
+	ctx.later(func() { ctx.s.error(ctx.srv.Respond(resp)) })
+}
+
+// cancelAll stops trying new targets and cancels the pending branches of
+// an INVITE, section 16.7 step 10
+func (ctx *forkContext) cancelAll() {
+	ctx.cancelled = true
+	ctx.groups = nil
+	if !ctx.invite {
+		return
+	}
+	for _, b := range ctx.branches {
+		if b.done {
+			continue
+		}
+		if b.provisional {
+			ctx.sendCancel(b)
+		} else {
+			b.cancel = true
+		}
+	}
+}
+
+// sendCancel sends a CANCEL for the request of b, section 9.1
+func (ctx *forkContext) sendCancel(b *forkBranch) {
+	if b.cancelSent || b.client == nil {
+		return
+	}
+	b.cancelSent = true
+	cancel, err := siprocket.NewCancel(b.req).Build()
+	if err != nil {
+		ctx.s.error(err)
+		return
+	}
+	c, err := transaction.NewClient(&cancel, ctx.s.clientConfig(b.hop), transaction.ClientHandler{
+		TransportError: ctx.s.error,
+	})
+	if err != nil {
+		ctx.s.error(err)
+		return
+	}
+	ctx.s.table.AddClient(c)
+	ctx.later(c.Start)
+}
+
+// cancel handles a CANCEL of the request of the context
+func (ctx *forkContext) cancel() {
+	ctx.mu.Lock()
+	defer ctx.unlock()
+	ctx.cancelAll()
+}
+
+// recurse adds the Contacts of a 3xx response as targets and returns how
+// many were new
+func (ctx *forkContext) recurse(resp *siprocket.SipMsg) int {
+	var targets []Target
+	for i := range resp.Contacts {
+		c := &resp.Contacts[i]
+		if c.IsWildcard() || len(c.Host) == 0 {
+			continue
+		}
+		hop, err := hopFor(c.UriType, c.Host, c.Port, string(c.Tran))
+		if err != nil {
+			continue
+		}
+		q, err := strconv.ParseFloat(string(c.Qval), 64)
+		if err != nil {
+			q = 1
+		}
+		targets = append(targets, Target{Uri: contactUri(c), Q: q, Hop: hop})
+	}
+	return ctx.addTargets(targets)
+}
+
+// forward2xx sends a 2xx upstream, the ones after the first go straight
+// to the transport as the INVITE server transaction ended with the first
+func (ctx *forkContext) forward2xx(resp *siprocket.SipMsg) {
+	err := ctx.srv.Respond(resp)
+	if errors.Is(err, transaction.ErrState) && ctx.invite {
+		err = ctx.s.Transport.Respond(resp)
+	}
+	ctx.s.error(err)
+}
+
+// generate builds a response of the proxy to the request
+func (ctx *forkContext) generate(code int) *siprocket.SipMsg {
+	resp, _ := siprocket.NewResponse(ctx.req, code, "").Build()
+	return &resp
+}
+
+// later queues a call to run once mu is released
+func (ctx *forkContext) later(f func()) {
+	ctx.queued = append(ctx.queued, f)
+}
+
+// unlock releases mu and runs the queued calls
+func (ctx *forkContext) unlock() {
+	queued := ctx.queued
+	ctx.queued = nil
+	ctx.mu.Unlock()
+	for _, f := range queued {
+		f()
+	}
+}
+
+// bestResponse chooses the final response to send upstream as section
+// 16.7 step 6 describes, or nil when there is none
+func bestResponse(responses []*siprocket.SipMsg) *siprocket.SipMsg {
+	var best *siprocket.SipMsg
+	for _, resp := range responses {
+		if best == nil || betterResponse(statusCode(resp), statusCode(best)) {
+			best = resp
+		}
+	}
+	return best
+}
+
+// betterResponse tells if the status code a beats b
+func betterResponse(a, b int) bool {
+	ca, cb := a/100, b/100
+	switch {
+	case ca == 6 || cb == 6:
+		return ca == 6 && cb != 6
+	case ca != cb:
+		return ca < cb
+	}
+	return responseRank(a) > responseRank(b)
+}
+
+// responseRank orders the codes of a class, the ones that help the caller
+// retry first and 503 last
+func responseRank(code int) int {
+	switch code {
+	case 401, 407, 415, 420, 484:
+		return 2
+	case 503:
+		return 0
+	}
+	return 1
+}
+
+// aggregateChallenges adds the challenges of every 401 and 407 response to
+// resp, section 16.7 step 7
+func aggregateChallenges(resp *siprocket.SipMsg, responses []*siprocket.SipMsg) {
+	for _, name := range []string{"WWW-Authenticate", "Proxy-Authenticate"} {
+		var values []string
+		seen := map[string]bool{}
+		for _, r := range responses {
+			if code := statusCode(r); code != 401 && code != 407 {
+				continue
+			}
+			for _, v := range r.HeaderValues(name) {
+				if !seen[string(v)] {
+					seen[string(v)] = true
+					values = append(values, string(v))
+				}
+			}
+		}
+		if len(values) == 0 {
+			continue
+		}
+		resp.RemoveHeader(name)
+		for _, v := range values {
+			resp.AddHeader(name, v)
+		}
+	}
+}
+
+// groupByQ sorts targets by q value, highest first, and groups the ones
+// with equal values
+func groupByQ(targets []Target) [][]Target {
+	sort.SliceStable(targets, func(i, j int) bool { return targets[i].Q > targets[j].Q })
+	var groups [][]Target
+	for i, t := range targets {
+		if i == 0 || t.Q != targets[i-1].Q {
+			groups = append(groups, nil)
+		}
+		groups[len(groups)-1] = append(groups[len(groups)-1], t)
+	}
+	return groups
+}
+
+// contactUri renders the URI of a Contact entry
+func contactUri(c *siprocket.SipContact) string {
+	var b strings.Builder
+	if len(c.UriType) > 0 {
+		b.Write(c.UriType)
+	} else {
+		b.WriteString("sip")
+	}
+	b.WriteByte(':')
+	if len(c.User) > 0 {
+		b.Write(c.User)
+		b.WriteByte('@')
+	}
+	b.Write(c.Host)
+	if len(c.Port) > 0 {
+		b.WriteByte(':')
+		b.Write(c.Port)
+	}
+	return b.String()
+}
+
+func statusCode(resp *siprocket.SipMsg) int {
+	code, _ := strconv.Atoi(string(resp.Req.StatusCode))
+	return code
+}
@@ -0,0 +1,246 @@
+// Package proxy forwards SIP requests and responses as an RFC 3261
+// section 16 proxy, on top of the transport package.
+package proxy
+
+/*
+ RFC 3261 - https://www.ietf.org/rfc/rfc3261.txt - 16.3 Request Validation
+
+   If the request does not contain a Max-Forwards header field, this
+   check is passed.  If the request contains a Max-Forwards header field
+   with a field value greater than zero, the check is passed.  If the
+   request contains a Max-Forwards header field with a field value of
+   zero (0), the element MUST NOT forward the request.  If the request
+   was for OPTIONS, the element MAY act as the final recipient and
+   respond per Section 11.  Otherwise, the element MUST return a 483 (Too
+   many hops) response.
+
+ 16.11 Stateless Proxy
+
+   The proxy examines the branch ID in the topmost Via header field of
+   the received request.  If it begins with the magic cookie, the first
+   component of the branch ID of the outgoing request is computed as a
+   hash of the received branch ID.  Otherwise, the first component of
+   the branch ID is computed as a hash of the topmost Via, the tag in the
+   To header field, the tag in the From header field, the Call-ID header
+   field, the CSeq number (but not method), and the Request-URI from the
+   received request.
+
+   The second component of the branch parameter is computed as a hash of
+   the Request-URI of the outgoing request, so a retransmission, the ACK
+   of a non-2xx response and a CANCEL all get the branch of the request
+   they belong to.
+
+   A stateless proxy removes the topmost Via of a response, which must be
+   its own, and forwards the response to the address of the next Via.
+
+ Messages are parsed again from their source with ParseLossless so the
+ headers without a typed field are passed on.
+
+*/
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/nullboundary/siprocket"
+	"github.com/nullboundary/siprocket/transport"
+)
+
+var (
+	ErrNotMine = errors.New("proxy: response whose top Via is not ours")
+	ErrNoVia   = errors.New("proxy: no Via left to forward the response to")
+)
+
+// Proxy is a stateless proxy. Set Handle as the Handler of its Transport.
+type Proxy struct {
+	Transport   *transport.Transport
+	Router      Router      // Picks the next hop, NextHop when nil
+	Host        string      // Host of the proxy in Via and Record-Route, also recognised in Route
+	Port        int         // Port of the proxy, 5060 when zero
+	RecordRoute bool        // Add a Record-Route to requests other than REGISTER
+	OnError     func(error) // Called for requests and responses that are dropped, optional
+}
+
+func New(t *transport.Transport, host string, port int) *Proxy {
+	return &Proxy{
+		Transport: t,
+		Host:      host,
+		Port:      port,
+	}
+}
+
+// Handle forwards a request or a response received by the transport
+func (p *Proxy) Handle(m *transport.Message) {
+	if len(m.Msg.Req.StatusCode) > 0 {
+		resp := siprocket.ParseLossless(m.Raw)
+		p.error(p.forwardResponse(&resp))
+		return
+	}
+
+	req := siprocket.ParseLossless(m.Raw)
+	transport.SetReceived(&req, m.Tuple.Src)
+
+	err := p.forwardRequest(&req)
+	var status *StatusError
+	if errors.As(err, &status) {
+		err = p.reply(&m.Msg, status)
+	}
+	p.error(err)
+}
+
+// forwardRequest forwards a request as section 16.6 describes
+func (p *Proxy) forwardRequest(req *siprocket.SipMsg) error {
+	hop, err := p.prepare(req)
+	if err != nil {
+		return err
+	}
+	return p.Transport.SendRequest(hop.Proto, hop.Addr, req)
+}
+
+// prepare validates a request, processes its routes and adds the Via and
+// Record-Route of the proxy. It returns where the request is sent next.
+func (p *Proxy) prepare(req *siprocket.SipMsg) (Hop, error) {
+	branch := p.branch(req)
+	if err := p.validate(req); err != nil {
+		return Hop{}, err
+	}
+	hop, err := p.route(req, p.Router)
+	if err != nil {
+		return Hop{}, err
+	}
+	p.stamp(req, hop, branch+hashHex(req.RequestUri())[:8])
+	return hop, nil
+}
+
+// validate checks Max-Forwards and removes the routes meant for the proxy
+func (p *Proxy) validate(req *siprocket.SipMsg) error {
+	if err := decrementMaxForwards(req); err != nil {
+		return err
+	}
+	return p.preprocessRoute(req)
+}
+
+// route gives the next hop of a validated request. The router, NextHop
+// when nil, is only asked when no Route header is left.
+func (p *Proxy) route(req *siprocket.SipMsg, router Router) (Hop, error) {
+	if len(req.Route) == 0 {
+		if router == nil {
+			router = RouterFunc(NextHop)
+		}
+		return router.Route(req)
+	}
+	strict, err := strictRoute(req)
+	if err != nil {
+		return Hop{}, err
+	}
+	if strict != nil {
+		return routeHop(strict)
+	}
+	return NextHop(req)
+}
+
+// stamp adds the Record-Route, when enabled, and the Via of the proxy
+func (p *Proxy) stamp(req *siprocket.SipMsg, hop Hop, branch string) {
+	if p.RecordRoute && !strings.EqualFold(string(req.Req.Method), "REGISTER") {
+		rr := siprocket.SipRoute{
+			UriType: []byte("sip"),
+			Host:    []byte(p.Host),
+			Port:    []byte(p.port()),
+			Params:  [][]byte{[]byte("lr")},
+		}
+		req.PrependRecordRoute(rr)
+	}
+
+	via := siprocket.SipVia{
+		Trans:  hop.Proto,
+		Host:   []byte(p.Host),
+		Port:   []byte(p.port()),
+		Branch: []byte(branch),
+	}
+	req.PrependVia(via)
+}
+
+// decrementMaxForwards applies section 16.3 item 3 and 16.6 item 3
+func decrementMaxForwards(req *siprocket.SipMsg) error {
+	if req.MaxFwd.Value == nil {
+		req.SetHeader(siprocket.HEADER_MAX_FORWARDS, strconv.Itoa(siprocket.DEFAULT_MAX_FORWARDS))
+		return nil
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(string(req.MaxFwd.Value)))
+	if err != nil || n < 0 {
+		return &StatusError{Code: 400, Reason: "Bad Max-Forwards"}
+	}
+	if n == 0 {
+		return &StatusError{Code: 483}
+	}
+	req.SetHeader(siprocket.HEADER_MAX_FORWARDS, strconv.Itoa(n-1))
+	return nil
+}
+
+// branch returns the first component of the Via branch of the request as
+// received, as section 16.11 recommends
+func (p *Proxy) branch(req *siprocket.SipMsg) string {
+	var key string
+	if len(req.Via) > 0 && strings.HasPrefix(string(req.Via[0].Branch), siprocket.BRANCH_MAGIC) {
+		key = string(req.Via[0].Branch)
+	} else {
+		var b strings.Builder
+		if len(req.Via) > 0 {
+			via := &req.Via[0]
+			b.WriteString(via.Trans + " " + string(via.Host) + ":" + string(via.Port) + ";" + string(via.Branch))
+		}
+		b.WriteString("\x00" + string(req.To.Tag))
+		b.WriteString("\x00" + string(req.From.Tag))
+		b.WriteString("\x00" + string(req.CallId.Value))
+		b.WriteString("\x00" + string(req.Cseq.Id))
+		b.WriteString("\x00" + req.RequestUri())
+		key = b.String()
+	}
+	return siprocket.BRANCH_MAGIC + hashHex(p.Host + ":" + p.port() + "\x00" + key)[:16] + "."
+}
+
+// forwardResponse removes the top Via of a response and sends it on to the
+// next one
+func (p *Proxy) forwardResponse(resp *siprocket.SipMsg) error {
+	if len(resp.Via) == 0 || !p.isLocal(nil, resp.Via[0].Host, resp.Via[0].Port) {
+		return ErrNotMine
+	}
+	if len(resp.Via) == 1 {
+		return ErrNoVia
+	}
+	resp.RemoveTopVia()
+	return p.Transport.Respond(resp)
+}
+
+// reply answers a request the proxy does not forward, no ACK is answered
+func (p *Proxy) reply(req *siprocket.SipMsg, status *StatusError) error {
+	if strings.EqualFold(string(req.Req.Method), "ACK") {
+		return status
+	}
+	resp, err := siprocket.NewResponse(req, status.Code, status.Reason).Build()
+	if err != nil {
+		return err
+	}
+	return p.Transport.Respond(&resp)
+}
+
+func (p *Proxy) port() string {
+	if p.Port == 0 {
+		return "5060"
+	}
+	return strconv.Itoa(p.Port)
+}
+
+func (p *Proxy) error(err error) {
+	if err != nil && p.OnError != nil {
+		p.OnError(err)
+	}
+}
+
+func hashHex(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,172 @@
+package proxy
+
+import (
+	"net/netip"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nullboundary/siprocket"
+	"github.com/nullboundary/siprocket/transport"
+)
+
+func invite(branch, maxFwd, extra string) string {
+	return "INVITE sip:bob@biloxi.com SIP/2.0\r\n" +
+		"Via: SIP/2.0/UDP 127.0.0.1:5999;rport;branch=" + branch + "\r\n" +
+		"Max-Forwards: " + maxFwd + "\r\n" +
+		"To: Bob <sip:bob@biloxi.com>\r\n" +
+		"From: Alice <sip:alice@atlanta.com>;tag=1928301774\r\n" +
+		"Call-ID: " + branch + "@atlanta.com\r\n" +
+		"CSeq: 1 INVITE\r\n" +
+		"Subject: lunch\r\n" +
+		extra +
+		"Content-Length: 0\r\n\r\n"
+}
+
+// element is a transport on loopback UDP whose messages go to a channel
+func element(t *testing.T) (*transport.Transport, netip.AddrPort, chan *transport.Message) {
+	tr := transport.New()
+	t.Cleanup(func() { tr.Close() })
+	received := make(chan *transport.Message, 8)
+	tr.Handler = func(m *transport.Message) { received <- m }
+	addr, err := tr.ListenUDP("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenUDP: %v", err)
+	}
+	return tr, addr, received
+}
+
+func wait(t *testing.T, ch chan *transport.Message) *transport.Message {
+	t.Helper()
+	select {
+	case m := <-ch:
+		return m
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Nothing received")
+	}
+	return nil
+}
+
+func Test_proxy_Udp(t *testing.T) {
+
+	uac, _, uacIn := element(t)
+	uas, uasAddr, uasIn := element(t)
+
+	// The port of the proxy is only known once it listens
+	var p *Proxy
+	ready := make(chan struct{})
+	pt := transport.New()
+	defer pt.Close()
+	pt.Handler = func(m *transport.Message) {
+		<-ready
+		p.Handle(m)
+	}
+	paddr, err := pt.ListenUDP("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenUDP: %v", err)
+	}
+	p = New(pt, "127.0.0.1", int(paddr.Port()))
+	p.RecordRoute = true
+	p.OnError = func(err error) { t.Errorf("Proxy: %v", err) }
+	p.Router = RouterFunc(func(req *siprocket.SipMsg) (Hop, error) {
+		return Hop{Proto: transport.PROTO_UDP, Addr: uasAddr.String()}, nil
+	})
+	close(ready)
+
+	// The UAC routes through the proxy with a loose route
+	route := "Route: <sip:127.0.0.1:" + strconv.Itoa(int(paddr.Port())) + ";lr>\r\n"
+	if err := uac.SendRaw("udp", paddr.String(), []byte(invite("z9hG4bKuac1", "70", route))); err != nil {
+		t.Fatal(err)
+	}
+
+	m := wait(t, uasIn)
+	req := m.Msg
+	if len(req.Via) != 2 || string(req.Via[0].Host) != "127.0.0.1" || string(req.Via[0].Port) != strconv.Itoa(int(paddr.Port())) ||
+		!strings.HasPrefix(string(req.Via[0].Branch), siprocket.BRANCH_MAGIC) {
+		t.Fatalf("Bad Via: %+v", req.Via)
+	}
+	if string(req.MaxFwd.Value) != "69" || len(req.Route) != 0 || len(req.RecordRoute) != 1 || !req.RecordRoute[0].IsLoose() {
+		t.Errorf("Bad request: %q %+v %+v", req.MaxFwd.Value, req.Route, req.RecordRoute)
+	}
+	raw := string(m.Raw)
+	if !strings.Contains(raw, "Subject: lunch\r\n") {
+		t.Errorf("Other header lost: %q", raw)
+	}
+
+	// The response is sent back along the Via
+	resp, _ := siprocket.NewResponse(&req, 180, "").Build()
+	if err := uas.Respond(&resp); err != nil {
+		t.Fatal(err)
+	}
+	got := wait(t, uacIn).Msg
+	if string(got.Req.StatusCode) != "180" || len(got.Via) != 1 || string(got.Via[0].Branch) != "z9hG4bKuac1" {
+		t.Errorf("Bad response: %q %+v", got.Req.StatusCode, got.Via)
+	}
+
+	// A request out of hops is answered by the proxy
+	if err := uac.SendRaw("udp", paddr.String(), []byte(invite("z9hG4bKuac2", "0", ""))); err != nil {
+		t.Fatal(err)
+	}
+	got = wait(t, uacIn).Msg
+	if string(got.Req.StatusCode) != "483" || string(got.CallId.Value) != "z9hG4bKuac2@atlanta.com" {
+		t.Errorf("Bad response: %q %q", got.Req.StatusCode, got.CallId.Value)
+	}
+	select {
+	case m := <-uasIn:
+		t.Errorf("Request forwarded: %q", m.Raw)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func Test_proxy_RegisterLossless(t *testing.T) {
+
+	uac, _, _ := element(t)
+	_, uasAddr, uasIn := element(t)
+
+	var p *Proxy
+	ready := make(chan struct{})
+	pt := transport.New()
+	defer pt.Close()
+	pt.Handler = func(m *transport.Message) {
+		<-ready
+		p.Handle(m)
+	}
+	paddr, err := pt.ListenUDP("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenUDP: %v", err)
+	}
+	p = New(pt, "127.0.0.1", int(paddr.Port()))
+	p.RecordRoute = true
+	p.OnError = func(err error) { t.Errorf("Proxy: %v", err) }
+	close(ready)
+
+	// The next hop comes from the Request-URI and its transport parameter
+	register := func(maxFwd string) string {
+		return "REGISTER sip:" + uasAddr.String() + ";transport=udp;x-keep SIP/2.0\r\n" +
+			"Via: SIP/2.0/UDP 127.0.0.1:5999;branch=z9hG4bKreg1\r\n" +
+			"Max-Forwards: " + maxFwd + "\r\n" +
+			"To: <sip:alice@atlanta.com>\r\n" +
+			"From: <sip:alice@atlanta.com>;tag=456248\r\n" +
+			"Call-ID: reg1@atlanta.com\r\n" +
+			"CSeq: 1 REGISTER\r\n" +
+			"Contact: <sip:alice@192.0.2.1:5999;transport=udp;ob>;+sip.instance=\"<urn:uuid:00000000-0000-1000-8000-AABBCCDDEEFF>\";reg-id=1;expires=3600\r\n" +
+			"Supported: outbound, path\r\n" +
+			"Content-Length: 0\r\n\r\n"
+	}
+	if err := uac.SendRaw("udp", paddr.String(), []byte(register("70"))); err != nil {
+		t.Fatal(err)
+	}
+
+	// Apart from the new Via and Max-Forwards the request is sent as it came
+	raw := string(wait(t, uasIn).Raw)
+	line, rest, _ := strings.Cut(raw, "\r\n")
+	via, rest, _ := strings.Cut(rest, "\r\n")
+	if !strings.HasPrefix(via, "Via: SIP/2.0/UDP 127.0.0.1:"+strconv.Itoa(int(paddr.Port()))+";") {
+		t.Errorf("Bad Via: %q", via)
+	}
+	exp := register("69")
+	if out := line + "\r\n" + rest; out != exp {
+		t.Errorf("Mismatch:\nExpected:\n%q\nGot:\n%q", exp, out)
+	}
+}
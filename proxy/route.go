@@ -0,0 +1,194 @@
+package proxy
+
+/*
+ RFC 3261 - https://www.ietf.org/rfc/rfc3261.txt - 16.4 Route Information Preprocessing
+
+   If the Request-URI contains a value this proxy previously placed into
+   a Record-Route header field (see Section 16.6 item 4), the proxy MUST
+   replace the Request-URI in the request with the last value from the
+   Route header field, and remove that value from the Route header field.
+
+   If the first value in the Route header field indicates this proxy,
+   the proxy MUST remove that value from the request.
+
+ 16.6 Request Forwarding, item 6
+
+   If the copy contains a Route header field, the proxy MUST inspect the
+   URI in its first value.  If that URI does not contain an lr
+   parameter, the proxy MUST modify the copy as follows:
+
+   -  The proxy MUST place the Request-URI into the Route header
+      field as the last value.
+
+   -  The proxy MUST then place the first Route header field value
+      into the Request-URI and remove that value from the Route
+      header field.
+
+ 16.6 item 7
+
+   If the proxy has reformatted the request to send to a strict-routing
+   element as described in step 6 above, the proxy MUST apply those
+   procedures to the Request-URI of the request.  Otherwise, the proxy
+   MUST apply the procedures to the first value in the Route header
+   field, if present, else the Request-URI.
+
+ The address is resolved with the procedures of RFC 3263. Only the
+ transport parameter, the sips scheme and the default ports are used here,
+ DNS SRV and NAPTR lookups are left to a Router.
+
+*/
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"strings"
+
+	"github.com/nullboundary/siprocket"
+	"github.com/nullboundary/siprocket/transport"
+)
+
+// Hop is where a request is sent next
+type Hop struct {
+	Proto string // One of the transport PROTO_ constants
+	Addr  string // Host and port
+}
+
+// Router picks the next hop of a request that has no Route header left
+// once this proxy removed its own. It may rewrite the Request-URI, as a
+// location service would, and return a *StatusError to reject the
+// request with that status.
+type Router interface {
+	Route(req *siprocket.SipMsg) (Hop, error)
+}
+
+// RouterFunc adapts a function to a Router
+type RouterFunc func(req *siprocket.SipMsg) (Hop, error)
+
+func (f RouterFunc) Route(req *siprocket.SipMsg) (Hop, error) {
+	return f(req)
+}
+
+// StatusError rejects a request with a status code
+type StatusError struct {
+	Code   int
+	Reason string // Empty for the usual phrase of the code
+}
+
+func (e *StatusError) Error() string {
+	reason := e.Reason
+	if reason == "" {
+		reason = siprocket.StatusText(e.Code)
+	}
+	return "proxy: " + reason
+}
+
+// NextHop gives the next hop of a request from its top Route or, without
+// one, its Request-URI
+func NextHop(req *siprocket.SipMsg) (Hop, error) {
+	if len(req.Route) > 0 {
+		return routeHop(&req.Route[0])
+	}
+	if len(req.Req.Host) == 0 {
+		return Hop{}, errors.New("proxy: no request uri")
+	}
+	return hopFor(req.Req.UriType, req.Req.Host, req.Req.Port, uriParam(req.Req.Params, "transport"))
+}
+
+// routeHop gives the next hop of a route entry
+func routeHop(r *siprocket.SipRoute) (Hop, error) {
+	return hopFor(r.UriType, r.Host, r.Port, uriParam(r.Params, "transport"))
+}
+
+func hopFor(uriType, host, port []byte, proto string) (Hop, error) {
+	if len(host) == 0 {
+		return Hop{}, errors.New("proxy: no host to route to")
+	}
+	proto = strings.ToLower(proto)
+	sips := bytes.EqualFold(uriType, []byte("sips"))
+	switch {
+	case proto == "" && sips:
+		proto = transport.PROTO_TLS
+	case proto == "":
+		proto = transport.PROTO_UDP
+	}
+	if len(port) == 0 {
+		port = []byte(defaultPort(proto))
+	}
+	return Hop{Proto: proto, Addr: net.JoinHostPort(strings.Trim(string(host), "[]"), string(port))}, nil
+}
+
+func defaultPort(proto string) string {
+	switch proto {
+	case transport.PROTO_TLS:
+		return "5061"
+	case transport.PROTO_WS:
+		return "80"
+	case transport.PROTO_WSS:
+		return "443"
+	}
+	return "5060"
+}
+
+// uriParam returns the value of a URI parameter, or an empty string
+func uriParam(params [][]byte, name string) string {
+	for _, param := range params {
+		key, val, _ := bytes.Cut(param, []byte("="))
+		if strings.EqualFold(string(key), name) {
+			return string(val)
+		}
+	}
+	return ""
+}
+
+// preprocessRoute applies section 16.4 to a request received by p
+func (p *Proxy) preprocessRoute(req *siprocket.SipMsg) error {
+	if len(req.Route) > 0 && p.isLocal(req.Req.UriType, req.Req.Host, req.Req.Port) {
+		// Sent by a strict router, the Request-URI is our Record-Route
+		last := req.Route[len(req.Route)-1]
+		if err := req.SetRequestUri(string(last.RouteUri())); err != nil {
+			return &StatusError{Code: 400, Reason: "Bad Route"}
+		}
+		req.Route = req.Route[:len(req.Route)-1]
+		req.MarkDirty(siprocket.HEADER_ROUTE)
+	}
+
+	if len(req.Route) > 0 && p.isLocal(req.Route[0].UriType, req.Route[0].Host, req.Route[0].Port) {
+		req.Route = req.Route[1:]
+		req.MarkDirty(siprocket.HEADER_ROUTE)
+	}
+	return nil
+}
+
+// strictRoute applies section 16.6 item 6 when the next hop is a strict
+// router, whose route entry is returned. It returns nil otherwise.
+func strictRoute(req *siprocket.SipMsg) (*siprocket.SipRoute, error) {
+	if len(req.Route) == 0 || req.Route[0].IsLoose() {
+		return nil, nil
+	}
+	first := req.Route[0]
+	uri := req.RequestUri()
+	if err := req.SetRequestUri(string(first.RouteUri())); err != nil {
+		return nil, &StatusError{Code: 400, Reason: "Bad Route"}
+	}
+
+	last := siprocket.SipRoute{Uri: []byte(uri)}
+	req.Route = append(req.Route[1:len(req.Route):len(req.Route)], last)
+	req.MarkDirty(siprocket.HEADER_ROUTE)
+	return &first, nil
+}
+
+// isLocal tells if a URI host and port are those of the proxy
+func (p *Proxy) isLocal(uriType, host, port []byte) bool {
+	if !strings.EqualFold(strings.Trim(string(host), "[]"), strings.Trim(p.Host, "[]")) {
+		return false
+	}
+	if len(port) == 0 {
+		if bytes.EqualFold(uriType, []byte("sips")) {
+			port = []byte("5061")
+		} else {
+			port = []byte("5060")
+		}
+	}
+	return string(port) == p.port()
+}
@@ -0,0 +1,159 @@
+package proxy
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/nullboundary/siprocket"
+)
+
+func Test_route_StrictRouter(t *testing.T) {
+
+	p := New(nil, "p1.example.com", 0)
+
+	// Sent on by a strict router, our Record-Route is the Request-URI and
+	// the request is bound for the last Route
+	req := siprocket.ParseLossless([]byte(strings.Replace(invite("z9hG4bKs1", "10", "Route: <sip:p2.example.com>\r\nRoute: <sip:bob@192.0.2.4;transport=tcp>\r\n"),
+		"INVITE sip:bob@biloxi.com", "INVITE sip:p1.example.com;lr", 1)))
+
+	hop, err := p.prepare(&req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The next element is a strict router too
+	if exp := (Hop{Proto: "udp", Addr: "p2.example.com:5060"}); hop != exp {
+		t.Errorf("Mismatch:\nExpected:\n%+v\nGot:\n%+v", exp, hop)
+	}
+	out := siprocket.MarshalLossless(&req)
+	if !strings.HasPrefix(out, "INVITE sip:p2.example.com SIP/2.0\r\n") || !strings.Contains(out, "Route: <sip:bob@192.0.2.4;transport=tcp>\r\n") {
+		t.Errorf("Bad request: %q", out)
+	}
+}
+
+func Test_route_StrictRouterUriParams(t *testing.T) {
+
+	p := New(nil, "p1.example.com", 0)
+
+	// The Request-URI pushed onto the Route keeps all its parameters
+	req := siprocket.ParseLossless([]byte(strings.Replace(invite("z9hG4bKs2", "10", "Route: <sip:p2.example.com>\r\n"),
+		"INVITE sip:bob@biloxi.com", "INVITE sip:bob@192.0.2.4:5080;transport=tcp;maddr=192.0.2.5;lr", 1)))
+	if _, err := p.prepare(&req); err != nil {
+		t.Fatal(err)
+	}
+	out := siprocket.MarshalLossless(&req)
+	if !strings.HasPrefix(out, "INVITE sip:p2.example.com SIP/2.0\r\n") ||
+		!strings.Contains(out, "Route: <sip:bob@192.0.2.4:5080;transport=tcp;maddr=192.0.2.5;lr>\r\n") {
+		t.Errorf("Bad request: %q", out)
+	}
+
+	// A rewritten Request-URI keeps its transport for the next hop
+	req = siprocket.ParseLossless([]byte(invite("z9hG4bKs3", "10", "")))
+	if err := req.SetRequestUri("sip:bob@192.0.2.4;transport=tcp"); err != nil {
+		t.Fatal(err)
+	}
+	req.SetRequestUser("carol")
+	hop, err := p.prepare(&req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp := (Hop{Proto: "tcp", Addr: "192.0.2.4:5060"}); hop != exp {
+		t.Errorf("Mismatch:\nExpected:\n%+v\nGot:\n%+v", exp, hop)
+	}
+	if req.RequestUri() != "sip:carol@192.0.2.4;transport=tcp" {
+		t.Errorf("Mismatch: %q", req.RequestUri())
+	}
+}
+
+func Test_route_LooseRouter(t *testing.T) {
+
+	p := New(nil, "p1.example.com", 5070)
+
+	req := siprocket.ParseLossless([]byte(invite("z9hG4bKl1", "10",
+		"Route: <sip:P1.example.com:5070;lr>,<sips:p2.example.com;lr>\r\n")))
+	hop, err := p.prepare(&req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp := (Hop{Proto: "tls", Addr: "p2.example.com:5061"}); hop != exp {
+		t.Errorf("Mismatch:\nExpected:\n%+v\nGot:\n%+v", exp, hop)
+	}
+	if len(req.Route) != 1 || req.RequestUri() != "sip:bob@biloxi.com" || string(req.MaxFwd.Value) != "9" {
+		t.Errorf("Bad request: %q %q %+v", req.RequestUri(), req.MaxFwd.Value, req.Route)
+	}
+	if req.Via[0].Trans != "tls" || string(req.Via[0].Port) != "5070" {
+		t.Errorf("Bad Via: %+v", req.Via[0])
+	}
+}
+
+func Test_route_NextHop(t *testing.T) {
+
+	tests := []struct {
+		line string
+		exp  Hop
+	}{
+		{"OPTIONS sip:bob@biloxi.com SIP/2.0", Hop{Proto: "udp", Addr: "biloxi.com:5060"}},
+		{"OPTIONS sip:bob@192.0.2.4:5080;transport=TCP SIP/2.0", Hop{Proto: "tcp", Addr: "192.0.2.4:5080"}},
+		{"OPTIONS sips:bob@biloxi.com SIP/2.0", Hop{Proto: "tls", Addr: "biloxi.com:5061"}},
+	}
+	for _, tt := range tests {
+		req := siprocket.Parse([]byte(tt.line + "\r\n\r\n"))
+		hop, err := NextHop(&req)
+		if err != nil || hop != tt.exp {
+			t.Errorf("%s: expected %+v, got %+v %v", tt.line, tt.exp, hop, err)
+		}
+	}
+}
+
+func Test_route_Branch(t *testing.T) {
+
+	p := New(nil, "p1.example.com", 0)
+	branchOf := func(raw string) string {
+		req := siprocket.ParseLossless([]byte(raw))
+		if _, err := p.prepare(&req); err != nil {
+			t.Fatal(err)
+		}
+		return string(req.Via[0].Branch)
+	}
+
+	// Retransmissions and the CANCEL share the branch of the INVITE
+	branches := []string{
+		branchOf(invite("z9hG4bKb1", "70", "")),
+		branchOf(invite("z9hG4bKb1", "70", "")),
+		branchOf(strings.NewReplacer("INVITE", "CANCEL").Replace(invite("z9hG4bKb1", "70", ""))),
+	}
+	if !reflect.DeepEqual(branches[1:], branches[:2]) {
+		t.Errorf("Branches differ: %q", branches)
+	}
+	if other := branchOf(invite("z9hG4bKb2", "70", "")); other == branches[0] {
+		t.Errorf("Same branch for another transaction: %q", other)
+	}
+
+	// Without the magic cookie the other fields are used
+	legacy := strings.Replace(invite("b3", "70", ""), ";branch=b3", "", 1)
+	if branchOf(legacy) != branchOf(legacy) || branchOf(legacy) == branchOf(strings.Replace(legacy, "tag=1928301774", "tag=2", 1)) {
+		t.Errorf("Bad branch without the magic cookie")
+	}
+}
+
+func Test_route_Reject(t *testing.T) {
+
+	p := New(nil, "p1.example.com", 0)
+	p.Router = RouterFunc(func(req *siprocket.SipMsg) (Hop, error) {
+		return Hop{}, &StatusError{Code: 404}
+	})
+
+	var status *StatusError
+	for _, raw := range []string{invite("z9hG4bKr1", "70", ""), invite("z9hG4bKr2", "0", ""), invite("z9hG4bKr3", "x", "")} {
+		req := siprocket.ParseLossless([]byte(raw))
+		_, err := p.prepare(&req)
+		if !errors.As(err, &status) {
+			t.Fatalf("Expected a StatusError, got %v", err)
+		}
+	}
+	if status.Code != 400 {
+		t.Errorf("Expected 400, got %d", status.Code)
+	}
+}
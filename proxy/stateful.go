@@ -0,0 +1,266 @@
+package proxy
+
+/*
+ RFC 3261 - https://www.ietf.org/rfc/rfc3261.txt - 16.2 Stateful Proxy
+
+   When stateful, a proxy is purely a SIP transaction processing engine.
+   Its behavior is modeled here in terms of the server and client
+   transactions defined in Section 17.  A stateful proxy has a server
+   transaction associated with one or more client transactions by a
+   higher layer proxy processing component (see figure 3), known as a
+   proxy core.
+
+ 16.10 CANCEL Processing
+
+   A stateful proxy MAY generate a CANCEL to any other request it has
+   generated at any time (subject to receiving a provisional response to
+   that request as described in section 9.1).
+
+   If a matching response context is found, the element MUST immediately
+   return a 200 (OK) response to the CANCEL request.  In this case, the
+   element is acting as a user agent server as defined in Section 8.2.
+   Furthermore, the element MUST generate CANCEL requests for all pending
+   client transactions in the context as described in Section 16.7 step
+   10.
+
+   If a response context is not found, the element does not have any
+   knowledge of the request to apply the CANCEL to.  It MUST statelessly
+   forward the CANCEL request.
+
+ An ACK for a 2xx and the responses that match no client transaction,
+ such as retransmitted 2xx, are forwarded statelessly too.
+
+*/
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/nullboundary/siprocket"
+	"github.com/nullboundary/siprocket/transaction"
+	"github.com/nullboundary/siprocket/transport"
+)
+
+// Fork modes
+const (
+	FORK_PARALLEL = "parallel" // Every target at once
+	FORK_SERIAL   = "serial"   // Highest q value first, equal ones at once
+)
+
+// DEFAULT_TIMER_C is the time an INVITE branch may stay in the proceeding
+// state before it is cancelled
+const DEFAULT_TIMER_C = 3*time.Minute + 30*time.Second
+
+// Target is one destination of a request
+type Target struct {
+	Uri string  // Request-URI of the branch
+	Q   float64 // q value of the Contact, serial forking tries higher ones first
+	Hop Hop     // Next hop, taken from the URI when zero
+}
+
+// Locator gives the targets a stateful proxy forks a request to, as a
+// location service does. No target at all sends the request to the next
+// hop picked by the Router of the proxy, a *StatusError rejects it.
+type Locator interface {
+	Targets(req *siprocket.SipMsg) ([]Target, error)
+}
+
+// LocatorFunc adapts a function to a Locator
+type LocatorFunc func(req *siprocket.SipMsg) ([]Target, error)
+
+func (f LocatorFunc) Targets(req *siprocket.SipMsg) ([]Target, error) {
+	return f(req)
+}
+
+// Stateful is a transaction stateful proxy that forks requests. Set
+// Handle as the Handler of its Transport.
+type Stateful struct {
+	Proxy
+	Locator Locator            // Targets of a request, optional
+	Fork    string             // FORK_PARALLEL or FORK_SERIAL
+	Recurse bool               // Try the Contacts of 3xx responses
+	TimerC  time.Duration      // Defaults to DEFAULT_TIMER_C
+	Clock   transaction.Clock  // Defaults to transaction.SystemClock
+	Timers  transaction.Timers // Zero fields default to transaction.DefaultTimers
+
+	table    *transaction.Table
+	mu       sync.Mutex
+	contexts map[transaction.Key]*forkContext
+	purged   time.Time
+}
+
+func NewStateful(t *transport.Transport, host string, port int) *Stateful {
+	return &Stateful{
+		Proxy:    Proxy{Transport: t, Host: host, Port: port},
+		Fork:     FORK_PARALLEL,
+		TimerC:   DEFAULT_TIMER_C,
+		table:    transaction.NewTable(),
+		contexts: make(map[transaction.Key]*forkContext),
+	}
+}
+
+// Handle passes a message received by the transport to its transaction,
+// or starts a new server transaction and forks the request
+func (s *Stateful) Handle(m *transport.Message) {
+	msg := siprocket.ParseLossless(m.Raw)
+
+	if len(msg.Req.StatusCode) > 0 {
+		if c, ok := s.table.MatchResponse(&msg); ok {
+			c.Receive(&msg)
+			return
+		}
+		s.error(s.forwardResponse(&msg))
+		return
+	}
+
+	transport.SetReceived(&msg, m.Tuple.Src)
+	if srv, ok := s.table.MatchRequest(&msg); ok {
+		srv.Receive(&msg)
+		return
+	}
+
+	switch string(msg.Req.Method) {
+	case "ACK":
+		s.error(s.forwardRequest(&msg))
+		return
+	case "CANCEL":
+		if s.cancel(&msg, m.Tuple.Proto) {
+			return
+		}
+		s.error(s.forwardRequest(&msg))
+		return
+	}
+
+	err := s.start(&msg, m.Tuple.Proto)
+	var status *StatusError
+	if errors.As(err, &status) {
+		err = s.reply(&m.Msg, status)
+	}
+	s.error(err)
+}
+
+// start creates the server transaction and response context of a new
+// request and sends it to its targets
+func (s *Stateful) start(req *siprocket.SipMsg, proto string) error {
+	s.purge()
+
+	if err := s.validate(req); err != nil {
+		return err
+	}
+
+	var targets []Target
+	if s.Locator != nil && len(req.Route) == 0 {
+		var err error
+		if targets, err = s.Locator.Targets(req); err != nil {
+			return err
+		}
+	}
+
+	var ctx *forkContext
+	srv, err := transaction.NewServer(req, s.config(proto), transaction.ServerHandler{
+		TransportError: s.error,
+		Terminated:     func() { s.done(ctx) },
+	})
+	if err != nil {
+		return err
+	}
+	s.table.AddServer(srv)
+
+	ctx = newForkContext(s, srv, req)
+	s.mu.Lock()
+	s.contexts[srv.Key()] = ctx
+	s.mu.Unlock()
+
+	ctx.run(targets)
+	return nil
+}
+
+// cancel answers a CANCEL that matches a response context and cancels its
+// pending branches, it tells if there was one
+func (s *Stateful) cancel(req *siprocket.SipMsg, proto string) bool {
+	srv, ok := s.table.MatchCancel(req)
+	if !ok {
+		return false
+	}
+	s.mu.Lock()
+	ctx := s.contexts[srv.Key()]
+	s.mu.Unlock()
+	if ctx == nil {
+		return false
+	}
+
+	cs, err := transaction.NewServer(req, s.config(proto), transaction.ServerHandler{TransportError: s.error})
+	if err != nil {
+		s.error(err)
+		return true
+	}
+	s.table.AddServer(cs)
+	if resp, err := siprocket.NewResponse(req, 200, "").Build(); err == nil {
+		s.error(cs.Respond(&resp))
+	}
+	ctx.cancel()
+	return true
+}
+
+// config returns the server transaction settings for a request received
+// over proto
+func (s *Stateful) config(proto string) transaction.Config {
+	return transaction.Config{
+		Send: func(resp *siprocket.SipMsg) error {
+			return s.Transport.Respond(resp)
+		},
+		Reliable: proto != transport.PROTO_UDP,
+		Clock:    s.Clock,
+		Timers:   s.Timers,
+	}
+}
+
+// clientConfig returns the client transaction settings for a request sent
+// to hop
+func (s *Stateful) clientConfig(hop Hop) transaction.Config {
+	return transaction.Config{
+		Send: func(msg *siprocket.SipMsg) error {
+			return s.Transport.SendRequest(hop.Proto, hop.Addr, msg)
+		},
+		Reliable: hop.Proto != transport.PROTO_UDP,
+		Clock:    s.Clock,
+		Timers:   s.Timers,
+	}
+}
+
+// done drops a response context once all of its transactions are over
+func (s *Stateful) done(ctx *forkContext) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.contexts[ctx.key] == ctx {
+		delete(s.contexts, ctx.key)
+	}
+}
+
+// purge drops the terminated transactions now and then
+func (s *Stateful) purge() {
+	now := s.clock().Now()
+	s.mu.Lock()
+	if now.Sub(s.purged) < time.Second {
+		s.mu.Unlock()
+		return
+	}
+	s.purged = now
+	s.mu.Unlock()
+	s.table.Purge()
+}
+
+func (s *Stateful) clock() transaction.Clock {
+	if s.Clock == nil {
+		return transaction.SystemClock
+	}
+	return s.Clock
+}
+
+func (s *Stateful) timerC() time.Duration {
+	if s.TimerC <= 0 {
+		return DEFAULT_TIMER_C
+	}
+	return s.TimerC
+}
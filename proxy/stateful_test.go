@@ -0,0 +1,230 @@
+package proxy
+
+import (
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nullboundary/siprocket"
+	"github.com/nullboundary/siprocket/transaction"
+	"github.com/nullboundary/siprocket/transport"
+)
+
+// stateful is a stateful proxy on loopback UDP forking to the given
+// addresses with the given q values
+func stateful(t *testing.T, fork string, q []float64, addrs ...netip.AddrPort) (*Stateful, netip.AddrPort) {
+	var s *Stateful
+	ready := make(chan struct{})
+	pt := transport.New()
+	t.Cleanup(func() { pt.Close() })
+	pt.Handler = func(m *transport.Message) {
+		<-ready
+		s.Handle(m)
+	}
+	paddr, err := pt.ListenUDP("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenUDP: %v", err)
+	}
+
+	s = NewStateful(pt, "127.0.0.1", int(paddr.Port()))
+	s.Fork = fork
+	s.Clock = transaction.NewManualClock(time.Unix(0, 0))
+	s.OnError = func(err error) { t.Errorf("Proxy: %v", err) }
+	s.Locator = LocatorFunc(func(req *siprocket.SipMsg) ([]Target, error) {
+		var targets []Target
+		for i, addr := range addrs {
+			targets = append(targets, Target{
+				Uri: "sip:bob@" + addr.String(),
+				Q:   q[i],
+				Hop: Hop{Proto: transport.PROTO_UDP, Addr: addr.String()},
+			})
+		}
+		return targets, nil
+	})
+	close(ready)
+	return s, paddr
+}
+
+// respond answers a request received by an element
+func respond(t *testing.T, tr *transport.Transport, req *siprocket.SipMsg, code int, extra ...string) {
+	t.Helper()
+	resp, err := siprocket.NewResponse(req, code, "").Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		resp.AddHeader(extra[i], extra[i+1])
+	}
+	if err := tr.Respond(&resp); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func method(m *transport.Message) string {
+	if len(m.Msg.Req.StatusCode) > 0 {
+		return string(m.Msg.Req.StatusCode)
+	}
+	return string(m.Msg.Req.Method)
+}
+
+func Test_stateful_ParallelFork(t *testing.T) {
+
+	uac, _, uacIn := element(t)
+	uas1, addr1, uas1In := element(t)
+	uas2, addr2, uas2In := element(t)
+	_, paddr := stateful(t, FORK_PARALLEL, []float64{1, 1}, addr1, addr2)
+
+	if err := uac.SendRaw("udp", paddr.String(), []byte(invite("z9hG4bKfork1", "70", ""))); err != nil {
+		t.Fatal(err)
+	}
+	inv1 := wait(t, uas1In).Msg
+	inv2 := wait(t, uas2In).Msg
+	if inv1.RequestUri() != "sip:bob@"+addr1.String() || inv2.RequestUri() != "sip:bob@"+addr2.String() {
+		t.Errorf("Bad targets: %q %q", inv1.RequestUri(), inv2.RequestUri())
+	}
+	if string(inv1.Via[0].Branch) == string(inv2.Via[0].Branch) || string(inv1.MaxFwd.Value) != "69" {
+		t.Errorf("Bad branches: %+v %+v", inv1.Via[0], inv2.Via[0])
+	}
+
+	// Provisional responses are passed on at once
+	respond(t, uas1, &inv1, 180)
+	if got := wait(t, uacIn); method(got) != "180" || len(got.Msg.Via) != 1 {
+		t.Fatalf("Bad response: %q", got.Raw)
+	}
+
+	// The 2xx goes upstream and the other branch is cancelled
+	respond(t, uas2, &inv2, 200)
+	if got := wait(t, uacIn); method(got) != "200" || string(got.Msg.Via[0].Branch) != "z9hG4bKfork1" {
+		t.Fatalf("Bad response: %q", got.Raw)
+	}
+	cancel := wait(t, uas1In).Msg
+	if string(cancel.Req.Method) != "CANCEL" || string(cancel.Via[0].Branch) != string(inv1.Via[0].Branch) {
+		t.Fatalf("Bad CANCEL: %q %+v", cancel.Req.Method, cancel.Via)
+	}
+	respond(t, uas1, &cancel, 200)
+	respond(t, uas1, &inv1, 487)
+
+	// The proxy acknowledges the 487 itself and keeps it from the UAC
+	if ack := wait(t, uas1In); method(ack) != "ACK" {
+		t.Errorf("Bad ACK: %q", ack.Raw)
+	}
+	select {
+	case m := <-uacIn:
+		t.Errorf("Response forwarded: %q", m.Raw)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func Test_stateful_SerialFork(t *testing.T) {
+
+	uac, _, uacIn := element(t)
+	uas1, addr1, uas1In := element(t)
+	uas2, addr2, uas2In := element(t)
+	_, paddr := stateful(t, FORK_SERIAL, []float64{0.5, 1}, addr1, addr2)
+
+	if err := uac.SendRaw("udp", paddr.String(), []byte(invite("z9hG4bKfork2", "70", ""))); err != nil {
+		t.Fatal(err)
+	}
+
+	// The target with the higher q value goes first
+	inv2 := wait(t, uas2In).Msg
+	select {
+	case m := <-uas1In:
+		t.Fatalf("Forked too soon: %q", m.Raw)
+	case <-time.After(50 * time.Millisecond):
+	}
+	respond(t, uas2, &inv2, 407, "Proxy-Authenticate", `Digest realm="uas2", nonce="a"`)
+	if ack := wait(t, uas2In); method(ack) != "ACK" {
+		t.Errorf("Bad ACK: %q", ack.Raw)
+	}
+
+	inv1 := wait(t, uas1In).Msg
+	respond(t, uas1, &inv1, 401, "WWW-Authenticate", `Digest realm="uas1", nonce="b"`)
+
+	// Both challenges reach the UAC in one response
+	got := wait(t, uacIn)
+	if method(got) != "407" {
+		t.Fatalf("Bad response: %q", got.Raw)
+	}
+	resp := siprocket.ParseLossless(got.Raw)
+	www := resp.HeaderValues("WWW-Authenticate")
+	proxy := resp.HeaderValues("Proxy-Authenticate")
+	if len(www) != 1 || len(proxy) != 1 || !strings.Contains(string(www[0]), "uas1") || !strings.Contains(string(proxy[0]), "uas2") {
+		t.Errorf("Bad challenges: %q", got.Raw)
+	}
+}
+
+func Test_stateful_Cancel(t *testing.T) {
+
+	uac, _, uacIn := element(t)
+	uas1, addr1, uas1In := element(t)
+	_, paddr := stateful(t, FORK_PARALLEL, []float64{1}, addr1)
+
+	raw := invite("z9hG4bKfork3", "70", "")
+	if err := uac.SendRaw("udp", paddr.String(), []byte(raw)); err != nil {
+		t.Fatal(err)
+	}
+	inv1 := wait(t, uas1In).Msg
+	respond(t, uas1, &inv1, 180)
+	wait(t, uacIn)
+
+	// The proxy answers the CANCEL and cancels the branch
+	req := siprocket.ParseLossless([]byte(raw))
+	cancel, _ := siprocket.NewCancel(&req).Build()
+	if err := uac.SendRaw("udp", paddr.String(), []byte(siprocket.Marshal(&cancel))); err != nil {
+		t.Fatal(err)
+	}
+	if got := wait(t, uacIn); method(got) != "200" || string(got.Msg.Cseq.Method) != "CANCEL" {
+		t.Fatalf("Bad response: %q", got.Raw)
+	}
+	down := wait(t, uas1In).Msg
+	if string(down.Req.Method) != "CANCEL" {
+		t.Fatalf("Bad request: %q", down.Req.Method)
+	}
+	respond(t, uas1, &down, 200)
+	respond(t, uas1, &inv1, 487)
+
+	if got := wait(t, uacIn); method(got) != "487" || string(got.Msg.Cseq.Method) != "INVITE" {
+		t.Errorf("Bad response: %q", got.Raw)
+	}
+}
+
+func Test_stateful_BestResponse(t *testing.T) {
+
+	tests := []struct {
+		codes []int
+		best  int
+	}{
+		{[]int{486, 603, 200}, 603},
+		{[]int{503, 404, 302}, 302},
+		{[]int{404, 407, 486}, 407},
+		{[]int{503, 500}, 500},
+		{[]int{503}, 503},
+		{nil, 0},
+	}
+
+	for _, test := range tests {
+		var responses []*siprocket.SipMsg
+		for _, code := range test.codes {
+			req := siprocket.ParseLossless([]byte(invite("z9hG4bKbest", "70", "")))
+			resp, _ := siprocket.NewResponse(&req, code, "").Build()
+			responses = append(responses, &resp)
+		}
+		got := 0
+		if best := bestResponse(responses); best != nil {
+			got = statusCode(best)
+		}
+		if got != test.best {
+			t.Errorf("Mismatch for %v:\nExpected:\n%+v\nGot:\n%+v", test.codes, test.best, got)
+		}
+	}
+}
+
+func Test_stateful_GroupByQ(t *testing.T) {
+
+	groups := groupByQ([]Target{{Uri: "a", Q: 0.5}, {Uri: "b", Q: 1}, {Uri: "c", Q: 0.5}})
+	if len(groups) != 2 || len(groups[0]) != 1 || groups[0][0].Uri != "b" || len(groups[1]) != 2 || groups[1][0].Uri != "a" {
+		t.Errorf("Bad groups: %+v", groups)
+	}
+}
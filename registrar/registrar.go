@@ -0,0 +1,497 @@
+// Package registrar follows REGISTER transactions to keep a table of the
+// contacts bound to each address of record, as a registrar would.
+package registrar
+
+/*
+ RFC 3261 - https://datatracker.ietf.org/doc/html/rfc3261#section-10.2.1.1
+
+ 10.2.1.1 Setting the Expiration Interval of Contact Addresses
+
+   The expires parameter of a Contact takes precedence over the Expires
+   header field, which applies to every Contact without the parameter.
+   Without either the registrar chooses, commonly 3600 seconds.
+
+ 10.2.2 Removing Bindings
+
+   Contact: * with Expires: 0 removes every binding of the address of
+   record.
+
+ 10.3 Processing REGISTER Requests, step 8
+
+   The 200 OK lists every current binding of the address of record, each
+   with an expires parameter. When it does this package takes it as the
+   full set of bindings, otherwise the Contacts of the request are applied.
+
+ RFC 5626 - https://datatracker.ietf.org/doc/html/rfc5626#section-6
+
+   Contact: <sip:line1@192.0.2.2;transport=tcp>;reg-id=1
+    ;+sip.instance="<urn:uuid:00000000-0000-1000-8000-000A95A0E128>"
+
+   A binding with +sip.instance and reg-id is identified by those two
+   rather than the Contact URI, so a new flow replaces the old one.
+
+ RFC 3327 - https://datatracker.ietf.org/doc/html/rfc3327#section-5.3
+
+   The Path header field values of the REGISTER are stored with the
+   binding and used as a Route set towards the contact.
+
+*/
+
+import (
+	"bytes"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nullboundary/siprocket"
+)
+
+// Binding events
+const (
+	EVENT_REGISTERED   = "registered"
+	EVENT_REFRESHED    = "refreshed"
+	EVENT_UNREGISTERED = "unregistered"
+	EVENT_EXPIRED      = "expired"
+)
+
+// Binding is one contact bound to an address of record
+type Binding struct {
+	Aor        string    // Address of record, user@host of the To
+	Contact    string    // Contact URI
+	Instance   string    // +sip.instance of RFC 5626, without quotes
+	RegId      int       // reg-id of RFC 5626, zero when absent
+	Path       []string  // Path URIs in order
+	Q          string    // q value of the contact
+	UserAgent  string    // User-Agent of the REGISTER
+	CallId     string    // Call-ID of the REGISTER
+	Registered time.Time // When the binding was created
+	Updated    time.Time // When the binding was last refreshed
+	Expires    time.Time // When the binding lapses
+}
+
+// Event tells of a binding that was added, refreshed or removed
+type Event struct {
+	Kind    string // One of the EVENT_ constants
+	Binding Binding
+}
+
+// UaStats counts the outcome of REGISTER requests by User-Agent
+type UaStats struct {
+	UserAgent  string
+	Requests   int // Requests that got a final response or timed out
+	Success    int // 2xx
+	Challenges int // 401 and 407
+	Failures   int // Any other final response, or none at all
+}
+
+// FailureRate is the share of requests that failed, challenges aside
+func (s *UaStats) FailureRate() float64 {
+	n := s.Requests - s.Challenges
+	if n <= 0 {
+		return 0
+	}
+	return float64(s.Failures) / float64(n)
+}
+
+type request struct {
+	aor      string
+	ua       string
+	callId   string
+	contacts []siprocket.SipContact
+	expires  []byte // Expires header
+	path     []string
+	at       time.Time
+}
+
+type txKey struct {
+	callId string
+	cseq   string
+}
+
+// Tracker keeps the bindings. It is safe for concurrent use.
+type Tracker struct {
+	mu       sync.Mutex
+	aors     map[string]map[string]*Binding
+	requests map[txKey]*request
+	stats    map[string]*UaStats
+
+	// DefaultExpires applies when neither the Contact nor the request
+	// give an expiry
+	DefaultExpires time.Duration
+
+	// RequestTimeout is how long a REGISTER may go without a final
+	// response before Expire counts it as failed
+	RequestTimeout time.Duration
+
+	// OnEvent is called for every change of a binding, without the
+	// tracker locked
+	OnEvent func(e Event)
+}
+
+func NewTracker() *Tracker {
+	return &Tracker{
+		aors:           make(map[string]map[string]*Binding),
+		requests:       make(map[txKey]*request),
+		stats:          make(map[string]*UaStats),
+		DefaultExpires: time.Hour,
+		RequestTimeout: 32 * time.Second,
+	}
+}
+
+// Process accounts for a REGISTER request or a response to one, other
+// messages are ignored
+func (t *Tracker) Process(at time.Time, msg *siprocket.SipMsg) {
+	if !strings.EqualFold(string(msg.Cseq.Method), "REGISTER") {
+		return
+	}
+	key := txKey{string(msg.CallId.Value), string(msg.Cseq.Id)}
+
+	var events []Event
+	t.mu.Lock()
+	if len(msg.Req.StatusCode) == 0 {
+		req := &request{
+			aor:      aorOf(&msg.To),
+			ua:       string(msg.Ua.Value),
+			callId:   key.callId,
+			contacts: cloneContacts(msg.Contacts),
+			expires:  bytes.Clone(msg.Exp.Value),
+			at:       at,
+		}
+		for i := range msg.Path {
+			req.path = append(req.path, string(msg.Path[i].RouteUri()))
+		}
+		t.requests[key] = req
+	} else if req, ok := t.requests[key]; ok {
+		events = t.response(at, req, msg)
+		if msg.Req.StatusCode[0] != '1' {
+			delete(t.requests, key)
+		}
+	}
+	t.mu.Unlock()
+
+	t.emit(events)
+}
+
+func (t *Tracker) response(at time.Time, req *request, msg *siprocket.SipMsg) []Event {
+	code, _ := strconv.Atoi(string(msg.Req.StatusCode))
+	if code < 200 {
+		return nil
+	}
+
+	stats := t.statsFor(req.ua)
+	stats.Requests++
+	switch {
+	case code < 300:
+		stats.Success++
+	case code == 401 || code == 407:
+		stats.Challenges++
+		return nil
+	default:
+		stats.Failures++
+		return nil
+	}
+
+	if len(msg.Contacts) > 0 {
+		// The response lists every binding of the address of record
+		return t.replace(at, req, msg)
+	}
+	return t.apply(at, req)
+}
+
+// apply adds, refreshes or removes the bindings of the request Contacts
+func (t *Tracker) apply(at time.Time, req *request) []Event {
+	var events []Event
+	bindings := t.aors[req.aor]
+
+	for i := range req.contacts {
+		c := &req.contacts[i]
+		if c.IsWildcard() {
+			for key, b := range bindings {
+				delete(bindings, key)
+				events = append(events, Event{EVENT_UNREGISTERED, *b})
+			}
+			continue
+		}
+		expires := t.expiry(c.Expires, req.expires, nil)
+		b := newBinding(req, c, at, expires)
+		events = t.set(req.aor, b, events)
+	}
+	t.cleanup(req.aor)
+	return events
+}
+
+// replace makes the bindings of the address of record those listed in
+// the response
+func (t *Tracker) replace(at time.Time, req *request, msg *siprocket.SipMsg) []Event {
+	var events []Event
+	listed := make(map[string]bool)
+
+	// Match the listed contacts to the request for Path and instance
+	requested := make(map[string]*siprocket.SipContact)
+	for i := range req.contacts {
+		requested[contactUri(&req.contacts[i])] = &req.contacts[i]
+	}
+
+	for i := range msg.Contacts {
+		c := &msg.Contacts[i]
+		if c.IsWildcard() {
+			continue
+		}
+		rc, fromReq := requested[contactUri(c)]
+		if !fromReq {
+			// Someone else's binding, only its expiry is news unless its
+			// REGISTER was missed
+			b := newBinding(req, c, at, t.expiry(c.Expires, msg.Exp.Value))
+			b.Path, b.UserAgent, b.CallId = nil, "", ""
+			if old, ok := t.aors[req.aor][b.key()]; ok && b.Expires.After(at) {
+				old.Expires = b.Expires
+				listed[b.key()] = true
+				continue
+			}
+			listed[b.key()] = true
+			events = t.set(req.aor, b, events)
+			continue
+		}
+
+		b := newBinding(req, c, at, t.expiry(c.Expires, msg.Exp.Value, rc.Expires, req.expires))
+		if b.Instance == "" {
+			b.Instance = strings.Trim(contactParam(rc.Src, "+sip.instance"), `"`)
+			b.RegId, _ = strconv.Atoi(contactParam(rc.Src, "reg-id"))
+		}
+		listed[b.key()] = true
+		events = t.set(req.aor, b, events)
+	}
+
+	for key, b := range t.aors[req.aor] {
+		if !listed[key] {
+			delete(t.aors[req.aor], key)
+			events = append(events, Event{EVENT_UNREGISTERED, *b})
+		}
+	}
+	t.cleanup(req.aor)
+	return events
+}
+
+// set stores a binding, one that expires now is removed
+func (t *Tracker) set(aor string, b Binding, events []Event) []Event {
+	bindings := t.aors[aor]
+	if bindings == nil {
+		bindings = make(map[string]*Binding)
+		t.aors[aor] = bindings
+	}
+	key := b.key()
+	old, exists := bindings[key]
+
+	if !b.Expires.After(b.Updated) {
+		if exists {
+			delete(bindings, key)
+			events = append(events, Event{EVENT_UNREGISTERED, *old})
+		}
+		return events
+	}
+	if exists {
+		b.Registered = old.Registered
+		bindings[key] = &b
+		return append(events, Event{EVENT_REFRESHED, b})
+	}
+	bindings[key] = &b
+	return append(events, Event{EVENT_REGISTERED, b})
+}
+
+func (t *Tracker) cleanup(aor string) {
+	if len(t.aors[aor]) == 0 {
+		delete(t.aors, aor)
+	}
+}
+
+// expiry picks the expiry in order of precedence, values that are not
+// numbers are skipped
+func (t *Tracker) expiry(values ...[]byte) time.Duration {
+	for _, v := range values {
+		if len(v) == 0 {
+			continue
+		}
+		if secs, err := strconv.ParseUint(string(bytes.TrimSpace(v)), 10, 32); err == nil {
+			return time.Duration(secs) * time.Second
+		}
+	}
+	return t.DefaultExpires
+}
+
+// Expire removes the bindings that have lapsed and counts the requests
+// that never got a final response as failed
+func (t *Tracker) Expire(now time.Time) []Event {
+	var events []Event
+
+	t.mu.Lock()
+	for aor, bindings := range t.aors {
+		for key, b := range bindings {
+			if !b.Expires.After(now) {
+				delete(bindings, key)
+				events = append(events, Event{EVENT_EXPIRED, *b})
+			}
+		}
+		t.cleanup(aor)
+	}
+	for key, req := range t.requests {
+		if now.Sub(req.at) > t.RequestTimeout {
+			stats := t.statsFor(req.ua)
+			stats.Requests++
+			stats.Failures++
+			delete(t.requests, key)
+		}
+	}
+	t.mu.Unlock()
+
+	t.emit(events)
+	return events
+}
+
+func (t *Tracker) emit(events []Event) {
+	if t.OnEvent == nil {
+		return
+	}
+	for _, e := range events {
+		t.OnEvent(e)
+	}
+}
+
+func (t *Tracker) statsFor(ua string) *UaStats {
+	s, ok := t.stats[ua]
+	if !ok {
+		s = &UaStats{UserAgent: ua}
+		t.stats[ua] = s
+	}
+	return s
+}
+
+// Bindings returns the bindings of an address of record ordered by
+// registration time
+func (t *Tracker) Bindings(aor string) []Binding {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	out := make([]Binding, 0, len(t.aors[aor]))
+	for _, b := range t.aors[aor] {
+		out = append(out, *b)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if !out[i].Registered.Equal(out[j].Registered) {
+			return out[i].Registered.Before(out[j].Registered)
+		}
+		return out[i].Contact < out[j].Contact
+	})
+	return out
+}
+
+// Registered returns the addresses of record that have at least one
+// binding that has not lapsed at the given time, sorted
+func (t *Tracker) Registered(now time.Time) []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var out []string
+	for aor, bindings := range t.aors {
+		for _, b := range bindings {
+			if b.Expires.After(now) {
+				out = append(out, aor)
+				break
+			}
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// Stats returns the REGISTER outcomes by User-Agent, sorted by name
+func (t *Tracker) Stats() []UaStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	out := make([]UaStats, 0, len(t.stats))
+	for _, s := range t.stats {
+		out = append(out, *s)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].UserAgent < out[j].UserAgent })
+	return out
+}
+
+func newBinding(req *request, c *siprocket.SipContact, at time.Time, expires time.Duration) Binding {
+	b := Binding{
+		Aor:        req.aor,
+		Contact:    contactUri(c),
+		Q:          string(c.Qval),
+		UserAgent:  req.ua,
+		CallId:     req.callId,
+		Path:       req.path,
+		Registered: at,
+		Updated:    at,
+		Expires:    at.Add(expires),
+	}
+	b.Instance = strings.Trim(contactParam(c.Src, "+sip.instance"), `"`)
+	b.RegId, _ = strconv.Atoi(contactParam(c.Src, "reg-id"))
+	return b
+}
+
+// key identifies a binding within its address of record
+func (b *Binding) key() string {
+	if b.Instance != "" {
+		return b.Instance + " " + strconv.Itoa(b.RegId)
+	}
+	return b.Contact
+}
+
+func aorOf(to *siprocket.SipTo) string {
+	if len(to.User) == 0 {
+		return strings.ToLower(string(to.Host))
+	}
+	return string(to.User) + "@" + strings.ToLower(string(to.Host))
+}
+
+// contactUri returns the URI of a contact without its header parameters
+func contactUri(c *siprocket.SipContact) string {
+	src := bytes.TrimSpace(c.Src)
+	if start := bytes.IndexByte(src, '<'); start > -1 {
+		if end := bytes.IndexByte(src, '>'); end > start {
+			return string(src[start+1 : end])
+		}
+	}
+	if idx := bytes.IndexByte(src, ';'); idx > -1 {
+		src = src[:idx]
+	}
+	return string(src)
+}
+
+// contactParam returns a header parameter of a contact, parameters inside
+// the <> belong to the URI and are not looked at
+func contactParam(src []byte, name string) string {
+	if start := bytes.IndexByte(src, '<'); start > -1 {
+		if end := bytes.IndexByte(src[start:], '>'); end > -1 {
+			src = src[start+end+1:]
+		}
+	}
+	for _, param := range bytes.Split(src, []byte(";")) {
+		param = bytes.TrimSpace(param)
+		pname, val, _ := bytes.Cut(param, []byte("="))
+		if strings.EqualFold(string(bytes.TrimSpace(pname)), name) {
+			return string(bytes.TrimSpace(val))
+		}
+	}
+	return ""
+}
+
+// cloneContacts copies the parts of the contacts used by the tracker so
+// they no longer point into the buffer of the request
+func cloneContacts(contacts []siprocket.SipContact) []siprocket.SipContact {
+	out := make([]siprocket.SipContact, len(contacts))
+	for i := range contacts {
+		out[i] = siprocket.SipContact{
+			Qval:    bytes.Clone(contacts[i].Qval),
+			Expires: bytes.Clone(contacts[i].Expires),
+			Src:     bytes.Clone(contacts[i].Src),
+		}
+	}
+	return out
+}
@@ -0,0 +1,138 @@
+package registrar
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/nullboundary/siprocket"
+)
+
+var testStart = time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+func process(tr *Tracker, at time.Duration, msg string) {
+	parsed := siprocket.Parse([]byte(msg))
+	tr.Process(testStart.Add(at), &parsed)
+}
+
+func register(callId, cseq, ua, extra string) string {
+	return "REGISTER sip:atlanta.com SIP/2.0\r\n" +
+		"From: <sip:alice@atlanta.com>;tag=456248\r\n" +
+		"To: <sip:alice@atlanta.com>\r\n" +
+		"Call-ID: " + callId + "\r\n" +
+		"CSeq: " + cseq + " REGISTER\r\n" +
+		"User-Agent: " + ua + "\r\n" +
+		extra + "\r\n"
+}
+
+func ok(callId, cseq, extra string) string {
+	return "SIP/2.0 200 OK\r\n" +
+		"From: <sip:alice@atlanta.com>;tag=456248\r\n" +
+		"To: <sip:alice@atlanta.com>;tag=2493k59kd\r\n" +
+		"Call-ID: " + callId + "\r\n" +
+		"CSeq: " + cseq + " REGISTER\r\n" +
+		extra + "\r\n"
+}
+
+func Test_registrarTracker_Bindings(t *testing.T) {
+
+	tr := NewTracker()
+	var events []string
+	tr.OnEvent = func(e Event) { events = append(events, e.Kind+" "+e.Binding.Contact) }
+
+	// The Contact expires parameter wins over the Expires header
+	process(tr, 0, register("reg-a", "1", "Phone A", "Contact: <sip:alice@192.0.2.4>;expires=300\r\n"+
+		"Expires: 600\r\nPath: <sip:edge.atlanta.com;lr>\r\n"))
+	process(tr, 0, ok("reg-a", "1", ""))
+
+	bindings := tr.Bindings("alice@atlanta.com")
+	exp := []Binding{{
+		Aor:        "alice@atlanta.com",
+		Contact:    "sip:alice@192.0.2.4",
+		Path:       []string{"sip:edge.atlanta.com;lr"},
+		UserAgent:  "Phone A",
+		CallId:     "reg-a",
+		Registered: testStart,
+		Updated:    testStart,
+		Expires:    testStart.Add(300 * time.Second),
+	}}
+	if !reflect.DeepEqual(bindings, exp) {
+		t.Fatalf("Mismatch:\nExpected:\n%+v\nGot:\n%+v", exp, bindings)
+	}
+
+	// A second device using outbound, the response lists both bindings
+	process(tr, 10*time.Second, register("reg-b", "1", "Phone B",
+		"Contact: <sip:alice@198.51.100.7:5062;transport=tcp>;reg-id=1;+sip.instance=\"<urn:uuid:0000-1>\"\r\n"))
+	process(tr, 10*time.Second, ok("reg-b", "1",
+		"Contact: <sip:alice@192.0.2.4>;expires=290, <sip:alice@198.51.100.7:5062;transport=tcp>;reg-id=1;+sip.instance=\"<urn:uuid:0000-1>\";expires=3600\r\n"))
+
+	bindings = tr.Bindings("alice@atlanta.com")
+	if len(bindings) != 2 || bindings[1].Instance != "<urn:uuid:0000-1>" || bindings[1].RegId != 1 ||
+		!bindings[1].Expires.Equal(testStart.Add(3610*time.Second)) || bindings[0].UserAgent != "Phone A" {
+		t.Fatalf("Mismatch: %+v", bindings)
+	}
+
+	// The same instance and reg-id from a new address is a refresh
+	process(tr, 20*time.Second, register("reg-b", "2", "Phone B",
+		"Contact: <sip:alice@198.51.100.9:5062;transport=tcp>;reg-id=1;+sip.instance=\"<urn:uuid:0000-1>\"\r\n"))
+	process(tr, 20*time.Second, ok("reg-b", "2", ""))
+	if bindings = tr.Bindings("alice@atlanta.com"); len(bindings) != 2 || bindings[1].Contact != "sip:alice@198.51.100.9:5062;transport=tcp" ||
+		!bindings[1].Registered.Equal(testStart.Add(10*time.Second)) {
+		t.Fatalf("Mismatch: %+v", bindings)
+	}
+
+	if reg := tr.Registered(testStart.Add(time.Minute)); !reflect.DeepEqual(reg, []string{"alice@atlanta.com"}) {
+		t.Errorf("Mismatch: %v", reg)
+	}
+
+	// The first binding lapses
+	if out := tr.Expire(testStart.Add(301 * time.Second)); len(out) != 1 || out[0].Kind != EVENT_EXPIRED {
+		t.Errorf("Mismatch: %+v", out)
+	}
+
+	// Remove everything
+	process(tr, 400*time.Second, register("reg-b", "3", "Phone B", "Contact: *\r\nExpires: 0\r\n"))
+	process(tr, 400*time.Second, ok("reg-b", "3", ""))
+	if len(tr.Bindings("alice@atlanta.com")) != 0 || len(tr.Registered(testStart)) != 0 {
+		t.Errorf("Bindings left after the wildcard")
+	}
+
+	expEvents := []string{
+		"registered sip:alice@192.0.2.4",
+		"registered sip:alice@198.51.100.7:5062;transport=tcp",
+		"refreshed sip:alice@198.51.100.9:5062;transport=tcp",
+		"expired sip:alice@192.0.2.4",
+		"unregistered sip:alice@198.51.100.9:5062;transport=tcp",
+	}
+	if !reflect.DeepEqual(events, expEvents) {
+		t.Errorf("Mismatch:\nExpected:\n%v\nGot:\n%v", expEvents, events)
+	}
+}
+
+func Test_registrarTracker_Failures(t *testing.T) {
+
+	tr := NewTracker()
+	contact := "Contact: <sip:alice@192.0.2.4>\r\n"
+
+	process(tr, 0, register("r1", "1", "Bad/1.0", contact))
+	process(tr, 0, "SIP/2.0 401 Unauthorized\r\nCall-ID: r1\r\nCSeq: 1 REGISTER\r\n\r\n")
+	process(tr, 0, register("r1", "2", "Bad/1.0", contact))
+	process(tr, 0, "SIP/2.0 403 Forbidden\r\nCall-ID: r1\r\nCSeq: 2 REGISTER\r\n\r\n")
+	process(tr, 0, register("r2", "1", "Good/2.0", contact))
+	process(tr, 0, ok("r2", "1", ""))
+	process(tr, 0, register("r2", "2", "Good/2.0", contact))
+
+	tr.Expire(testStart.Add(time.Minute))
+
+	exp := []UaStats{
+		{UserAgent: "Bad/1.0", Requests: 2, Challenges: 1, Failures: 1},
+		{UserAgent: "Good/2.0", Requests: 2, Success: 1, Failures: 1},
+	}
+	stats := tr.Stats()
+	if !reflect.DeepEqual(stats, exp) {
+		t.Fatalf("Mismatch:\nExpected:\n%+v\nGot:\n%+v", exp, stats)
+	}
+	if stats[0].FailureRate() != 1 || stats[1].FailureRate() != 0.5 {
+		t.Errorf("Mismatch: %v %v", stats[0].FailureRate(), stats[1].FailureRate())
+	}
+}
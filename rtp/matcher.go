@@ -0,0 +1,291 @@
+package rtp
+
+/*
+ RFC 3264 - https://datatracker.ietf.org/doc/html/rfc3264#section-5.1
+
+ The media stream is sent to the connection address and port given in
+ the SDP of the receiving side, RTCP uses the next higher port unless
+ an a=rtcp attribute (RFC 3605) or a=rtcp-mux (RFC 5761) says otherwise.
+
+ a=rtpmap:<payload type> <encoding name>/<clock rate> [/<encoding parameters>]
+
+*/
+
+import (
+	"bytes"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/nullboundary/siprocket"
+)
+
+// Codec is a payload type mapping from a=rtpmap or the RFC 3551 static table
+type Codec struct {
+	PayloadType uint8  // Payload type
+	Name        string // Encoding name eg PCMU
+	ClockRate   int    // RTP clock rate in Hz
+	Channels    int    // Number of channels
+}
+
+// Static payload types from RFC 3551 section 6
+var staticCodecs = map[uint8]Codec{
+	0:  {0, "PCMU", 8000, 1},
+	3:  {3, "GSM", 8000, 1},
+	4:  {4, "G723", 8000, 1},
+	5:  {5, "DVI4", 8000, 1},
+	6:  {6, "DVI4", 16000, 1},
+	7:  {7, "LPC", 8000, 1},
+	8:  {8, "PCMA", 8000, 1},
+	9:  {9, "G722", 8000, 1},
+	10: {10, "L16", 44100, 2},
+	11: {11, "L16", 44100, 1},
+	12: {12, "QCELP", 8000, 1},
+	13: {13, "CN", 8000, 1},
+	14: {14, "MPA", 90000, 1},
+	15: {15, "G728", 8000, 1},
+	16: {16, "DVI4", 11025, 1},
+	17: {17, "DVI4", 22050, 1},
+	18: {18, "G729", 8000, 1},
+	25: {25, "CelB", 90000, 0},
+	26: {26, "JPEG", 90000, 0},
+	28: {28, "nv", 90000, 0},
+	31: {31, "H261", 90000, 0},
+	32: {32, "MPV", 90000, 0},
+	33: {33, "MP2T", 90000, 0},
+	34: {34, "H263", 90000, 0},
+}
+
+// Codecs returns the payload types offered in a media section, using the
+// a=rtpmap attributes and falling back to the static payload types
+func Codecs(media *siprocket.SdpMedia) map[uint8]Codec {
+	codecs := make(map[uint8]Codec)
+
+	for _, f := range strings.Fields(string(media.MediaDesc.Fmt)) {
+		pt, err := strconv.ParseUint(f, 10, 7)
+		if err != nil {
+			continue
+		}
+		if codec, ok := staticCodecs[uint8(pt)]; ok {
+			codecs[uint8(pt)] = codec
+		}
+	}
+
+	for _, attr := range media.Attrib {
+		if !bytes.EqualFold(attr.Cat, []byte("rtpmap")) {
+			continue
+		}
+		if codec, ok := parseRtpmap(attr.Val); ok {
+			codecs[codec.PayloadType] = codec
+		}
+	}
+
+	return codecs
+}
+
+// parseRtpmap parses the value of an a=rtpmap attribute
+func parseRtpmap(v []byte) (Codec, bool) {
+	var codec Codec
+
+	fields := strings.Fields(string(v))
+	if len(fields) != 2 {
+		return codec, false
+	}
+	pt, err := strconv.ParseUint(fields[0], 10, 7)
+	if err != nil {
+		return codec, false
+	}
+	codec.PayloadType = uint8(pt)
+
+	parts := strings.Split(fields[1], "/")
+	codec.Name = parts[0]
+	if len(parts) > 1 {
+		codec.ClockRate, _ = strconv.Atoi(parts[1])
+	}
+	codec.Channels = 1
+	if len(parts) > 2 {
+		codec.Channels, _ = strconv.Atoi(parts[2])
+	}
+
+	return codec, true
+}
+
+// Stream is a media stream negotiated for a call
+type Stream struct {
+	CallId    string          // Call-ID of the dialog
+	Media     int             // Position of the m= line
+	MediaType string          // audio, video etc
+	Addr      netip.AddrPort  // Address RTP is sent to
+	RtcpAddr  netip.AddrPort  // Address RTCP is sent to
+	Codecs    map[uint8]Codec // Payload types by number
+}
+
+// Matcher maps packets to the streams negotiated in SDP. It is safe for
+// concurrent use.
+type Matcher struct {
+	mu      sync.RWMutex
+	streams map[netip.AddrPort]Stream
+	calls   map[string]map[string][]netip.AddrPort // Addresses by Call-ID and SDP origin
+}
+
+func NewMatcher() *Matcher {
+	return &Matcher{
+		streams: make(map[netip.AddrPort]Stream),
+		calls:   make(map[string]map[string][]netip.AddrPort),
+	}
+}
+
+// AddSdp registers the receiving addresses of every active stream in the
+// session description. Both the offer and the answer of a call should be
+// added. A later description from the same origin, such as a re-INVITE,
+// replaces the earlier one and the addresses it no longer lists are
+// forgotten.
+func (m *Matcher) AddSdp(callId []byte, sdp *siprocket.SdpMsg) {
+	id := string(callId)
+	media := sdp.Media
+	if len(media) == 0 && sdp.MediaDesc.MediaType != nil {
+		media = []siprocket.SdpMedia{{MediaDesc: sdp.MediaDesc, ConnData: sdp.ConnData, Attrib: sdp.Attrib}}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	origins := m.calls[id]
+	if origins == nil {
+		origins = make(map[string][]netip.AddrPort)
+		m.calls[id] = origins
+	}
+	origin := sdpOriginKey(&sdp.Origin)
+	old := origins[origin]
+
+	// Without an o= line the sender is unknown, so nothing is replaced
+	var addrs []netip.AddrPort
+	if origin == "" {
+		addrs, old = old, nil
+	}
+	for _, s := range sdp.Streams() {
+		if s.Rejected || s.LegacyHold || s.Index >= len(media) {
+			continue
+		}
+		addr, err := netip.ParseAddr(strings.Split(s.ConnAddr, "/")[0])
+		if err != nil {
+			continue
+		}
+		stream := Stream{
+			CallId:    id,
+			Media:     s.Index,
+			MediaType: s.MediaType,
+			Addr:      netip.AddrPortFrom(addr, uint16(s.Port)),
+			RtcpAddr:  rtcpAddr(addr, s.Port, media[s.Index].Attrib),
+			Codecs:    Codecs(&media[s.Index]),
+		}
+
+		m.streams[stream.Addr] = stream
+		addrs = appendAddr(addrs, stream.Addr)
+		if stream.RtcpAddr != stream.Addr {
+			m.streams[stream.RtcpAddr] = stream
+			addrs = appendAddr(addrs, stream.RtcpAddr)
+		}
+	}
+	origins[origin] = addrs
+
+	// Forget what the earlier description had that this one dropped
+	for _, addr := range old {
+		if !m.listed(id, addr) && m.streams[addr].CallId == id {
+			delete(m.streams, addr)
+		}
+	}
+}
+
+// sdpOriginKey identifies the sender of a session description, every
+// field of o= but the version stays the same for the life of a session.
+// It is empty when there is no o= line.
+func sdpOriginKey(o *siprocket.SdpOrigin) string {
+	if len(o.Src) == 0 && len(o.UnicastAddr) == 0 {
+		return ""
+	}
+	return string(o.Username) + " " + string(o.SessId) + " " + string(o.NetType) + " " +
+		string(o.AddrType) + " " + string(o.UnicastAddr)
+}
+
+// appendAddr appends the address unless addrs already has it
+func appendAddr(addrs []netip.AddrPort, addr netip.AddrPort) []netip.AddrPort {
+	for _, a := range addrs {
+		if a == addr {
+			return addrs
+		}
+	}
+	return append(addrs, addr)
+}
+
+// listed tells if any description of the call has the address
+func (m *Matcher) listed(id string, addr netip.AddrPort) bool {
+	for _, addrs := range m.calls[id] {
+		for _, a := range addrs {
+			if a == addr {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// rtcpAddr works out where RTCP for a stream is sent
+func rtcpAddr(addr netip.Addr, port int, attribs []siprocket.SdpAttrib) netip.AddrPort {
+	rtcp := netip.AddrPortFrom(addr, uint16(port+1))
+	for _, attr := range attribs {
+		switch strings.ToLower(string(attr.Cat)) {
+		case "rtcp-mux":
+			return netip.AddrPortFrom(addr, uint16(port))
+		case "rtcp":
+			// a=rtcp:<port> [<nettype> <addrtype> <connection-address>]
+			fields := strings.Fields(string(attr.Val))
+			if len(fields) == 0 {
+				continue
+			}
+			p, err := strconv.ParseUint(fields[0], 10, 16)
+			if err != nil {
+				continue
+			}
+			a := addr
+			if len(fields) == 4 {
+				if parsed, err := netip.ParseAddr(fields[3]); err == nil {
+					a = parsed
+				}
+			}
+			rtcp = netip.AddrPortFrom(a, uint16(p))
+		}
+	}
+	return rtcp
+}
+
+// Remove forgets every stream of the call
+func (m *Matcher) Remove(callId []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	id := string(callId)
+	for _, addrs := range m.calls[id] {
+		for _, addr := range addrs {
+			if m.streams[addr].CallId == id {
+				delete(m.streams, addr)
+			}
+		}
+	}
+	delete(m.calls, id)
+}
+
+// Match finds the stream a packet belongs to by its destination address,
+// or failing that its source address as symmetric RTP sends from the
+// port it receives on
+func (m *Matcher) Match(t siprocket.FiveTuple) (Stream, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if s, ok := m.streams[t.Dst]; ok {
+		return s, true
+	}
+	s, ok := m.streams[t.Src]
+	return s, ok
+}
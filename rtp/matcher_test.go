@@ -0,0 +1,109 @@
+package rtp
+
+import (
+	"testing"
+
+	"github.com/nullboundary/siprocket"
+)
+
+func Test_rtpMatcher_Match(t *testing.T) {
+
+	offer := siprocket.Parse([]byte("INVITE sip:bob@10.0.0.1 SIP/2.0\r\n" +
+		"Call-ID: call-1\r\n" +
+		"Content-Type: application/sdp\r\n" +
+		"\r\n" +
+		"v=0\r\n" +
+		"c=IN IP4 10.0.0.2\r\n" +
+		"m=audio 4000 RTP/AVP 0 101\r\n" +
+		"a=rtpmap:101 telephone-event/8000\r\n" +
+		"m=video 5000 RTP/AVP 96\r\n" +
+		"a=rtpmap:96 H264/90000\r\n" +
+		"a=rtcp:5005 IN IP4 10.0.0.5\r\n"))
+	answer := siprocket.Parse([]byte("SIP/2.0 200 OK\r\n" +
+		"Call-ID: call-1\r\n" +
+		"\r\n" +
+		"v=0\r\n" +
+		"c=IN IP4 10.0.0.1\r\n" +
+		"m=audio 6000 RTP/AVP 0 101\r\n" +
+		"a=rtcp-mux\r\n" +
+		"m=video 0 RTP/AVP 96\r\n"))
+
+	m := NewMatcher()
+	m.AddSdp(offer.CallId.Value, &offer.Sdp)
+	m.AddSdp(answer.CallId.Value, &answer.Sdp)
+
+	s, ok := m.Match(siprocket.NewFiveTuple("udp", "10.0.0.1:6000", "10.0.0.2:4000"))
+	if !ok || s.CallId != "call-1" || s.Media != 0 || s.MediaType != "audio" {
+		t.Fatalf("Mismatch: %+v %v", s, ok)
+	}
+	if s.Codecs[0].Name != "PCMU" || s.Codecs[101].Name != "telephone-event" || s.Codecs[101].ClockRate != 8000 {
+		t.Errorf("Mismatch: codecs %+v", s.Codecs)
+	}
+	if s.RtcpAddr.String() != "10.0.0.2:4001" {
+		t.Errorf("Mismatch: rtcp %s", s.RtcpAddr)
+	}
+
+	s, ok = m.Match(siprocket.NewFiveTuple("udp", "10.0.0.9:1234", "10.0.0.5:5005"))
+	if !ok || s.Media != 1 || s.Codecs[96].ClockRate != 90000 {
+		t.Errorf("Mismatch: %+v %v", s, ok)
+	}
+
+	// The answer muxes RTCP, packets from its port match by source
+	s, ok = m.Match(siprocket.NewFiveTuple("udp", "10.0.0.1:6000", "10.0.0.9:4001"))
+	if !ok || s.Addr.String() != "10.0.0.1:6000" || s.RtcpAddr != s.Addr {
+		t.Errorf("Mismatch: %+v %v", s, ok)
+	}
+
+	m.Remove([]byte("call-1"))
+	if _, ok := m.Match(siprocket.NewFiveTuple("udp", "10.0.0.1:6000", "10.0.0.2:4000")); ok {
+		t.Errorf("streams should be removed with the call")
+	}
+}
+
+func Test_rtpMatcher_Reinvite(t *testing.T) {
+
+	sdp := func(port string) siprocket.SdpMsg {
+		sdp, err := siprocket.ParseSdp([]byte("v=0\r\n" +
+			"o=alice 2890844526 2890844526 IN IP4 10.0.0.2\r\n" +
+			"s=-\r\n" +
+			"c=IN IP4 10.0.0.2\r\n" +
+			"t=0 0\r\n" +
+			"m=audio " + port + " RTP/AVP 0\r\n"))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return sdp
+	}
+	answer, err := siprocket.ParseSdp([]byte("v=0\r\n" +
+		"o=bob 2808844564 2808844564 IN IP4 10.0.0.1\r\n" +
+		"s=-\r\n" +
+		"c=IN IP4 10.0.0.1\r\n" +
+		"t=0 0\r\n" +
+		"m=audio 6000 RTP/AVP 0\r\n"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	m := NewMatcher()
+	offer := sdp("4000")
+	m.AddSdp([]byte("call-1"), &offer)
+	m.AddSdp([]byte("call-1"), &answer)
+	m.AddSdp([]byte("call-1"), &offer)
+
+	// The re-INVITE moves the offerer to a new port
+	reinvite := sdp("4100")
+	m.AddSdp([]byte("call-1"), &reinvite)
+
+	if _, ok := m.Match(siprocket.NewFiveTuple("udp", "10.0.0.9:1234", "10.0.0.2:4000")); ok {
+		t.Errorf("the old port should be forgotten")
+	}
+	if _, ok := m.Match(siprocket.NewFiveTuple("udp", "10.0.0.9:1234", "10.0.0.2:4100")); !ok {
+		t.Errorf("the new port should match")
+	}
+	if _, ok := m.Match(siprocket.NewFiveTuple("udp", "10.0.0.9:1234", "10.0.0.1:6000")); !ok {
+		t.Errorf("the answer should still match")
+	}
+	if n := len(m.calls["call-1"]["alice 2890844526 IN IP4 10.0.0.2"]); n != 2 {
+		t.Errorf("expected 2 addresses for the offer, got %d", n)
+	}
+}
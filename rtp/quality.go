@@ -0,0 +1,287 @@
+package rtp
+
+/*
+ RFC 3550 - https://datatracker.ietf.org/doc/html/rfc3550#appendix-A.8
+
+ A.8 Estimating the Interarrival Jitter
+
+   int transit = arrival - r->ts;
+   int d = transit - s->transit;
+   s->transit = transit;
+   if (d < 0) d = -d;
+   s->jitter += (1./16.) * ((double)d - s->jitter);
+
+ ITU-T G.107 - The E-model
+
+ The simplified E-model used by most monitoring tools takes the default
+ R of 93.2 and removes the delay impairment Id and the effective
+ equipment impairment Ie-eff, which depends on the codec and packet loss:
+
+   Ie-eff = Ie + (95 - Ie) * Ppl / (Ppl + Bpl)
+
+*/
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	maxDropout  = 3000
+	maxMisorder = 100
+	seqWindow   = 1024
+)
+
+// Equipment impairment Ie and packet loss robustness Bpl of a codec, from
+// ITU-T G.113 Appendix I where listed
+type codecImpairment struct {
+	Ie  float64
+	Bpl float64
+}
+
+var codecImpairments = map[string]codecImpairment{
+	"PCMU": {0, 25.1},
+	"PCMA": {0, 25.1},
+	"G722": {0, 25.1},
+	"G729": {11, 19},
+	"G723": {15, 16.1},
+	"GSM":  {20, 10},
+	"ILBC": {11, 32},
+	"OPUS": {0, 20},
+}
+
+var defaultImpairment = codecImpairment{0, 10}
+
+// StreamStats are the reception statistics of one SSRC
+type StreamStats struct {
+	SSRC        uint32        // Synchronization source
+	PayloadType uint8         // Payload type of the last media packet
+	Codec       Codec         // Codec of the last media packet
+	Packets     int64         // Packets received including duplicates
+	Expected    int64         // Packets expected from the sequence numbers
+	Lost        int64         // Expected minus unique packets received
+	Duplicates  int64         // Packets received more than once
+	OutOfOrder  int64         // Packets received after a later one
+	Jitter      float64       // Interarrival jitter in ms
+	MaxJitter   float64       // Highest interarrival jitter in ms
+	MaxDelta    time.Duration // Longest gap between two arrivals
+	First       time.Time     // Arrival of the first packet
+	Last        time.Time     // Arrival of the last packet
+	RFactor     float64       // E-model R factor
+	Mos         float64       // Estimated MOS from the R factor
+}
+
+// LossPercent returns the share of expected packets that were lost
+func (s *StreamStats) LossPercent() float64 {
+	if s.Expected <= 0 || s.Lost <= 0 {
+		return 0
+	}
+	return float64(s.Lost) * 100 / float64(s.Expected)
+}
+
+type ssrcState struct {
+	stats     StreamStats
+	started   bool
+	baseSeq   uint64
+	maxSeq    uint64
+	expected  int64 // Packets expected before the last restart
+	seen      [seqWindow]uint64
+	measured  bool
+	transit   float64
+	jitter    float64
+	clockRate int
+}
+
+// Analyser computes the quality of the RTP streams of one media section,
+// one set of statistics per SSRC. It is safe for concurrent use.
+type Analyser struct {
+	mu     sync.Mutex
+	codecs map[uint8]Codec
+	ssrcs  map[uint32]*ssrcState
+
+	// Delay is the one way network delay used by the E-model. When zero
+	// it is estimated from the jitter as twice the jitter plus 10ms.
+	Delay time.Duration
+}
+
+// NewAnalyser returns an analyser using the payload types negotiated in
+// SDP, see Codecs and Stream.Codecs
+func NewAnalyser(codecs map[uint8]Codec) *Analyser {
+	return &Analyser{
+		codecs: codecs,
+		ssrcs:  make(map[uint32]*ssrcState),
+	}
+}
+
+// Add accounts for a packet that arrived at the given time
+func (a *Analyser) Add(at time.Time, p *Packet) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	st, ok := a.ssrcs[p.SSRC]
+	if !ok {
+		st = &ssrcState{stats: StreamStats{SSRC: p.SSRC, First: at}}
+		a.ssrcs[p.SSRC] = st
+	}
+	s := &st.stats
+
+	s.Packets++
+	if !s.Last.IsZero() {
+		if delta := at.Sub(s.Last); delta > s.MaxDelta {
+			s.MaxDelta = delta
+		}
+	}
+	s.Last = at
+
+	// Extend the sequence number to 64 bits using the highest one seen
+	seq := uint64(p.Sequence)
+	if !st.started {
+		st.started = true
+		st.baseSeq = seq
+		st.maxSeq = seq
+	} else {
+		seq = extendSeq(st.maxSeq, p.Sequence)
+		switch {
+		case seq > st.maxSeq && seq-st.maxSeq < maxDropout:
+			st.maxSeq = seq
+		case seq == st.maxSeq || st.seen[seq%seqWindow] == seq+1:
+			s.Duplicates++
+			return
+		case seq < st.maxSeq && st.maxSeq-seq <= maxMisorder:
+			s.OutOfOrder++
+			if seq < st.baseSeq {
+				st.baseSeq = seq
+			}
+		default:
+			// A large jump, the source restarted so begin again from here
+			st.expected += int64(st.maxSeq-st.baseSeq) + 1
+			st.baseSeq = seq
+			st.maxSeq = seq
+		}
+	}
+	st.seen[seq%seqWindow] = seq + 1
+
+	// Media packets decide the codec and clock rate
+	codec, known := a.codecs[p.PayloadType]
+	if !known {
+		codec = staticCodecs[p.PayloadType]
+	}
+	if isEventCodec(codec.Name) {
+		// Events repeat one timestamp across retransmits and comfort noise
+		// is sent sparsely, neither says anything about jitter
+		return
+	}
+	s.PayloadType = p.PayloadType
+	s.Codec = codec
+	clockRate := codec.ClockRate
+	if clockRate == 0 {
+		clockRate = 8000
+	}
+	if clockRate != st.clockRate {
+		// Transit times are not comparable across clock rates
+		st.clockRate = clockRate
+		st.measured = false
+	}
+
+	arrival := float64(at.UnixNano()) * float64(clockRate) / 1e9
+	transit := arrival - float64(p.Timestamp)
+	if st.measured {
+		d := math.Abs(transit - st.transit)
+		st.jitter += (d - st.jitter) / 16
+		s.Jitter = st.jitter * 1000 / float64(clockRate)
+		if s.Jitter > s.MaxJitter {
+			s.MaxJitter = s.Jitter
+		}
+	}
+	st.transit = transit
+	st.measured = true
+}
+
+// extendSeq picks the 64 bit sequence number closest to the highest seen
+func extendSeq(highest uint64, seq uint16) uint64 {
+	ext := highest&^0xffff | uint64(seq)
+	switch {
+	case ext+0x8000 < highest:
+		ext += 0x10000
+	case ext > highest+0x8000 && ext >= 0x10000:
+		ext -= 0x10000
+	}
+	return ext
+}
+
+func isEventCodec(name string) bool {
+	return strings.EqualFold(name, "telephone-event") || strings.EqualFold(name, "CN")
+}
+
+// StatsFor returns the statistics of a single SSRC
+func (a *Analyser) StatsFor(ssrc uint32) (StreamStats, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	st, ok := a.ssrcs[ssrc]
+	if !ok {
+		return StreamStats{}, false
+	}
+	return a.stats(st), true
+}
+
+// Stats returns the statistics of every SSRC ordered by first arrival
+func (a *Analyser) Stats() []StreamStats {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	out := make([]StreamStats, 0, len(a.ssrcs))
+	for _, st := range a.ssrcs {
+		out = append(out, a.stats(st))
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].First.Before(out[j].First) })
+	return out
+}
+
+func (a *Analyser) stats(st *ssrcState) StreamStats {
+	s := st.stats
+	s.Expected = st.expected + int64(st.maxSeq-st.baseSeq) + 1
+	s.Lost = max(s.Expected-(s.Packets-s.Duplicates), 0)
+
+	delay := a.Delay
+	if delay == 0 {
+		delay = time.Duration((2*s.Jitter + 10) * float64(time.Millisecond))
+	}
+	s.RFactor = RFactor(s.Codec.Name, s.LossPercent(), delay)
+	s.Mos = Mos(s.RFactor)
+	return s
+}
+
+// RFactor estimates the E-model R factor for a codec given the packet loss
+// in percent and the one way delay
+func RFactor(codec string, loss float64, delay time.Duration) float64 {
+	imp, ok := codecImpairments[strings.ToUpper(codec)]
+	if !ok {
+		imp = defaultImpairment
+	}
+
+	// Delay impairment, Cole and Rosenbluth approximation of G.107
+	d := float64(delay) / float64(time.Millisecond)
+	id := 0.024 * d
+	if d > 177.3 {
+		id += 0.11 * (d - 177.3)
+	}
+
+	ie := imp.Ie + (95-imp.Ie)*loss/(loss+imp.Bpl)
+
+	return 93.2 - id - ie
+}
+
+// Mos converts an R factor to a mean opinion score as in G.107 Annex B
+func Mos(r float64) float64 {
+	switch {
+	case r <= 0:
+		return 1
+	case r >= 100:
+		return 4.5
+	}
+	return 1 + 0.035*r + 7e-6*r*(r-60)*(100-r)
+}
@@ -0,0 +1,130 @@
+package rtp
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func Test_rtpAnalyser_Sequence(t *testing.T) {
+
+	a := NewAnalyser(map[uint8]Codec{8: {8, "PCMA", 8000, 1}, 101: {101, "telephone-event", 8000, 1}})
+	start := time.Unix(1700000000, 0)
+
+	// 65534 and 65535 then a wrap, 2 is lost, 4 arrives late and twice
+	seqs := []uint16{65534, 65535, 0, 1, 3, 5, 4, 4, 6}
+	for i, seq := range seqs {
+		p := Packet{Header: Header{PayloadType: 8, Sequence: seq, Timestamp: uint32(i) * 160, SSRC: 7}}
+		a.Add(start.Add(time.Duration(i)*20*time.Millisecond), &p)
+	}
+	// A DTMF packet does not change the codec
+	dtmf := Packet{Header: Header{PayloadType: 101, Sequence: 7, Timestamp: 9 * 160, SSRC: 7}}
+	a.Add(start.Add(180*time.Millisecond), &dtmf)
+
+	s, ok := a.StatsFor(7)
+	if !ok {
+		t.Fatalf("no statistics for SSRC 7")
+	}
+	if s.Packets != 10 || s.Expected != 10 || s.Lost != 1 || s.Duplicates != 1 || s.OutOfOrder != 1 {
+		t.Errorf("Mismatch: packets %d expected %d lost %d duplicates %d out of order %d",
+			s.Packets, s.Expected, s.Lost, s.Duplicates, s.OutOfOrder)
+	}
+	if s.Codec.Name != "PCMA" || s.PayloadType != 8 {
+		t.Errorf("Mismatch: codec %+v", s.Codec)
+	}
+	if s.MaxDelta != 20*time.Millisecond {
+		t.Errorf("Mismatch: max delta %s", s.MaxDelta)
+	}
+	if math.Abs(s.LossPercent()-10) > 1e-9 {
+		t.Errorf("Mismatch: loss %f", s.LossPercent())
+	}
+}
+
+func Test_rtpAnalyser_Restart(t *testing.T) {
+
+	a := NewAnalyser(nil)
+	start := time.Unix(1700000000, 0)
+
+	// The source restarts far away after 3 packets, 40002 is lost
+	seqs := []uint16{1, 2, 3, 40000, 40001, 40003}
+	for i, seq := range seqs {
+		p := Packet{Header: Header{PayloadType: 0, Sequence: seq, Timestamp: uint32(i) * 160, SSRC: 3}}
+		a.Add(start.Add(time.Duration(i)*20*time.Millisecond), &p)
+	}
+
+	s, _ := a.StatsFor(3)
+	if s.Packets != 6 || s.Expected != 7 || s.Lost != 1 {
+		t.Errorf("Mismatch: packets %d expected %d lost %d", s.Packets, s.Expected, s.Lost)
+	}
+}
+
+func Test_rtpAnalyser_Jitter(t *testing.T) {
+
+	a := NewAnalyser(nil)
+	start := time.Unix(1700000000, 0)
+
+	// Every other packet arrives 10ms late, each difference is 80 units
+	for i := 0; i < 2000; i++ {
+		at := start.Add(time.Duration(i) * 20 * time.Millisecond)
+		if i%2 == 1 {
+			at = at.Add(10 * time.Millisecond)
+		}
+		p := Packet{Header: Header{PayloadType: 0, Sequence: uint16(i), Timestamp: uint32(i) * 160, SSRC: 1}}
+		a.Add(at, &p)
+	}
+
+	stats := a.Stats()
+	if len(stats) != 1 {
+		t.Fatalf("expected one stream, got %d", len(stats))
+	}
+	s := stats[0]
+	if math.Abs(s.Jitter-10) > 0.01 {
+		t.Errorf("Mismatch: jitter %fms", s.Jitter)
+	}
+	if s.Lost != 0 || s.Codec.Name != "PCMU" || s.Codec.ClockRate != 8000 {
+		t.Errorf("Mismatch: lost %d codec %+v", s.Lost, s.Codec)
+	}
+	// 30ms of delay and no loss on G.711
+	if math.Abs(s.RFactor-92.48) > 0.01 || math.Abs(s.Mos-4.40) > 0.01 {
+		t.Errorf("Mismatch: R %f MOS %f", s.RFactor, s.Mos)
+	}
+}
+
+func Test_rtpAnalyser_JitterDtmf(t *testing.T) {
+
+	a := NewAnalyser(map[uint8]Codec{101: {101, "telephone-event", 8000, 1}})
+	start := time.Unix(1700000000, 0)
+
+	// Media every 20ms with a digit sent in place of packets 50 to 59, the
+	// event packets all carry the timestamp of the start of the digit
+	for i := 0; i < 100; i++ {
+		p := Packet{Header: Header{PayloadType: 0, Sequence: uint16(i), Timestamp: uint32(i) * 160, SSRC: 1}}
+		if i >= 50 && i < 60 {
+			p.PayloadType = 101
+			p.Timestamp = 50 * 160
+		}
+		a.Add(start.Add(time.Duration(i)*20*time.Millisecond), &p)
+	}
+
+	s, _ := a.StatsFor(1)
+	if s.Jitter > 0.001 || s.MaxJitter > 0.001 {
+		t.Errorf("Mismatch: jitter %f max %f", s.Jitter, s.MaxJitter)
+	}
+	if s.Codec.Name != "PCMU" || s.Packets != 100 {
+		t.Errorf("Mismatch: codec %+v packets %d", s.Codec, s.Packets)
+	}
+}
+
+func Test_rtpAnalyser_EModel(t *testing.T) {
+
+	// G.729 is worse than G.711 at the same loss
+	if RFactor("G729", 2, 50*time.Millisecond) >= RFactor("PCMU", 2, 50*time.Millisecond) {
+		t.Errorf("G.729 should score lower than G.711")
+	}
+	if Mos(-5) != 1 || Mos(120) != 4.5 {
+		t.Errorf("MOS should be clamped")
+	}
+	if r := RFactor("PCMA", 0, 400*time.Millisecond); r > 70 {
+		t.Errorf("long delay should impair the R factor, got %f", r)
+	}
+}
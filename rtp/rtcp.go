@@ -0,0 +1,377 @@
+package rtp
+
+/*
+ RFC 3550 - https://datatracker.ietf.org/doc/html/rfc3550#section-6.4
+
+ 6.4 Sender and Receiver Reports
+
+        0                   1                   2                   3
+        0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1
+       +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+header |V=2|P|    RC   |   PT=SR=200   |             length            |
+       +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+
+ Multiple RTCP packets can be concatenated without any intervening
+ separators to form a compound RTCP packet that is sent in a single
+ packet of the lower layer protocol.
+
+ RFC 3611 - https://datatracker.ietf.org/doc/html/rfc3611#section-4.7
+
+ 4.7 VoIP Metrics Report Block (BT=7)
+
+*/
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+const (
+	RTCP_SR   = 200
+	RTCP_RR   = 201
+	RTCP_SDES = 202
+	RTCP_BYE  = 203
+	RTCP_APP  = 204
+	RTCP_XR   = 207
+)
+
+const (
+	SDES_END   = 0
+	SDES_CNAME = 1
+	SDES_NAME  = 2
+	SDES_EMAIL = 3
+	SDES_PHONE = 4
+	SDES_LOC   = 5
+	SDES_TOOL  = 6
+	SDES_NOTE  = 7
+	SDES_PRIV  = 8
+)
+
+const XR_VOIP_METRICS = 7
+
+// RtcpPacket is one packet of a compound RTCP packet, only the field
+// matching Type is set
+type RtcpPacket struct {
+	Version uint8  // Always 2
+	Padding bool   // Padding bytes follow
+	Count   uint8  // Report count, source count or subtype
+	Type    uint8  // Packet type eg RTCP_SR
+	Length  uint16 // Length in 32 bit words minus one
+	Raw     []byte // Full packet including the header
+
+	SenderReport   *SenderReport
+	ReceiverReport *ReceiverReport
+	Sdes           []SdesChunk
+	Bye            *Bye
+	App            *App
+	Xr             *Xr
+}
+
+type SenderReport struct {
+	SSRC        uint32        // Sender
+	NtpTime     uint64        // NTP timestamp, 32.32 fixed point
+	RtpTime     uint32        // RTP timestamp matching NtpTime
+	PacketCount uint32        // Packets sent
+	OctetCount  uint32        // Payload octets sent
+	Reports     []ReportBlock // Reception reports
+}
+
+type ReceiverReport struct {
+	SSRC    uint32        // Sender of this report
+	Reports []ReportBlock // Reception reports
+}
+
+type ReportBlock struct {
+	SSRC         uint32 // Source this block reports on
+	FractionLost uint8  // Fraction lost since the last report, over 256
+	TotalLost    int32  // Cumulative number of packets lost
+	HighestSeq   uint32 // Extended highest sequence number received
+	Jitter       uint32 // Interarrival jitter in timestamp units
+	LastSR       uint32 // Middle 32 bits of the last SR NTP timestamp
+	DelaySinceSR uint32 // Delay since the last SR in 1/65536 seconds
+}
+
+type SdesChunk struct {
+	SSRC  uint32     // Source the items describe
+	Items []SdesItem // Items, eg SDES_CNAME
+}
+
+type SdesItem struct {
+	Type uint8  // Item type eg SDES_CNAME
+	Text []byte // Item text
+}
+
+type Bye struct {
+	Sources []uint32 // Sources leaving
+	Reason  []byte   // Optional reason
+}
+
+type App struct {
+	SSRC uint32 // Source
+	Name string // Four ASCII characters
+	Data []byte // Application dependent data
+}
+
+type Xr struct {
+	SSRC   uint32    // Sender of the report
+	Blocks []XrBlock // Report blocks
+}
+
+type XrBlock struct {
+	Type         uint8        // Block type eg XR_VOIP_METRICS
+	TypeSpecific uint8        // Type specific byte of the block header
+	Data         []byte       // Block contents after the header
+	VoipMetrics  *VoipMetrics // Set for XR_VOIP_METRICS blocks
+}
+
+type VoipMetrics struct {
+	SSRC           uint32 // Source the metrics describe
+	LossRate       uint8  // Fraction lost, over 256
+	DiscardRate    uint8  // Fraction discarded, over 256
+	BurstDensity   uint8  // Fraction lost or discarded within bursts, over 256
+	GapDensity     uint8  // Fraction lost or discarded within gaps, over 256
+	BurstDuration  uint16 // Mean burst duration in ms
+	GapDuration    uint16 // Mean gap duration in ms
+	RoundTripDelay uint16 // Round trip delay in ms
+	EndSystemDelay uint16 // End system delay in ms
+	SignalLevel    int8   // dBm, 127 when unavailable
+	NoiseLevel     int8   // dBm, 127 when unavailable
+	Rerl           uint8  // Residual echo return loss in dB
+	Gmin           uint8  // Gap threshold
+	RFactor        uint8  // Listening R factor, 127 when unavailable
+	ExtRFactor     uint8  // External R factor, 127 when unavailable
+	MosLq          uint8  // Listening quality MOS times 10
+	MosCq          uint8  // Conversational quality MOS times 10
+	RxConfig       uint8  // Receiver configuration
+	JbNominal      uint16 // Jitter buffer nominal delay in ms
+	JbMaximum      uint16 // Jitter buffer maximum delay in ms
+	JbAbsMax       uint16 // Jitter buffer absolute maximum delay in ms
+}
+
+// ParseRtcp decodes a compound RTCP packet. Packets of unknown type are
+// returned with only the header fields and Raw set.
+func ParseRtcp(b []byte) ([]RtcpPacket, error) {
+	var out []RtcpPacket
+
+	for len(b) > 0 {
+		if len(b) < 4 {
+			return out, ErrShort
+		}
+
+		var p RtcpPacket
+		p.Version = b[0] >> 6
+		if p.Version != 2 {
+			return out, ErrVersion
+		}
+		p.Padding = b[0]&0x20 != 0
+		p.Count = b[0] & 0x1f
+		p.Type = b[1]
+		p.Length = binary.BigEndian.Uint16(b[2:4])
+
+		size := (int(p.Length) + 1) * 4
+		if len(b) < size {
+			return out, ErrShort
+		}
+		p.Raw = b[:size]
+		body := b[4:size]
+		b = b[size:]
+
+		// Padding is only allowed on the last packet of the compound
+		if p.Padding {
+			if len(body) == 0 {
+				return out, errors.New("rtcp: invalid padding")
+			}
+			pad := int(body[len(body)-1])
+			if pad == 0 || pad > len(body) {
+				return out, errors.New("rtcp: invalid padding")
+			}
+			body = body[:len(body)-pad]
+		}
+
+		var err error
+		switch p.Type {
+		case RTCP_SR:
+			p.SenderReport, err = parseSenderReport(body, int(p.Count))
+		case RTCP_RR:
+			p.ReceiverReport, err = parseReceiverReport(body, int(p.Count))
+		case RTCP_SDES:
+			p.Sdes, err = parseSdes(body, int(p.Count))
+		case RTCP_BYE:
+			p.Bye, err = parseBye(body, int(p.Count))
+		case RTCP_APP:
+			p.App, err = parseApp(body)
+		case RTCP_XR:
+			p.Xr, err = parseXr(body)
+		}
+		if err != nil {
+			return out, err
+		}
+
+		out = append(out, p)
+	}
+
+	return out, nil
+}
+
+func parseSenderReport(b []byte, count int) (*SenderReport, error) {
+	if len(b) < 24 {
+		return nil, ErrShort
+	}
+	sr := &SenderReport{
+		SSRC:        binary.BigEndian.Uint32(b[0:]),
+		NtpTime:     binary.BigEndian.Uint64(b[4:]),
+		RtpTime:     binary.BigEndian.Uint32(b[12:]),
+		PacketCount: binary.BigEndian.Uint32(b[16:]),
+		OctetCount:  binary.BigEndian.Uint32(b[20:]),
+	}
+	var err error
+	sr.Reports, err = parseReportBlocks(b[24:], count)
+	return sr, err
+}
+
+func parseReceiverReport(b []byte, count int) (*ReceiverReport, error) {
+	if len(b) < 4 {
+		return nil, ErrShort
+	}
+	rr := &ReceiverReport{SSRC: binary.BigEndian.Uint32(b[0:])}
+	var err error
+	rr.Reports, err = parseReportBlocks(b[4:], count)
+	return rr, err
+}
+
+func parseReportBlocks(b []byte, count int) ([]ReportBlock, error) {
+	if len(b) < count*24 {
+		return nil, ErrShort
+	}
+	var blocks []ReportBlock
+	for i := 0; i < count; i++ {
+		r := b[i*24:]
+		// Cumulative lost is a signed 24 bit value
+		lost := int32(binary.BigEndian.Uint32(r[4:])<<8) >> 8
+		blocks = append(blocks, ReportBlock{
+			SSRC:         binary.BigEndian.Uint32(r[0:]),
+			FractionLost: r[4],
+			TotalLost:    lost,
+			HighestSeq:   binary.BigEndian.Uint32(r[8:]),
+			Jitter:       binary.BigEndian.Uint32(r[12:]),
+			LastSR:       binary.BigEndian.Uint32(r[16:]),
+			DelaySinceSR: binary.BigEndian.Uint32(r[20:]),
+		})
+	}
+	return blocks, nil
+}
+
+func parseSdes(b []byte, count int) ([]SdesChunk, error) {
+	var chunks []SdesChunk
+	pos := 0
+	for i := 0; i < count; i++ {
+		if len(b) < pos+4 {
+			return chunks, ErrShort
+		}
+		chunk := SdesChunk{SSRC: binary.BigEndian.Uint32(b[pos:])}
+		pos += 4
+		for {
+			if pos >= len(b) {
+				return chunks, ErrShort
+			}
+			typ := b[pos]
+			if typ == SDES_END {
+				// The list ends with a null octet and is padded to 32 bits
+				pos += 4 - pos%4
+				break
+			}
+			if len(b) < pos+2 || len(b) < pos+2+int(b[pos+1]) {
+				return chunks, ErrShort
+			}
+			size := int(b[pos+1])
+			chunk.Items = append(chunk.Items, SdesItem{Type: typ, Text: b[pos+2 : pos+2+size]})
+			pos += 2 + size
+		}
+		chunks = append(chunks, chunk)
+	}
+	return chunks, nil
+}
+
+func parseBye(b []byte, count int) (*Bye, error) {
+	if len(b) < count*4 {
+		return nil, ErrShort
+	}
+	bye := &Bye{}
+	for i := 0; i < count; i++ {
+		bye.Sources = append(bye.Sources, binary.BigEndian.Uint32(b[i*4:]))
+	}
+	if rest := b[count*4:]; len(rest) > 0 {
+		size := int(rest[0])
+		if len(rest) < 1+size {
+			return bye, ErrShort
+		}
+		bye.Reason = rest[1 : 1+size]
+	}
+	return bye, nil
+}
+
+func parseApp(b []byte) (*App, error) {
+	if len(b) < 8 {
+		return nil, ErrShort
+	}
+	return &App{
+		SSRC: binary.BigEndian.Uint32(b[0:]),
+		Name: string(b[4:8]),
+		Data: b[8:],
+	}, nil
+}
+
+func parseXr(b []byte) (*Xr, error) {
+	if len(b) < 4 {
+		return nil, ErrShort
+	}
+	xr := &Xr{SSRC: binary.BigEndian.Uint32(b[0:])}
+	for pos := 4; pos < len(b); {
+		if len(b) < pos+4 {
+			return xr, ErrShort
+		}
+		block := XrBlock{Type: b[pos], TypeSpecific: b[pos+1]}
+		size := int(binary.BigEndian.Uint16(b[pos+2:])) * 4
+		pos += 4
+		if len(b) < pos+size {
+			return xr, ErrShort
+		}
+		block.Data = b[pos : pos+size]
+		pos += size
+
+		if block.Type == XR_VOIP_METRICS {
+			block.VoipMetrics = parseVoipMetrics(block.Data)
+		}
+		xr.Blocks = append(xr.Blocks, block)
+	}
+	return xr, nil
+}
+
+func parseVoipMetrics(b []byte) *VoipMetrics {
+	if len(b) < 32 {
+		return nil
+	}
+	return &VoipMetrics{
+		SSRC:           binary.BigEndian.Uint32(b[0:]),
+		LossRate:       b[4],
+		DiscardRate:    b[5],
+		BurstDensity:   b[6],
+		GapDensity:     b[7],
+		BurstDuration:  binary.BigEndian.Uint16(b[8:]),
+		GapDuration:    binary.BigEndian.Uint16(b[10:]),
+		RoundTripDelay: binary.BigEndian.Uint16(b[12:]),
+		EndSystemDelay: binary.BigEndian.Uint16(b[14:]),
+		SignalLevel:    int8(b[16]),
+		NoiseLevel:     int8(b[17]),
+		Rerl:           b[18],
+		Gmin:           b[19],
+		RFactor:        b[20],
+		ExtRFactor:     b[21],
+		MosLq:          b[22],
+		MosCq:          b[23],
+		RxConfig:       b[24],
+		JbNominal:      binary.BigEndian.Uint16(b[26:]),
+		JbMaximum:      binary.BigEndian.Uint16(b[28:]),
+		JbAbsMax:       binary.BigEndian.Uint16(b[30:]),
+	}
+}
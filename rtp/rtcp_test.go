@@ -0,0 +1,127 @@
+package rtp
+
+import (
+	"reflect"
+	"testing"
+)
+
+func Test_rtcpParse_Compound(t *testing.T) {
+
+	b := []byte{
+		// SR with one report block
+		0x81, 200, 0x00, 0x0c,
+		0x00, 0x00, 0x00, 0x01, // SSRC
+		0xe0, 0x00, 0x00, 0x00, 0x80, 0x00, 0x00, 0x00, // NTP
+		0x00, 0x00, 0x10, 0x00, // RTP time
+		0x00, 0x00, 0x00, 0x64, // packets
+		0x00, 0x00, 0x3e, 0x80, // octets
+		0x00, 0x00, 0x00, 0x02, // report SSRC
+		0x19, 0xff, 0xff, 0xfe, // fraction lost 25, cumulative -2
+		0x00, 0x01, 0x00, 0x10, // highest seq
+		0x00, 0x00, 0x00, 0x20, // jitter
+		0x00, 0x00, 0x00, 0x30, // LSR
+		0x00, 0x00, 0x00, 0x40, // DLSR
+		// SDES with a CNAME
+		0x81, 202, 0x00, 0x03,
+		0x00, 0x00, 0x00, 0x01,
+		0x01, 0x05, 'a', 'l', 'i', 'c', 'e', 0x00,
+		// BYE with a reason
+		0x81, 203, 0x00, 0x02,
+		0x00, 0x00, 0x00, 0x01,
+		0x03, 'b', 'y', 'e',
+	}
+
+	out, err := ParseRtcp(b)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(out) != 3 {
+		t.Fatalf("expected 3 packets, got %d", len(out))
+	}
+
+	expSR := &SenderReport{
+		SSRC:        1,
+		NtpTime:     0xe000000080000000,
+		RtpTime:     0x1000,
+		PacketCount: 100,
+		OctetCount:  16000,
+		Reports: []ReportBlock{
+			{SSRC: 2, FractionLost: 25, TotalLost: -2, HighestSeq: 0x10010, Jitter: 32, LastSR: 48, DelaySinceSR: 64},
+		},
+	}
+	if !reflect.DeepEqual(out[0].SenderReport, expSR) {
+		t.Errorf("Mismatch:\nExpected:\n%+v\nGot:\n%+v", expSR, out[0].SenderReport)
+	}
+
+	expSdes := []SdesChunk{{SSRC: 1, Items: []SdesItem{{Type: SDES_CNAME, Text: []byte("alice")}}}}
+	if !reflect.DeepEqual(out[1].Sdes, expSdes) {
+		t.Errorf("Mismatch:\nExpected:\n%+v\nGot:\n%+v", expSdes, out[1].Sdes)
+	}
+
+	expBye := &Bye{Sources: []uint32{1}, Reason: []byte("bye")}
+	if !reflect.DeepEqual(out[2].Bye, expBye) {
+		t.Errorf("Mismatch:\nExpected:\n%+v\nGot:\n%+v", expBye, out[2].Bye)
+	}
+}
+
+func Test_rtcpParse_AppAndXr(t *testing.T) {
+
+	b := []byte{
+		// RR without report blocks
+		0x80, 201, 0x00, 0x01,
+		0x00, 0x00, 0x00, 0x07,
+		// APP
+		0x81, 204, 0x00, 0x03,
+		0x00, 0x00, 0x00, 0x07,
+		'T', 'E', 'S', 'T',
+		0x01, 0x02, 0x03, 0x04,
+		// XR with a VoIP metrics block
+		0x80, 207, 0x00, 0x0a,
+		0x00, 0x00, 0x00, 0x07,
+		0x07, 0x00, 0x00, 0x08,
+		0x00, 0x00, 0x00, 0x09, // SSRC
+		0x05, 0x01, 0x10, 0x02, // loss, discard, burst, gap density
+		0x00, 0x14, 0x01, 0xf4, // burst 20ms, gap 500ms
+		0x00, 0x28, 0x00, 0x50, // RTT 40ms, end system 80ms
+		0xe2, 0xb5, 0x7f, 0x10, // signal -30, noise -75, RERL 127, Gmin 16
+		0x5d, 0x7f, 0x29, 0x28, // R 93, ext R 127, MOS-LQ 4.1, MOS-CQ 4.0
+		0x00, 0x00, 0x00, 0x28, // rx config, JB nominal 40
+		0x00, 0x50, 0x00, 0x78, // JB max 80, abs max 120
+	}
+
+	out, err := ParseRtcp(b)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(out) != 3 || out[0].ReceiverReport == nil || out[0].ReceiverReport.SSRC != 7 {
+		t.Fatalf("Mismatch: %+v", out)
+	}
+
+	expApp := &App{SSRC: 7, Name: "TEST", Data: []byte{1, 2, 3, 4}}
+	if !reflect.DeepEqual(out[1].App, expApp) || out[1].Count != 1 {
+		t.Errorf("Mismatch:\nExpected:\n%+v\nGot:\n%+v", expApp, out[1].App)
+	}
+
+	expVoip := &VoipMetrics{
+		SSRC: 9, LossRate: 5, DiscardRate: 1, BurstDensity: 16, GapDensity: 2,
+		BurstDuration: 20, GapDuration: 500, RoundTripDelay: 40, EndSystemDelay: 80,
+		SignalLevel: -30, NoiseLevel: -75, Rerl: 127, Gmin: 16,
+		RFactor: 93, ExtRFactor: 127, MosLq: 41, MosCq: 40,
+		JbNominal: 40, JbMaximum: 80, JbAbsMax: 120,
+	}
+	if len(out[2].Xr.Blocks) != 1 || !reflect.DeepEqual(out[2].Xr.Blocks[0].VoipMetrics, expVoip) {
+		t.Errorf("Mismatch:\nExpected:\n%+v\nGot:\n%+v", expVoip, out[2].Xr.Blocks)
+	}
+}
+
+func Test_rtcpParse_Truncated(t *testing.T) {
+
+	if _, err := ParseRtcp([]byte{0x81, 200, 0x00, 0x0c, 0, 0, 0, 1}); err != ErrShort {
+		t.Errorf("expected ErrShort, got %v", err)
+	}
+
+	// Padding bit set on a packet without a body
+	if _, err := ParseRtcp([]byte{0xa0, 200, 0, 0}); err == nil || err.Error() != "rtcp: invalid padding" {
+		t.Errorf("expected invalid padding, got %v", err)
+	}
+}
@@ -0,0 +1,266 @@
+// Package rtp parses RTP and RTCP packets and ties them to the media
+// sections negotiated in SIP signalling parsed by siprocket.
+package rtp
+
+/*
+ RFC 3550 - https://datatracker.ietf.org/doc/html/rfc3550#section-5.1
+
+ 5.1 RTP Fixed Header Fields
+
+    0                   1                   2                   3
+    0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1
+   +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+   |V=2|P|X|  CC   |M|     PT      |       sequence number         |
+   +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+   |                           timestamp                           |
+   +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+   |           synchronization source (SSRC) identifier            |
+   +=+=+=+=+=+=+=+=+=+=+=+=+=+=+=+=+=+=+=+=+=+=+=+=+=+=+=+=+=+=+=+=+
+   |            contributing source (CSRC) identifiers             |
+   |                             ....                              |
+   +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+
+ RFC 8285 - https://datatracker.ietf.org/doc/html/rfc8285#section-4
+
+ Header extension elements use either the one-byte form, profile 0xBEDE,
+ or the two-byte form, profile 0x100 followed by 4 application bits.
+
+*/
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+const (
+	headerLen = 12
+
+	extProfileOneByte = 0xBEDE
+	extProfileTwoByte = 0x1000
+)
+
+var (
+	ErrShort   = errors.New("rtp: packet too short")
+	ErrVersion = errors.New("rtp: unsupported version")
+)
+
+type Header struct {
+	Version     uint8       // Always 2
+	Padding     bool        // Padding bytes follow the payload
+	Extension   bool        // A header extension follows the CSRC list
+	Marker      bool        // Marker bit, eg start of a talk spurt
+	PayloadType uint8       // Payload type as mapped by a=rtpmap
+	Sequence    uint16      // Sequence number
+	Timestamp   uint32      // Media timestamp
+	SSRC        uint32      // Synchronization source
+	CSRC        []uint32    // Contributing sources
+	ExtProfile  uint16      // Profile of the header extension
+	ExtData     []byte      // Raw header extension data
+	Extensions  []Extension // RFC 8285 extension elements
+}
+
+type Extension struct {
+	ID   uint8  // Local identifier as negotiated by a=extmap
+	Data []byte // Element data
+}
+
+type Packet struct {
+	Header
+	Payload []byte // Payload without padding
+	PadLen  uint8  // Number of padding bytes
+}
+
+// Parse decodes an RTP packet. The returned slices point into b.
+func Parse(b []byte) (Packet, error) {
+	var p Packet
+
+	if len(b) < headerLen {
+		return p, ErrShort
+	}
+
+	p.Version = b[0] >> 6
+	if p.Version != 2 {
+		return p, ErrVersion
+	}
+	p.Padding = b[0]&0x20 != 0
+	p.Extension = b[0]&0x10 != 0
+	cc := int(b[0] & 0x0f)
+	p.Marker = b[1]&0x80 != 0
+	p.PayloadType = b[1] & 0x7f
+	p.Sequence = binary.BigEndian.Uint16(b[2:4])
+	p.Timestamp = binary.BigEndian.Uint32(b[4:8])
+	p.SSRC = binary.BigEndian.Uint32(b[8:12])
+
+	pos := headerLen
+	if len(b) < pos+cc*4 {
+		return p, ErrShort
+	}
+	for i := 0; i < cc; i++ {
+		p.CSRC = append(p.CSRC, binary.BigEndian.Uint32(b[pos:]))
+		pos += 4
+	}
+
+	if p.Extension {
+		if len(b) < pos+4 {
+			return p, ErrShort
+		}
+		p.ExtProfile = binary.BigEndian.Uint16(b[pos:])
+		extLen := int(binary.BigEndian.Uint16(b[pos+2:])) * 4
+		pos += 4
+		if len(b) < pos+extLen {
+			return p, ErrShort
+		}
+		p.ExtData = b[pos : pos+extLen]
+		pos += extLen
+
+		var err error
+		if p.Extensions, err = parseExtensions(p.ExtProfile, p.ExtData); err != nil {
+			return p, err
+		}
+	}
+
+	end := len(b)
+	if p.Padding {
+		p.PadLen = b[end-1]
+		if p.PadLen == 0 || int(p.PadLen) > end-pos {
+			return p, errors.New("rtp: invalid padding")
+		}
+		end -= int(p.PadLen)
+	}
+	p.Payload = b[pos:end]
+
+	return p, nil
+}
+
+// parseExtensions splits the RFC 8285 elements out of the extension data,
+// other profiles are left for the caller to decode from ExtData
+func parseExtensions(profile uint16, data []byte) ([]Extension, error) {
+	var exts []Extension
+
+	switch {
+	case profile == extProfileOneByte:
+		for pos := 0; pos < len(data); {
+			// Padding bytes
+			if data[pos] == 0 {
+				pos++
+				continue
+			}
+			id := data[pos] >> 4
+			size := int(data[pos]&0x0f) + 1
+			// ID 15 ends the processing of the extension
+			if id == 15 {
+				break
+			}
+			pos++
+			if pos+size > len(data) {
+				return exts, errors.New("rtp: one-byte header extension overruns")
+			}
+			exts = append(exts, Extension{ID: id, Data: data[pos : pos+size]})
+			pos += size
+		}
+	case profile&0xfff0 == extProfileTwoByte:
+		for pos := 0; pos < len(data); {
+			// Padding bytes
+			if data[pos] == 0 {
+				pos++
+				continue
+			}
+			if pos+2 > len(data) {
+				return exts, errors.New("rtp: two-byte header extension overruns")
+			}
+			id := data[pos]
+			size := int(data[pos+1])
+			pos += 2
+			if pos+size > len(data) {
+				return exts, errors.New("rtp: two-byte header extension overruns")
+			}
+			exts = append(exts, Extension{ID: id, Data: data[pos : pos+size]})
+			pos += size
+		}
+	}
+
+	return exts, nil
+}
+
+// Marshal encodes the packet. When Extensions is set the extension is
+// written in the one-byte form if every element fits, otherwise in the
+// two-byte form, and ExtData is ignored.
+func Marshal(p *Packet) []byte {
+	ext := p.ExtData
+	profile := p.ExtProfile
+	if len(p.Extensions) > 0 {
+		profile, ext = marshalExtensions(p.Extensions)
+	}
+
+	size := headerLen + len(p.CSRC)*4 + len(p.Payload) + int(p.PadLen)
+	if p.Extension || len(ext) > 0 {
+		size += 4 + len(ext)
+	}
+	b := make([]byte, headerLen, size)
+
+	b[0] = 2<<6 | uint8(len(p.CSRC))&0x0f
+	if p.PadLen > 0 {
+		b[0] |= 0x20
+	}
+	if p.Extension || len(ext) > 0 {
+		b[0] |= 0x10
+	}
+	b[1] = p.PayloadType & 0x7f
+	if p.Marker {
+		b[1] |= 0x80
+	}
+	binary.BigEndian.PutUint16(b[2:], p.Sequence)
+	binary.BigEndian.PutUint32(b[4:], p.Timestamp)
+	binary.BigEndian.PutUint32(b[8:], p.SSRC)
+
+	for _, csrc := range p.CSRC {
+		b = binary.BigEndian.AppendUint32(b, csrc)
+	}
+	if p.Extension || len(ext) > 0 {
+		b = binary.BigEndian.AppendUint16(b, profile)
+		b = binary.BigEndian.AppendUint16(b, uint16(len(ext)/4))
+		b = append(b, ext...)
+	}
+	b = append(b, p.Payload...)
+	if p.PadLen > 0 {
+		b = append(b, make([]byte, p.PadLen-1)...)
+		b = append(b, p.PadLen)
+	}
+
+	return b
+}
+
+func marshalExtensions(exts []Extension) (uint16, []byte) {
+	oneByte := true
+	for _, ext := range exts {
+		if ext.ID == 0 || ext.ID > 14 || len(ext.Data) == 0 || len(ext.Data) > 16 {
+			oneByte = false
+		}
+	}
+
+	var data []byte
+	profile := uint16(extProfileOneByte)
+	for _, ext := range exts {
+		if oneByte {
+			data = append(data, ext.ID<<4|uint8(len(ext.Data)-1))
+		} else {
+			profile = extProfileTwoByte
+			data = append(data, ext.ID, uint8(len(ext.Data)))
+		}
+		data = append(data, ext.Data...)
+	}
+
+	// Pad to a multiple of 4 bytes
+	for len(data)%4 != 0 {
+		data = append(data, 0)
+	}
+
+	return profile, data
+}
+
+// IsRtcp tells RTP and RTCP apart when both share a port as described in
+// RFC 5761 section 4, RTCP packet types 192 to 223 clash with RTP payload
+// types 64 to 95 which are not used
+func IsRtcp(b []byte) bool {
+	return len(b) >= 2 && b[0]>>6 == 2 && b[1] >= 192 && b[1] <= 223
+}
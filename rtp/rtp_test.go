@@ -0,0 +1,99 @@
+package rtp
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func Test_rtpParse_Header(t *testing.T) {
+
+	b := []byte{
+		0xb1, 0x88, 0x12, 0x34, // V=2 P X CC=1, M PT=8, seq
+		0x00, 0x00, 0x03, 0x20, // timestamp 800
+		0xde, 0xad, 0xbe, 0xef, // SSRC
+		0x00, 0x00, 0x00, 0x01, // CSRC
+		0xbe, 0xde, 0x00, 0x02, // one-byte extension, 2 words
+		0x11, 0xaa, 0xbb, 0x22, // id 1 len 2, id 2 len 3 ...
+		0xcc, 0xdd, 0xee, 0x00, // ... padding
+		0x01, 0x02, 0x03, // payload
+		0x00, 0x00, 0x03, // padding of 3
+	}
+
+	p, err := Parse(b)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	exp := Header{
+		Version:     2,
+		Padding:     true,
+		Extension:   true,
+		Marker:      true,
+		PayloadType: 8,
+		Sequence:    0x1234,
+		Timestamp:   800,
+		SSRC:        0xdeadbeef,
+		CSRC:        []uint32{1},
+		ExtProfile:  0xbede,
+		ExtData:     b[20:28],
+		Extensions: []Extension{
+			{ID: 1, Data: []byte{0xaa, 0xbb}},
+			{ID: 2, Data: []byte{0xcc, 0xdd, 0xee}},
+		},
+	}
+	if !reflect.DeepEqual(p.Header, exp) {
+		t.Errorf("Mismatch:\nExpected:\n%+v\nGot:\n%+v", exp, p.Header)
+	}
+	if !bytes.Equal(p.Payload, []byte{1, 2, 3}) || p.PadLen != 3 {
+		t.Errorf("Mismatch: payload %v padding %d", p.Payload, p.PadLen)
+	}
+
+	if out := Marshal(&p); !bytes.Equal(out, b) {
+		t.Errorf("Mismatch:\nExpected:\n%x\nGot:\n%x", b, out)
+	}
+}
+
+func Test_rtpParse_TwoByteExtension(t *testing.T) {
+
+	p := Packet{
+		Header: Header{
+			PayloadType: 111,
+			Sequence:    65535,
+			SSRC:        42,
+			Extensions: []Extension{
+				{ID: 20, Data: []byte{1}},
+				{ID: 3, Data: nil},
+			},
+		},
+		Payload: []byte("opus"),
+	}
+
+	out, err := Parse(Marshal(&p))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out.ExtProfile != extProfileTwoByte || len(out.Extensions) != 2 || out.Extensions[0].ID != 20 || out.Extensions[1].ID != 3 {
+		t.Errorf("Mismatch: profile %x extensions %+v", out.ExtProfile, out.Extensions)
+	}
+	if string(out.Payload) != "opus" || out.Sequence != 65535 {
+		t.Errorf("Mismatch: payload %q sequence %d", out.Payload, out.Sequence)
+	}
+}
+
+func Test_rtpParse_Invalid(t *testing.T) {
+
+	if _, err := Parse([]byte{0x80, 0x00}); err != ErrShort {
+		t.Errorf("expected ErrShort, got %v", err)
+	}
+	if _, err := Parse(make([]byte, 12)); err != ErrVersion {
+		t.Errorf("expected ErrVersion, got %v", err)
+	}
+	// CSRC count larger than the packet
+	if _, err := Parse([]byte{0x8f, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}); err != ErrShort {
+		t.Errorf("expected ErrShort, got %v", err)
+	}
+	if !IsRtcp([]byte{0x80, RTCP_SR}) || IsRtcp([]byte{0x80, 0x08}) {
+		t.Errorf("IsRtcp does not tell RTP and RTCP apart")
+	}
+}
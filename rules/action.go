@@ -0,0 +1,137 @@
+package rules
+
+/*
+ RFC 3264 - https://datatracker.ietf.org/doc/html/rfc3264#section-6
+
+   An offered stream MAY be rejected in the answer by setting its port to
+   zero.
+
+ strip_codec removes a format from the m= line along with its rtpmap, fmtp
+ and rtcp-fb attributes. A media section that would be left without any
+ format is rejected that way instead, as an m= line must list at least one.
+
+*/
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+
+	"github.com/nullboundary/siprocket"
+	"github.com/nullboundary/siprocket/rtp"
+)
+
+// apply applies the action to msg and tells if the run ends here
+func (a *action) apply(msg *siprocket.SipMsg, res *Result) bool {
+	switch a.typ {
+	case ACTION_SET_HEADER:
+		msg.SetHeader(a.header, a.value)
+	case ACTION_ADD_HEADER:
+		msg.AddHeader(a.header, a.value)
+	case ACTION_REMOVE_HEADER:
+		msg.RemoveHeader(a.header)
+	case ACTION_REWRITE_URI:
+		uri := msg.RequestUri()
+		if uri == "" || !a.re.MatchString(uri) {
+			break
+		}
+		// A rewrite that gives a bad URI leaves the message as it was
+		msg.SetRequestUri(a.re.ReplaceAllString(uri, a.value))
+	case ACTION_STRIP_CODEC:
+		if stripCodec(&msg.Sdp, a.codec) {
+			msg.Body = siprocket.MarshalSdp(&msg.Sdp)
+		}
+	case ACTION_REPLY:
+		res.Reply = a.code
+		res.Reason = a.reason
+		return true
+	}
+	return false
+}
+
+// stripCodec removes codec from every media section of sdp and tells if
+// anything was removed
+func stripCodec(sdp *siprocket.SdpMsg, codec string) bool {
+	if len(sdp.Media) == 0 {
+		if sdp.MediaDesc.MediaType == nil {
+			return false
+		}
+		// Built by hand using the flat fields only
+		media := siprocket.SdpMedia{MediaDesc: sdp.MediaDesc, Attrib: sdp.Attrib}
+		if !stripMediaCodec(&media, codec) {
+			return false
+		}
+		sdp.MediaDesc, sdp.Attrib = media.MediaDesc, media.Attrib
+		return true
+	}
+
+	changed := false
+	for i := range sdp.Media {
+		if stripMediaCodec(&sdp.Media[i], codec) {
+			changed = true
+		}
+	}
+	if !changed {
+		return false
+	}
+
+	// Keep the flat fields as parsing leaves them
+	sdp.MediaDesc = sdp.Media[len(sdp.Media)-1].MediaDesc
+	sdp.Attrib = append(sdp.Attrib[:0:0], sdp.SessAttrib...)
+	for i := range sdp.Media {
+		sdp.Attrib = append(sdp.Attrib, sdp.Media[i].Attrib...)
+	}
+	return true
+}
+
+func stripMediaCodec(media *siprocket.SdpMedia, codec string) bool {
+	drop := map[string]bool{}
+	for pt, c := range rtp.Codecs(media) {
+		if strings.EqualFold(c.Name, codec) || strconv.Itoa(int(pt)) == codec {
+			drop[strconv.Itoa(int(pt))] = true
+		}
+	}
+	// A dynamic payload type without an rtpmap
+	for _, f := range strings.Fields(string(media.MediaDesc.Fmt)) {
+		if f == codec {
+			drop[f] = true
+		}
+	}
+	if len(drop) == 0 {
+		return false
+	}
+
+	var fmts []string
+	for _, f := range strings.Fields(string(media.MediaDesc.Fmt)) {
+		if !drop[f] {
+			fmts = append(fmts, f)
+		}
+	}
+	media.MediaDesc.Src = nil
+	if len(fmts) == 0 {
+		media.MediaDesc.Port = []byte("0")
+		return true
+	}
+	media.MediaDesc.Fmt = []byte(strings.Join(fmts, " "))
+
+	attribs := media.Attrib[:0:0]
+	for _, attr := range media.Attrib {
+		if isFormatAttrib(attr.Cat) {
+			pt, _, _ := bytes.Cut(attr.Val, []byte(" "))
+			if drop[string(pt)] {
+				continue
+			}
+		}
+		attribs = append(attribs, attr)
+	}
+	media.Attrib = attribs
+	return true
+}
+
+// isFormatAttrib tells if an attribute refers to a format by its payload
+// type as the first field of its value
+func isFormatAttrib(cat []byte) bool {
+	return bytes.EqualFold(cat, []byte("rtpmap")) ||
+		bytes.EqualFold(cat, []byte("fmtp")) ||
+		bytes.EqualFold(cat, []byte("rtcp-fb"))
+}
@@ -0,0 +1,398 @@
+// Package rules applies declarative header manipulation rules, loaded from
+// YAML or JSON, to SIP messages as an edge proxy normalising traffic would.
+package rules
+
+/*
+ A rule file is a list of rules, each with a match and a list of actions:
+
+   - name: anonymise-ua
+     match:
+       method: [INVITE, REGISTER]   # Any of, a response matches its CSeq method
+       status: [404, 5xx]           # Any of, only responses match
+       source: [10.0.0.0/8]         # Any of, addresses or prefixes
+       header:                      # All of, an empty regex tests presence
+         - name: User-Agent
+           regex: ^Acme
+     actions:
+       - action: set_header         # header, value
+         header: User-Agent
+         value: SBC
+       - action: add_header         # header, value
+       - action: remove_header      # header
+       - action: rewrite_uri        # match, value as in regexp.ReplaceAllString
+       - action: strip_codec        # codec, an encoding name or payload type
+       - action: reply              # code, reason
+
+ An empty match matches every message. Rules run in order and a reply
+ action ends the run, the caller answers the request with the code given.
+
+*/
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/netip"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/nullboundary/siprocket"
+)
+
+// Action types
+const (
+	ACTION_SET_HEADER    = "set_header"
+	ACTION_ADD_HEADER    = "add_header"
+	ACTION_REMOVE_HEADER = "remove_header"
+	ACTION_REWRITE_URI   = "rewrite_uri"
+	ACTION_STRIP_CODEC   = "strip_codec"
+	ACTION_REPLY         = "reply"
+)
+
+// Rule is one rule as written in a rule file
+type Rule struct {
+	Name    string   `json:"name"`
+	Match   Match    `json:"match"`
+	Actions []Action `json:"actions"`
+}
+
+// Match holds the conditions of a rule, all of which must hold
+type Match struct {
+	Method Values        `json:"method"` // Request methods, any of
+	Status Values        `json:"status"` // Status codes such as 404 or 4xx, any of
+	Source Values        `json:"source"` // Source addresses or prefixes, any of
+	Header []HeaderMatch `json:"header"` // Header conditions, all of
+}
+
+// HeaderMatch holds when any value of the header matches the regex, or
+// when the header is present for an empty regex
+type HeaderMatch struct {
+	Name  string `json:"name"`
+	Regex string `json:"regex"`
+}
+
+// Action is one action of a rule, the fields used depend on the type
+type Action struct {
+	Type   string `json:"action"` // One of the ACTION_ constants
+	Header string `json:"header"` // Header name
+	Value  Text   `json:"value"`  // Header value or URI replacement
+	Match  string `json:"match"`  // URI regex, the whole URI when empty
+	Codec  Text   `json:"codec"`  // Encoding name or payload type
+	Code   int    `json:"code"`   // Reply status code
+	Reason string `json:"reason"` // Reply reason phrase
+}
+
+// Values is a list of strings, a rule file may also give a single value
+// and numbers are taken as written
+type Values []string
+
+func (v *Values) UnmarshalJSON(b []byte) error {
+	if bytes.HasPrefix(bytes.TrimSpace(b), []byte("[")) {
+		var list []Text
+		if err := json.Unmarshal(b, &list); err != nil {
+			return err
+		}
+		*v = make(Values, len(list))
+		for i := range list {
+			(*v)[i] = string(list[i])
+		}
+		return nil
+	}
+	var t Text
+	if err := t.UnmarshalJSON(b); err != nil {
+		return err
+	}
+	*v = Values{string(t)}
+	return nil
+}
+
+// Text is a string, a rule file may also give a number which is taken as
+// written
+type Text string
+
+func (t *Text) UnmarshalJSON(b []byte) error {
+	b = bytes.TrimSpace(b)
+	if len(b) > 0 && (b[0] == '-' || b[0] >= '0' && b[0] <= '9') {
+		*t = Text(b)
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	*t = Text(s)
+	return nil
+}
+
+// Load decodes a rule file, JSON when it starts with [ and YAML otherwise
+func Load(b []byte) ([]Rule, error) {
+	b = bytes.TrimPrefix(b, []byte("\xef\xbb\xbf"))
+	if !bytes.HasPrefix(bytes.TrimSpace(b), []byte("[")) {
+		doc, err := decodeYaml(b)
+		if err != nil {
+			return nil, err
+		}
+		if doc == nil {
+			return nil, nil
+		}
+		if b, err = json.Marshal(doc); err != nil {
+			return nil, err
+		}
+	}
+
+	var rules []Rule
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&rules); err != nil {
+		return nil, fmt.Errorf("rules: %v", err)
+	}
+	return rules, nil
+}
+
+// Result tells what a run of the rules did
+type Result struct {
+	Matched []string // Names of the rules that matched, in order
+	Reply   int      // Status code of the reply action that ended the run, zero for none
+	Reason  string   // Reason phrase of the reply
+}
+
+// Engine runs compiled rules. It holds no state of its own so it is safe
+// for concurrent use, each message must only be used by one goroutine.
+type Engine struct {
+	rules []rule
+}
+
+type rule struct {
+	name    string
+	methods []string
+	status  []string
+	source  []netip.Prefix
+	headers []headerMatch
+	actions []action
+}
+
+type headerMatch struct {
+	name string
+	re   *regexp.Regexp
+}
+
+type action struct {
+	typ    string
+	header string
+	value  string
+	re     *regexp.Regexp
+	codec  string
+	code   int
+	reason string
+}
+
+// Compile checks the rules and compiles their regexes, rules without a
+// name are named by their position starting at 1
+func Compile(rules []Rule) (*Engine, error) {
+	e := &Engine{rules: make([]rule, 0, len(rules))}
+	for i := range rules {
+		r, err := compileRule(&rules[i])
+		if r.name == "" {
+			r.name = strconv.Itoa(i + 1)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("rule %q: %v", r.name, err)
+		}
+		e.rules = append(e.rules, r)
+	}
+	return e, nil
+}
+
+func compileRule(in *Rule) (rule, error) {
+	r := rule{name: in.Name}
+
+	for _, m := range in.Match.Method {
+		r.methods = append(r.methods, strings.ToUpper(m))
+	}
+
+	for _, s := range in.Match.Status {
+		s = strings.ToLower(s)
+		if len(s) != 3 || s[0] < '1' || s[0] > '6' || strings.Trim(s[1:], "0123456789x") != "" {
+			return r, fmt.Errorf("bad status %q", s)
+		}
+		r.status = append(r.status, s)
+	}
+
+	for _, s := range in.Match.Source {
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			addr, aerr := netip.ParseAddr(s)
+			if aerr != nil {
+				return r, fmt.Errorf("bad source %q", s)
+			}
+			prefix = netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen())
+		}
+		r.source = append(r.source, prefix.Masked())
+	}
+
+	for _, h := range in.Match.Header {
+		if h.Name == "" {
+			return r, errors.New("header match without a name")
+		}
+		hm := headerMatch{name: h.Name}
+		if h.Regex != "" {
+			re, err := regexp.Compile(h.Regex)
+			if err != nil {
+				return r, err
+			}
+			hm.re = re
+		}
+		r.headers = append(r.headers, hm)
+	}
+
+	if len(in.Actions) == 0 {
+		return r, errors.New("no actions")
+	}
+	for i := range in.Actions {
+		a, err := compileAction(&in.Actions[i])
+		if err != nil {
+			return r, fmt.Errorf("action %d: %v", i+1, err)
+		}
+		r.actions = append(r.actions, a)
+	}
+	return r, nil
+}
+
+func compileAction(in *Action) (action, error) {
+	a := action{
+		typ:    in.Type,
+		header: in.Header,
+		value:  string(in.Value),
+		codec:  string(in.Codec),
+		code:   in.Code,
+		reason: in.Reason,
+	}
+
+	switch a.typ {
+	case ACTION_SET_HEADER, ACTION_ADD_HEADER, ACTION_REMOVE_HEADER:
+		if a.header == "" {
+			return a, fmt.Errorf("%s without a header", a.typ)
+		}
+		if strings.ContainsAny(a.header, ": \t\r\n") || strings.ContainsAny(a.value, "\r\n") {
+			return a, fmt.Errorf("%s with a bad header", a.typ)
+		}
+	case ACTION_REWRITE_URI:
+		if a.value == "" {
+			return a, errors.New("rewrite_uri without a value")
+		}
+		expr := in.Match
+		if expr == "" {
+			expr = "^.*$"
+		}
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return a, err
+		}
+		a.re = re
+	case ACTION_STRIP_CODEC:
+		if a.codec == "" {
+			return a, errors.New("strip_codec without a codec")
+		}
+	case ACTION_REPLY:
+		if a.code < 300 || a.code > 699 {
+			return a, fmt.Errorf("reply with bad code %d", a.code)
+		}
+		if a.reason == "" {
+			a.reason = siprocket.StatusText(a.code)
+		}
+	default:
+		return a, fmt.Errorf("unknown action %q", a.typ)
+	}
+	return a, nil
+}
+
+// Apply runs the rules against msg, received from src, applying the
+// actions of every rule that matches. An invalid src only matches rules
+// without a source condition.
+func (e *Engine) Apply(msg *siprocket.SipMsg, src netip.Addr) Result {
+	var res Result
+	for i := range e.rules {
+		r := &e.rules[i]
+		if !r.match(msg, src) {
+			continue
+		}
+		res.Matched = append(res.Matched, r.name)
+		for j := range r.actions {
+			if r.actions[j].apply(msg, &res) {
+				return res
+			}
+		}
+	}
+	return res
+}
+
+// DryRun reports what Apply would do for msg, which is left unchanged. The
+// actions are applied to a copy so later rules see the earlier ones.
+func (e *Engine) DryRun(msg *siprocket.SipMsg, src netip.Addr) Result {
+	dup := siprocket.ParseLossless(siprocket.AppendMarshalLossless(nil, msg))
+	return e.Apply(&dup, src)
+}
+
+func (r *rule) match(msg *siprocket.SipMsg, src netip.Addr) bool {
+	response := len(msg.Req.StatusCode) > 0
+
+	if len(r.methods) > 0 {
+		method := msg.Req.Method
+		if response {
+			method = msg.Cseq.Method
+		}
+		if !anyOf(r.methods, func(m string) bool { return strings.EqualFold(m, string(method)) }) {
+			return false
+		}
+	}
+
+	if len(r.status) > 0 {
+		code := string(msg.Req.StatusCode)
+		if !response || !anyOf(r.status, func(s string) bool { return statusMatch(s, code) }) {
+			return false
+		}
+	}
+
+	if len(r.source) > 0 {
+		addr := src.Unmap()
+		if !addr.IsValid() || !anyOf(r.source, func(p netip.Prefix) bool { return p.Contains(addr) }) {
+			return false
+		}
+	}
+
+	for i := range r.headers {
+		h := &r.headers[i]
+		vals := msg.HeaderValues(h.name)
+		if len(vals) == 0 {
+			return false
+		}
+		if h.re != nil && !anyOf(vals, h.re.Match) {
+			return false
+		}
+	}
+	return true
+}
+
+// statusMatch tells if a status code matches a pattern such as 486 or 4xx
+func statusMatch(pattern, code string) bool {
+	if len(code) != len(pattern) {
+		return false
+	}
+	for i := 0; i < len(pattern); i++ {
+		if pattern[i] != 'x' && pattern[i] != code[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func anyOf[T any](list []T, f func(T) bool) bool {
+	for _, v := range list {
+		if f(v) {
+			return true
+		}
+	}
+	return false
+}
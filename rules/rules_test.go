@@ -0,0 +1,227 @@
+package rules
+
+import (
+	"net/netip"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/nullboundary/siprocket"
+)
+
+var testInvite = "INVITE sip:bob@biloxi.com SIP/2.0\r\n" +
+	"Via: SIP/2.0/UDP pc33.atlanta.com;branch=z9hG4bK776asdhds\r\n" +
+	"Max-Forwards: 70\r\n" +
+	"To: Bob <sip:bob@biloxi.com>\r\n" +
+	"From: Alice <sip:alice@atlanta.com>;tag=1928301774\r\n" +
+	"Call-ID: a84b4c76e66710@pc33.atlanta.com\r\n" +
+	"CSeq: 314159 INVITE\r\n" +
+	"User-Agent: Acme Phone 1.2\r\n" +
+	"P-Asserted-Identity: <sip:alice@atlanta.com>\r\n" +
+	"Contact: <sip:alice@pc33.atlanta.com>\r\n" +
+	"Content-Type: application/sdp\r\n" +
+	"Content-Length: 181\r\n" +
+	"\r\n" +
+	"v=0\r\n" +
+	"o=alice 2890844526 2890844526 IN IP4 pc33.atlanta.com\r\n" +
+	"s=-\r\n" +
+	"c=IN IP4 192.0.2.10\r\n" +
+	"t=0 0\r\n" +
+	"m=audio 49170 RTP/AVP 0 18 101\r\n" +
+	"a=fmtp:18 annexb=no\r\n" +
+	"a=rtpmap:101 telephone-event/8000\r\n"
+
+var testRules = `
+- name: edge-normalise
+  match:
+    method: invite
+    source: [192.0.2.0/24, 2001:db8::1]
+    header:
+      - name: User-Agent
+        regex: ^Acme
+  actions:
+    - action: set_header
+      header: User-Agent
+      value: SBC
+    - action: remove_header
+      header: P-Asserted-Identity
+    - action: add_header
+      header: X-Edge
+      value: 1.10
+    - action: rewrite_uri
+      match: ^sip:([^@]+)@biloxi\.com$
+      value: sip:+1$1@gw.example.com
+    - action: strip_codec
+      codec: G729
+
+- name: block-busy
+  match:
+    status: 4xx
+  actions:
+    - action: reply
+      code: 403
+
+- name: never-source
+  match:
+    source: 198.51.100.7
+  actions:
+    - action: reply
+      code: 503
+`
+
+func Test_rules_Load(t *testing.T) {
+
+	yamlRules, err := Load([]byte(testRules))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jsonRules, err := Load([]byte(`[
+		{"name": "edge-normalise",
+		 "match": {"method": "invite", "source": ["192.0.2.0/24", "2001:db8::1"],
+		           "header": [{"name": "User-Agent", "regex": "^Acme"}]},
+		 "actions": [
+			{"action": "set_header", "header": "User-Agent", "value": "SBC"},
+			{"action": "remove_header", "header": "P-Asserted-Identity"},
+			{"action": "add_header", "header": "X-Edge", "value": 1.10},
+			{"action": "rewrite_uri", "match": "^sip:([^@]+)@biloxi\\.com$", "value": "sip:+1$1@gw.example.com"},
+			{"action": "strip_codec", "codec": "G729"}]},
+		{"name": "block-busy", "match": {"status": "4xx"}, "actions": [{"action": "reply", "code": 403}]},
+		{"name": "never-source", "match": {"source": "198.51.100.7"}, "actions": [{"action": "reply", "code": 503}]}
+	]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(yamlRules, jsonRules) {
+		t.Errorf("Mismatch:\nYAML:\n%+v\nJSON:\n%+v", yamlRules, jsonRules)
+	}
+	if v := yamlRules[0].Actions[2].Value; v != "1.10" {
+		t.Errorf("Number not taken as written: %q", v)
+	}
+
+	if _, err := Load([]byte("- name: typo\n  match:\n    methd: INVITE\n")); err == nil {
+		t.Errorf("Expected an error for an unknown field")
+	}
+}
+
+func Test_rules_Apply(t *testing.T) {
+
+	rules, err := Load([]byte(testRules))
+	if err != nil {
+		t.Fatal(err)
+	}
+	engine, err := Compile(rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := siprocket.ParseLossless([]byte(testInvite))
+	res := engine.Apply(&msg, netip.MustParseAddr("::ffff:192.0.2.4"))
+	if exp := (Result{Matched: []string{"edge-normalise"}}); !reflect.DeepEqual(res, exp) {
+		t.Errorf("Mismatch:\nExpected:\n%+v\nGot:\n%+v", exp, res)
+	}
+
+	body := "v=0\r\n" +
+		"o=alice 2890844526 2890844526 IN IP4 pc33.atlanta.com\r\n" +
+		"s=-\r\n" +
+		"c=IN IP4 192.0.2.10\r\n" +
+		"t=0 0\r\n" +
+		"m=audio 49170 RTP/AVP 0 101\r\n" +
+		"a=rtpmap:101 telephone-event/8000\r\n"
+	exp := strings.NewReplacer(
+		"INVITE sip:bob@biloxi.com", "INVITE sip:+1bob@gw.example.com",
+		"User-Agent: Acme Phone 1.2\r\n", "User-Agent: SBC\r\n",
+		"P-Asserted-Identity: <sip:alice@atlanta.com>\r\n", "",
+		"Content-Length: 181\r\n", "X-Edge: 1.10\r\nContent-Length: 157\r\n",
+	).Replace(testInvite[:strings.Index(testInvite, "v=0")]) + body
+	if out := siprocket.MarshalLossless(&msg); out != exp {
+		t.Errorf("Mismatch:\nExpected:\n%q\nGot:\n%q", exp, out)
+	}
+
+	// The rewritten message no longer matches
+	if res := engine.Apply(&msg, netip.MustParseAddr("192.0.2.4")); len(res.Matched) != 0 {
+		t.Errorf("Expected no match, got %+v", res)
+	}
+
+	// A reply ends the run
+	resp := siprocket.Parse([]byte("SIP/2.0 486 Busy Here\r\nCSeq: 1 INVITE\r\n\r\n"))
+	res = engine.Apply(&resp, netip.MustParseAddr("198.51.100.7"))
+	if exp := (Result{Matched: []string{"block-busy"}, Reply: 403, Reason: "Forbidden"}); !reflect.DeepEqual(res, exp) {
+		t.Errorf("Mismatch:\nExpected:\n%+v\nGot:\n%+v", exp, res)
+	}
+}
+
+func Test_rules_DryRun(t *testing.T) {
+
+	rules, _ := Load([]byte(testRules))
+	engine, err := Compile(rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := siprocket.Parse([]byte(testInvite))
+	before := siprocket.Marshal(&msg)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res := engine.DryRun(&msg, netip.MustParseAddr("2001:db8::1"))
+			if !reflect.DeepEqual(res.Matched, []string{"edge-normalise"}) {
+				t.Errorf("Bad dry run: %+v", res)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if after := siprocket.Marshal(&msg); after != before {
+		t.Errorf("Message changed by a dry run:\n%q\n%q", before, after)
+	}
+}
+
+func Test_rules_StripLastCodec(t *testing.T) {
+
+	engine, err := Compile([]Rule{{Actions: []Action{
+		{Type: ACTION_STRIP_CODEC, Codec: "0"},
+		{Type: ACTION_STRIP_CODEC, Codec: "g729"},
+		{Type: ACTION_STRIP_CODEC, Codec: "telephone-event"},
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := siprocket.ParseLossless([]byte(testInvite))
+	if res := engine.Apply(&msg, netip.Addr{}); !reflect.DeepEqual(res.Matched, []string{"1"}) {
+		t.Errorf("Unnamed rule not named by position: %+v", res)
+	}
+	if !strings.HasSuffix(string(msg.Body), "m=audio 0 RTP/AVP 101\r\na=rtpmap:101 telephone-event/8000\r\n") {
+		t.Errorf("Media not rejected: %q", msg.Body)
+	}
+}
+
+func Test_rules_CompileErrors(t *testing.T) {
+
+	tests := []struct {
+		name string
+		rule Rule
+	}{
+		{"no actions", Rule{}},
+		{"bad status", Rule{Match: Match{Status: Values{"40"}}, Actions: []Action{{Type: ACTION_REMOVE_HEADER, Header: "X"}}}},
+		{"bad source", Rule{Match: Match{Source: Values{"host"}}, Actions: []Action{{Type: ACTION_REMOVE_HEADER, Header: "X"}}}},
+		{"bad regex", Rule{Match: Match{Header: []HeaderMatch{{Name: "X", Regex: "("}}}, Actions: []Action{{Type: ACTION_REMOVE_HEADER, Header: "X"}}}},
+		{"no header", Rule{Actions: []Action{{Type: ACTION_ADD_HEADER, Value: "1"}}}},
+		{"header injection", Rule{Actions: []Action{{Type: ACTION_ADD_HEADER, Header: "X", Value: "1\r\nY: 2"}}}},
+		{"bad code", Rule{Actions: []Action{{Type: ACTION_REPLY, Code: 200}}}},
+		{"unknown action", Rule{Actions: []Action{{Type: "drop"}}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Compile([]Rule{tt.rule}); err == nil {
+				t.Errorf("Expected an error")
+			}
+		})
+	}
+}
@@ -0,0 +1,330 @@
+package rules
+
+/*
+ YAML 1.2 - https://yaml.org/spec/1.2.2/
+
+ Rule files only need the block style subset of YAML, which is decoded
+ here rather than pulling in a dependency:
+
+   # comment
+   - name: strip-ua
+     match:
+       method: [INVITE, REGISTER]
+     actions:
+       - action: remove_header
+         header: User-Agent
+
+ Mappings, sequences, plain, single and double quoted scalars and flow
+ sequences of scalars are supported. Anchors, tags, flow mappings and
+ multi-line scalars are not.
+
+*/
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// yamlLine is a line of a YAML document with its indentation removed
+type yamlLine struct {
+	num    int    // Line number starting at 1
+	indent int    // Number of leading spaces
+	text   string // Line without indentation and comment
+}
+
+type yamlDecoder struct {
+	lines []yamlLine
+	pos   int
+}
+
+// decodeYaml decodes a YAML document into the values encoding/json uses:
+// map[string]any, []any, string, bool and nil. Numbers are kept as
+// json.Number so they can be taken as written.
+func decodeYaml(b []byte) (any, error) {
+	d := &yamlDecoder{}
+	for i, text := range strings.Split(string(b), "\n") {
+		text = strings.TrimRight(stripYamlComment(text), " \t\r")
+		trimmed := strings.TrimLeft(text, " ")
+		if trimmed == "" || trimmed == "---" {
+			continue
+		}
+		if strings.HasPrefix(trimmed, "\t") {
+			return nil, fmt.Errorf("yaml line %d: tab in indentation", i+1)
+		}
+		d.lines = append(d.lines, yamlLine{num: i + 1, indent: len(text) - len(trimmed), text: trimmed})
+	}
+	if len(d.lines) == 0 {
+		return nil, nil
+	}
+
+	v, err := d.block(d.lines[0].indent)
+	if err != nil {
+		return nil, err
+	}
+	if d.pos < len(d.lines) {
+		return nil, d.errorf("unexpected indentation")
+	}
+	return v, nil
+}
+
+// block decodes the mapping or sequence starting at the current line
+func (d *yamlDecoder) block(indent int) (any, error) {
+	if isSeqItem(d.lines[d.pos].text) {
+		return d.sequence(indent)
+	}
+	return d.mapping(indent)
+}
+
+// sequence decodes the items of a block sequence at indent
+func (d *yamlDecoder) sequence(indent int) (any, error) {
+	list := []any{}
+	for d.pos < len(d.lines) && d.lines[d.pos].indent == indent && isSeqItem(d.lines[d.pos].text) {
+		line := d.lines[d.pos]
+		rest := strings.TrimLeft(line.text[1:], " ")
+
+		switch {
+		case rest == "":
+			// The item is the block on the following lines
+			d.pos++
+			if d.pos == len(d.lines) || d.lines[d.pos].indent <= indent {
+				list = append(list, nil)
+				continue
+			}
+			v, err := d.block(d.lines[d.pos].indent)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+
+		case isSeqItem(rest) || isMapItem(rest):
+			// A compact block, its first line shares the line of the dash
+			d.lines[d.pos] = yamlLine{num: line.num, indent: indent + len(line.text) - len(rest), text: rest}
+			v, err := d.block(d.lines[d.pos].indent)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+
+		default:
+			v, err := yamlScalar(rest)
+			if err != nil {
+				return nil, d.errorf("%v", err)
+			}
+			list = append(list, v)
+			d.pos++
+		}
+	}
+	return list, nil
+}
+
+// mapping decodes the entries of a block mapping at indent
+func (d *yamlDecoder) mapping(indent int) (any, error) {
+	m := map[string]any{}
+	for d.pos < len(d.lines) && d.lines[d.pos].indent == indent {
+		line := d.lines[d.pos]
+		if isSeqItem(line.text) {
+			return nil, d.errorf("sequence item inside a mapping")
+		}
+		key, rest, ok := splitYamlKey(line.text)
+		if !ok {
+			return nil, d.errorf("expected key: value")
+		}
+		if _, dup := m[key]; dup {
+			return nil, d.errorf("duplicate key %q", key)
+		}
+		d.pos++
+
+		if rest != "" {
+			v, err := yamlScalar(rest)
+			if err != nil {
+				return nil, fmt.Errorf("yaml line %d: %v", line.num, err)
+			}
+			m[key] = v
+			continue
+		}
+
+		// The value is the block on the following lines, a sequence may
+		// also sit at the indentation of its key
+		switch {
+		case d.pos < len(d.lines) && d.lines[d.pos].indent > indent:
+			v, err := d.block(d.lines[d.pos].indent)
+			if err != nil {
+				return nil, err
+			}
+			m[key] = v
+		case d.pos < len(d.lines) && d.lines[d.pos].indent == indent && isSeqItem(d.lines[d.pos].text):
+			v, err := d.sequence(indent)
+			if err != nil {
+				return nil, err
+			}
+			m[key] = v
+		default:
+			m[key] = nil
+		}
+	}
+	if d.pos < len(d.lines) && d.lines[d.pos].indent > indent {
+		return nil, d.errorf("unexpected indentation")
+	}
+	return m, nil
+}
+
+func (d *yamlDecoder) errorf(format string, args ...any) error {
+	return fmt.Errorf("yaml line %d: %s", d.lines[d.pos].num, fmt.Sprintf(format, args...))
+}
+
+func isSeqItem(text string) bool {
+	return text == "-" || strings.HasPrefix(text, "- ")
+}
+
+func isMapItem(text string) bool {
+	_, _, ok := splitYamlKey(text)
+	return ok
+}
+
+// splitYamlKey splits key: value, the key may be quoted
+func splitYamlKey(text string) (string, string, bool) {
+	if text == "" || text[0] == '[' || text[0] == '{' {
+		return "", "", false
+	}
+	if text[0] == '"' || text[0] == '\'' {
+		end := quoteEnd(text)
+		if end == -1 || !strings.HasPrefix(text[end+1:], ":") {
+			return "", "", false
+		}
+		key, err := yamlScalar(text[:end+1])
+		if err != nil {
+			return "", "", false
+		}
+		return key.(string), strings.TrimSpace(text[end+2:]), true
+	}
+	for i := 0; i < len(text); i++ {
+		if text[i] == ':' && (i+1 == len(text) || text[i+1] == ' ') {
+			return strings.TrimSpace(text[:i]), strings.TrimSpace(text[i+1:]), true
+		}
+	}
+	return "", "", false
+}
+
+// yamlScalar decodes a scalar or a flow sequence of scalars
+func yamlScalar(text string) (any, error) {
+	switch {
+	case text[0] == '[':
+		if !strings.HasSuffix(text, "]") {
+			return nil, errors.New("unterminated flow sequence")
+		}
+		list := []any{}
+		for _, item := range splitFlow(text[1 : len(text)-1]) {
+			if item == "" {
+				continue
+			}
+			v, err := yamlScalar(item)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+		}
+		return list, nil
+
+	case text[0] == '{' || text[0] == '&' || text[0] == '*' || text[0] == '!' || text[0] == '|' || text[0] == '>':
+		return nil, fmt.Errorf("unsupported yaml %q", text)
+
+	case text[0] == '"':
+		if quoteEnd(text) != len(text)-1 {
+			return nil, errors.New("unterminated double quoted string")
+		}
+		return strconv.Unquote(text)
+
+	case text[0] == '\'':
+		if quoteEnd(text) != len(text)-1 {
+			return nil, errors.New("unterminated single quoted string")
+		}
+		return strings.ReplaceAll(text[1:len(text)-1], "''", "'"), nil
+	}
+
+	switch text {
+	case "true", "True", "TRUE":
+		return true, nil
+	case "false", "False", "FALSE":
+		return false, nil
+	case "null", "Null", "NULL", "~":
+		return nil, nil
+	}
+	if isYamlNumber(text) {
+		if _, err := strconv.ParseFloat(text, 64); err == nil {
+			return json.Number(text), nil
+		}
+	}
+	return text, nil
+}
+
+// splitFlow splits the items of a flow sequence on commas outside quotes
+func splitFlow(text string) []string {
+	var items []string
+	start := 0
+	for i := 0; i < len(text); i++ {
+		switch text[i] {
+		case '"', '\'':
+			if end := quoteEnd(text[i:]); end > -1 {
+				i += end
+			}
+		case ',':
+			items = append(items, strings.TrimSpace(text[start:i]))
+			start = i + 1
+		}
+	}
+	return append(items, strings.TrimSpace(text[start:]))
+}
+
+// quoteEnd returns the index of the quote closing the string text starts
+// with, or -1
+func quoteEnd(text string) int {
+	q := text[0]
+	for i := 1; i < len(text); i++ {
+		switch {
+		case q == '"' && text[i] == '\\':
+			i++
+		case q == '\'' && text[i] == '\'' && i+1 < len(text) && text[i+1] == '\'':
+			i++
+		case text[i] == q:
+			return i
+		}
+	}
+	return -1
+}
+
+// stripYamlComment removes a # comment that is not inside quotes
+func stripYamlComment(text string) string {
+	for i := 0; i < len(text); i++ {
+		switch text[i] {
+		case '"', '\'':
+			if end := quoteEnd(text[i:]); end > -1 {
+				i += end
+			}
+		case '#':
+			if i == 0 || text[i-1] == ' ' || text[i-1] == '\t' {
+				return text[:i]
+			}
+		}
+	}
+	return text
+}
+
+// isYamlNumber tells if a plain scalar is a decimal integer or float
+func isYamlNumber(text string) bool {
+	digits := false
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case c >= '0' && c <= '9':
+			digits = true
+		case (c == '-' || c == '+') && (i == 0 || text[i-1] == 'e' || text[i-1] == 'E'):
+		case c == '.' || c == 'e' || c == 'E':
+		default:
+			return false
+		}
+	}
+	return digits
+}
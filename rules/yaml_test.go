@@ -0,0 +1,69 @@
+package rules
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func Test_rulesYaml_Decode(t *testing.T) {
+
+	doc := `
+# A comment
+- name: "quoted # not a comment"
+  match:
+    method: [INVITE, 'it''s', "a,b"]
+    status:
+    - 404
+    - 5xx
+  actions:
+    - action: reply
+      code: 403
+      flag: true
+      none: ~
+- plain
+`
+	v, err := decodeYaml([]byte(doc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := []any{
+		map[string]any{
+			"name": "quoted # not a comment",
+			"match": map[string]any{
+				"method": []any{"INVITE", "it's", "a,b"},
+				"status": []any{json.Number("404"), "5xx"},
+			},
+			"actions": []any{
+				map[string]any{"action": "reply", "code": json.Number("403"), "flag": true, "none": nil},
+			},
+		},
+		"plain",
+	}
+	if !reflect.DeepEqual(v, exp) {
+		t.Errorf("Mismatch:\nExpected:\n%#v\nGot:\n%#v", exp, v)
+	}
+}
+
+func Test_rulesYaml_Errors(t *testing.T) {
+
+	tests := []struct {
+		name string
+		doc  string
+	}{
+		{"tab", "a:\n\t- b"},
+		{"duplicate", "a: 1\na: 2"},
+		{"no key", "a: 1\nb"},
+		{"indentation", "a: 1\n  b: 2"},
+		{"anchor", "a: &x 1"},
+		{"flow mapping", "a: {b: 1}"},
+		{"unterminated", "a: \"b"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := decodeYaml([]byte(tt.doc)); err == nil {
+				t.Errorf("Expected an error for %q", tt.doc)
+			}
+		})
+	}
+}
@@ -0,0 +1,193 @@
+package siprocket
+
+/*
+RFC4566 - https://tools.ietf.org/html/rfc4566#section-5
+
+5.  SDP Specification
+
+  An SDP session description consists of a number of lines of text of
+  the form:
+
+     <type>=<value>
+
+  where <type> MUST be exactly one case-significant character and
+  <value> is structured text whose format depends on <type>.  In
+  general, <value> is either a number of fields delimited by a single
+  space character or a free format string, and is case-significant
+  unless a specific field defines otherwise.  Whitespace MUST NOT be
+  used on either side of the "=" sign.
+
+  An SDP session description consists of a session-level section
+  followed by zero or more media-level sections.  The session-level
+  part starts with a "v=" line and continues to the first media-level
+  section.
+
+*/
+
+import (
+	"bytes"
+	"fmt"
+)
+
+type SdpMsg struct {
+	Version   []byte
+	Origin    SdpOrigin
+	Session   []byte
+	Timing    []byte
+	Bandwidth []SdpAttrib
+	MediaDesc SdpMediaDesc
+	Attrib    []SdpAttrib
+	ConnData  SdpConnData
+
+	SessConnData  SdpConnData // Session-level c= only
+	SessBandwidth []SdpAttrib // Session-level b= only
+	SessAttrib    []SdpAttrib // Session-level a= only
+	Other         []SdpAttrib // Other session-level lines, Cat holds the type eg i, u, e, p, r, z, k
+	Media         []SdpMedia  // One entry per m= section
+	Eol           []byte      // Line ending of the parsed body, CRLF when empty
+}
+
+// SdpLineError reports a malformed line in a session description
+type SdpLineError struct {
+	Line int    // Line number starting at 1
+	Text []byte // The offending line
+	Msg  string // What is wrong with it
+}
+
+func (e *SdpLineError) Error() string {
+	return fmt.Sprintf("sdp line %d %q: %s", e.Line, e.Text, e.Msg)
+}
+
+// ParseSdp parses a bare session description, such as the body of a SIP
+// message or one received over HTTP or RTSP. Malformed lines are skipped
+// and the first one found is returned as an *SdpLineError along with
+// everything that could be parsed.
+func ParseSdp(v []byte) (SdpMsg, error) {
+	var output SdpMsg
+
+	lines := bytes.Split(v, []byte("\n"))
+	err := parseSdpLines(lines, &output)
+	if len(lines) > 1 && !bytes.Contains(v, []byte("\r\n")) {
+		output.Eol = []byte("\n")
+	}
+
+	return output, err
+}
+
+func parseSdpLines(lines [][]byte, output *SdpMsg) error {
+	var err error
+
+	// Allow multiple media sections and Attribs
+	attr_idx := 0
+	band_idx := 0
+	media_idx := -1
+	output.Attrib = make([]SdpAttrib, 0, 8)
+	output.Bandwidth = make([]SdpAttrib, 0, 8)
+
+	// Remember the first malformed line only
+	lineError := func(i int, line []byte, msg string) {
+		if err == nil {
+			err = &SdpLineError{Line: i + 1, Text: line, Msg: msg}
+		}
+	}
+
+	first := true
+	for i, line := range lines {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+
+		if len(line) < 2 || line[1] != '=' || line[0] < 'a' || line[0] > 'z' {
+			lineError(i, line, "not in the form <type>=<value>")
+			continue
+		}
+		if first && line[0] != 'v' {
+			lineError(i, line, "session description must start with v=")
+		}
+		first = false
+
+		// SDP: Break up into type and value
+		lhdr := line[0]
+		lval := bytes.TrimSpace(line[2:])
+
+		// Switch on the line type
+		switch {
+		case lhdr == 'v':
+			output.Version = lval
+		case lhdr == 'o':
+			parseSdpOrigin(lval, &output.Origin)
+			if output.Origin.UnicastAddr == nil {
+				lineError(i, line, "origin requires 6 fields")
+			}
+		case lhdr == 's':
+			output.Session = lval
+			if lval == nil {
+				// Keep the "s= " form used for a session with no name
+				output.Session = bytes.TrimRight(bytes.TrimLeft(lines[i], " \t")[2:], "\r")
+			}
+		case lhdr == 't' && output.Timing == nil:
+			output.Timing = lval
+		case lhdr == 'm':
+			parseSdpMediaDesc(lval, &output.MediaDesc)
+			if output.MediaDesc.Proto == nil {
+				lineError(i, line, "media description requires media, port, proto and fmt")
+			}
+			// Start a new media section
+			output.Media = append(output.Media, SdpMedia{MediaDesc: output.MediaDesc})
+			media_idx++
+		case lhdr == 'c':
+			parseSdpConnectionData(lval, &output.ConnData)
+			if output.ConnData.ConnAddr == nil {
+				lineError(i, line, "connection data requires 3 fields")
+			}
+			if media_idx < 0 && output.SessConnData.ConnAddr != nil {
+				output.Other = append(output.Other, SdpAttrib{Cat: line[0:1], Val: lval, Src: output.ConnData.Src})
+			} else if media_idx < 0 {
+				output.SessConnData = output.ConnData
+			} else if output.Media[media_idx].ConnData.ConnAddr != nil {
+				// Multicast media may carry several c= lines
+				output.Media[media_idx].Other = append(output.Media[media_idx].Other, SdpAttrib{Cat: line[0:1], Val: lval, Src: output.ConnData.Src})
+			} else {
+				output.Media[media_idx].ConnData = output.ConnData
+			}
+		case lhdr == 'a':
+			var tmpAttrib SdpAttrib
+			output.Attrib = append(output.Attrib, tmpAttrib)
+			parseSdpAttrib(lval, &output.Attrib[attr_idx])
+			if media_idx < 0 {
+				output.SessAttrib = append(output.SessAttrib, output.Attrib[attr_idx])
+			} else {
+				output.Media[media_idx].Attrib = append(output.Media[media_idx].Attrib, output.Attrib[attr_idx])
+			}
+			attr_idx++
+		case lhdr == 'b':
+			// Same as above but for Bandwidth
+			var tmpAttrib SdpAttrib
+			output.Bandwidth = append(output.Bandwidth, tmpAttrib)
+			parseSdpAttrib(lval, &output.Bandwidth[band_idx])
+			if len(output.Bandwidth[band_idx].Val) == 0 {
+				lineError(i, line, "bandwidth requires <bwtype>:<bandwidth>")
+			}
+			if media_idx < 0 {
+				output.SessBandwidth = append(output.SessBandwidth, output.Bandwidth[band_idx])
+			} else {
+				output.Media[media_idx].Bandwidth = append(output.Media[media_idx].Bandwidth, output.Bandwidth[band_idx])
+			}
+			band_idx++
+		default:
+			// Keep any other line so that the body can be written back
+			other := SdpAttrib{Cat: line[0:1], Val: lval}
+			if keep_src {
+				other.Src = lval
+			}
+			if media_idx < 0 {
+				output.Other = append(output.Other, other)
+			} else {
+				output.Media[media_idx].Other = append(output.Media[media_idx].Other, other)
+			}
+		} // End of Switch
+	}
+
+	return err
+}
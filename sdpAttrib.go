@@ -29,12 +29,16 @@ type SdpAttrib struct {
 	Src []byte // Full source if needed
 }
 
+// NewSdpAttrib returns an attribute, an empty val gives one without a value
 func NewSdpAttrib(cat, val, src string) SdpAttrib {
-	return SdpAttrib{
+	out := SdpAttrib{
 		Cat: []byte(cat),
-		Val: []byte(val),
 		Src: []byte(src),
 	}
+	if val != "" {
+		out.Val = []byte(val)
+	}
+	return out
 }
 
 func parseSdpAttrib(v []byte, out *SdpAttrib) {
@@ -57,6 +61,8 @@ func parseSdpAttrib(v []byte, out *SdpAttrib) {
 		switch state {
 		case FIELD_CAT:
 			if v[pos] == ':' {
+				// A colon gives a value, even an empty one
+				out.Val = []byte{}
 				state = FIELD_VALUE
 				pos++
 				continue
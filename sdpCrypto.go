@@ -0,0 +1,280 @@
+package siprocket
+
+/*
+RFC4568 - https://datatracker.ietf.org/doc/html/rfc4568#section-9.1
+
+9.1.  Generic "Crypto" Attribute Grammar
+
+  a=crypto:<tag> <crypto-suite> <key-params> [<session-params>]
+
+  key-params  = key-param *(";" key-param)
+  key-param   = key-method ":" key-info
+  key-info    = key-salt ["|" lifetime] ["|" mki ":" mki-length]   (inline)
+
+eg:
+a=crypto:1 AES_CM_128_HMAC_SHA1_80 inline:PS1uQCVeeCFCanVmcjkpPywjNWhcYD0mXXtxaVBR|2^20|1:4
+
+*/
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type SdpCrypto struct {
+	Tag           []byte         // Tag, unique per media description
+	Suite         []byte         // Crypto Suite eg AES_CM_128_HMAC_SHA1_80
+	KeyParams     []SdpCryptoKey // One or more key-params
+	SessionParams [][]byte       // Session parameters eg UNENCRYPTED_SRTP
+	Src           []byte         // Full source if needed
+}
+
+type SdpCryptoKey struct {
+	Method    []byte // Key Method, only inline is defined
+	KeySalt   []byte // Decoded concatenated master key and salt
+	Key       []byte // Master key portion of KeySalt
+	Salt      []byte // Master salt portion of KeySalt
+	Lifetime  []byte // Lifetime eg 2^20
+	Mki       []byte // MKI value
+	MkiLength []byte // MKI length in bytes
+	Info      []byte // Key info as written, for methods other than inline
+	Src       []byte // Full source if needed
+}
+
+// Master key and salt lengths in bytes for the known crypto suites
+var sdpCryptoSuites = map[string][2]int{
+	"AES_CM_128_HMAC_SHA1_80": {16, 14},
+	"AES_CM_128_HMAC_SHA1_32": {16, 14},
+	"F8_128_HMAC_SHA1_80":     {16, 14},
+	"AES_192_CM_HMAC_SHA1_80": {24, 14},
+	"AES_192_CM_HMAC_SHA1_32": {24, 14},
+	"AES_256_CM_HMAC_SHA1_80": {32, 14},
+	"AES_256_CM_HMAC_SHA1_32": {32, 14},
+	"AEAD_AES_128_GCM":        {16, 12},
+	"AEAD_AES_256_GCM":        {32, 12},
+}
+
+// ParseSdpCrypto parses the value of an a=crypto attribute
+func ParseSdpCrypto(v []byte) (SdpCrypto, error) {
+	var out SdpCrypto
+	err := parseSdpCrypto(v, &out)
+	return out, err
+}
+
+// SdpCryptoAttribs parses every a=crypto attribute found in the list
+func SdpCryptoAttribs(attribs []SdpAttrib) ([]SdpCrypto, error) {
+	var out []SdpCrypto
+	for _, attr := range attribs {
+		if !strings.EqualFold(string(attr.Cat), "crypto") {
+			continue
+		}
+		crypto, err := ParseSdpCrypto(attr.Val)
+		if err != nil {
+			return out, err
+		}
+		out = append(out, crypto)
+	}
+	return out, nil
+}
+
+func parseSdpCrypto(v []byte, out *SdpCrypto) error {
+
+	// Init the output area
+	out.Tag = nil
+	out.Suite = nil
+	out.KeyParams = nil
+	out.SessionParams = nil
+	out.Src = nil
+
+	// Keep the source line if needed
+	if keep_src {
+		out.Src = v
+	}
+
+	fields := bytes.Fields(v)
+	if len(fields) < 3 {
+		return errors.New("crypto attribute requires tag, suite and key-params")
+	}
+
+	out.Tag = fields[0]
+	if _, err := strconv.ParseUint(string(out.Tag), 10, 32); err != nil {
+		return fmt.Errorf("invalid crypto tag %q", out.Tag)
+	}
+	out.Suite = fields[1]
+
+	for _, param := range bytes.Split(fields[2], []byte(";")) {
+		var key SdpCryptoKey
+		if err := parseSdpCryptoKey(param, string(out.Suite), &key); err != nil {
+			return err
+		}
+		out.KeyParams = append(out.KeyParams, key)
+	}
+
+	out.SessionParams = fields[3:]
+	if len(out.SessionParams) == 0 {
+		out.SessionParams = nil
+	}
+
+	return nil
+}
+
+func parseSdpCryptoKey(v []byte, suite string, out *SdpCryptoKey) error {
+	var idx int
+
+	// Keep the source line if needed
+	if keep_src {
+		out.Src = v
+	}
+
+	if idx = bytes.IndexByte(v, ':'); idx == -1 {
+		return fmt.Errorf("key-param %q has no key method", v)
+	}
+	out.Method = v[:idx]
+	v = v[idx+1:]
+
+	// Only the inline method has a defined key-info format
+	if !strings.EqualFold(string(out.Method), "inline") {
+		out.Info = v
+		return nil
+	}
+
+	parts := bytes.Split(v, []byte("|"))
+	keySalt, err := decodeSdpCryptoKey(parts[0])
+	if err != nil {
+		return fmt.Errorf("invalid key-salt %q: %v", parts[0], err)
+	}
+	out.KeySalt = keySalt
+
+	// Lifetime and MKI are both optional, the MKI is the one with a colon
+	for _, part := range parts[1:] {
+		if idx = bytes.IndexByte(part, ':'); idx > -1 {
+			out.Mki = part[:idx]
+			out.MkiLength = part[idx+1:]
+			continue
+		}
+		out.Lifetime = part
+	}
+
+	// Split the key from the salt when the suite is known
+	if lens, ok := sdpCryptoSuites[strings.ToUpper(suite)]; ok {
+		if len(keySalt) != lens[0]+lens[1] {
+			return fmt.Errorf("key-salt for %s is %d bytes, expected %d", suite, len(keySalt), lens[0]+lens[1])
+		}
+		out.Key = keySalt[:lens[0]]
+		out.Salt = keySalt[lens[0]:]
+	}
+
+	return nil
+}
+
+// decodeSdpCryptoKey accepts the key with or without base64 padding
+func decodeSdpCryptoKey(v []byte) ([]byte, error) {
+	s := strings.TrimRight(string(v), "=")
+	return base64.RawStdEncoding.DecodeString(s)
+}
+
+// sdpCryptoKeyText returns the key as written in Src when it still decodes
+// to keySalt, so a key sent without padding is written back the same way.
+// It returns nil when the key was changed or there is no Src.
+func sdpCryptoKeyText(key *SdpCryptoKey, keySalt []byte) []byte {
+	_, text, ok := bytes.Cut(key.Src, []byte(":"))
+	if !ok {
+		return nil
+	}
+	text, _, _ = bytes.Cut(text, []byte("|"))
+	var buf [64]byte
+	raw := bytes.TrimRight(text, "=")
+	if base64.RawStdEncoding.DecodedLen(len(raw)) > len(buf) {
+		return nil
+	}
+	n, err := base64.RawStdEncoding.Decode(buf[:], raw)
+	if err != nil || !bytes.Equal(buf[:n], keySalt) {
+		return nil
+	}
+	return text
+}
+
+// SdpCryptoLifetime returns the key lifetime in packets, accepting both
+// the decimal and the 2^n forms. It returns 0 when no lifetime was given.
+func SdpCryptoLifetime(key *SdpCryptoKey) (uint64, error) {
+	if len(key.Lifetime) == 0 {
+		return 0, nil
+	}
+	if exp, ok := bytes.CutPrefix(key.Lifetime, []byte("2^")); ok {
+		n, err := strconv.ParseUint(string(exp), 10, 8)
+		if err != nil || n > 63 {
+			return 0, fmt.Errorf("invalid lifetime %q", key.Lifetime)
+		}
+		return 1 << n, nil
+	}
+	return strconv.ParseUint(string(key.Lifetime), 10, 64)
+}
+
+// MarshalSdpCrypto writes the value of an a=crypto attribute, the key is
+// taken from KeySalt or, when that is empty, from Key followed by Salt. A
+// parsed key that was not changed keeps the encoding it came with.
+func MarshalSdpCrypto(data *SdpCrypto) string {
+	return string(AppendSdpCrypto(nil, data))
+}
+
+// AppendSdpCrypto appends the value of an a=crypto attribute to dst and
+// returns the extended buffer
+func AppendSdpCrypto(dst []byte, data *SdpCrypto) []byte {
+	dst = append(dst, data.Tag...)
+	dst = append(dst, ' ')
+	dst = append(dst, data.Suite...)
+	dst = append(dst, ' ')
+
+	// Key and Salt are joined in a buffer large enough for every known suite
+	var buf [64]byte
+	for i := range data.KeyParams {
+		key := &data.KeyParams[i]
+		if i > 0 {
+			dst = append(dst, ';')
+		}
+		method := key.Method
+		if len(method) == 0 {
+			method = []byte("inline")
+		}
+		dst = append(dst, method...)
+		dst = append(dst, ':')
+
+		// Key methods other than inline have no defined key-info format
+		if !strings.EqualFold(string(method), "inline") {
+			dst = append(dst, key.Info...)
+			continue
+		}
+
+		keySalt := key.KeySalt
+		if len(keySalt) == 0 {
+			keySalt = append(append(buf[:0], key.Key...), key.Salt...)
+		}
+		if text := sdpCryptoKeyText(key, keySalt); text != nil {
+			dst = append(dst, text...)
+		} else {
+			dst = base64.StdEncoding.AppendEncode(dst, keySalt)
+		}
+
+		if len(key.Lifetime) > 0 {
+			dst = append(dst, '|')
+			dst = append(dst, key.Lifetime...)
+		}
+		if len(key.Mki) > 0 {
+			dst = append(dst, '|')
+			dst = append(dst, key.Mki...)
+			dst = append(dst, ':')
+			dst = append(dst, key.MkiLength...)
+		}
+	}
+
+	for _, param := range data.SessionParams {
+		dst = append(dst, ' ')
+		dst = append(dst, param...)
+	}
+
+	return dst
+}
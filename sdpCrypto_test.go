@@ -0,0 +1,183 @@
+package siprocket
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func Test_sdpParseCrypto_AES_CM(t *testing.T) {
+
+	val := []byte("1 AES_CM_128_HMAC_SHA1_80 inline:PS1uQCVeeCFCanVmcjkpPywjNWhcYD0mXXtxaVBR|2^20|1:4")
+
+	out, err := ParseSdpCrypto(val)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if string(out.Tag) != "1" || string(out.Suite) != "AES_CM_128_HMAC_SHA1_80" {
+		t.Errorf("Mismatch: tag %q suite %q", out.Tag, out.Suite)
+	}
+	if len(out.KeyParams) != 1 {
+		t.Fatalf("expected 1 key-param, got %d", len(out.KeyParams))
+	}
+	key := out.KeyParams[0]
+	if len(key.KeySalt) != 30 || len(key.Key) != 16 || len(key.Salt) != 14 {
+		t.Errorf("Mismatch: key-salt %d key %d salt %d", len(key.KeySalt), len(key.Key), len(key.Salt))
+	}
+	if !bytes.Equal(key.Key, key.KeySalt[:16]) || !bytes.Equal(key.Salt, key.KeySalt[16:]) {
+		t.Errorf("key and salt do not split the key-salt")
+	}
+	if string(key.Lifetime) != "2^20" || string(key.Mki) != "1" || string(key.MkiLength) != "4" {
+		t.Errorf("Mismatch: lifetime %q mki %q:%q", key.Lifetime, key.Mki, key.MkiLength)
+	}
+	if lifetime, err := SdpCryptoLifetime(&key); err != nil || lifetime != 1<<20 {
+		t.Errorf("Mismatch: lifetime %d %v", lifetime, err)
+	}
+	if out.SessionParams != nil {
+		t.Errorf("unexpected session params %q", out.SessionParams)
+	}
+
+	if got := MarshalSdpCrypto(&out); got != string(val) {
+		t.Errorf("Mismatch:\nExpected:\n%s\nGot:\n%s", val, got)
+	}
+}
+
+func Test_sdpParseCrypto_GCM_SessionParams(t *testing.T) {
+
+	val := []byte("2 AEAD_AES_256_GCM inline:AQIDBAUGBwgJCgsMDQ4PEBESExQVFhcYGRobHB0eHyAhIiMkJSYnKCkqKyw= UNENCRYPTED_SRTCP KDR=1")
+
+	out, err := ParseSdpCrypto(val)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	key := out.KeyParams[0]
+	expKey := []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20, 21, 22, 23, 24, 25, 26, 27, 28, 29, 30, 31, 32}
+	expSalt := []byte{33, 34, 35, 36, 37, 38, 39, 40, 41, 42, 43, 44}
+	if !reflect.DeepEqual(key.Key, expKey) || !reflect.DeepEqual(key.Salt, expSalt) {
+		t.Errorf("Mismatch: key %v salt %v", key.Key, key.Salt)
+	}
+	if key.Lifetime != nil || key.Mki != nil {
+		t.Errorf("unexpected lifetime %q or mki %q", key.Lifetime, key.Mki)
+	}
+	expParams := [][]byte{[]byte("UNENCRYPTED_SRTCP"), []byte("KDR=1")}
+	if !reflect.DeepEqual(out.SessionParams, expParams) {
+		t.Errorf("Mismatch: session params %q", out.SessionParams)
+	}
+
+	if got := MarshalSdpCrypto(&out); got != string(val) {
+		t.Errorf("Mismatch:\nExpected:\n%s\nGot:\n%s", val, got)
+	}
+}
+
+func Test_sdpParseCrypto_OtherMethod(t *testing.T) {
+
+	val := []byte("1 AES_CM_128_HMAC_SHA1_80 mikey:AQIDBA|x")
+
+	out, err := ParseSdpCrypto(val)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := MarshalSdpCrypto(&out); got != string(val) {
+		t.Errorf("Mismatch:\nExpected:\n%s\nGot:\n%s", val, got)
+	}
+
+	// Built in code, without a source
+	built := SdpCrypto{
+		Tag:       []byte("1"),
+		Suite:     []byte("AES_CM_128_HMAC_SHA1_80"),
+		KeyParams: []SdpCryptoKey{{Method: []byte("mikey"), Info: []byte("AQIDBA|x")}},
+	}
+	if got := MarshalSdpCrypto(&built); got != string(val) {
+		t.Errorf("Mismatch:\nExpected:\n%s\nGot:\n%s", val, got)
+	}
+}
+
+func Test_sdpParseCrypto_Invalid(t *testing.T) {
+
+	for _, val := range []string{
+		"1 AES_CM_128_HMAC_SHA1_80",
+		"x AES_CM_128_HMAC_SHA1_80 inline:PS1uQCVeeCFCanVmcjkpPywjNWhcYD0mXXtxaVBR",
+		"1 AES_CM_128_HMAC_SHA1_80 inline:AQID",
+		"1 AES_CM_128_HMAC_SHA1_80 inline:!!!",
+	} {
+		if _, err := ParseSdpCrypto([]byte(val)); err == nil {
+			t.Errorf("expected an error for %q", val)
+		}
+	}
+}
+
+func Test_sdpParseCrypto_FromMessage(t *testing.T) {
+
+	msg := "INVITE sip:bob@127.0.0.1 SIP/2.0\r\n" +
+		"Content-Type: application/sdp\r\n" +
+		"\r\n" +
+		"v=0\r\n" +
+		"m=audio 4000 RTP/SAVP 0\r\n" +
+		"a=crypto:1 AES_CM_128_HMAC_SHA1_80 inline:PS1uQCVeeCFCanVmcjkpPywjNWhcYD0mXXtxaVBR|2^20|1:4\r\n" +
+		"a=crypto:2 AES_CM_128_HMAC_SHA1_32 inline:PS1uQCVeeCFCanVmcjkpPywjNWhcYD0mXXtxaVBR\r\n" +
+		"a=sendrecv\r\n"
+
+	sip := Parse([]byte(msg))
+	cryptos, err := SdpCryptoAttribs(sip.Sdp.Attrib)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(cryptos) != 2 {
+		t.Fatalf("expected 2 crypto attributes, got %d", len(cryptos))
+	}
+	if string(cryptos[1].Suite) != "AES_CM_128_HMAC_SHA1_32" || len(cryptos[1].KeyParams[0].Key) != 16 {
+		t.Errorf("Mismatch: %q", cryptos[1].Src)
+	}
+}
+
+func Test_sdpAppendCrypto(t *testing.T) {
+
+	val := "1 AES_CM_128_HMAC_SHA1_80 inline:PS1uQCVeeCFCanVmcjkpPywjNWhcYD0mXXtxaVBR|2^20|1:4"
+
+	out, err := ParseSdpCrypto([]byte(val))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Built from Key and Salt only, appended after existing content
+	key := out.KeyParams[0]
+	built := SdpCrypto{
+		Tag:   out.Tag,
+		Suite: out.Suite,
+		KeyParams: []SdpCryptoKey{{
+			Key:       key.Key,
+			Salt:      key.Salt,
+			Lifetime:  key.Lifetime,
+			Mki:       key.Mki,
+			MkiLength: key.MkiLength,
+		}},
+	}
+	if got := string(AppendSdpCrypto([]byte("a=crypto:"), &built)); got != "a=crypto:"+val {
+		t.Errorf("Mismatch:\nExpected:\na=crypto:%s\nGot:\n%s", val, got)
+	}
+}
+
+func Test_sdpParseCrypto_Unpadded(t *testing.T) {
+
+	val := "2 AEAD_AES_256_GCM inline:AQIDBAUGBwgJCgsMDQ4PEBESExQVFhcYGRobHB0eHyAhIiMkJSYnKCkqKyw|2^31"
+
+	out, err := ParseSdpCrypto([]byte(val))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// An unchanged key is written as it was sent
+	if got := MarshalSdpCrypto(&out); got != val {
+		t.Errorf("Mismatch:\nExpected:\n%s\nGot:\n%s", val, got)
+	}
+
+	// A new key is written with padding
+	key := bytes.Repeat([]byte{1}, 44)
+	out.KeyParams[0].KeySalt = key
+	exp := "2 AEAD_AES_256_GCM inline:AQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQE=|2^31"
+	if got := MarshalSdpCrypto(&out); got != exp {
+		t.Errorf("Mismatch:\nExpected:\n%s\nGot:\n%s", exp, got)
+	}
+}
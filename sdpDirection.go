@@ -0,0 +1,213 @@
+package siprocket
+
+/*
+RFC3264 - https://datatracker.ietf.org/doc/html/rfc3264#section-8.4
+
+8.4.  Putting a Unicast Media Stream on Hold
+
+  If a party in a call wants to put the other party "on hold", i.e.,
+  request that it temporarily stops sending one or more unicast media
+  streams, a party offers the other an updated SDP.
+
+  If the stream to be placed on hold was previously a sendrecv media
+  stream, it is placed on hold by marking it sendonly.  If the stream to
+  be placed on hold was previously a recvonly media stream, it is placed
+  on hold by marking it inactive.
+
+  RFC 2543 [10] specified that placing a user on hold was accomplished
+  by setting the connection address to 0.0.0.0.
+
+eg:
+c=IN IP4 0.0.0.0
+a=sendonly
+
+*/
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+)
+
+const (
+	SDP_SENDRECV = "sendrecv"
+	SDP_SENDONLY = "sendonly"
+	SDP_RECVONLY = "recvonly"
+	SDP_INACTIVE = "inactive"
+)
+
+const (
+	SDP_CHANGE_CODEC     = "codec"
+	SDP_CHANGE_ADDRESS   = "address"
+	SDP_CHANGE_DIRECTION = "direction"
+	SDP_CHANGE_ADDED     = "added"
+	SDP_CHANGE_REMOVED   = "removed"
+)
+
+// SdpStream is the effective state of one media section once the
+// session-level defaults have been applied
+type SdpStream struct {
+	Index      int      // Position of the m= line
+	MediaType  string   // audio, video etc
+	Port       int      // Media port, 0 when rejected
+	ConnAddr   string   // Effective connection address
+	Direction  string   // sendrecv, sendonly, recvonly or inactive
+	Fmt        []string // Media formats in order of preference
+	Rejected   bool     // Port is zero
+	LegacyHold bool     // RFC 2543 hold, c=IN IP4 0.0.0.0
+}
+
+// SdpChange describes one difference between two session descriptions
+type SdpChange struct {
+	Kind  string // One of the SDP_CHANGE_ constants
+	Index int    // Position of the m= line
+	Old   string // Value in the old description
+	New   string // Value in the new description
+}
+
+// sdpDirection returns the direction attribute in the list or an empty string
+func sdpDirection(attribs []SdpAttrib) string {
+	dir := ""
+	for _, attr := range attribs {
+		switch strings.ToLower(string(attr.Cat)) {
+		case SDP_SENDRECV, SDP_SENDONLY, SDP_RECVONLY, SDP_INACTIVE:
+			dir = strings.ToLower(string(attr.Cat))
+		}
+	}
+	return dir
+}
+
+// MediaDirection returns the effective direction of the media section at
+// idx. A media-level attribute overrides the session-level one and the
+// default is sendrecv.
+func (s *SdpMsg) MediaDirection(idx int) string {
+	media := s.mediaSections()
+	if idx < 0 || idx >= len(media) {
+		return ""
+	}
+	if dir := sdpDirection(media[idx].Attrib); dir != "" {
+		return dir
+	}
+	if dir := sdpDirection(s.SessAttrib); dir != "" {
+		return dir
+	}
+	return SDP_SENDRECV
+}
+
+// MediaConnData returns the effective connection data of the media
+// section at idx, falling back to the session-level c= line
+func (s *SdpMsg) MediaConnData(idx int) SdpConnData {
+	media := s.mediaSections()
+	if idx < 0 || idx >= len(media) {
+		return SdpConnData{}
+	}
+	if media[idx].ConnData.ConnAddr != nil {
+		return media[idx].ConnData
+	}
+	return s.SessConnData
+}
+
+// IsRejected reports whether the media section at idx has port zero
+func (s *SdpMsg) IsRejected(idx int) bool {
+	media := s.mediaSections()
+	if idx < 0 || idx >= len(media) {
+		return false
+	}
+	return sdpMediaPort(&media[idx].MediaDesc) == 0
+}
+
+// IsLegacyHold reports whether the media section at idx uses the RFC 2543
+// hold form of an all zeros IPv4 connection address
+func (s *SdpMsg) IsLegacyHold(idx int) bool {
+	conn := s.MediaConnData(idx)
+	return bytes.Equal(conn.ConnAddr, []byte("0.0.0.0"))
+}
+
+// Streams returns the effective state of every media section
+func (s *SdpMsg) Streams() []SdpStream {
+	media := s.mediaSections()
+	streams := make([]SdpStream, 0, len(media))
+	for i := range media {
+		port := sdpMediaPort(&media[i].MediaDesc)
+		streams = append(streams, SdpStream{
+			Index:      i,
+			MediaType:  string(media[i].MediaDesc.MediaType),
+			Port:       port,
+			ConnAddr:   string(s.MediaConnData(i).ConnAddr),
+			Direction:  s.MediaDirection(i),
+			Fmt:        strings.Fields(string(media[i].MediaDesc.Fmt)),
+			Rejected:   port == 0,
+			LegacyHold: s.IsLegacyHold(i),
+		})
+	}
+	return streams
+}
+
+// IsHold reports whether the description puts the call on hold, that is
+// every stream that is not rejected is either sendonly, inactive or uses
+// the legacy 0.0.0.0 address
+func (s *SdpMsg) IsHold() bool {
+	held := false
+	for _, stream := range s.Streams() {
+		if stream.Rejected {
+			continue
+		}
+		if stream.LegacyHold || stream.Direction == SDP_SENDONLY || stream.Direction == SDP_INACTIVE {
+			held = true
+			continue
+		}
+		return false
+	}
+	return held
+}
+
+// CompareSdp reports what changed between two session descriptions, such
+// as an offer and the re-INVITE that follows it. Media sections are
+// matched by position as described in RFC 3264 section 8.
+func CompareSdp(prev, next *SdpMsg) []SdpChange {
+	var changes []SdpChange
+
+	oldStreams := prev.Streams()
+	newStreams := next.Streams()
+
+	for i := 0; i < len(oldStreams) || i < len(newStreams); i++ {
+		oldLive := i < len(oldStreams) && !oldStreams[i].Rejected
+		newLive := i < len(newStreams) && !newStreams[i].Rejected
+
+		switch {
+		case !oldLive && !newLive:
+			continue
+		case !oldLive:
+			changes = append(changes, SdpChange{Kind: SDP_CHANGE_ADDED, Index: i, New: newStreams[i].MediaType})
+			continue
+		case !newLive:
+			changes = append(changes, SdpChange{Kind: SDP_CHANGE_REMOVED, Index: i, Old: oldStreams[i].MediaType})
+			continue
+		}
+
+		o, n := oldStreams[i], newStreams[i]
+		if oldFmt, newFmt := strings.Join(o.Fmt, " "), strings.Join(n.Fmt, " "); oldFmt != newFmt {
+			changes = append(changes, SdpChange{Kind: SDP_CHANGE_CODEC, Index: i, Old: oldFmt, New: newFmt})
+		}
+		oldAddr := o.ConnAddr + ":" + strconv.Itoa(o.Port)
+		newAddr := n.ConnAddr + ":" + strconv.Itoa(n.Port)
+		if oldAddr != newAddr {
+			changes = append(changes, SdpChange{Kind: SDP_CHANGE_ADDRESS, Index: i, Old: oldAddr, New: newAddr})
+		}
+		if o.Direction != n.Direction {
+			changes = append(changes, SdpChange{Kind: SDP_CHANGE_DIRECTION, Index: i, Old: o.Direction, New: n.Direction})
+		}
+	}
+
+	return changes
+}
+
+// sdpMediaPort returns the media port, ignoring any /<number of ports>
+func sdpMediaPort(m *SdpMediaDesc) int {
+	port := m.Port
+	if idx := bytes.IndexByte(port, '/'); idx > -1 {
+		port = port[:idx]
+	}
+	n, _ := strconv.Atoi(string(port))
+	return n
+}
@@ -0,0 +1,93 @@
+package siprocket
+
+import (
+	"reflect"
+	"testing"
+)
+
+const sdpDirectionOffer = "INVITE sip:bob@10.0.0.1 SIP/2.0\r\n" +
+	"Content-Type: application/sdp\r\n" +
+	"\r\n" +
+	"v=0\r\n" +
+	"o=alice 2890844526 2890844526 IN IP4 10.0.0.2\r\n" +
+	"s=-\r\n" +
+	"c=IN IP4 10.0.0.2\r\n" +
+	"t=0 0\r\n" +
+	"a=recvonly\r\n" +
+	"m=audio 49170 RTP/AVP 0 8 101\r\n" +
+	"a=sendrecv\r\n" +
+	"m=video 51372 RTP/AVP 31\r\n" +
+	"c=IN IP4 10.0.0.3\r\n"
+
+func Test_sdpDirection_Streams(t *testing.T) {
+
+	sip := Parse([]byte(sdpDirectionOffer))
+
+	exp := []SdpStream{
+		{Index: 0, MediaType: "audio", Port: 49170, ConnAddr: "10.0.0.2", Direction: SDP_SENDRECV, Fmt: []string{"0", "8", "101"}},
+		{Index: 1, MediaType: "video", Port: 51372, ConnAddr: "10.0.0.3", Direction: SDP_RECVONLY, Fmt: []string{"31"}},
+	}
+
+	out := sip.Sdp.Streams()
+	if !reflect.DeepEqual(out, exp) {
+		t.Errorf("Mismatch:\nExpected:\n%+v\nGot:\n%+v", exp, out)
+	}
+	if sip.Sdp.IsHold() {
+		t.Errorf("offer should not be a hold")
+	}
+}
+
+func Test_sdpDirection_Hold(t *testing.T) {
+
+	sendonly := Parse([]byte("INVITE sip:bob@10.0.0.1 SIP/2.0\r\n\r\n" +
+		"v=0\r\n" +
+		"c=IN IP4 10.0.0.2\r\n" +
+		"m=audio 49170 RTP/AVP 0\r\n" +
+		"a=sendonly\r\n" +
+		"m=video 0 RTP/AVP 31\r\n"))
+	if !sendonly.Sdp.IsHold() {
+		t.Errorf("sendonly with a rejected video stream should be a hold")
+	}
+	if !sendonly.Sdp.IsRejected(1) || sendonly.Sdp.IsRejected(0) {
+		t.Errorf("only the video stream should be rejected")
+	}
+
+	legacy := Parse([]byte("INVITE sip:bob@10.0.0.1 SIP/2.0\r\n\r\n" +
+		"v=0\r\n" +
+		"c=IN IP4 0.0.0.0\r\n" +
+		"m=audio 49170 RTP/AVP 0\r\n"))
+	if !legacy.Sdp.IsLegacyHold(0) || !legacy.Sdp.IsHold() {
+		t.Errorf("c=IN IP4 0.0.0.0 should be a legacy hold")
+	}
+	if legacy.Sdp.MediaDirection(0) != SDP_SENDRECV {
+		t.Errorf("Mismatch: direction %q", legacy.Sdp.MediaDirection(0))
+	}
+}
+
+func Test_sdpDirection_Compare(t *testing.T) {
+
+	offer := Parse([]byte(sdpDirectionOffer))
+	reinvite := Parse([]byte("INVITE sip:bob@10.0.0.1 SIP/2.0\r\n\r\n" +
+		"v=0\r\n" +
+		"c=IN IP4 10.0.0.9\r\n" +
+		"m=audio 49170 RTP/AVP 8 101\r\n" +
+		"a=sendonly\r\n" +
+		"m=video 0 RTP/AVP 31\r\n" +
+		"m=audio 50000 RTP/AVP 0\r\n"))
+
+	exp := []SdpChange{
+		{Kind: SDP_CHANGE_CODEC, Index: 0, Old: "0 8 101", New: "8 101"},
+		{Kind: SDP_CHANGE_ADDRESS, Index: 0, Old: "10.0.0.2:49170", New: "10.0.0.9:49170"},
+		{Kind: SDP_CHANGE_DIRECTION, Index: 0, Old: SDP_SENDRECV, New: SDP_SENDONLY},
+		{Kind: SDP_CHANGE_REMOVED, Index: 1, Old: "video"},
+		{Kind: SDP_CHANGE_ADDED, Index: 2, New: "audio"},
+	}
+
+	out := CompareSdp(&offer.Sdp, &reinvite.Sdp)
+	if !reflect.DeepEqual(out, exp) {
+		t.Errorf("Mismatch:\nExpected:\n%+v\nGot:\n%+v", exp, out)
+	}
+	if len(CompareSdp(&offer.Sdp, &offer.Sdp)) != 0 {
+		t.Errorf("comparing a description with itself should report no changes")
+	}
+}
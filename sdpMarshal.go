@@ -0,0 +1,211 @@
+package siprocket
+
+/*
+RFC8866 - https://datatracker.ietf.org/doc/html/rfc8866#section-5
+
+5.  SDP Specification
+
+  Some lines in each description are required and some are optional, but
+  when present, they must appear in exactly the order given here.
+
+   Session description
+      v=  (protocol version)
+      o=  (originator and session identifier)
+      s=  (session name)
+      i=* (session information)
+      u=* (URI of description)
+      e=* (email address)
+      p=* (phone number)
+      c=* (connection information -- not required if included in
+           all media descriptions)
+      b=* (zero or more bandwidth information lines)
+      One or more time descriptions:
+        ("t=", "r=" and "z=" lines; see below)
+      k=* (obsolete)
+      a=* (zero or more session attribute lines)
+      Zero or more media descriptions
+
+   Media description, if present
+      m=  (media name and transport address)
+      i=* (media title)
+      c=* (connection information -- optional if included at
+           session level)
+      b=* (zero or more bandwidth information lines)
+      k=* (obsolete)
+      a=* (zero or more media attribute lines)
+
+*/
+
+import (
+	"strings"
+)
+
+// The line types written from the Other lists that are known to SDP
+const sdpKnownTypes = "voiuepcbtrzkam"
+
+// MarshalSdp writes the session description in RFC 8866 order using the
+// line ending it was parsed with, CRLF otherwise. Session-level c=, b= and
+// a= lines are taken from SessConnData, SessBandwidth and SessAttrib and
+// each media section from Media. A message that only has the flat
+// MediaDesc, ConnData and Attrib fields set is written as a single media
+// section.
+func MarshalSdp(sdp *SdpMsg) []byte {
+	return appendSdp(make([]byte, 0, 256), sdp)
+}
+
+// appendSdp appends the session description to dst, see MarshalSdp
+func appendSdp(dst []byte, sdp *SdpMsg) []byte {
+	eol := ENDL
+	if len(sdp.Eol) > 0 {
+		eol = string(sdp.Eol)
+	}
+	sessConn := sdp.SessConnData
+	sessBand := sdp.SessBandwidth
+	sessAttr := sdp.SessAttrib
+	if len(sdp.Media) == 0 {
+		// Built by hand using the flat fields only
+		if sessBand == nil {
+			sessBand = sdp.Bandwidth
+		}
+		if sdp.MediaDesc.MediaType == nil {
+			if sessConn.ConnAddr == nil {
+				sessConn = sdp.ConnData
+			}
+			if sessAttr == nil {
+				sessAttr = sdp.Attrib
+			}
+		}
+	}
+
+	// Write Protocol Version
+	if sdp.Version != nil {
+		dst = appendSdpLine(dst, 'v', sdp.Version, eol)
+	}
+
+	// Write Origin
+	if !sdpOriginEmpty(&sdp.Origin) {
+		o := &sdp.Origin
+		dst = append(dst, "o="...)
+		dst = append(dst, o.Username...)
+		dst = append(dst, ' ')
+		dst = append(dst, o.SessId...)
+		dst = append(dst, ' ')
+		dst = append(dst, o.SessVer...)
+		dst = append(dst, ' ')
+		dst = append(dst, o.NetType...)
+		dst = append(dst, ' ')
+		dst = append(dst, o.AddrType...)
+		dst = append(dst, ' ')
+		dst = append(dst, o.UnicastAddr...)
+		dst = append(dst, eol...)
+	}
+
+	// Write Session Name, the s= line is mandatory so an empty name is
+	// written as a single space
+	if len(sdp.Session) > 0 {
+		dst = appendSdpLine(dst, 's', sdp.Session, eol)
+	} else if sdp.Version != nil || sdp.Session != nil {
+		dst = appendSdpLine(dst, 's', []byte(" "), eol)
+	}
+
+	dst = appendSdpOther(dst, sdp.Other, "i", eol)
+	dst = appendSdpOther(dst, sdp.Other, "u", eol)
+	dst = appendSdpOther(dst, sdp.Other, "e", eol)
+	dst = appendSdpOther(dst, sdp.Other, "p", eol)
+	dst = appendSdpConnData(dst, &sessConn, eol)
+	dst = appendSdpOther(dst, sdp.Other, "c", eol)
+	dst = appendSdpAttribs(dst, 'b', sessBand, eol)
+
+	// Write Timing, repeat times follow the t= line they belong to
+	if sdp.Timing != nil {
+		dst = appendSdpLine(dst, 't', sdp.Timing, eol)
+	}
+	dst = appendSdpOther(dst, sdp.Other, "tr", eol)
+	dst = appendSdpOther(dst, sdp.Other, "z", eol)
+	dst = appendSdpOther(dst, sdp.Other, "k", eol)
+	dst = appendSdpOther(dst, sdp.Other, "", eol)
+	dst = appendSdpAttribs(dst, 'a', sessAttr, eol)
+
+	// Write Media Descriptions
+	for _, media := range sdp.mediaSections() {
+		m := &media.MediaDesc
+		dst = append(dst, "m="...)
+		dst = append(dst, m.MediaType...)
+		dst = append(dst, ' ')
+		dst = append(dst, m.Port...)
+		dst = append(dst, ' ')
+		dst = append(dst, m.Proto...)
+		if len(m.Fmt) > 0 {
+			dst = append(dst, ' ')
+			dst = append(dst, m.Fmt...)
+		}
+		dst = append(dst, eol...)
+
+		dst = appendSdpOther(dst, media.Other, "i", eol)
+		dst = appendSdpConnData(dst, &media.ConnData, eol)
+		dst = appendSdpOther(dst, media.Other, "c", eol)
+		dst = appendSdpAttribs(dst, 'b', media.Bandwidth, eol)
+		dst = appendSdpOther(dst, media.Other, "k", eol)
+		dst = appendSdpOther(dst, media.Other, "", eol)
+		dst = appendSdpAttribs(dst, 'a', media.Attrib, eol)
+	}
+
+	return dst
+}
+
+// appendSdpLine appends a single <type>=<value> line
+func appendSdpLine(dst []byte, typ byte, val []byte, eol string) []byte {
+	dst = append(dst, typ, '=')
+	dst = append(dst, val...)
+	return append(dst, eol...)
+}
+
+// appendSdpConnData appends a c= line if any of its fields are set
+func appendSdpConnData(dst []byte, c *SdpConnData, eol string) []byte {
+	if c.NetType == nil && c.AddrType == nil && c.ConnAddr == nil {
+		return dst
+	}
+	dst = append(dst, "c="...)
+	dst = append(dst, c.NetType...)
+	dst = append(dst, ' ')
+	dst = append(dst, c.AddrType...)
+	dst = append(dst, ' ')
+	dst = append(dst, c.ConnAddr...)
+	return append(dst, eol...)
+}
+
+// appendSdpAttribs appends a= or b= lines, the value is only separated by
+// a colon when present, even if empty
+func appendSdpAttribs(dst []byte, typ byte, attribs []SdpAttrib, eol string) []byte {
+	for _, attr := range attribs {
+		dst = append(dst, typ, '=')
+		dst = append(dst, attr.Cat...)
+		if attr.Val != nil {
+			dst = append(dst, ':')
+			dst = append(dst, attr.Val...)
+		}
+		dst = append(dst, eol...)
+	}
+	return dst
+}
+
+// appendSdpOther appends the lines of the given types in the order they
+// were found. An empty types string appends the lines of unknown types.
+func appendSdpOther(dst []byte, other []SdpAttrib, types, eol string) []byte {
+	for _, line := range other {
+		if len(line.Cat) != 1 {
+			continue
+		}
+		known := strings.IndexByte(sdpKnownTypes, line.Cat[0]) > -1
+		if types == "" && known || types != "" && strings.IndexByte(types, line.Cat[0]) == -1 {
+			continue
+		}
+		dst = appendSdpLine(dst, line.Cat[0], line.Val, eol)
+	}
+	return dst
+}
+
+func sdpOriginEmpty(o *SdpOrigin) bool {
+	return o.Username == nil && o.SessId == nil && o.SessVer == nil &&
+		o.NetType == nil && o.AddrType == nil && o.UnicastAddr == nil
+}
@@ -0,0 +1,133 @@
+package siprocket
+
+import (
+	"strings"
+	"testing"
+)
+
+func Test_sdpMarshal_RoundTrip(t *testing.T) {
+
+	body := "v=0\r\n" +
+		"o=jdoe 2890844526 2890842807 IN IP4 10.47.16.5\r\n" +
+		"s=SDP Seminar\r\n" +
+		"i=A Seminar on the session description protocol\r\n" +
+		"u=http://www.example.com/seminars/sdp.pdf\r\n" +
+		"e=j.doe@example.com (Jane Doe)\r\n" +
+		"p=+1 617 555-6011\r\n" +
+		"c=IN IP4 224.2.17.12/127\r\n" +
+		"b=CT:128\r\n" +
+		"t=2873397496 2873404696\r\n" +
+		"r=7d 1h 0 25h\r\n" +
+		"t=2873500000 2873600000\r\n" +
+		"z=2882844526 -1h 2898848070 0\r\n" +
+		"a=recvonly\r\n" +
+		"m=audio 49170 RTP/AVP 0\r\n" +
+		"i=Audio stream\r\n" +
+		"b=AS:64\r\n" +
+		"a=rtpmap:0 PCMU/8000\r\n" +
+		"m=video 51372 RTP/AVP 99\r\n" +
+		"c=IN IP6 FF15::101/3\r\n" +
+		"b=AS:512\r\n" +
+		"a=rtpmap:99 h263-1998/90000\r\n" +
+		"a=sendonly\r\n"
+
+	sip := Parse([]byte("INVITE sip:bob@10.0.0.1 SIP/2.0\r\nContent-Type: application/sdp\r\n\r\n" + body))
+
+	out := string(MarshalSdp(&sip.Sdp))
+	if out != body {
+		t.Errorf("Mismatch:\nExpected:\n%q\nGot:\n%q", body, out)
+	}
+
+	if string(sip.Sdp.SessConnData.ConnAddr) != "224.2.17.12/127" || len(sip.Sdp.SessBandwidth) != 1 {
+		t.Errorf("Mismatch: session c= %q b= %d", sip.Sdp.SessConnData.ConnAddr, len(sip.Sdp.SessBandwidth))
+	}
+	if len(sip.Sdp.Media) != 2 || len(sip.Sdp.Media[1].Bandwidth) != 1 || len(sip.Sdp.Media[1].Attrib) != 2 {
+		t.Fatalf("media sections not split as expected")
+	}
+}
+
+func Test_sdpMarshal_RoundTripLF(t *testing.T) {
+
+	body := "v=0\n" +
+		"o=- 1 1 IN IP4 10.0.0.1\n" +
+		"s=-\n" +
+		"c=IN IP4 224.2.1.1/127\n" +
+		"c=IN IP4 224.2.1.2/127\n" +
+		"t=0 0\n" +
+		"a=tool:\n" +
+		"m=audio 49170 RTP/AVP 0\n" +
+		"a=sendrecv\n"
+
+	sdp, err := ParseSdp([]byte(body))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out := string(MarshalSdp(&sdp)); out != body {
+		t.Errorf("Mismatch:\nExpected:\n%q\nGot:\n%q", body, out)
+	}
+
+	sip := Parse([]byte("INVITE sip:bob@10.0.0.1 SIP/2.0\nContent-Type: application/sdp\n\n" + body))
+	if out := string(MarshalSdp(&sip.Sdp)); out != body {
+		t.Errorf("Mismatch:\nExpected:\n%q\nGot:\n%q", body, out)
+	}
+}
+
+func Test_sdpMarshal_RoundTripEmptySession(t *testing.T) {
+
+	body := "v=0\r\n" +
+		"o=- 1 1 IN IP4 10.0.0.1\r\n" +
+		"s= \r\n" +
+		"c=IN IP4 10.0.0.1\r\n" +
+		"t=0 0\r\n" +
+		"m=audio 49170 RTP/AVP 0\r\n"
+
+	sdp, err := ParseSdp([]byte(body))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out := string(MarshalSdp(&sdp)); out != body {
+		t.Errorf("Mismatch:\nExpected:\n%q\nGot:\n%q", body, out)
+	}
+
+	// The mandatory s= line is written even when the name was cleared
+	sdp.Session = nil
+	if out := string(MarshalSdp(&sdp)); out != body {
+		t.Errorf("Mismatch:\nExpected:\n%q\nGot:\n%q", body, out)
+	}
+}
+
+func Test_sdpMarshal_Order(t *testing.T) {
+
+	// Fields filled in out of order are written in RFC 8866 order
+	sdp := SdpMsg{
+		Version:       []byte("0"),
+		Origin:        NewSdpOrigin("-", "1", "1", "IN", "IP4", "", ""),
+		Session:       []byte("-"),
+		Timing:        []byte("0 0"),
+		SessBandwidth: []SdpAttrib{NewSdpAttrib("AS", "64", "")},
+		SessConnData:  SdpConnData{NetType: []byte("IN"), ConnAddr: []byte("10.0.0.1")},
+		Media: []SdpMedia{
+			{
+				MediaDesc: NewSdpMediaDesc("audio", "4000", "RTP/AVP", "0", ""),
+				Attrib:    []SdpAttrib{NewSdpAttrib("sendrecv", "", "")},
+			},
+		},
+	}
+
+	exp := strings.Join([]string{
+		"v=0",
+		"o=- 1 1 IN IP4 ",
+		"s=-",
+		"c=IN  10.0.0.1",
+		"b=AS:64",
+		"t=0 0",
+		"m=audio 4000 RTP/AVP 0",
+		"a=sendrecv",
+		"",
+	}, "\r\n")
+
+	out := string(MarshalSdp(&sdp))
+	if out != exp {
+		t.Errorf("Mismatch:\nExpected:\n%q\nGot:\n%q", exp, out)
+	}
+}
@@ -0,0 +1,38 @@
+package siprocket
+
+/*
+RFC4566 - https://tools.ietf.org/html/rfc4566#section-5
+
+5.  SDP Specification
+
+  A session description consists of a session-level section followed by
+  zero or more media-level sections.  The session-level part starts with
+  a "v=" line and continues to the first media-level section.  Each
+  media-level section starts with an "m=" line and continues to the next
+  media-level section or the end of the whole session description.  In
+  general, session-level values are the default for all media unless
+  overridden by an equivalent media-level value.
+
+*/
+
+type SdpMedia struct {
+	MediaDesc SdpMediaDesc // m= line
+	ConnData  SdpConnData  // Media-level c= line
+	Bandwidth []SdpAttrib  // Media-level b= lines
+	Attrib    []SdpAttrib  // Media-level a= lines
+	Other     []SdpAttrib  // Other media-level lines, Cat holds the type eg i, k
+}
+
+// mediaSections returns the media sections of the message. When the
+// message was built by hand with only the flat fields set, those are
+// treated as a single media section.
+func (s *SdpMsg) mediaSections() []SdpMedia {
+	if len(s.Media) > 0 || s.MediaDesc.MediaType == nil {
+		return s.Media
+	}
+	return []SdpMedia{{
+		MediaDesc: s.MediaDesc,
+		ConnData:  s.ConnData,
+		Attrib:    s.Attrib,
+	}}
+}
@@ -0,0 +1,94 @@
+package siprocket
+
+import (
+	"errors"
+	"testing"
+)
+
+func Test_sdpParse_Bare(t *testing.T) {
+
+	// WebRTC style offer with LF line endings
+	body := "v=0\n" +
+		"o=- 4611731400430051336 2 IN IP4 127.0.0.1\n" +
+		"s=-\n" +
+		"t=0 0\n" +
+		"a=group:BUNDLE 0\n" +
+		"m=audio 9 UDP/TLS/RTP/SAVPF 111\n" +
+		"c=IN IP4 0.0.0.0\n" +
+		"a=mid:0\n" +
+		"a=rtpmap:111 opus/48000/2\n"
+
+	out, err := ParseSdp([]byte(body))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if string(out.Origin.SessId) != "4611731400430051336" || string(out.Timing) != "0 0" {
+		t.Errorf("Mismatch: origin %q timing %q", out.Origin.Src, out.Timing)
+	}
+	if len(out.SessAttrib) != 1 || string(out.SessAttrib[0].Cat) != "group" {
+		t.Errorf("Mismatch: session attributes %d", len(out.SessAttrib))
+	}
+	if len(out.Media) != 1 || string(out.Media[0].MediaDesc.Proto) != "UDP/TLS/RTP/SAVPF" || len(out.Media[0].Attrib) != 2 {
+		t.Errorf("Mismatch: media %+v", out.Media)
+	}
+	if len(out.Attrib) != 3 {
+		t.Errorf("Mismatch: expected 3 attributes in total, got %d", len(out.Attrib))
+	}
+}
+
+func Test_sdpParse_LineError(t *testing.T) {
+
+	body := "v=0\r\n" +
+		"o=- 1 1 IN IP4 10.0.0.1\r\n" +
+		"s=-\r\n" +
+		"m=audio\r\n" +
+		"c=IN IP4 10.0.0.1\r\n" +
+		"bogus line\r\n"
+
+	out, err := ParseSdp([]byte(body))
+
+	var lineErr *SdpLineError
+	if !errors.As(err, &lineErr) {
+		t.Fatalf("expected an *SdpLineError, got %v", err)
+	}
+	if lineErr.Line != 4 || string(lineErr.Text) != "m=audio" {
+		t.Errorf("Mismatch: line %d text %q", lineErr.Line, lineErr.Text)
+	}
+
+	// The lines after the error are still parsed
+	if len(out.Media) != 1 || string(out.Media[0].ConnData.ConnAddr) != "10.0.0.1" {
+		t.Errorf("Mismatch: media %+v", out.Media)
+	}
+
+	if _, err := ParseSdp([]byte("s=-\r\nv=0\r\n")); err == nil {
+		t.Errorf("expected an error when v= is not first")
+	}
+}
+
+func Test_sdpParse_MatchesSipBody(t *testing.T) {
+
+	body := "v=0\r\n" +
+		"o=- 4000 4000 IN IP4 192.168.7.219\r\n" +
+		"s=-\r\n" +
+		"c=IN IP4 192.168.7.219\r\n" +
+		"t=0 0\r\n" +
+		"m=audio 4000 RTP/AVP 0 101\r\n" +
+		"b=AS:64\r\n" +
+		"a=rtpmap:0 PCMU/8000\r\n"
+
+	sip := Parse([]byte("INVITE sip:bob@10.0.0.1 SIP/2.0\r\n" +
+		"Content-Type: application/sdp\r\n" +
+		"\r\n" + body))
+
+	sdp, err := ParseSdp([]byte(body))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(MarshalSdp(&sdp)) != string(MarshalSdp(&sip.Sdp)) {
+		t.Errorf("Mismatch between ParseSdp and Parse:\n%q\n%q", MarshalSdp(&sdp), MarshalSdp(&sip.Sdp))
+	}
+	if string(sip.Sdp.Media[0].Bandwidth[0].Val) != "64" || len(sip.Sdp.Attrib) != 1 {
+		t.Errorf("bandwidth and attributes should be indexed separately")
+	}
+}
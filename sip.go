@@ -3,6 +3,7 @@ package siprocket
 import (
 	"bytes"
 	"fmt"
+	"strconv"
 	"strings"
 )
 
@@ -17,6 +18,7 @@ type SipMsg struct {
 	Via      []SipVia
 	Cseq     SipCseq
 	Ua       SipVal
+	Server   SipVal
 	Exp      SipVal
 	Auth     SipAuth
 	Allow    SipAllow
@@ -26,18 +28,15 @@ type SipMsg struct {
 	ContLen  SipVal
 	XGammaIP SipVal
 
-	Sdp SdpMsg
-}
+	Contacts    []SipContact // Every Contact entry in order, Contact holds the last header line
+	RecordRoute []SipRoute   // Record-Route entries in order
+	Route       []SipRoute   // Route entries in order
+	Path        []SipRoute   // Path entries in order, RFC 3327
+
+	Sdp  SdpMsg
+	Body []byte // Raw message body, whatever its content type
 
-type SdpMsg struct {
-	Version   []byte
-	Origin    SdpOrigin
-	Session   []byte
-	Timing    []byte
-	Bandwidth []SdpAttrib
-	MediaDesc SdpMediaDesc
-	Attrib    []SdpAttrib
-	ConnData  SdpConnData
+	Headers []SipHeader // Every header line in order, only kept by ParseLossless
 }
 
 type SipVal struct {
@@ -58,118 +57,173 @@ func Unmarshal(v []byte) (SipMsg, error) {
 
 // Main parsing routine, passes by value
 func Parse(v []byte) (output SipMsg) {
+	return parse(v, false)
+}
+
+// ParseLossless parses like Parse and also keeps every header line in
+// Headers along with its source, so MarshalLossless can write the message
+// back out unchanged apart from the headers marked dirty
+func ParseLossless(v []byte) SipMsg {
+	return parse(v, true)
+}
+
+func parse(v []byte, lossless bool) (output SipMsg) {
 
-	// Allow multiple vias and media Attribs
-	via_idx := 0
+	// Allow multiple vias
 	output.Via = make([]SipVia, 0, 8)
-	attr_idx := 0
-	output.Sdp.Attrib = make([]SdpAttrib, 0, 8)
-	output.Sdp.Bandwidth = make([]SdpAttrib, 0, 8)
 
-	lines := bytes.Split(v, []byte("\r\n"))
+	sep := []byte("\r\n")
+	lines := bytes.Split(v, sep)
 	if len(lines) < 2 {
-		lines = bytes.Split(v, []byte("\n"))
+		sep = sep[1:]
+		lines = bytes.Split(v, sep)
+	}
+
+	// The body starts after the first empty line
+	body := len(lines)
+
+	// Offset of the current line within v
+	off := 0
+	if lossless {
+		output.Headers = make([]SipHeader, 0, 16)
 	}
 
 	for i, line := range lines {
 		//fmt.Println(i, string(line))
+		raw := v[off:min(off+len(line)+len(sep), len(v))]
+		off += len(line) + len(sep)
 		line = bytes.TrimSpace(line)
 		if i == 0 {
 			// For the first line parse the request
 			parseSipReq(line, &output.Req)
-		} else {
-			// For subsequent lines split in sep (: for sip, = for sdp)
-			spos, stype := indexSep(line)
-			if spos > 0 && stype == ':' {
-				// SIP: Break up into header and value
-				lhdr := strings.ToLower(string(line[0:spos]))
-				lval := bytes.TrimSpace(line[spos+1:])
-
-				// Switch on the line header
-				//fmt.Println(i, string(lhdr), string(lval))
-				switch {
-				case lhdr == "f" || lhdr == "from":
-					parseSipFrom(lval, &output.From)
-				case lhdr == "t" || lhdr == "to":
-					parseSipTo(lval, &output.To)
-				case lhdr == "m" || lhdr == "contact":
-					parseSipContact(lval, &output.Contact)
-				case lhdr == "v" || lhdr == "via":
-					var tmpVia SipVia
-					output.Via = append(output.Via, tmpVia)
-					parseSipVia(lval, &output.Via[via_idx])
-					via_idx++
-				case lhdr == "i" || lhdr == "call-id":
-					output.CallId.Value = lval
-					output.CallId.Src = lval
-				case lhdr == "c" || lhdr == "content-type":
-					output.ContType.Value = lval
-					output.ContType.Src = lval
-				case lhdr == "content-length":
-					output.ContLen.Value = lval
-					output.ContLen.Src = lval
-				case lhdr == "user-agent":
-					output.Ua.Value = lval
-					output.Ua.Src = lval
-				case lhdr == "expires":
-					output.Exp.Value = lval
-					output.Exp.Src = lval
-				case lhdr == "max-forwards":
-					output.MaxFwd.Value = lval
-					output.MaxFwd.Src = lval
-				case lhdr == "cseq":
-					parseSipCseq(lval, &output.Cseq)
-				case lhdr == "authorization":
-					parseSipAuthorization(lval, &output.Auth)
-					output.Auth.Src = lval
-				case lhdr == "allow":
-					parseSipAllow(lval, &output.Allow)
-					output.Allow.Src = lval
-				case lhdr == "x-gamma-public-ip":
-					output.XGammaIP.Value = lval
-					output.XGammaIP.Src = lval
-				} // End of Switch
-			}
-			if spos == 1 && stype == '=' {
-				// SDP: Break up into header and value
-				lhdr := strings.ToLower(string(line[0]))
-				lval := bytes.TrimSpace(line[2:])
-				// Switch on the line header
-				//fmt.Println(i, spos, string(lhdr), string(lval))
-				switch {
-				case lhdr == "v":
-					output.Sdp.Version = lval
-				case lhdr == "o":
-					parseSdpOrigin(lval, &output.Sdp.Origin)
-					// output.Sdp.Origin = lval
-				case lhdr == "s":
-					output.Sdp.Session = lval
-				case lhdr == "t":
-					output.Sdp.Timing = lval
-				case lhdr == "m":
-					parseSdpMediaDesc(lval, &output.Sdp.MediaDesc)
-				case lhdr == "c":
-					parseSdpConnectionData(lval, &output.Sdp.ConnData)
-				case lhdr == "a":
-					var tmpAttrib SdpAttrib
-					output.Sdp.Attrib = append(output.Sdp.Attrib, tmpAttrib)
-					parseSdpAttrib(lval, &output.Sdp.Attrib[attr_idx])
-					attr_idx++
-				case lhdr == "b":
-					// Same as above but for Bandwidth
-					var tmpAttrib SdpAttrib
-					output.Sdp.Bandwidth = append(output.Sdp.Bandwidth, tmpAttrib)
-					parseSdpAttrib(lval, &output.Sdp.Bandwidth[attr_idx])
-					attr_idx++
-				} // End of Switch
-
-			}
+			continue
+		}
+		if len(line) == 0 {
+			body = i + 1
+			break
+		}
+
+		// For subsequent lines split in sep (: for sip, = for sdp)
+		spos, stype := indexSep(line)
+		if spos == 1 && stype == '=' {
+			// SDP without the empty line in front of it
+			body = i
+			break
 		}
+		if lossless {
+			output.Headers = appendSipHeader(output.Headers, raw, line)
+		}
+		if spos > 0 && stype == ':' {
+			// SIP: Break up into header and value
+			lhdr := strings.ToLower(string(line[0:spos]))
+			lval := bytes.TrimSpace(line[spos+1:])
+			output.parseHeader(lhdr, lval)
+		}
+	}
+
+	if body > len(lines) {
+		body = len(lines)
+	}
+	output.Body = sipBody(v, lines[:body], len(sep), output.ContLen.Value)
+
+	// Parse the body as SDP, a SIP message is still usable if it is not
+	if output.Body != nil && isSdpContentType(output.ContType.Value) {
+		output.Sdp, _ = ParseSdp(output.Body)
+	} else {
+		parseSdpLines(nil, &output.Sdp)
 	}
 
 	return
 }
 
+// isSdpContentType tells if a body with the Content-Type v is SDP, a body
+// without a Content-Type is taken to be SDP
+func isSdpContentType(v []byte) bool {
+	if len(v) == 0 {
+		return true
+	}
+	mediaType, _, _ := bytes.Cut(v, []byte(";"))
+	return strings.EqualFold(string(bytes.TrimSpace(mediaType)), "application/sdp")
+}
+
+// parseHeader parses the value of a header line into the typed fields of
+// the message, lhdr is the lower case header name
+func (out *SipMsg) parseHeader(lhdr string, lval []byte) {
+	switch {
+	case lhdr == "f" || lhdr == "from":
+		parseSipFrom(lval, &out.From)
+	case lhdr == "t" || lhdr == "to":
+		parseSipTo(lval, &out.To)
+	case lhdr == "m" || lhdr == "contact":
+		parseSipContact(lval, &out.Contact)
+		out.Contacts = parseSipContacts(lval, out.Contacts)
+	case lhdr == "v" || lhdr == "via":
+		// Several Via values may share a line
+		for _, v := range splitSipList(lval) {
+			out.Via = append(out.Via, SipVia{})
+			parseSipVia(v, &out.Via[len(out.Via)-1])
+		}
+	case lhdr == "i" || lhdr == "call-id":
+		out.CallId.Value = lval
+		out.CallId.Src = lval
+	case lhdr == "c" || lhdr == "content-type":
+		out.ContType.Value = lval
+		out.ContType.Src = lval
+	case lhdr == "l" || lhdr == "content-length":
+		out.ContLen.Value = lval
+		out.ContLen.Src = lval
+	case lhdr == "user-agent":
+		out.Ua.Value = lval
+		out.Ua.Src = lval
+	case lhdr == "server":
+		out.Server.Value = lval
+		out.Server.Src = lval
+	case lhdr == "expires":
+		out.Exp.Value = lval
+		out.Exp.Src = lval
+	case lhdr == "max-forwards":
+		out.MaxFwd.Value = lval
+		out.MaxFwd.Src = lval
+	case lhdr == "cseq":
+		parseSipCseq(lval, &out.Cseq)
+	case lhdr == "authorization":
+		parseSipAuthorization(lval, &out.Auth)
+		out.Auth.Src = lval
+	case lhdr == "allow":
+		parseSipAllow(lval, &out.Allow)
+		out.Allow.Src = lval
+	case lhdr == "record-route":
+		out.RecordRoute, _ = parseSipRoutes(lval, out.RecordRoute)
+	case lhdr == "route":
+		out.Route, _ = parseSipRoutes(lval, out.Route)
+	case lhdr == "path":
+		out.Path, _ = parseSipRoutes(lval, out.Path)
+	case lhdr == "x-gamma-public-ip" || lhdr == "x-gamma-ip":
+		out.XGammaIP.Value = lval
+		out.XGammaIP.Src = lval
+	} // End of Switch
+}
+
+// sipBody slices the body out of the message given the lines in front of
+// it, the body is cut short when Content-Length says so
+func sipBody(v []byte, head [][]byte, sepLen int, contLen []byte) []byte {
+	pos := 0
+	for _, line := range head {
+		pos += len(line) + sepLen
+	}
+	if pos >= len(v) {
+		return nil
+	}
+	body := v[pos:]
+	if n, err := strconv.Atoi(string(contLen)); err == nil && n >= 0 && n < len(body) {
+		body = body[:n]
+	}
+	if len(body) == 0 {
+		return nil
+	}
+	return body
+}
+
 // Finds the first valid Seperate or notes its type
 func indexSep(s []byte) (int, byte) {
 
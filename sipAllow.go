@@ -2,7 +2,6 @@ package siprocket
 
 import (
 	"bytes"
-	"strings"
 )
 
 type SipAllow struct {
@@ -33,18 +32,17 @@ func parseSipAllow(v []byte, out *SipAllow) {
 }
 
 func MarshalSipAllow(data *SipAllow) string {
-	var sb bytes.Buffer
-
-	sb.WriteString(HEADER_ALLOW + ": ")
+	return string(appendSipAllow(make([]byte, 0, 128), data))
+}
 
-	for _, method := range data.Methods {
-		sb.Write(method)
-		sb.WriteString(", ")
+// appendSipAllow appends the Allow header line to dst
+func appendSipAllow(dst []byte, data *SipAllow) []byte {
+	dst = append(dst, HEADER_ALLOW+": "...)
+	for i, method := range data.Methods {
+		if i > 0 {
+			dst = append(dst, ", "...)
+		}
+		dst = append(dst, method...)
 	}
-
-	result := sb.String()
-	result = strings.TrimSuffix(result, ", ") // Remove the trailing comma and space
-	result += ENDL
-
-	return result
+	return append(dst, ENDL...)
 }
@@ -2,8 +2,6 @@ package siprocket
 
 import (
 	"bytes"
-	"fmt"
-	"strings"
 )
 
 /*
@@ -263,48 +261,51 @@ func parseSipAuthorization(v []byte, out *SipAuth) {
 }
 
 func MarshalSipAuth(auth *SipAuth) string {
-	var sb strings.Builder
+	return string(appendSipAuth(make([]byte, 0, 256), auth))
+}
 
-	sb.WriteString("Authorization: ")
+// appendSipAuth appends the Authorization header line to dst
+func appendSipAuth(dst []byte, auth *SipAuth) []byte {
+	start := len(dst)
+	dst = append(dst, "Authorization: "...)
 
 	if auth.Digest != nil {
-		fmt.Fprintf(&sb, "%s ", auth.Digest)
+		dst = append(dst, auth.Digest...)
+		dst = append(dst, ' ')
 	}
 
-	if auth.Username != nil {
-		fmt.Fprintf(&sb, `username="%s", `, auth.Username)
-	}
-	if auth.Realm != nil {
-		fmt.Fprintf(&sb, `realm="%s", `, auth.Realm)
-	}
-	if auth.Nonce != nil {
-		fmt.Fprintf(&sb, `nonce="%s", `, auth.Nonce)
-	}
-	if auth.Uri != nil {
-		fmt.Fprintf(&sb, `uri="%s", `, auth.Uri)
-	}
-	if auth.Qop != nil {
-		fmt.Fprintf(&sb, `qop=%s, `, auth.Qop)
-	}
-	if auth.Nc != nil {
-		fmt.Fprintf(&sb, `nc=%s, `, auth.Nc)
-	}
-	if auth.Cnonce != nil {
-		fmt.Fprintf(&sb, `cnonce="%s", `, auth.Cnonce)
+	dst = appendAuthParam(dst, "username", auth.Username, true)
+	dst = appendAuthParam(dst, "realm", auth.Realm, true)
+	dst = appendAuthParam(dst, "nonce", auth.Nonce, true)
+	dst = appendAuthParam(dst, "uri", auth.Uri, true)
+	dst = appendAuthParam(dst, "qop", auth.Qop, false)
+	dst = appendAuthParam(dst, "nc", auth.Nc, false)
+	dst = appendAuthParam(dst, "cnonce", auth.Cnonce, true)
+	dst = appendAuthParam(dst, "response", auth.Response, true)
+	dst = appendAuthParam(dst, "algorithm", auth.Algorithm, false)
+	dst = appendAuthParam(dst, "opaque", auth.Opaque, true)
+
+	// Remove the trailing comma and space
+	if bytes.HasSuffix(dst[start:], []byte(", ")) {
+		dst = dst[:len(dst)-2]
 	}
-	if auth.Response != nil {
-		fmt.Fprintf(&sb, `response="%s", `, auth.Response)
+	return append(dst, ENDL...)
+}
+
+// appendAuthParam appends name=value followed by a comma, quoting the value
+// when asked, nothing is appended for a nil value
+func appendAuthParam(dst []byte, name string, val []byte, quote bool) []byte {
+	if val == nil {
+		return dst
 	}
-	if auth.Algorithm != nil {
-		fmt.Fprintf(&sb, `algorithm=%s, `, auth.Algorithm)
+	dst = append(dst, name...)
+	dst = append(dst, '=')
+	if quote {
+		dst = append(dst, '"')
 	}
-	if auth.Opaque != nil {
-		fmt.Fprintf(&sb, `opaque="%s", `, auth.Opaque)
+	dst = append(dst, val...)
+	if quote {
+		dst = append(dst, '"')
 	}
-
-	result := sb.String()
-	result = strings.TrimSuffix(result, ", ") // Remove the trailing comma and space
-	result += "\r\n"
-
-	return result
+	return append(dst, ", "...)
 }
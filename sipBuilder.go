@@ -0,0 +1,491 @@
+package siprocket
+
+/*
+ RFC 3261 - https://www.ietf.org/rfc/rfc3261.txt
+
+ 8.1.1 Generating the Request
+
+   A valid SIP request formulated by a UAC MUST, at a minimum, contain
+   the following header fields: To, From, CSeq, Call-ID, Max-Forwards,
+   and Via; all of these header fields are mandatory in all SIP
+   requests.
+
+ 8.2.6.2 Headers and Tags
+
+   The From field of the response MUST equal the From header field of
+   the request.  The Call-ID header field of the response MUST equal the
+   Call-ID header field of the request.  The CSeq header field of the
+   response MUST equal the CSeq field of the request.  The Via header
+   field values in the response MUST equal the Via header field values
+   in the request and MUST maintain the same ordering.
+
+   If a request contained a To tag in the request, the To header field
+   in the response MUST equal that of the request.  However, if the To
+   header field in the request did not contain a tag, the URI in the To
+   header field in the response MUST equal the URI in the To header
+   field; additionally, the UAS MUST add a tag to the To header field in
+   the response (with the exception of the 100 (Trying) response, in
+   which a tag MAY be present).
+
+ The ACK of a non-2xx final response belongs to the INVITE transaction
+ (17.1.1.3) while the ACK of a 2xx is a request of its own within the
+ dialog (13.2.2.4). A CANCEL (9.1) copies the Request-URI, Call-ID, To,
+ From, the CSeq number and the top Via of the request it cancels.
+
+*/
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+const (
+	BRANCH_MAGIC         = "z9hG4bK" // Branch prefix of RFC 3261 compliant transactions
+	DEFAULT_MAX_FORWARDS = 70
+)
+
+// statusText holds the reason phrases of RFC 3261 section 21 along with
+// a few common extensions
+var statusText = map[int]string{
+	100: "Trying",
+	180: "Ringing",
+	181: "Call Is Being Forwarded",
+	182: "Queued",
+	183: "Session Progress",
+	200: "OK",
+	202: "Accepted",
+	300: "Multiple Choices",
+	301: "Moved Permanently",
+	302: "Moved Temporarily",
+	305: "Use Proxy",
+	380: "Alternative Service",
+	400: "Bad Request",
+	401: "Unauthorized",
+	402: "Payment Required",
+	403: "Forbidden",
+	404: "Not Found",
+	405: "Method Not Allowed",
+	406: "Not Acceptable",
+	407: "Proxy Authentication Required",
+	408: "Request Timeout",
+	410: "Gone",
+	413: "Request Entity Too Large",
+	414: "Request-URI Too Long",
+	415: "Unsupported Media Type",
+	416: "Unsupported URI Scheme",
+	420: "Bad Extension",
+	421: "Extension Required",
+	423: "Interval Too Brief",
+	480: "Temporarily Unavailable",
+	481: "Call/Transaction Does Not Exist",
+	482: "Loop Detected",
+	483: "Too Many Hops",
+	484: "Address Incomplete",
+	485: "Ambiguous",
+	486: "Busy Here",
+	487: "Request Terminated",
+	488: "Not Acceptable Here",
+	491: "Request Pending",
+	493: "Undecipherable",
+	500: "Server Internal Error",
+	501: "Not Implemented",
+	502: "Bad Gateway",
+	503: "Service Unavailable",
+	504: "Server Time-out",
+	505: "Version Not Supported",
+	513: "Message Too Large",
+	600: "Busy Everywhere",
+	603: "Decline",
+	604: "Does Not Exist Anywhere",
+	606: "Not Acceptable",
+}
+
+// StatusText returns the reason phrase of a status code, or an empty
+// string when the code is unknown
+func StatusText(code int) string {
+	return statusText[code]
+}
+
+// SipBuilder builds a SipMsg one header at a time, each method returns the
+// builder so calls can be chained. The first error met is kept and
+// returned by Build.
+type SipBuilder struct {
+	msg SipMsg
+	err error
+}
+
+// NewRequest starts a request for method to the Request-URI uri, eg
+// sip:bob@biloxi.com. The To header is set to the same URI, and a Call-ID,
+// From tag, Via branch and CSeq number are generated. The sent-by of the
+// Via and the From are left to the caller.
+func NewRequest(method, uri string) *SipBuilder {
+	b := &SipBuilder{}
+	method = strings.ToUpper(method)
+
+	if err := parseSipReq([]byte(method+" "+uri+" SIP/2.0"), &b.msg.Req); err != nil {
+		b.err = err
+	} else if len(b.msg.Req.Host) == 0 {
+		b.err = errors.New("request uri has no host")
+	}
+	b.msg.Req.SipVersion = []byte("SIP/2.0")
+	b.msg.Req.Src = nil
+
+	b.msg.Via = []SipVia{{Trans: "udp", Branch: []byte(NewBranch())}}
+	b.msg.From.Tag = []byte(NewTag())
+	b.msg.To = SipTo{
+		UriType: b.msg.Req.UriType,
+		User:    b.msg.Req.User,
+		Host:    b.msg.Req.Host,
+		Port:    b.msg.Req.Port,
+	}
+	b.msg.CallId.Value = []byte(NewCallId())
+	b.msg.Cseq = SipCseq{
+		Id:     []byte(strconv.Itoa(int(randomUint32()%0xffff) + 1)),
+		Method: []byte(method),
+	}
+	b.msg.MaxFwd.Value = []byte(strconv.Itoa(DEFAULT_MAX_FORWARDS))
+
+	return b
+}
+
+// NewResponse starts a response to req. The Via, From, To, Call-ID and CSeq
+// headers are copied from the request, a To tag is added unless the
+// request had one or the code is 100, and the Record-Route headers are
+// copied for the 1xx and 2xx responses that can create a dialog. An empty
+// reason is replaced by the usual phrase of the code.
+func NewResponse(req *SipMsg, code int, reason string) *SipBuilder {
+	b := &SipBuilder{}
+
+	if code < 100 || code > 699 {
+		b.err = errors.New("status code out of range")
+	}
+	if reason == "" {
+		reason = StatusText(code)
+	}
+	b.msg.Req = SipReq{
+		SipVersion: []byte("SIP/2.0"),
+		StatusCode: []byte(strconv.Itoa(code)),
+		StatusDesc: []byte(reason),
+	}
+
+	b.msg.Via = append([]SipVia(nil), req.Via...)
+	b.msg.From = req.From
+	b.msg.To = req.To
+	if len(b.msg.To.Tag) == 0 && code > 100 {
+		b.msg.To.Tag = []byte(NewTag())
+		b.msg.To.Src = nil
+	}
+	b.msg.CallId = req.CallId
+	b.msg.Cseq = req.Cseq
+	if code > 100 && code < 300 {
+		b.msg.RecordRoute = append([]SipRoute(nil), req.RecordRoute...)
+	}
+
+	return b
+}
+
+// NewAck starts the ACK of the final response resp to invite. A non-2xx
+// response is acknowledged within the INVITE transaction, with the same
+// Request-URI, top Via and Route headers as the INVITE. A 2xx response is
+// acknowledged with a new transaction sent to the remote target of its
+// Contact along the route set taken from its Record-Route headers.
+func NewAck(invite, resp *SipMsg) *SipBuilder {
+	b := &SipBuilder{}
+
+	b.msg.From = invite.From
+	b.msg.To = resp.To
+	b.msg.CallId = invite.CallId
+	b.msg.Cseq = SipCseq{Id: invite.Cseq.Id, Method: []byte("ACK")}
+	b.msg.MaxFwd.Value = []byte(strconv.Itoa(DEFAULT_MAX_FORWARDS))
+	if len(invite.Via) == 0 {
+		b.err = errors.New("invite has no via")
+		return b
+	}
+
+	b.msg.Req = invite.Req
+	b.msg.Req.Method = []byte("ACK")
+	b.msg.Req.Src = nil
+
+	if len(resp.Req.StatusCode) == 0 || resp.Req.StatusCode[0] != '2' {
+		b.msg.Via = []SipVia{invite.Via[0]}
+		b.msg.Route = append([]SipRoute(nil), invite.Route...)
+		return b
+	}
+
+	// The 2xx ACK is a transaction of its own so gets a new branch
+	via := invite.Via[0]
+	via.Branch = []byte(NewBranch())
+	via.Rport = nil
+	via.Rcvd = nil
+	via.Src = nil
+	b.msg.Via = []SipVia{via}
+
+	// The remote target comes from the Contact of the response
+	if len(resp.Contact.Host) > 0 {
+		b.msg.Req.UriType = resp.Contact.UriType
+		b.msg.Req.User = resp.Contact.User
+		b.msg.Req.Host = resp.Contact.Host
+		b.msg.Req.Port = resp.Contact.Port
+		b.msg.Req.UserType = nil
+		b.msg.Req.Params = nil
+	}
+
+	// The route set is the Record-Route in reverse order, section 12.1.2
+	for i := len(resp.RecordRoute) - 1; i >= 0; i-- {
+		b.msg.Route = append(b.msg.Route, resp.RecordRoute[i])
+	}
+
+	// A strict router at the head of the route set takes the Request-URI,
+	// section 12.2.1.1
+	if len(b.msg.Route) > 0 && !b.msg.Route[0].IsLoose() {
+		first := b.msg.Route[0]
+		b.msg.Route = append(b.msg.Route[1:], SipRoute{
+			UriType: b.msg.Req.UriType,
+			User:    b.msg.Req.User,
+			Host:    b.msg.Req.Host,
+			Port:    b.msg.Req.Port,
+		})
+		b.msg.Req.UriType = first.UriType
+		b.msg.Req.User = first.User
+		b.msg.Req.Host = first.Host
+		b.msg.Req.Port = first.Port
+	}
+
+	return b
+}
+
+// NewCancel starts the CANCEL of req, it shares the Request-URI, Call-ID,
+// From, To, CSeq number, top Via and Route headers of the request
+func NewCancel(req *SipMsg) *SipBuilder {
+	b := &SipBuilder{}
+
+	if len(req.Via) == 0 {
+		b.err = errors.New("request has no via")
+		return b
+	}
+	b.msg.Req = req.Req
+	b.msg.Req.Method = []byte("CANCEL")
+	b.msg.Req.Src = nil
+	b.msg.Via = []SipVia{req.Via[0]}
+	b.msg.Route = append([]SipRoute(nil), req.Route...)
+	b.msg.From = req.From
+	b.msg.To = req.To
+	b.msg.CallId = req.CallId
+	b.msg.Cseq = SipCseq{Id: req.Cseq.Id, Method: []byte("CANCEL")}
+	b.msg.MaxFwd.Value = []byte(strconv.Itoa(DEFAULT_MAX_FORWARDS))
+
+	return b
+}
+
+// Via sets the transport and sent-by of the top Via, keeping its branch
+func (b *SipBuilder) Via(trans, host, port string) *SipBuilder {
+	if len(b.msg.Via) == 0 {
+		b.msg.Via = []SipVia{{Branch: []byte(NewBranch())}}
+	}
+	via := &b.msg.Via[0]
+	via.Trans = strings.ToLower(trans)
+	via.Host = []byte(host)
+	via.Port = []byte(port)
+	via.Src = nil
+	return b
+}
+
+// From sets the From header from a name-addr such as
+// "Alice" <sip:alice@atlanta.com>, keeping the tag already set
+func (b *SipBuilder) From(addr string) *SipBuilder {
+	tag := b.msg.From.Tag
+	if err := parseSipFrom([]byte(addr), &b.msg.From); err != nil {
+		b.setErr(err)
+	}
+	if len(b.msg.From.Tag) == 0 {
+		b.msg.From.Tag = tag
+	}
+	b.msg.From.Src = nil
+	return b
+}
+
+// To sets the To header from a name-addr, keeping the tag already set
+func (b *SipBuilder) To(addr string) *SipBuilder {
+	tag := b.msg.To.Tag
+	if err := parseSipTo([]byte(addr), &b.msg.To); err != nil {
+		b.setErr(err)
+	}
+	if len(b.msg.To.Tag) == 0 {
+		b.msg.To.Tag = tag
+	}
+	b.msg.To.Src = nil
+	return b
+}
+
+// FromTag replaces the tag of the From header
+func (b *SipBuilder) FromTag(tag string) *SipBuilder {
+	b.msg.From.Tag = []byte(tag)
+	b.msg.From.Src = nil
+	return b
+}
+
+// ToTag replaces the tag of the To header, a UAS uses it to give all the
+// responses to a request the same tag
+func (b *SipBuilder) ToTag(tag string) *SipBuilder {
+	b.msg.To.Tag = []byte(tag)
+	b.msg.To.Src = nil
+	return b
+}
+
+// Contact sets the Contact header from a name-addr
+func (b *SipBuilder) Contact(addr string) *SipBuilder {
+	if err := parseSipContact([]byte(addr), &b.msg.Contact); err != nil {
+		b.setErr(err)
+	}
+	b.msg.Contact.Src = nil
+	b.msg.Contacts = []SipContact{b.msg.Contact}
+	return b
+}
+
+// Route appends a Route header holding uri, eg <sip:p1.example.com;lr>
+func (b *SipBuilder) Route(uri string) *SipBuilder {
+	var err error
+	if b.msg.Route, err = parseSipRoutes([]byte(uri), b.msg.Route); err != nil {
+		b.setErr(err)
+	}
+	return b
+}
+
+// RecordRoute appends a Record-Route header holding uri
+func (b *SipBuilder) RecordRoute(uri string) *SipBuilder {
+	var err error
+	if b.msg.RecordRoute, err = parseSipRoutes([]byte(uri), b.msg.RecordRoute); err != nil {
+		b.setErr(err)
+	}
+	return b
+}
+
+// CallId replaces the generated Call-ID
+func (b *SipBuilder) CallId(id string) *SipBuilder {
+	b.msg.CallId = SipVal{Value: []byte(id)}
+	return b
+}
+
+// Cseq replaces the sequence number of the CSeq header
+func (b *SipBuilder) Cseq(id int) *SipBuilder {
+	b.msg.Cseq.Id = []byte(strconv.Itoa(id))
+	b.msg.Cseq.Src = nil
+	return b
+}
+
+// MaxForwards sets the Max-Forwards header
+func (b *SipBuilder) MaxForwards(n int) *SipBuilder {
+	b.msg.MaxFwd = SipVal{Value: []byte(strconv.Itoa(n))}
+	return b
+}
+
+// UserAgent sets the User-Agent header
+func (b *SipBuilder) UserAgent(ua string) *SipBuilder {
+	b.msg.Ua = SipVal{Value: []byte(ua)}
+	return b
+}
+
+// Server sets the Server header
+func (b *SipBuilder) Server(server string) *SipBuilder {
+	b.msg.Server = SipVal{Value: []byte(server)}
+	return b
+}
+
+// Expires sets the Expires header
+func (b *SipBuilder) Expires(secs int) *SipBuilder {
+	b.msg.Exp = SipVal{Value: []byte(strconv.Itoa(secs))}
+	return b
+}
+
+// Allow sets the Allow header to the given methods
+func (b *SipBuilder) Allow(methods ...string) *SipBuilder {
+	b.msg.Allow = SipAllow{}
+	for _, method := range methods {
+		b.msg.Allow.Methods = append(b.msg.Allow.Methods, []byte(method))
+	}
+	return b
+}
+
+// Body sets the Content-Type and body of the message, an application/sdp
+// body is also parsed into Sdp
+func (b *SipBuilder) Body(contentType string, body []byte) *SipBuilder {
+	b.msg.ContType = SipVal{Value: []byte(contentType)}
+	b.msg.ContLen = SipVal{Value: []byte(strconv.Itoa(len(body)))}
+	b.msg.Body = body
+	b.msg.Sdp = SdpMsg{}
+	if strings.EqualFold(contentType, "application/sdp") {
+		sdp, err := ParseSdp(body)
+		if err != nil {
+			b.setErr(err)
+		}
+		b.msg.Sdp = sdp
+	}
+	return b
+}
+
+// Build returns the message, or the first error met while building it. A
+// request must have a Request-URI, a From and a Via sent-by.
+func (b *SipBuilder) Build() (SipMsg, error) {
+	if b.err != nil {
+		return SipMsg{}, b.err
+	}
+	if len(b.msg.Req.StatusCode) == 0 {
+		if len(b.msg.Req.Method) == 0 || len(b.msg.Req.Host) == 0 {
+			return SipMsg{}, errors.New("request has no request uri")
+		}
+		if len(b.msg.From.Host) == 0 {
+			return SipMsg{}, errors.New("request has no from")
+		}
+		if len(b.msg.Via) == 0 || len(b.msg.Via[0].Host) == 0 {
+			return SipMsg{}, errors.New("request has no via sent-by")
+		}
+	}
+	return b.msg, nil
+}
+
+// String builds and marshals the message, an empty string is returned
+// when the message can not be built
+func (b *SipBuilder) String() string {
+	msg, err := b.Build()
+	if err != nil {
+		return ""
+	}
+	return Marshal(&msg)
+}
+
+func (b *SipBuilder) setErr(err error) {
+	if b.err == nil {
+		b.err = err
+	}
+}
+
+// NewBranch returns a new Via branch starting with the RFC 3261 magic cookie
+func NewBranch() string {
+	return BRANCH_MAGIC + randomHex(8)
+}
+
+// NewTag returns a new From or To tag
+func NewTag() string {
+	return randomHex(8)
+}
+
+// NewCallId returns a new Call-ID
+func NewCallId() string {
+	return randomHex(16)
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func randomUint32() uint32 {
+	var b [4]byte
+	rand.Read(b[:])
+	return binary.BigEndian.Uint32(b[:])
+}
@@ -0,0 +1,208 @@
+package siprocket
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func Test_sipBuilder_Request(t *testing.T) {
+
+	b := NewRequest("invite", "sip:bob@biloxi.com:5070").
+		Via("udp", "pc33.atlanta.com", "5060").
+		From(`"Alice" <sip:alice@atlanta.com>`).
+		Contact("<sip:alice@pc33.atlanta.com>").
+		UserAgent("siprocket")
+	msg, err := b.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(string(msg.Via[0].Branch), BRANCH_MAGIC) || len(msg.Via[0].Branch) != 23 {
+		t.Errorf("Bad branch: %s", msg.Via[0].Branch)
+	}
+	if len(msg.From.Tag) != 16 || len(msg.CallId.Value) != 32 || len(msg.Cseq.Id) == 0 {
+		t.Errorf("Missing generated values: tag %q call-id %q cseq %q", msg.From.Tag, msg.CallId.Value, msg.Cseq.Id)
+	}
+	if string(msg.Cseq.Method) != "INVITE" {
+		t.Errorf("Bad CSeq method: %s", msg.Cseq.Method)
+	}
+
+	// The marshalled request must parse back to the same values
+	got := Parse([]byte(Marshal(&msg)))
+	expected := []string{"INVITE", "bob", "biloxi.com", "5070", "Alice", "alice", "atlanta.com", "bob", "5070", "pc33.atlanta.com", "70", "siprocket"}
+	result := []string{string(got.Req.Method), string(got.Req.User), string(got.Req.Host), string(got.Req.Port),
+		string(got.From.Name), string(got.From.User), string(got.From.Host), string(got.To.User), string(got.To.Port),
+		string(got.Contact.Host), string(got.MaxFwd.Value), string(got.Ua.Value)}
+	if !reflect.DeepEqual(expected, result) {
+		t.Errorf("Mismatch:\nExpected:\n%q\nGot:\n%q", expected, result)
+	}
+	if !reflect.DeepEqual(msg.Via[0].Branch, got.Via[0].Branch) || !reflect.DeepEqual(msg.From.Tag, got.From.Tag) {
+		t.Errorf("Branch or tag lost in marshal")
+	}
+	if got.To.Tag != nil {
+		t.Errorf("Unexpected To tag: %s", got.To.Tag)
+	}
+
+	// Two requests never share generated values
+	other, _ := NewRequest("INVITE", "sip:bob@biloxi.com").Via("UDP", "h", "").From("sip:a@h").Build()
+	if string(other.CallId.Value) == string(msg.CallId.Value) || string(other.From.Tag) == string(msg.From.Tag) {
+		t.Errorf("Generated values repeated")
+	}
+}
+
+func Test_sipBuilder_RequestErrors(t *testing.T) {
+
+	tests := []struct {
+		name string
+		b    *SipBuilder
+	}{
+		{"no from", NewRequest("OPTIONS", "sip:bob@biloxi.com").Via("UDP", "h", "")},
+		{"no via", NewRequest("OPTIONS", "sip:bob@biloxi.com").From("sip:a@h")},
+		{"bad uri", NewRequest("OPTIONS", "mailto:bob@biloxi.com").Via("UDP", "h", "").From("sip:a@h")},
+		{"bad code", NewResponse(&SipMsg{}, 42, "")},
+	}
+	for _, tt := range tests {
+		if _, err := tt.b.Build(); err == nil {
+			t.Errorf("%s: expected an error", tt.name)
+		}
+		if tt.b.String() != "" {
+			t.Errorf("%s: expected an empty string", tt.name)
+		}
+	}
+}
+
+func Test_sipBuilder_Response(t *testing.T) {
+
+	req := Parse([]byte("INVITE sip:bob@biloxi.com SIP/2.0\r\n" +
+		"Via: SIP/2.0/UDP pc33.atlanta.com;branch=z9hG4bK776asdhds\r\n" +
+		"Via: SIP/2.0/UDP bigbox3.site3.atlanta.com;branch=z9hG4bK77ef4c2312983.1\r\n" +
+		"Record-Route: <sip:bigbox3.site3.atlanta.com;lr>\r\n" +
+		"Max-Forwards: 70\r\n" +
+		"To: Bob <sip:bob@biloxi.com>\r\n" +
+		"From: Alice <sip:alice@atlanta.com>;tag=1928301774\r\n" +
+		"Call-ID: a84b4c76e66710@pc33.atlanta.com\r\n" +
+		"CSeq: 314159 INVITE\r\n" +
+		"Content-Length: 0\r\n\r\n"))
+
+	trying, err := NewResponse(&req, 100, "").Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if trying.To.Tag != nil || trying.RecordRoute != nil || string(trying.Req.StatusDesc) != "Trying" {
+		t.Errorf("Bad 100: tag %q record-route %d reason %q", trying.To.Tag, len(trying.RecordRoute), trying.Req.StatusDesc)
+	}
+
+	ok, err := NewResponse(&req, 200, "Fine").ToTag("a6c85cf").Contact("<sip:bob@192.0.2.4>").Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := Parse([]byte(Marshal(&ok)))
+	expected := []string{"200", "Fine", "2", "z9hG4bK776asdhds", "z9hG4bK77ef4c2312983.1", "1928301774", "a6c85cf",
+		"a84b4c76e66710@pc33.atlanta.com", "314159", "INVITE", "bigbox3.site3.atlanta.com", "192.0.2.4"}
+	result := []string{string(got.Req.StatusCode), string(got.Req.StatusDesc), string(rune('0' + len(got.Via))),
+		string(got.Via[0].Branch), string(got.Via[1].Branch), string(got.From.Tag), string(got.To.Tag),
+		string(got.CallId.Value), string(got.Cseq.Id), string(got.Cseq.Method), string(got.RecordRoute[0].Host), string(got.Contact.Host)}
+	if !reflect.DeepEqual(expected, result) {
+		t.Errorf("Mismatch:\nExpected:\n%q\nGot:\n%q", expected, result)
+	}
+
+	// An error response still gets a To tag but no Record-Route
+	busy, _ := NewResponse(&req, 486, "").Build()
+	if len(busy.To.Tag) == 0 || busy.RecordRoute != nil || string(busy.Req.StatusDesc) != "Busy Here" {
+		t.Errorf("Bad 486: tag %q record-route %d reason %q", busy.To.Tag, len(busy.RecordRoute), busy.Req.StatusDesc)
+	}
+}
+
+func Test_sipBuilder_AckCancel(t *testing.T) {
+
+	invite, err := NewRequest("INVITE", "sip:bob@biloxi.com").
+		Via("UDP", "pc33.atlanta.com", "").
+		From("<sip:alice@atlanta.com>").
+		Route("<sip:p1.atlanta.com;lr>").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A non-2xx ACK stays within the INVITE transaction
+	busy, _ := NewResponse(&invite, 486, "").Build()
+	ack, err := NewAck(&invite, &busy).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"ACK", "biloxi.com", string(invite.Via[0].Branch), string(busy.To.Tag), string(invite.Cseq.Id), "ACK", "p1.atlanta.com"}
+	result := []string{string(ack.Req.Method), string(ack.Req.Host), string(ack.Via[0].Branch), string(ack.To.Tag), string(ack.Cseq.Id), string(ack.Cseq.Method), string(ack.Route[0].Host)}
+	if !reflect.DeepEqual(expected, result) {
+		t.Errorf("Mismatch:\nExpected:\n%q\nGot:\n%q", expected, result)
+	}
+
+	// A 2xx ACK goes to the Contact along the reversed Record-Route
+	ok, _ := NewResponse(&invite, 200, "").
+		Contact("<sip:bob@192.0.2.4:5062>").
+		RecordRoute("<sip:p2.biloxi.com;lr>").
+		RecordRoute("<sip:p1.atlanta.com;lr>").
+		Build()
+	ack, err = NewAck(&invite, &ok).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = []string{"ACK", "192.0.2.4", "5062", string(ok.To.Tag), "p1.atlanta.com", "p2.biloxi.com"}
+	result = []string{string(ack.Req.Method), string(ack.Req.Host), string(ack.Req.Port), string(ack.To.Tag), string(ack.Route[0].Host), string(ack.Route[1].Host)}
+	if !reflect.DeepEqual(expected, result) {
+		t.Errorf("Mismatch:\nExpected:\n%q\nGot:\n%q", expected, result)
+	}
+	if string(ack.Via[0].Branch) == string(invite.Via[0].Branch) {
+		t.Errorf("2xx ACK reused the INVITE branch")
+	}
+
+	// A strict router at the head of the route set takes the Request-URI
+	strict, _ := NewResponse(&invite, 200, "").Contact("<sip:bob@192.0.2.4>").RecordRoute("<sip:p3.biloxi.com>").Build()
+	ack, _ = NewAck(&invite, &strict).Build()
+	if string(ack.Req.Host) != "p3.biloxi.com" || len(ack.Route) != 1 || string(ack.Route[0].Host) != "192.0.2.4" {
+		t.Errorf("Bad strict route ACK: %s", Marshal(&ack))
+	}
+
+	cancel, err := NewCancel(&invite).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = []string{"CANCEL", "biloxi.com", string(invite.Via[0].Branch), "", string(invite.Cseq.Id), "CANCEL", string(invite.CallId.Value)}
+	result = []string{string(cancel.Req.Method), string(cancel.Req.Host), string(cancel.Via[0].Branch), string(cancel.To.Tag), string(cancel.Cseq.Id), string(cancel.Cseq.Method), string(cancel.CallId.Value)}
+	if !reflect.DeepEqual(expected, result) {
+		t.Errorf("Mismatch:\nExpected:\n%q\nGot:\n%q", expected, result)
+	}
+
+	// Changing the Via of the builder leaves the request alone
+	host := string(invite.Via[0].Host)
+	if _, err := NewCancel(&invite).Via("TCP", "proxy.biloxi.com", "5060").Build(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewAck(&invite, &invite).Via("TCP", "proxy.biloxi.com", "5060").Build(); err != nil {
+		t.Fatal(err)
+	}
+	if string(invite.Via[0].Host) != host {
+		t.Errorf("Request Via changed: %q", invite.Via[0].Host)
+	}
+}
+
+func Test_sipBuilder_Body(t *testing.T) {
+
+	sdp := "v=0\r\no=alice 2890844526 2890844526 IN IP4 pc33.atlanta.com\r\ns=-\r\nc=IN IP4 192.0.2.101\r\nt=0 0\r\nm=audio 49172 RTP/AVP 0\r\na=rtpmap:0 PCMU/8000\r\n"
+	msg, err := NewRequest("INVITE", "sip:bob@biloxi.com").
+		Via("UDP", "pc33.atlanta.com", "").
+		From("<sip:alice@atlanta.com>").
+		Body("application/sdp", []byte(sdp)).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(msg.Sdp.MediaDesc.Port) != "49172" {
+		t.Errorf("SDP not parsed: %q", msg.Sdp.MediaDesc.Port)
+	}
+
+	got := Parse([]byte(Marshal(&msg)))
+	if string(got.ContType.Value) != "application/sdp" || string(got.Sdp.MediaDesc.Port) != "49172" {
+		t.Errorf("Bad body: %s", Marshal(&msg))
+	}
+}
@@ -140,6 +140,23 @@ func parseSipContact(v []byte, out *SipContact) error {
 
 }
 
+// parseSipContacts parses every entry of a Contact header line and appends
+// them to out, the wildcard * of a REGISTER is kept with only Src set
+func parseSipContacts(v []byte, out []SipContact) []SipContact {
+	for _, entry := range splitSipList(v) {
+		var contact SipContact
+		if parseSipContact(entry, &contact) == nil {
+			out = append(out, contact)
+		}
+	}
+	return out
+}
+
+// IsWildcard tells if the contact is the * used to remove every binding
+func (c *SipContact) IsWildcard() bool {
+	return string(bytes.TrimSpace(c.Src)) == "*"
+}
+
 func parseUri(uriPart []byte, out *SipContact) {
 	// Find the URI scheme (sip or sips)
 	if idx := bytes.Index(uriPart, []byte("sip:")); idx > -1 {
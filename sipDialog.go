@@ -0,0 +1,403 @@
+package siprocket
+
+/*
+ RFC 3261 - https://datatracker.ietf.org/doc/html/rfc3261#section-12
+
+ 12 Dialogs
+
+   A dialog is identified at each UA with a dialog ID, which consists of
+   a Call-ID value, a local tag and a remote tag.
+
+   A dialog created by a provisional response is in the "early" state,
+   it becomes "confirmed" when a 2xx final response arrives. A request
+   forked to several UAS may create several early dialogs, one per To tag.
+
+ 12.1.1 UAS behavior, 12.1.2 UAC Behavior
+
+   The route set MUST be set to the list of URIs in the Record-Route
+   header field from the request, taken in order and preserving all URI
+   parameters. The UAC takes the same list in reverse order.
+
+   The remote target MUST be set to the URI from the Contact header
+   field of the request or response, and is updated by target refresh
+   requests such as re-INVITE and UPDATE.
+
+ RFC 5057 - https://datatracker.ietf.org/doc/html/rfc5057#section-5.1
+
+   A 481 or 408 response to a request within the dialog terminates it.
+
+*/
+
+import (
+	"bytes"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Dialog states
+const (
+	DIALOG_EARLY      = "early"
+	DIALOG_CONFIRMED  = "confirmed"
+	DIALOG_TERMINATED = "terminated"
+)
+
+// DialogId identifies a dialog from the point of view of the caller, the
+// UA that sent the INVITE
+type DialogId struct {
+	CallId    string // Call-ID
+	CallerTag string // From tag of the INVITE
+	CalleeTag string // To tag of the response
+}
+
+// Dialog is the state of one dialog as seen on the wire
+type Dialog struct {
+	Id           DialogId
+	State        string     // One of the DIALOG_ constants
+	CallerSeq    uint32     // Highest CSeq sent by the caller
+	CalleeSeq    uint32     // Highest CSeq sent by the callee, zero until it sends a request
+	SeqErrors    int        // Requests whose CSeq did not increase
+	CallerTarget SipContact // Contact of the caller, the callee's remote target
+	CalleeTarget SipContact // Contact of the callee, the caller's remote target
+	RecordRoute  []SipRoute // Record-Route entries as they appear in the messages
+	Reason       string     // What terminated the dialog eg BYE, 487, timeout
+	Created      time.Time
+	Updated      time.Time
+}
+
+// CallerRouteSet returns the route set of the caller, the Record-Route
+// entries in reverse order
+func (d *Dialog) CallerRouteSet() []SipRoute {
+	out := make([]SipRoute, len(d.RecordRoute))
+	for i := range d.RecordRoute {
+		out[len(out)-1-i] = d.RecordRoute[i]
+	}
+	return out
+}
+
+// CalleeRouteSet returns the route set of the callee, the Record-Route
+// entries in order
+func (d *Dialog) CalleeRouteSet() []SipRoute {
+	return append([]SipRoute(nil), d.RecordRoute...)
+}
+
+type inviteKey struct {
+	callId    string
+	callerTag string
+}
+
+// pendingInvite holds what the INVITE told about the caller until the
+// responses create dialogs from it
+type pendingInvite struct {
+	cseq    uint32
+	contact SipContact
+	updated time.Time
+}
+
+// DialogTracker builds the dialogs of INVITE sessions from the messages
+// of both sides. It is safe for concurrent use.
+type DialogTracker struct {
+	mu      sync.Mutex
+	dialogs map[DialogId]*Dialog
+	invites map[inviteKey]*pendingInvite
+
+	// IdleTimeout is how long a dialog may go without a message before
+	// Expire removes it
+	IdleTimeout time.Duration
+
+	// OnChange is called when a dialog is created or changes state, prev
+	// is empty for a new dialog. It is called without the tracker locked.
+	OnChange func(d Dialog, prev string)
+}
+
+func NewDialogTracker() *DialogTracker {
+	return &DialogTracker{
+		dialogs:     make(map[DialogId]*Dialog),
+		invites:     make(map[inviteKey]*pendingInvite),
+		IdleTimeout: time.Hour,
+	}
+}
+
+type dialogChange struct {
+	d    Dialog
+	prev string
+}
+
+// Process updates the dialogs with a message seen at the given time
+func (t *DialogTracker) Process(at time.Time, msg *SipMsg) {
+	var changes []dialogChange
+
+	t.mu.Lock()
+	if len(msg.Req.StatusCode) > 0 {
+		changes = t.response(at, msg)
+	} else {
+		changes = t.request(at, msg)
+	}
+	t.mu.Unlock()
+
+	if t.OnChange != nil {
+		for _, c := range changes {
+			t.OnChange(c.d, c.prev)
+		}
+	}
+}
+
+func (t *DialogTracker) request(at time.Time, msg *SipMsg) []dialogChange {
+	method := strings.ToUpper(string(msg.Req.Method))
+	callId := string(msg.CallId.Value)
+	seq := parseCseqId(msg.Cseq.Id)
+
+	// An initial INVITE, the dialogs are created by its responses
+	if len(msg.To.Tag) == 0 {
+		if method == "INVITE" {
+			t.invites[inviteKey{callId, string(msg.From.Tag)}] = &pendingInvite{
+				cseq:    seq,
+				contact: cloneSipContact(&msg.Contact),
+				updated: at,
+			}
+		}
+		return nil
+	}
+
+	d, fromCaller := t.lookup(callId, msg.From.Tag, msg.To.Tag)
+	if d == nil || d.State == DIALOG_TERMINATED {
+		return nil
+	}
+	d.Updated = at
+
+	// CSeq numbers increase in each direction, ACK and CANCEL reuse the
+	// number of the request they belong to
+	if method != "ACK" && method != "CANCEL" {
+		last := &d.CallerSeq
+		if !fromCaller {
+			last = &d.CalleeSeq
+		}
+		if seq <= *last && *last != 0 {
+			d.SeqErrors++
+		} else {
+			*last = seq
+		}
+	}
+
+	switch method {
+	case "INVITE", "UPDATE":
+		// Target refresh
+		if len(msg.Contact.Host) > 0 {
+			if fromCaller {
+				d.CallerTarget = cloneSipContact(&msg.Contact)
+			} else {
+				d.CalleeTarget = cloneSipContact(&msg.Contact)
+			}
+		}
+	case "BYE":
+		return t.setState(d, DIALOG_TERMINATED, "BYE", nil)
+	}
+	return nil
+}
+
+func (t *DialogTracker) response(at time.Time, msg *SipMsg) []dialogChange {
+	code, _ := strconv.Atoi(string(msg.Req.StatusCode))
+	method := strings.ToUpper(string(msg.Cseq.Method))
+	callId := string(msg.CallId.Value)
+	key := inviteKey{callId, string(msg.From.Tag)}
+
+	// Responses within a confirmed dialog
+	d, _ := t.lookup(callId, msg.From.Tag, msg.To.Tag)
+	if d != nil && d.State == DIALOG_CONFIRMED {
+		d.Updated = at
+		switch {
+		case code == 481 || code == 408:
+			return t.setState(d, DIALOG_TERMINATED, strconv.Itoa(code), nil)
+		case code >= 200 && code < 300 && (method == "INVITE" || method == "UPDATE"):
+			// Target refresh of the side that answered
+			if len(msg.Contact.Host) > 0 {
+				if bytes.Equal(msg.From.Tag, []byte(d.Id.CallerTag)) {
+					d.CalleeTarget = cloneSipContact(&msg.Contact)
+				} else {
+					d.CallerTarget = cloneSipContact(&msg.Contact)
+				}
+			}
+		}
+		return nil
+	}
+
+	if method != "INVITE" {
+		return nil
+	}
+
+	// A failure ends every early dialog of the INVITE
+	if code >= 300 {
+		var changes []dialogChange
+		for _, early := range t.dialogs {
+			if early.Id.CallId == key.callId && early.Id.CallerTag == key.callerTag && early.State == DIALOG_EARLY {
+				early.Updated = at
+				changes = t.setState(early, DIALOG_TERMINATED, strconv.Itoa(code), changes)
+			}
+		}
+		delete(t.invites, key)
+		return changes
+	}
+
+	// 100 Trying and responses without a To tag do not create a dialog
+	if code < 101 || len(msg.To.Tag) == 0 {
+		return nil
+	}
+
+	var changes []dialogChange
+	if d == nil {
+		id := DialogId{CallId: callId, CallerTag: key.callerTag, CalleeTag: string(msg.To.Tag)}
+		d = &Dialog{
+			Id:           id,
+			CalleeTarget: cloneSipContact(&msg.Contact),
+			RecordRoute:  cloneSipRoutes(msg.RecordRoute),
+			CallerSeq:    parseCseqId(msg.Cseq.Id),
+			Created:      at,
+		}
+		if inv, ok := t.invites[key]; ok {
+			d.CallerTarget = inv.contact
+			d.CallerSeq = inv.cseq
+		}
+		t.dialogs[id] = d
+		changes = t.setState(d, DIALOG_EARLY, "", changes)
+	}
+	if d.State == DIALOG_TERMINATED {
+		return changes
+	}
+	d.Updated = at
+	if len(msg.Contact.Host) > 0 {
+		d.CalleeTarget = cloneSipContact(&msg.Contact)
+	}
+	if code >= 200 {
+		// The route set is fixed by the 2xx
+		d.RecordRoute = cloneSipRoutes(msg.RecordRoute)
+		changes = t.setState(d, DIALOG_CONFIRMED, "", changes)
+	}
+	return changes
+}
+
+// lookup finds the dialog of an in-dialog message sent by either side
+func (t *DialogTracker) lookup(callId string, fromTag, toTag []byte) (*Dialog, bool) {
+	if d, ok := t.dialogs[DialogId{callId, string(fromTag), string(toTag)}]; ok {
+		return d, true
+	}
+	if d, ok := t.dialogs[DialogId{callId, string(toTag), string(fromTag)}]; ok {
+		return d, false
+	}
+	return nil, false
+}
+
+func (t *DialogTracker) setState(d *Dialog, state, reason string, changes []dialogChange) []dialogChange {
+	if d.State == state {
+		return changes
+	}
+	prev := d.State
+	d.State = state
+	if reason != "" {
+		d.Reason = reason
+	}
+	return append(changes, dialogChange{d: *d, prev: prev})
+}
+
+// Expire terminates and removes the dialogs that have been idle for longer
+// than IdleTimeout, it returns how many were removed
+func (t *DialogTracker) Expire(now time.Time) int {
+	var changes []dialogChange
+
+	t.mu.Lock()
+	n := 0
+	for id, d := range t.dialogs {
+		if now.Sub(d.Updated) <= t.IdleTimeout {
+			continue
+		}
+		changes = t.setState(d, DIALOG_TERMINATED, "timeout", changes)
+		delete(t.dialogs, id)
+		n++
+	}
+	for key, inv := range t.invites {
+		if now.Sub(inv.updated) > t.IdleTimeout {
+			delete(t.invites, key)
+		}
+	}
+	t.mu.Unlock()
+
+	if t.OnChange != nil {
+		for _, c := range changes {
+			t.OnChange(c.d, c.prev)
+		}
+	}
+	return n
+}
+
+// Get returns a copy of a dialog
+func (t *DialogTracker) Get(id DialogId) (Dialog, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	d, ok := t.dialogs[id]
+	if !ok {
+		return Dialog{}, false
+	}
+	return *d, true
+}
+
+// Find returns a copy of the dialog a message belongs to, whichever side
+// sent it
+func (t *DialogTracker) Find(msg *SipMsg) (Dialog, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	d, _ := t.lookup(string(msg.CallId.Value), msg.From.Tag, msg.To.Tag)
+	if d == nil {
+		return Dialog{}, false
+	}
+	return *d, true
+}
+
+// Dialogs returns copies of every dialog of a call ordered by creation,
+// or of every dialog when callId is empty
+func (t *DialogTracker) Dialogs(callId string) []Dialog {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var out []Dialog
+	for _, d := range t.dialogs {
+		if callId == "" || d.Id.CallId == callId {
+			out = append(out, *d)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Created.Before(out[j].Created) })
+	return out
+}
+
+func parseCseqId(v []byte) uint32 {
+	id, _ := strconv.ParseUint(string(bytes.TrimSpace(v)), 10, 32)
+	return uint32(id)
+}
+
+// cloneSipContact copies a contact so that it no longer points into the
+// buffer of the message it was parsed from
+func cloneSipContact(c *SipContact) SipContact {
+	if len(c.Src) == 0 {
+		return *c
+	}
+	var out SipContact
+	parseSipContact(bytes.Clone(c.Src), &out)
+	return out
+}
+
+func cloneSipRoutes(routes []SipRoute) []SipRoute {
+	if len(routes) == 0 {
+		return nil
+	}
+	out := make([]SipRoute, len(routes))
+	for i := range routes {
+		var route SipRoute
+		if len(routes[i].Src) == 0 || parseSipRoute(bytes.Clone(routes[i].Src), &route) != nil {
+			route = routes[i]
+		}
+		out[i] = route
+	}
+	return out
+}
@@ -0,0 +1,132 @@
+package siprocket
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func Test_sipDialog_Forking(t *testing.T) {
+
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	tracker := NewDialogTracker()
+	var changes []string
+	tracker.OnChange = func(d Dialog, prev string) {
+		changes = append(changes, d.Id.CalleeTag+":"+prev+">"+d.State)
+	}
+
+	msgs := []string{
+		"INVITE sip:bob@biloxi.com SIP/2.0\r\n" +
+			"From: <sip:alice@atlanta.com>;tag=1928301774\r\n" +
+			"To: <sip:bob@biloxi.com>\r\n" +
+			"Call-ID: a84b4c76e66710\r\n" +
+			"CSeq: 314159 INVITE\r\n" +
+			"Contact: <sip:alice@pc33.atlanta.com>\r\n" +
+			"\r\n",
+		"SIP/2.0 180 Ringing\r\n" +
+			"Record-Route: <sip:p2.biloxi.com;lr>, <sip:p1.atlanta.com;lr>\r\n" +
+			"From: <sip:alice@atlanta.com>;tag=1928301774\r\n" +
+			"To: <sip:bob@biloxi.com>;tag=aaa\r\n" +
+			"Call-ID: a84b4c76e66710\r\n" +
+			"CSeq: 314159 INVITE\r\n" +
+			"Contact: <sip:bob@192.0.2.4>\r\n" +
+			"\r\n",
+		"SIP/2.0 183 Session Progress\r\n" +
+			"From: <sip:alice@atlanta.com>;tag=1928301774\r\n" +
+			"To: <sip:bob@biloxi.com>;tag=bbb\r\n" +
+			"Call-ID: a84b4c76e66710\r\n" +
+			"CSeq: 314159 INVITE\r\n" +
+			"Contact: <sip:bob@192.0.2.5>\r\n" +
+			"\r\n",
+		"SIP/2.0 200 OK\r\n" +
+			"Record-Route: <sip:p2.biloxi.com;lr>, <sip:p1.atlanta.com;lr>\r\n" +
+			"From: <sip:alice@atlanta.com>;tag=1928301774\r\n" +
+			"To: <sip:bob@biloxi.com>;tag=aaa\r\n" +
+			"Call-ID: a84b4c76e66710\r\n" +
+			"CSeq: 314159 INVITE\r\n" +
+			"Contact: <sip:bob@192.0.2.4:5062>\r\n" +
+			"\r\n",
+		// A re-INVITE from the callee moves its target
+		"INVITE sip:alice@pc33.atlanta.com SIP/2.0\r\n" +
+			"From: <sip:bob@biloxi.com>;tag=aaa\r\n" +
+			"To: <sip:alice@atlanta.com>;tag=1928301774\r\n" +
+			"Call-ID: a84b4c76e66710\r\n" +
+			"CSeq: 20 INVITE\r\n" +
+			"Contact: <sip:bob@192.0.2.9>\r\n" +
+			"\r\n",
+		"BYE sip:bob@192.0.2.9 SIP/2.0\r\n" +
+			"From: <sip:alice@atlanta.com>;tag=1928301774\r\n" +
+			"To: <sip:bob@biloxi.com>;tag=aaa\r\n" +
+			"Call-ID: a84b4c76e66710\r\n" +
+			"CSeq: 314160 BYE\r\n" +
+			"\r\n",
+	}
+
+	for i, msg := range msgs {
+		parsed := Parse([]byte(msg))
+		tracker.Process(start.Add(time.Duration(i)*time.Second), &parsed)
+		if i == 4 {
+			d, ok := tracker.Find(&parsed)
+			if !ok || d.CalleeSeq != 20 || string(d.CalleeTarget.Host) != "192.0.2.9" {
+				t.Errorf("Mismatch: %+v", d)
+			}
+		}
+	}
+
+	d, ok := tracker.Get(DialogId{"a84b4c76e66710", "1928301774", "aaa"})
+	if !ok || d.State != DIALOG_TERMINATED || d.Reason != "BYE" || d.CallerSeq != 314160 {
+		t.Fatalf("Mismatch: %+v", d)
+	}
+	if string(d.CallerTarget.User) != "alice" || string(d.CallerTarget.Host) != "pc33.atlanta.com" {
+		t.Errorf("Mismatch: caller target %s", d.CallerTarget.Src)
+	}
+	routes := d.CallerRouteSet()
+	if len(routes) != 2 || string(routes[0].Host) != "p1.atlanta.com" || string(d.CalleeRouteSet()[0].Host) != "p2.biloxi.com" {
+		t.Errorf("Mismatch: route set %s", routes)
+	}
+
+	if dialogs := tracker.Dialogs("a84b4c76e66710"); len(dialogs) != 2 || dialogs[1].State != DIALOG_EARLY {
+		t.Errorf("Mismatch: %+v", dialogs)
+	}
+
+	// The early dialog of the other fork is left to expire
+	if n := tracker.Expire(start.Add(time.Hour + 3*time.Second)); n != 1 {
+		t.Errorf("Expired %d", n)
+	}
+	if n := tracker.Expire(start.Add(2 * time.Hour)); n != 1 || len(tracker.Dialogs("")) != 0 {
+		t.Errorf("Expired %d", n)
+	}
+
+	exp := []string{"aaa:>early", "bbb:>early", "aaa:early>confirmed", "aaa:confirmed>terminated", "bbb:early>terminated"}
+	if !reflect.DeepEqual(changes, exp) {
+		t.Errorf("Mismatch:\nExpected:\n%v\nGot:\n%v", exp, changes)
+	}
+}
+
+func Test_sipDialog_Rejected(t *testing.T) {
+
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	tracker := NewDialogTracker()
+	for _, msg := range []string{
+		"SIP/2.0 180 Ringing\r\n" +
+			"From: <sip:alice@atlanta.com>;tag=1\r\n" +
+			"To: <sip:bob@biloxi.com>;tag=2\r\n" +
+			"Call-ID: c1\r\n" +
+			"CSeq: 1 INVITE\r\n" +
+			"\r\n",
+		"SIP/2.0 487 Request Terminated\r\n" +
+			"From: <sip:alice@atlanta.com>;tag=1\r\n" +
+			"To: <sip:bob@biloxi.com>;tag=2\r\n" +
+			"Call-ID: c1\r\n" +
+			"CSeq: 1 INVITE\r\n" +
+			"\r\n",
+	} {
+		parsed := Parse([]byte(msg))
+		tracker.Process(now, &parsed)
+	}
+
+	d, ok := tracker.Get(DialogId{"c1", "1", "2"})
+	if !ok || d.State != DIALOG_TERMINATED || d.Reason != "487" || d.CallerSeq != 1 {
+		t.Errorf("Mismatch: %+v", d)
+	}
+}
@@ -0,0 +1,230 @@
+package siprocket
+
+/*
+
+RFC 3261 - https://www.ietf.org/rfc/rfc3261.txt - 18.3 Framing
+
+   In the case of message-oriented transports (such as UDP), if the
+   message has a Content-Length header field, the message body is assumed
+   to contain that many bytes.
+
+   In the case of stream-oriented transports such as TCP, the Content-
+   Length header field indicates the size of the body.  All SIP
+   implementations MUST use this header field when sending over a
+   stream-oriented transport.
+
+RFC 5626 - https://www.ietf.org/rfc/rfc5626.txt - 3.5.1 CRLF Keep-Alive
+
+   The double CRLF ping is sent between messages and answered with a
+   single CRLF, both are skipped.
+
+*/
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Messages larger than this are dropped by a SipFramer
+const MAX_MESSAGE_SIZE = 65535
+
+type framerMark struct {
+	off int       // Offset into the buffer
+	at  time.Time // Time the bytes from off were written
+}
+
+// SipFramer splits a SIP byte stream into messages using Content-Length.
+// Each message is returned with the time its first byte was written.
+// Bytes that do not start with a request or status line, such as those
+// seen when joining a stream part way through or after lost data, are
+// skipped up to the next line that does.
+type SipFramer struct {
+	MaxSize int // Largest message accepted, MAX_MESSAGE_SIZE by default
+
+	buf     []byte
+	marks   []framerMark
+	discard int // Bytes still to drop of a message that was too large
+}
+
+func NewSipFramer() *SipFramer {
+	return &SipFramer{MaxSize: MAX_MESSAGE_SIZE}
+}
+
+// Write adds bytes received at the given time
+func (f *SipFramer) Write(at time.Time, b []byte) {
+	if len(b) == 0 {
+		return
+	}
+	f.marks = append(f.marks, framerMark{off: len(f.buf), at: at})
+	f.buf = append(f.buf, b...)
+}
+
+// Buffered returns the number of bytes waiting for the rest of a message
+func (f *SipFramer) Buffered() int {
+	return len(f.buf)
+}
+
+// Reset drops the buffered bytes, used when some of the stream was lost
+func (f *SipFramer) Reset() {
+	f.discard = 0
+	f.buf = f.buf[:0]
+	f.marks = f.marks[:0]
+}
+
+// Next returns the next whole message, the slice is owned by the caller
+func (f *SipFramer) Next() ([]byte, time.Time, bool) {
+	for {
+		if f.discard > 0 {
+			n := min(f.discard, len(f.buf))
+			f.advance(n)
+			f.discard -= n
+			if f.discard > 0 {
+				return nil, time.Time{}, false
+			}
+		}
+
+		// Skip keepalives between messages
+		skip := 0
+		for skip < len(f.buf) && (f.buf[skip] == '\r' || f.buf[skip] == '\n') {
+			skip++
+		}
+		f.advance(skip)
+		if len(f.buf) == 0 {
+			return nil, time.Time{}, false
+		}
+
+		nl := bytes.IndexByte(f.buf, '\n')
+		if nl == -1 {
+			if len(f.buf) > f.MaxSize {
+				f.Reset()
+			}
+			return nil, time.Time{}, false
+		}
+		if !IsSipStart(f.buf[:nl]) {
+			f.advance(nl + 1)
+			continue
+		}
+
+		head := sipHeadLen(f.buf)
+		if head == -1 {
+			if len(f.buf) > f.MaxSize {
+				f.advance(nl + 1)
+				continue
+			}
+			return nil, time.Time{}, false
+		}
+		cl, ok := sipContentLength(f.buf[:head])
+		if !ok {
+			f.advance(nl + 1)
+			continue
+		}
+		if head+cl > f.MaxSize {
+			f.discard = head + cl
+			continue
+		}
+		if len(f.buf) < head+cl {
+			return nil, time.Time{}, false
+		}
+
+		msg := append([]byte(nil), f.buf[:head+cl]...)
+		at := f.marks[0].at
+		f.advance(head + cl)
+		return msg, at, true
+	}
+}
+
+// advance drops n bytes from the front of the buffer
+func (f *SipFramer) advance(n int) {
+	if n == 0 {
+		return
+	}
+	f.buf = append(f.buf[:0], f.buf[n:]...)
+	drop := 0
+	for drop+1 < len(f.marks) && f.marks[drop+1].off <= n {
+		drop++
+	}
+	f.marks = append(f.marks[:0], f.marks[drop:]...)
+	for i := range f.marks {
+		f.marks[i].off -= n
+	}
+	if len(f.marks) > 0 && f.marks[0].off < 0 {
+		f.marks[0].off = 0
+	}
+	if len(f.buf) == 0 {
+		f.marks = f.marks[:0]
+	}
+}
+
+// sipHeadLen returns the length of the start line and headers including
+// the empty line after them, or -1 when it has not arrived yet
+func sipHeadLen(v []byte) int {
+	crlf := bytes.Index(v, []byte("\r\n\r\n"))
+	lf := bytes.Index(v, []byte("\n\n"))
+	switch {
+	case crlf > -1 && (lf == -1 || crlf+2 <= lf):
+		return crlf + 4
+	case lf > -1:
+		return lf + 2
+	}
+	return -1
+}
+
+// sipContentLength finds the Content-Length, or its compact form l, of a
+// message head. A missing header is taken as an empty body.
+func sipContentLength(head []byte) (int, bool) {
+	for _, line := range bytes.Split(head, []byte("\n")) {
+		spos := bytes.IndexByte(line, ':')
+		if spos < 1 {
+			continue
+		}
+		hdr := strings.ToLower(string(bytes.TrimSpace(line[:spos])))
+		if hdr != "content-length" && hdr != "l" {
+			continue
+		}
+		n, err := strconv.Atoi(string(bytes.TrimSpace(line[spos+1:])))
+		if err != nil || n < 0 {
+			return 0, false
+		}
+		return n, true
+	}
+	return 0, true
+}
+
+// IsSipStart tells if v starts with a SIP request or status line
+func IsSipStart(v []byte) bool {
+	line := v
+	if idx := bytes.IndexByte(line, '\n'); idx > -1 {
+		line = line[:idx]
+	}
+	line = bytes.TrimRight(line, "\r")
+
+	// Status-Line = SIP-Version SP Status-Code SP Reason-Phrase
+	if bytes.HasPrefix(line, []byte("SIP/2.0 ")) {
+		if len(line) < 11 {
+			return false
+		}
+		for _, c := range line[8:11] {
+			if c < '0' || c > '9' {
+				return false
+			}
+		}
+		return true
+	}
+
+	// Request-Line = Method SP Request-URI SP SIP-Version
+	if !bytes.HasSuffix(line, []byte(" SIP/2.0")) {
+		return false
+	}
+	sp := bytes.IndexByte(line, ' ')
+	if sp < 1 {
+		return false
+	}
+	for _, c := range line[:sp] {
+		if c < 'A' || c > 'Z' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,88 @@
+package siprocket
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func Test_sipFramer_Split(t *testing.T) {
+
+	invite := "INVITE sip:bob@10.0.0.2 SIP/2.0\r\n" +
+		"Call-ID: f1\r\n" +
+		"Content-Length: 4\r\n\r\n" +
+		"v=0\n"
+	ok := "SIP/2.0 200 OK\r\n" +
+		"Call-ID: f1\r\n" +
+		"l: 0\r\n\r\n"
+	stream := "\r\n\r\n" + invite + ok
+
+	start := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+	f := NewSipFramer()
+	var got []string
+	var times []time.Time
+	// One byte at a time, each a millisecond apart
+	for i := 0; i < len(stream); i++ {
+		f.Write(start.Add(time.Duration(i)*time.Millisecond), []byte{stream[i]})
+		for {
+			msg, at, ok := f.Next()
+			if !ok {
+				break
+			}
+			got = append(got, string(msg))
+			times = append(times, at)
+		}
+	}
+
+	exp := []string{invite, ok}
+	if !reflect.DeepEqual(exp, got) {
+		t.Errorf("Mismatch:\nExpected:\n%q\nGot:\n%q", exp, got)
+	}
+	expTimes := []time.Time{start.Add(4 * time.Millisecond), start.Add(time.Duration(4+len(invite)) * time.Millisecond)}
+	if !reflect.DeepEqual(expTimes, times) {
+		t.Errorf("Mismatch:\nExpected:\n%v\nGot:\n%v", expTimes, times)
+	}
+	if f.Buffered() != 0 {
+		t.Errorf("%d bytes left", f.Buffered())
+	}
+}
+
+func Test_sipFramer_Resync(t *testing.T) {
+
+	at := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+	bye := "BYE sip:bob@10.0.0.2 SIP/2.0\r\nCall-ID: f2\r\n\r\n"
+
+	// The tail of a message seen when joining part way through
+	f := NewSipFramer()
+	f.Write(at, []byte("tag=1234\r\nContent-Length: 4\r\n\r\nab\r\n"+bye))
+	msg, _, ok := f.Next()
+	if !ok || string(msg) != bye {
+		t.Errorf("Mismatch:\nExpected:\n%q\nGot:\n%q", bye, msg)
+	}
+
+	// A message larger than the limit is skipped
+	f.MaxSize = 64
+	f.Write(at, []byte("MESSAGE sip:bob@10.0.0.2 SIP/2.0\r\nContent-Length: 100\r\n\r\n"))
+	f.Write(at, make([]byte, 100))
+	f.Write(at, []byte(bye))
+	msg, _, ok = f.Next()
+	if !ok || string(msg) != bye {
+		t.Errorf("Mismatch:\nExpected:\n%q\nGot:\n%q", bye, msg)
+	}
+}
+
+func Test_sipFramer_IsSipStart(t *testing.T) {
+
+	tests := map[string]bool{
+		"OPTIONS sip:a@b SIP/2.0\r\n": true,
+		"SIP/2.0 180 Ringing":         true,
+		"SIP/2.0 18 Ringing":          false,
+		"GET / HTTP/1.1\r\n":          false,
+		"Call-ID: x SIP/2.0":          false,
+	}
+	for line, exp := range tests {
+		if got := IsSipStart([]byte(line)); got != exp {
+			t.Errorf("IsSipStart(%q) = %v", line, got)
+		}
+	}
+}
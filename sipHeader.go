@@ -0,0 +1,256 @@
+package siprocket
+
+/*
+ RFC 3261 - https://www.ietf.org/rfc/rfc3261.txt - 7.3.1 Header Field Format
+
+   The relative order of header fields with different field names is not
+   significant.  However, it is RECOMMENDED that header fields which are
+   needed for proxy processing (Via, Route, Record-Route, Proxy-Require,
+   Max-Forwards, and Proxy-Authorization, for example) appear towards
+   the top of the message to facilitate rapid parsing.
+
+   Header fields can be extended over multiple lines by preceding each
+   extra line with at least one SP or horizontal tab (HT).
+
+ Peers do not always agree on how a message should look, so a proxy that
+ rewrites one header is safest leaving the others exactly as they came.
+ ParseLossless keeps each header line with its source for MarshalLossless,
+ which writes the lines back unchanged unless they are marked dirty by
+ dropping their source, then they are written from their name and value.
+
+*/
+
+import (
+	"bytes"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+type SipHeader struct {
+	Name  []byte // Header name as written, may be a compact form
+	Value []byte // Header value, folded lines are kept as they are
+	Src   []byte // Full source line including the line ending, nil once the header is dirty
+}
+
+// IsDirty tells if the header has to be rendered again rather than copied
+// from its source
+func (h *SipHeader) IsDirty() bool {
+	return h.Src == nil
+}
+
+// compactHeaders maps the compact forms of RFC 3261 section 7.3.3 and
+// later RFCs to their full names
+var compactHeaders = map[string]string{
+	"a": "accept-contact",
+	"b": "referred-by",
+	"c": "content-type",
+	"d": "request-disposition",
+	"e": "content-encoding",
+	"f": "from",
+	"i": "call-id",
+	"j": "reject-contact",
+	"k": "supported",
+	"l": "content-length",
+	"m": "contact",
+	"o": "event",
+	"r": "refer-to",
+	"s": "subject",
+	"t": "to",
+	"u": "allow-events",
+	"v": "via",
+	"x": "session-expires",
+	"y": "identity",
+}
+
+// HeaderKey returns the lower case full name of a header, compact forms
+// are expanded so v and Via both give via
+func HeaderKey(name []byte) string {
+	key := strings.ToLower(string(bytes.TrimSpace(name)))
+	if full, ok := compactHeaders[key]; ok {
+		return full
+	}
+	if key == "x-gamma-ip" {
+		// The name HEADER_XGAMMA_IP used to give
+		return "x-gamma-public-ip"
+	}
+	return key
+}
+
+// appendSipHeader adds the header line raw to headers, line is the same
+// line with the surrounding space trimmed. A line starting with a space or
+// tab continues the header before it.
+func appendSipHeader(headers []SipHeader, raw, line []byte) []SipHeader {
+	if n := len(headers); n > 0 && len(raw) > 0 && (raw[0] == ' ' || raw[0] == '\t') {
+		prev := &headers[n-1]
+		prev.Src = prev.Src[:len(prev.Src)+len(raw)]
+		if prev.Name != nil {
+			prev.Value = bytes.TrimSpace(prev.Src[bytes.IndexByte(prev.Src, ':')+1:])
+		}
+		return headers
+	}
+
+	idx := bytes.IndexByte(line, ':')
+	if idx < 1 {
+		// Not a header, it is still written back as it was
+		return append(headers, SipHeader{Src: raw})
+	}
+	return append(headers, SipHeader{
+		Name:  bytes.TrimSpace(line[:idx]),
+		Value: bytes.TrimSpace(line[idx+1:]),
+		Src:   raw,
+	})
+}
+
+// MarkDirty marks every header called name, in full or compact form, to be
+// rendered again by MarshalLossless. The lines of a header with a typed
+// field are replaced by lines rendered from it, in place of the first one
+// or in front of the Content-Length when there were none. Nothing is done
+// for a message without Headers as it is rendered from the typed fields
+// anyway.
+func (data *SipMsg) MarkDirty(name string) {
+	if data.Headers == nil {
+		return
+	}
+	key := HeaderKey([]byte(name))
+	if isTypedHeader(key) {
+		data.refreshHeaders(key)
+		return
+	}
+
+	found := false
+	for i := range data.Headers {
+		if data.Headers[i].Name != nil && HeaderKey(data.Headers[i].Name) == key {
+			data.Headers[i].Src = nil
+			found = true
+		}
+	}
+	if !found {
+		data.insertHeader(data.contentLengthIndex(), name, "")
+	}
+}
+
+// MarshalLossless returns the message as AppendMarshalLossless writes it
+func MarshalLossless(data *SipMsg) string {
+	return string(AppendMarshalLossless(make([]byte, 0, 512), data))
+}
+
+// AppendMarshalLossless appends the message to dst keeping the header order
+// and formatting of the message it was parsed from by ParseLossless. Every
+// header line is copied from its source unless it is dirty, then it is
+// written from its Name and Value. The request or status line is rendered
+// again when Req.Src is nil and the body is written from Body, with the
+// Content-Length corrected when it no longer matches. A message without
+// Headers is written by AppendMarshal.
+func AppendMarshalLossless(dst []byte, data *SipMsg) []byte {
+	if data.Headers == nil {
+		return AppendMarshal(dst, data)
+	}
+
+	eol := data.headerEol()
+	if len(data.Req.Src) == 0 {
+		dst = appendRequestLine(dst, data, eol)
+	} else {
+		dst = append(dst, data.Req.Src...)
+		dst = append(dst, eol...)
+	}
+
+	for i := range data.Headers {
+		h := &data.Headers[i]
+		if h.Name != nil && HeaderKey(h.Name) == "content-length" &&
+			(h.IsDirty() || !bytes.Equal(h.Value, strconv.AppendInt(nil, int64(len(data.Body)), 10))) {
+			dst = append(dst, HEADER_CONTENT_LENGTH+": "...)
+			dst = strconv.AppendInt(dst, int64(len(data.Body)), 10)
+			dst = append(dst, eol...)
+			continue
+		}
+		if !h.IsDirty() {
+			dst = append(dst, h.Src...)
+			continue
+		}
+		dst = append(dst, h.Name...)
+		dst = append(dst, ": "...)
+		dst = append(dst, h.Value...)
+		dst = append(dst, eol...)
+	}
+
+	dst = append(dst, eol...)
+	return append(dst, data.Body...)
+}
+
+// headerEol returns the line ending of the header lines kept from the
+// parsed message, CRLF when there are none
+func (data *SipMsg) headerEol() string {
+	for i := range data.Headers {
+		if src := data.Headers[i].Src; src != nil {
+			if !bytes.HasSuffix(src, []byte(ENDL)) {
+				return ENDL[1:]
+			}
+			break
+		}
+	}
+	return ENDL
+}
+
+// isTypedHeader tells if a header, given by its key, is held in a typed
+// field of SipMsg
+func isTypedHeader(key string) bool {
+	return slices.Contains(typedHeaders, key)
+}
+
+// appendTypedHeader appends every header of the given key from the typed
+// fields of the message, nothing is written for an empty field
+func appendTypedHeader(dst []byte, data *SipMsg, key string) []byte {
+	switch key {
+	case "via":
+		return appendViaHeaders(dst, data)
+	case "from":
+		return appendFromHeader(dst, data)
+	case "to":
+		return appendToHeader(dst, data)
+	case "contact":
+		return appendContactHeader(dst, data)
+	case "call-id":
+		return appendValHeader(dst, HEADER_CALL_ID, data.CallId.Value, false)
+	case "cseq":
+		if data.Cseq.Id == nil && data.Cseq.Method == nil {
+			return dst
+		}
+		return appendCseqHeader(dst, data)
+	case "max-forwards":
+		return appendValHeader(dst, HEADER_MAX_FORWARDS, data.MaxFwd.Value, false)
+	case "user-agent":
+		return appendValHeader(dst, HEADER_USER_AGENT, data.Ua.Value, false)
+	case "server":
+		return appendValHeader(dst, HEADER_SERVER, data.Server.Value, false)
+	case "expires":
+		return appendValHeader(dst, HEADER_EXPIRES, data.Exp.Value, false)
+	case "authorization":
+		if data.Auth.Digest == nil {
+			return dst
+		}
+		return appendSipAuth(dst, &data.Auth)
+	case "allow":
+		if data.Allow.Methods == nil {
+			return dst
+		}
+		return appendSipAllow(dst, &data.Allow)
+	case "content-type":
+		return appendValHeader(dst, HEADER_CONTENT_TYPE, data.ContType.Value, false)
+	case "record-route":
+		for i := range data.RecordRoute {
+			dst = appendSipRoute(dst, HEADER_RECORD_ROUTE, &data.RecordRoute[i])
+		}
+	case "route":
+		for i := range data.Route {
+			dst = appendSipRoute(dst, HEADER_ROUTE, &data.Route[i])
+		}
+	case "path":
+		for i := range data.Path {
+			dst = appendSipRoute(dst, HEADER_PATH, &data.Path[i])
+		}
+	case "x-gamma-public-ip":
+		return appendValHeader(dst, HEADER_XGAMMA_PUBLIC, data.XGammaIP.Value, false)
+	}
+	return dst
+}
@@ -0,0 +1,144 @@
+package siprocket
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// A message full of quirks a lossless round trip has to keep
+var losslessMsg = "INVITE sip:bob@biloxi.com;user=phone SIP/2.0\r\n" +
+	"v: SIP/2.0/UDP pc33.atlanta.com;branch=z9hG4bK776asdhds\r\n" +
+	"VIA:SIP/2.0/UDP bigbox3.site3.atlanta.com;branch=z9hG4bK77ef4c2312983.1\r\n" +
+	"Max-Forwards:    70\r\n" +
+	"t: Bob <sip:bob@biloxi.com>\r\n" +
+	"f: Alice <sip:alice@atlanta.com>;tag=1928301774;x-odd=\"a;b\"\r\n" +
+	"i: a84b4c76e66710@pc33.atlanta.com\r\n" +
+	"CSeq: 314159 INVITE\r\n" +
+	"Subject: a long\r\n" +
+	" folded subject\r\n" +
+	"X-Custom: keep me\r\n" +
+	"m: <sip:alice@pc33.atlanta.com>\r\n" +
+	"c: application/dtmf-relay\r\n" +
+	"l: 24\r\n" +
+	"\r\n" +
+	"Signal=5\r\nDuration=160\r\n"
+
+func Test_sipHeader_RoundTrip(t *testing.T) {
+
+	// The body of the LF variant is two bytes shorter
+	lf := strings.ReplaceAll(strings.Replace(losslessMsg, "l: 24", "l: 22", 1), "\r\n", "\n")
+
+	for _, raw := range []string{losslessMsg, lf} {
+		msg := ParseLossless([]byte(raw))
+		if out := MarshalLossless(&msg); out != raw {
+			t.Errorf("Mismatch:\nExpected:\n%q\nGot:\n%q", raw, out)
+		}
+	}
+
+	// Apart from Headers the typed fields match those of Parse
+	msg := ParseLossless([]byte(losslessMsg))
+	if len(msg.Headers) != 12 {
+		t.Errorf("Expected 12 headers, got %d", len(msg.Headers))
+	}
+	msg.Headers = nil
+	if exp := Parse([]byte(losslessMsg)); !reflect.DeepEqual(exp, msg) {
+		t.Errorf("Mismatch:\nExpected:\n%q\nGot:\n%q", exp, msg)
+	}
+}
+
+func Test_sipHeader_Dirty(t *testing.T) {
+
+	msg := ParseLossless([]byte(losslessMsg))
+
+	// Only the Via lines change, the group is written where the first was
+	msg.Via[0].Rcvd = []byte("192.0.2.1")
+	msg.MarkDirty("Via")
+	exp := strings.Replace(losslessMsg,
+		"v: SIP/2.0/UDP pc33.atlanta.com;branch=z9hG4bK776asdhds\r\nVIA:SIP/2.0/UDP bigbox3.site3.atlanta.com;branch=z9hG4bK77ef4c2312983.1\r\n",
+		"Via: SIP/2.0/UDP pc33.atlanta.com;rport;branch=z9hG4bK776asdhds;received=192.0.2.1\r\n"+
+			"Via: SIP/2.0/UDP bigbox3.site3.atlanta.com;rport;branch=z9hG4bK77ef4c2312983.1\r\n", 1)
+	if out := MarshalLossless(&msg); out != exp {
+		t.Errorf("Mismatch:\nExpected:\n%q\nGot:\n%q", exp, out)
+	}
+
+	// A header without a typed field is written from its value and a new
+	// typed header goes in front of the Content-Length
+	for i := range msg.Headers {
+		if HeaderKey(msg.Headers[i].Name) == "x-custom" {
+			msg.Headers[i].Value = []byte("changed")
+			msg.Headers[i].Src = nil
+		}
+	}
+	msg.Ua.Value = []byte("siprocket")
+	msg.MarkDirty(HEADER_USER_AGENT)
+	exp = strings.Replace(exp, "X-Custom: keep me\r\n", "X-Custom: changed\r\n", 1)
+	exp = strings.Replace(exp, "l: 24\r\n", "User-Agent: siprocket\r\nl: 24\r\n", 1)
+	if out := MarshalLossless(&msg); out != exp {
+		t.Errorf("Mismatch:\nExpected:\n%q\nGot:\n%q", exp, out)
+	}
+
+	// A new body corrects the Content-Length and a dropped Req.Src
+	// renders the request line
+	msg.Body = []byte("Signal=1\r\n")
+	msg.Req.Src = nil
+	exp = strings.Replace(exp, "l: 24\r\n\r\nSignal=5\r\nDuration=160\r\n", "Content-Length: 10\r\n\r\nSignal=1\r\n", 1)
+	msg.Req.Host = []byte("biloxi.example.com")
+	exp = strings.Replace(exp, "INVITE sip:bob@biloxi.com;user=phone SIP/2.0", "INVITE sip:bob@biloxi.example.com;user=phone SIP/2.0", 1)
+	if out := MarshalLossless(&msg); out != exp {
+		t.Errorf("Mismatch:\nExpected:\n%q\nGot:\n%q", exp, out)
+	}
+
+	// Without Headers the message is written by Marshal
+	plain := Parse([]byte(losslessMsg))
+	if MarshalLossless(&plain) != Marshal(&plain) {
+		t.Errorf("Expected Marshal output for a message without Headers")
+	}
+}
+
+func Test_sipHeader_DirtyLF(t *testing.T) {
+
+	lf := strings.ReplaceAll(strings.Replace(losslessMsg, "l: 24", "l: 22", 1), "\r\n", "\n")
+	msg := ParseLossless([]byte(lf))
+
+	// Rendered lines take the line ending of the message
+	msg.Req.Src = nil
+	msg.XGammaIP.Value = []byte("192.0.2.1")
+	msg.MarkDirty(HEADER_XGAMMA_PUBLIC)
+	msg.MarkDirty("Via")
+	out := MarshalLossless(&msg)
+	if strings.Contains(out, "\r") {
+		t.Errorf("Mixed line endings: %q", out)
+	}
+	if !strings.Contains(out, "\nX-Gamma-Public-IP: 192.0.2.1\nl: 22\n") {
+		t.Errorf("Bad X-Gamma-Public-IP: %q", out)
+	}
+
+	// Both writers use the header name the parser reads
+	if again := Parse([]byte(out)); string(again.XGammaIP.Value) != "192.0.2.1" {
+		t.Errorf("Mismatch: %q", again.XGammaIP.Value)
+	}
+	msg.Headers = nil
+	if again := Parse([]byte(Marshal(&msg))); string(again.XGammaIP.Value) != "192.0.2.1" {
+		t.Errorf("Mismatch: %q", again.XGammaIP.Value)
+	}
+
+	// The old name still matches the header
+	again := ParseLossless([]byte(out))
+	if vals := again.HeaderValues(HEADER_XGAMMA_IP); len(vals) != 1 || string(vals[0]) != "192.0.2.1" {
+		t.Errorf("Mismatch: %q", vals)
+	}
+	if old := Parse([]byte("OPTIONS sip:bob@10.0.0.1 SIP/2.0\r\nX-Gamma-IP: 192.0.2.2\r\n\r\n")); string(old.XGammaIP.Value) != "192.0.2.2" {
+		t.Errorf("Mismatch: %q", old.XGammaIP.Value)
+	}
+}
+
+func Test_sipHeader_HeaderKey(t *testing.T) {
+
+	tests := map[string]string{"v": "via", "Via": "via", " L ": "content-length", "X-Custom": "x-custom", "i": "call-id"}
+	for in, exp := range tests {
+		if got := HeaderKey([]byte(in)); got != exp {
+			t.Errorf("HeaderKey(%q): expected %q got %q", in, exp, got)
+		}
+	}
+}
@@ -0,0 +1,451 @@
+package siprocket
+
+/*
+ Header manipulation in the style of the textops module of Kamailio
+
+   insert_hf("X-Hdr: 1\r\n", "Contact")   insert before a header
+   append_hf("X-Hdr: 1\r\n", "Contact")   insert after a header
+   remove_hf("User-Agent")                remove every instance
+   subst('/^(To:.*)sip:[^@]*@/\1sip:12345@/')
+
+ A header held in a typed field of SipMsg is kept in step with its lines
+ in Headers: editing the lines parses them into the typed field again and
+ the typed helpers render their lines again. Headers without a typed field
+ only live in Headers and Marshal writes them in front of the
+ Content-Length. The first edit of a message without Headers fills them in
+ from the typed fields.
+
+*/
+
+import (
+	"bytes"
+	"errors"
+	"regexp"
+	"strconv"
+)
+
+// typedHeaders lists the headers held in typed fields in the order Marshal
+// writes them
+var typedHeaders = []string{
+	"via", "record-route", "route", "path", "from", "to", "contact",
+	"call-id", "cseq", "max-forwards", "user-agent", "server", "expires",
+	"authorization", "allow", "content-type", "x-gamma-public-ip",
+}
+
+// HeaderValues returns the value of every header called name, in full or
+// compact form, in the order they appear
+func (data *SipMsg) HeaderValues(name string) [][]byte {
+	key := HeaderKey([]byte(name))
+	if data.Headers == nil {
+		var vals [][]byte
+		for _, h := range renderTypedHeaders(data, key) {
+			vals = append(vals, h.Value)
+		}
+		return vals
+	}
+
+	var vals [][]byte
+	for i := range data.Headers {
+		if data.Headers[i].Name != nil && HeaderKey(data.Headers[i].Name) == key {
+			vals = append(vals, data.Headers[i].Value)
+		}
+	}
+	return vals
+}
+
+// AddHeader adds a header in front of the Content-Length, after any other
+// header of the same name
+func (data *SipMsg) AddHeader(name, value string) {
+	data.ensureHeaders()
+	data.insertHeader(data.contentLengthIndex(), name, value)
+}
+
+// InsertHeaderBefore adds a header in front of the first header called
+// ref, false is returned when there is none
+func (data *SipMsg) InsertHeaderBefore(ref, name, value string) bool {
+	data.ensureHeaders()
+	idx := data.headerIndex(ref, false)
+	if idx == -1 {
+		return false
+	}
+	data.insertHeader(idx, name, value)
+	return true
+}
+
+// InsertHeaderAfter adds a header behind the last header called ref, false
+// is returned when there is none
+func (data *SipMsg) InsertHeaderAfter(ref, name, value string) bool {
+	data.ensureHeaders()
+	idx := data.headerIndex(ref, true)
+	if idx == -1 {
+		return false
+	}
+	data.insertHeader(idx+1, name, value)
+	return true
+}
+
+// SetHeader gives the first header called name the value and removes the
+// others, the header is added as AddHeader does when there is none
+func (data *SipMsg) SetHeader(name, value string) {
+	data.ensureHeaders()
+	idx := data.headerIndex(name, false)
+	if idx == -1 {
+		data.insertHeader(data.contentLengthIndex(), name, value)
+		return
+	}
+	key := HeaderKey([]byte(name))
+
+	headers := data.Headers[:idx+1]
+	for _, h := range data.Headers[idx+1:] {
+		if h.Name != nil && HeaderKey(h.Name) == key {
+			continue
+		}
+		headers = append(headers, h)
+	}
+	data.Headers = headers
+	data.Headers[idx] = SipHeader{Name: []byte(name), Value: []byte(value)}
+	data.syncTyped(key)
+}
+
+// RemoveHeader removes every header called name and returns how many were
+// removed, the typed field of the header is cleared
+func (data *SipMsg) RemoveHeader(name string) int {
+	data.ensureHeaders()
+	key := HeaderKey([]byte(name))
+
+	n := 0
+	headers := data.Headers[:0]
+	for _, h := range data.Headers {
+		if h.Name != nil && HeaderKey(h.Name) == key {
+			n++
+			continue
+		}
+		headers = append(headers, h)
+	}
+	data.Headers = headers
+	if n > 0 {
+		data.syncTyped(key)
+	}
+	return n
+}
+
+// ReplaceHeader replaces the matches of re with repl in the value of every
+// header called name, repl may refer to submatches as in
+// regexp.ReplaceAll. It returns how many headers were changed.
+func (data *SipMsg) ReplaceHeader(name string, re *regexp.Regexp, repl string) int {
+	data.ensureHeaders()
+	key := HeaderKey([]byte(name))
+
+	n := 0
+	for i := range data.Headers {
+		h := &data.Headers[i]
+		if h.Name == nil || HeaderKey(h.Name) != key {
+			continue
+		}
+		val := re.ReplaceAll(h.Value, []byte(repl))
+		if bytes.Equal(val, h.Value) {
+			continue
+		}
+		h.Value = val
+		h.Src = nil
+		n++
+	}
+	if n > 0 {
+		data.syncTyped(key)
+	}
+	return n
+}
+
+// SetRequestUser rewrites the user part of the Request-URI
+func (data *SipMsg) SetRequestUser(user string) {
+	data.Req.User = []byte(user)
+	data.Req.Src = nil
+}
+
+// RequestUri returns the Request-URI of a request, or an empty string for a
+// response
+func (data *SipMsg) RequestUri() string {
+	if len(data.Req.Method) == 0 {
+		return ""
+	}
+	return string(appendReqUri(nil, &data.Req))
+}
+
+// SetRequestUri replaces the Request-URI of a request
+func (data *SipMsg) SetRequestUri(uri string) error {
+	if len(data.Req.Method) == 0 {
+		return errors.New("not a request")
+	}
+	line := make([]byte, 0, len(data.Req.Method)+len(uri)+9)
+	line = append(line, data.Req.Method...)
+	line = append(line, ' ')
+	line = append(line, uri...)
+	line = append(line, " SIP/2.0"...)
+
+	var req SipReq
+	if err := parseSipReq(line, &req); err != nil {
+		return err
+	}
+	if req.Host == nil {
+		return errors.New("no host in uri")
+	}
+	req.SipVersion = data.Req.SipVersion
+	req.Src = nil
+	data.Req = req
+	return nil
+}
+
+// SetToUser rewrites the user part of the To URI
+func (data *SipMsg) SetToUser(user string) {
+	data.To.User = []byte(user)
+	data.To.Src = nil
+	data.refreshHeaders("to")
+}
+
+// PrependVia adds via on top of the Via headers, as a proxy does before
+// forwarding a request. The Via lines already there are kept as they were.
+func (data *SipMsg) PrependVia(via SipVia) {
+	data.Via = append([]SipVia{via}, data.Via...)
+	if data.Headers == nil {
+		return
+	}
+	idx := data.headerIndex(HEADER_VIA, false)
+	if idx == -1 {
+		idx = 0
+	}
+	fresh := headerLines(appendSipVia(nil, &via))
+	data.Headers = append(data.Headers[:idx], append(fresh, data.Headers[idx:]...)...)
+}
+
+// SetTopVia replaces the top Via, or adds it when there is none. Only its
+// value changes, it is written from the Src of via when that is set so a
+// caller changing a field either uses SetParam or clears Src. The other Via
+// values are kept as they were.
+func (data *SipMsg) SetTopVia(via SipVia) {
+	if len(data.Via) == 0 {
+		data.PrependVia(via)
+		return
+	}
+	data.Via[0] = via
+	val := via.Src
+	if len(val) == 0 {
+		val = headerLines(appendSipVia(nil, &via))[0].Value
+	}
+	data.setTopViaValue(val)
+}
+
+// RemoveTopVia removes the top Via, as a proxy does before forwarding a
+// response. The other Via values are kept as they were.
+func (data *SipMsg) RemoveTopVia() {
+	if len(data.Via) == 0 {
+		return
+	}
+	data.Via = data.Via[1:]
+	data.setTopViaValue(nil)
+}
+
+// setTopViaValue replaces the first value of the first Via line with val,
+// or removes it when val is nil. A line holding several values joined by
+// commas keeps the others.
+func (data *SipMsg) setTopViaValue(val []byte) {
+	idx := data.headerIndex(HEADER_VIA, false)
+	if idx == -1 {
+		return
+	}
+	h := &data.Headers[idx]
+	entries := splitSipList(h.Value)
+	if len(entries) < 2 {
+		if val == nil {
+			data.Headers = append(data.Headers[:idx], data.Headers[idx+1:]...)
+			return
+		}
+		h.Value = val
+		h.Src = nil
+		return
+	}
+
+	start := bytes.Index(h.Value, entries[0])
+	rest := h.Value[start+len(entries[0]):]
+	if val == nil {
+		rest = bytes.TrimLeft(bytes.TrimSpace(rest)[1:], " \t")
+	}
+	value := append([]byte(nil), h.Value[:start]...)
+	value = append(value, val...)
+	h.Value = append(value, rest...)
+	h.Src = nil
+}
+
+// PrependRecordRoute adds route on top of the Record-Route headers, as a
+// proxy does to stay on the path of a dialog. The Record-Route lines
+// already there are kept as they were.
+func (data *SipMsg) PrependRecordRoute(route SipRoute) {
+	data.RecordRoute = append([]SipRoute{route}, data.RecordRoute...)
+	if data.Headers == nil {
+		return
+	}
+	idx := data.headerIndex(HEADER_RECORD_ROUTE, false)
+	if idx == -1 {
+		idx = data.contentLengthIndex()
+	}
+	fresh := headerLines(appendSipRoute(nil, HEADER_RECORD_ROUTE, &route))
+	data.Headers = append(data.Headers[:idx], append(fresh, data.Headers[idx:]...)...)
+}
+
+// ensureHeaders fills in Headers from the typed fields of a message that
+// has none, in the order Marshal writes them
+func (data *SipMsg) ensureHeaders() {
+	if data.Headers != nil {
+		return
+	}
+	data.Headers = make([]SipHeader, 0, 16)
+	for _, key := range typedHeaders {
+		data.Headers = append(data.Headers, renderTypedHeaders(data, key)...)
+	}
+	data.Headers = append(data.Headers, SipHeader{
+		Name:  []byte(HEADER_CONTENT_LENGTH),
+		Value: strconv.AppendInt(nil, int64(len(data.Body)), 10),
+	})
+}
+
+// insertHeader adds a header at idx of Headers and parses it into its
+// typed field
+func (data *SipMsg) insertHeader(idx int, name, value string) {
+	hdr := SipHeader{Name: []byte(name), Value: []byte(value)}
+	data.Headers = append(data.Headers, SipHeader{})
+	copy(data.Headers[idx+1:], data.Headers[idx:])
+	data.Headers[idx] = hdr
+	data.syncTyped(HeaderKey(hdr.Name))
+}
+
+// headerIndex returns the index of the first or last header called name,
+// or -1 when there is none
+func (data *SipMsg) headerIndex(name string, last bool) int {
+	key := HeaderKey([]byte(name))
+	idx := -1
+	for i := range data.Headers {
+		if data.Headers[i].Name != nil && HeaderKey(data.Headers[i].Name) == key {
+			if !last {
+				return i
+			}
+			idx = i
+		}
+	}
+	return idx
+}
+
+// contentLengthIndex returns the index of the Content-Length header, or the
+// length of Headers when there is none
+func (data *SipMsg) contentLengthIndex() int {
+	if idx := data.headerIndex(HEADER_CONTENT_LENGTH, false); idx > -1 {
+		return idx
+	}
+	return len(data.Headers)
+}
+
+// syncTyped parses the headers of the given key into their typed field
+// again, nothing is done for a header without one
+func (data *SipMsg) syncTyped(key string) {
+	if !isTypedHeader(key) && key != "content-length" {
+		return
+	}
+	data.clearTyped(key)
+	for i := range data.Headers {
+		if data.Headers[i].Name != nil && HeaderKey(data.Headers[i].Name) == key {
+			data.parseHeader(key, data.Headers[i].Value)
+		}
+	}
+}
+
+// refreshHeaders renders the headers of the given key again from their
+// typed field, in place of the first of them or in front of the
+// Content-Length when there were none
+func (data *SipMsg) refreshHeaders(key string) {
+	if data.Headers == nil {
+		return
+	}
+
+	idx := -1
+	headers := data.Headers[:0]
+	for _, h := range data.Headers {
+		if h.Name != nil && HeaderKey(h.Name) == key {
+			if idx == -1 {
+				idx = len(headers)
+			}
+			continue
+		}
+		headers = append(headers, h)
+	}
+	data.Headers = headers
+	if idx == -1 {
+		idx = data.contentLengthIndex()
+	}
+
+	fresh := renderTypedHeaders(data, key)
+	data.Headers = append(data.Headers[:idx], append(fresh, data.Headers[idx:]...)...)
+}
+
+// clearTyped empties the typed field of a header
+func (data *SipMsg) clearTyped(key string) {
+	switch key {
+	case "via":
+		data.Via = nil
+	case "record-route":
+		data.RecordRoute = nil
+	case "route":
+		data.Route = nil
+	case "path":
+		data.Path = nil
+	case "from":
+		data.From = SipFrom{}
+	case "to":
+		data.To = SipTo{}
+	case "contact":
+		data.Contact = SipContact{}
+		data.Contacts = nil
+	case "call-id":
+		data.CallId = SipVal{}
+	case "cseq":
+		data.Cseq = SipCseq{}
+	case "max-forwards":
+		data.MaxFwd = SipVal{}
+	case "user-agent":
+		data.Ua = SipVal{}
+	case "server":
+		data.Server = SipVal{}
+	case "expires":
+		data.Exp = SipVal{}
+	case "authorization":
+		data.Auth = SipAuth{}
+	case "allow":
+		data.Allow = SipAllow{}
+	case "content-type":
+		data.ContType = SipVal{}
+	case "content-length":
+		data.ContLen = SipVal{}
+	case "x-gamma-public-ip":
+		data.XGammaIP = SipVal{}
+	}
+}
+
+// renderTypedHeaders renders the typed field of a header as dirty header
+// lines, they get the line ending of the message when it is written
+func renderTypedHeaders(data *SipMsg, key string) []SipHeader {
+	return headerLines(appendTypedHeader(nil, data, key))
+}
+
+// headerLines splits rendered header lines into dirty headers
+func headerLines(b []byte) []SipHeader {
+	var headers []SipHeader
+	for len(b) > 0 {
+		var line []byte
+		line, b, _ = bytes.Cut(b, []byte("\n"))
+		line = bytes.TrimSuffix(line, []byte("\r"))
+		if idx := bytes.IndexByte(line, ':'); idx > 0 {
+			headers = append(headers, SipHeader{
+				Name:  line[:idx],
+				Value: bytes.TrimSpace(line[idx+1:]),
+			})
+		}
+	}
+	return headers
+}
@@ -0,0 +1,190 @@
+package siprocket
+
+import (
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func Test_sipManipulate_Lossless(t *testing.T) {
+
+	msg := ParseLossless([]byte(losslessMsg))
+
+	if !msg.InsertHeaderBefore("Contact", "X-Before", "1") || !msg.InsertHeaderAfter("v", "X-After", "2") {
+		t.Fatal("Reference header not found")
+	}
+	if msg.InsertHeaderBefore("Route", "X-Never", "3") {
+		t.Errorf("Inserted before a missing header")
+	}
+	if n := msg.RemoveHeader("x-custom"); n != 1 {
+		t.Errorf("Expected 1 header removed, got %d", n)
+	}
+	if n := msg.ReplaceHeader("To", regexp.MustCompile(`sip:bob@`), "sip:12345@"); n != 1 {
+		t.Errorf("Expected 1 header replaced, got %d", n)
+	}
+
+	// The typed field follows the raw header
+	if string(msg.To.User) != "12345" || string(msg.To.Name) != "Bob" {
+		t.Errorf("To not in sync: %q %q", msg.To.Name, msg.To.User)
+	}
+
+	exp := strings.NewReplacer(
+		"VIA:SIP/2.0/UDP bigbox3.site3.atlanta.com;branch=z9hG4bK77ef4c2312983.1\r\n",
+		"VIA:SIP/2.0/UDP bigbox3.site3.atlanta.com;branch=z9hG4bK77ef4c2312983.1\r\nX-After: 2\r\n",
+		"t: Bob <sip:bob@biloxi.com>\r\n", "t: Bob <sip:12345@biloxi.com>\r\n",
+		"X-Custom: keep me\r\n", "",
+		"m: <sip:alice@pc33.atlanta.com>\r\n", "X-Before: 1\r\nm: <sip:alice@pc33.atlanta.com>\r\n",
+	).Replace(losslessMsg)
+	if out := MarshalLossless(&msg); out != exp {
+		t.Errorf("Mismatch:\nExpected:\n%q\nGot:\n%q", exp, out)
+	}
+
+	// The proxy helpers add their own line and keep the others as they were
+	msg.PrependVia(NewSipVia("TCP", "p1.example.com", "5060", "z9hG4bKp1", "", ""))
+	msg.PrependRecordRoute(NewSipRoute("sip", "", "", "p1.example.com", "", "sip:p1.example.com;lr", ""))
+	msg.SetRequestUser("12345")
+	exp = strings.NewReplacer(
+		"INVITE sip:bob@biloxi.com;user=phone SIP/2.0\r\n", "INVITE sip:12345@biloxi.com;user=phone SIP/2.0\r\n",
+		"v: SIP/2.0/UDP pc33.atlanta.com;branch=z9hG4bK776asdhds\r\n",
+		"Via: SIP/2.0/TCP p1.example.com:5060;rport;branch=z9hG4bKp1\r\nv: SIP/2.0/UDP pc33.atlanta.com;branch=z9hG4bK776asdhds\r\n",
+		"l: 24\r\n", "Record-Route: <sip:p1.example.com;lr>\r\nl: 24\r\n",
+	).Replace(exp)
+	if out := MarshalLossless(&msg); out != exp {
+		t.Errorf("Mismatch:\nExpected:\n%q\nGot:\n%q", exp, out)
+	}
+
+	// Only the top Via line changes
+	via := msg.Via[0]
+	via.Trans = "UDP"
+	msg.SetTopVia(via)
+	top := strings.Replace(exp, "SIP/2.0/TCP p1.example.com", "SIP/2.0/UDP p1.example.com", 1)
+	if out := MarshalLossless(&msg); out != top {
+		t.Errorf("Mismatch:\nExpected:\n%q\nGot:\n%q", top, out)
+	}
+	msg.RemoveTopVia()
+	if len(msg.Via) != 2 || string(msg.Via[0].Host) != "pc33.atlanta.com" {
+		t.Errorf("Bad Via: %+v", msg.Via)
+	}
+	msg.PrependVia(NewSipVia("TCP", "p1.example.com", "5060", "z9hG4bKp1", "", ""))
+	if out := MarshalLossless(&msg); out != exp {
+		t.Errorf("Mismatch:\nExpected:\n%q\nGot:\n%q", exp, out)
+	}
+
+	// Marshal writes the headers without a typed field too
+	if out := Marshal(&msg); !strings.Contains(out, "X-After: 2\r\nSubject: a long\r\n folded subject\r\nX-Before: 1\r\nContent-Length: 24\r\n") {
+		t.Errorf("Other headers missing: %q", out)
+	}
+}
+
+func Test_sipManipulate_Plain(t *testing.T) {
+
+	msg := Parse([]byte(losslessMsg))
+
+	msg.AddHeader("X-Foo", "bar")
+	msg.AddHeader("Via", "SIP/2.0/TCP p1.example.com;branch=z9hG4bKp1")
+	if n := msg.RemoveHeader("Max-Forwards"); n != 1 || msg.MaxFwd.Value != nil {
+		t.Errorf("Max-Forwards not removed: %d %q", n, msg.MaxFwd.Value)
+	}
+
+	expected := []string{"pc33.atlanta.com", "bigbox3.site3.atlanta.com", "p1.example.com"}
+	var result []string
+	for _, via := range msg.Via {
+		result = append(result, string(via.Host))
+	}
+	if !reflect.DeepEqual(expected, result) {
+		t.Errorf("Mismatch:\nExpected:\n%q\nGot:\n%q", expected, result)
+	}
+	if vals := msg.HeaderValues("v"); len(vals) != 3 || string(vals[2]) != "SIP/2.0/TCP p1.example.com;branch=z9hG4bKp1" {
+		t.Errorf("Bad Via values: %q", vals)
+	}
+
+	out := Marshal(&msg)
+	if !strings.Contains(out, "X-Foo: bar\r\nContent-Length: 24\r\n") || strings.Contains(out, HEADER_MAX_FORWARDS) {
+		t.Errorf("Bad message: %q", out)
+	}
+
+	// A message built from typed fields only has its values rendered
+	built, _ := NewRequest("OPTIONS", "sip:bob@biloxi.com").Via("UDP", "h", "").From("<sip:a@h>").CallId("c1").Build()
+	if vals := built.HeaderValues("i"); len(vals) != 1 || string(vals[0]) != "c1" {
+		t.Errorf("Bad Call-ID values: %q", vals)
+	}
+	built.SetToUser("carol")
+	if out := Marshal(&built); !strings.Contains(out, "To: <sip:carol@biloxi.com>\r\n") {
+		t.Errorf("To not rewritten: %q", out)
+	}
+}
+
+func Test_sipManipulate_SetHeader(t *testing.T) {
+
+	msg := ParseLossless([]byte(losslessMsg))
+
+	msg.SetHeader("Via", "SIP/2.0/TCP p1.example.com;branch=z9hG4bKp1")
+	msg.SetHeader("X-New", "1")
+	if len(msg.Via) != 1 || string(msg.Via[0].Host) != "p1.example.com" {
+		t.Errorf("Via not in sync: %+v", msg.Via)
+	}
+
+	exp := strings.NewReplacer(
+		"v: SIP/2.0/UDP pc33.atlanta.com;branch=z9hG4bK776asdhds\r\nVIA:SIP/2.0/UDP bigbox3.site3.atlanta.com;branch=z9hG4bK77ef4c2312983.1\r\n",
+		"Via: SIP/2.0/TCP p1.example.com;branch=z9hG4bKp1\r\n",
+		"l: 24\r\n", "X-New: 1\r\nl: 24\r\n",
+	).Replace(losslessMsg)
+	if out := MarshalLossless(&msg); out != exp {
+		t.Errorf("Mismatch:\nExpected:\n%q\nGot:\n%q", exp, out)
+	}
+}
+
+func Test_sipManipulate_RequestUri(t *testing.T) {
+
+	msg := ParseLossless([]byte(losslessMsg))
+	if uri := msg.RequestUri(); uri != "sip:bob@biloxi.com;user=phone" {
+		t.Errorf("Bad Request-URI: %q", uri)
+	}
+
+	if err := msg.SetRequestUri("sips:+15551234@gw.example.com:5061"); err != nil {
+		t.Fatal(err)
+	}
+	if out := MarshalLossless(&msg); !strings.HasPrefix(out, "INVITE sips:+15551234@gw.example.com:5061 SIP/2.0\r\nv: ") {
+		t.Errorf("Request-URI not rewritten: %q", out)
+	}
+
+	if err := msg.SetRequestUri("mailto:bob@biloxi.com"); err == nil {
+		t.Errorf("Expected an error for an unsupported scheme")
+	}
+	resp := Parse([]byte("SIP/2.0 200 OK\r\n\r\n"))
+	if resp.RequestUri() != "" || resp.SetRequestUri("sip:bob@biloxi.com") == nil {
+		t.Errorf("Expected no Request-URI on a response")
+	}
+}
+
+func Test_sipManipulate_ViaList(t *testing.T) {
+
+	// Several Via values share the second line
+	msg := ParseLossless([]byte("SIP/2.0 200 OK\r\n" +
+		"Via: SIP/2.0/UDP a.example.com;branch=z9hG4bKa\r\n" +
+		"Via: SIP/2.0/UDP c.example.com;branch=z9hG4bKc, SIP/2.0/TCP d.example.com;branch=z9hG4bKd;keep\r\n" +
+		"Content-Length: 0\r\n\r\n"))
+	if len(msg.Via) != 3 || string(msg.Via[1].Branch) != "z9hG4bKc" || string(msg.Via[2].Host) != "d.example.com" {
+		t.Fatalf("Bad Via: %+v", msg.Via)
+	}
+
+	msg.RemoveTopVia()
+	via := msg.Via[0]
+	via.SetParam("received", "9.9.9.9")
+	msg.SetTopVia(via)
+	exp := "SIP/2.0 200 OK\r\n" +
+		"Via: SIP/2.0/UDP c.example.com;branch=z9hG4bKc;received=9.9.9.9, SIP/2.0/TCP d.example.com;branch=z9hG4bKd;keep\r\n" +
+		"Content-Length: 0\r\n\r\n"
+	if out := MarshalLossless(&msg); out != exp {
+		t.Errorf("Mismatch:\nExpected:\n%q\nGot:\n%q", exp, out)
+	}
+
+	msg.RemoveTopVia()
+	exp = "SIP/2.0 200 OK\r\n" +
+		"Via: SIP/2.0/TCP d.example.com;branch=z9hG4bKd;keep\r\n" +
+		"Content-Length: 0\r\n\r\n"
+	if out := MarshalLossless(&msg); out != exp || len(msg.Via) != 1 {
+		t.Errorf("Mismatch:\nExpected:\n%q\nGot:\n%q %+v", exp, out, msg.Via)
+	}
+}
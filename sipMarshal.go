@@ -1,8 +1,11 @@
 package siprocket
 
 import (
-	"fmt"
-	"strings"
+	"bytes"
+	"errors"
+	"io"
+	"strconv"
+	"sync"
 )
 
 const (
@@ -14,13 +17,18 @@ const (
 	HEADER_CSEQ           = "CSeq"
 	HEADER_MAX_FORWARDS   = "Max-Forwards"
 	HEADER_USER_AGENT     = "User-Agent"
+	HEADER_SERVER         = "Server"
 	HEADER_EXPIRES        = "Expires"
 	HEADER_AUTHORIZATION  = "Authorization"
 	HEADER_ALLOW          = "Allow"
 	HEADER_CONTENT_TYPE   = "Content-Type"
-	HEADER_XGAMMA_IP      = "X-Gamma-IP"
+	HEADER_XGAMMA_PUBLIC  = "X-Gamma-Public-IP"
 	HEADER_CONTENT_LENGTH = "Content-Length"
 	ENDL                  = "\r\n"
+
+	// Deprecated: the parser reads X-Gamma-Public-IP, use
+	// HEADER_XGAMMA_PUBLIC. Both names match the same header.
+	HEADER_XGAMMA_IP = "X-Gamma-IP"
 )
 
 func Marshal(data *SipMsg) string {
@@ -28,222 +36,287 @@ func Marshal(data *SipMsg) string {
 }
 
 func SipStructToStr(data *SipMsg) string {
-	var sb strings.Builder
-	sb.Grow(512) // Pre-allocate memory for the string builder
-
-	writeHeaders(&sb, data) // Write all headers
-
-	return sb.String()
+	return string(AppendMarshal(make([]byte, 0, 512), data))
 }
 
-func writeHeaders(sb *strings.Builder, data *SipMsg) {
-	writeRequestLine(sb, data)
-	writeViaHeaders(sb, data)
-	writeFromHeader(sb, data)
-	writeToHeader(sb, data)
-	writeContactHeader(sb, data)
-	writeCallIdHeader(sb, data)
-	writeCseqHeader(sb, data)
-	writeMaxForwardsHeader(sb, data)
-	writeUserAgentHeader(sb, data)
-	writeExpiresHeader(sb, data)
-	writeAuthorizationHeader(sb, data)
-	writeAllowHeader(sb, data)
-	writeContentTypeHeader(sb, data)
-	writeXGammaIPHeader(sb, data)
-	writeContentLengthAndSdpBody(sb, data)
+// AppendMarshal appends the message to dst and returns the extended
+// buffer, a caller that reuses dst marshals without allocating
+func AppendMarshal(dst []byte, data *SipMsg) []byte {
+	return appendHeaders(dst, data)
 }
 
-// writeStatusLine writes the Status Line or Request Line to the string builder
-func writeRequestLine(sb *strings.Builder, data *SipMsg) {
-
-	// This is a response header write the Status Line
-	if len(data.Req.StatusCode) > 0 {
-		fmt.Fprintf(sb, "%s %s %s%s", data.Req.SipVersion, data.Req.StatusCode, data.Req.StatusDesc, ENDL)
-		return
-	}
-
-	// This is a request header write the Request Line
-	if data.Req.User == nil {
-		fmt.Fprintf(sb, "%s sip:%s SIP/2.0%s", data.Req.Method, data.Req.Host, ENDL)
-		return
-	}
-	fmt.Fprintf(sb, "%s sip:%s@%s SIP/2.0%s", data.Req.Method, data.Req.User, data.Req.Host, ENDL)
-
+// marshalPool holds the buffers used by WriteTo
+var marshalPool = sync.Pool{
+	New: func() any {
+		b := make([]byte, 0, 1024)
+		return &b
+	},
 }
 
-// writeViaHeaders writes the Via headers to the string builder
-func writeViaHeaders(sb *strings.Builder, data *SipMsg) {
-	for _, via := range data.Via {
-		viaHeader := MarshalSipVia(&via)
-		sb.WriteString(viaHeader)
-	}
+// WriteTo writes the marshalled message to w, it implements io.WriterTo
+func (data *SipMsg) WriteTo(w io.Writer) (int64, error) {
+	bp := marshalPool.Get().(*[]byte)
+	b := AppendMarshal((*bp)[:0], data)
+	n, err := w.Write(b)
+	*bp = b
+	marshalPool.Put(bp)
+	return int64(n), err
 }
 
-// writeFromHeader writes the From header to the string builder
-func writeFromHeader(sb *strings.Builder, data *SipMsg) {
-	if data.From.Tag != nil {
-		if len(data.From.Tag) > 0 {
-			fmt.Fprintf(sb, "%s: \"%s\" <sip:%s@%s>;tag=%s%s", HEADER_FROM, data.From.User, data.From.User, data.From.Host, data.From.Tag, ENDL)
-		} else {
-			fmt.Fprintf(sb, "%s: \"%s\" <sip:%s@%s>;tag=%s", HEADER_FROM, data.From.User, data.From.User, data.From.Host, ENDL)
-		}
-	} else {
-		fmt.Fprintf(sb, "%s: \"%s\" <sip:%s@%s>%s", HEADER_FROM, data.From.User, data.From.User, data.From.Host, ENDL)
-	}
+// MarshalText implements encoding.TextMarshaler
+func (data *SipMsg) MarshalText() ([]byte, error) {
+	return AppendMarshal(make([]byte, 0, 512), data), nil
 }
 
-// writeToHeader writes the To header to the string builder
-func writeToHeader(sb *strings.Builder, data *SipMsg) {
-	if data.To.Tag != nil {
-		if len(data.To.Tag) > 0 {
-			fmt.Fprintf(sb, "%s: \"%s\" <sip:%s@%s>;tag=%s%s", HEADER_TO, data.To.User, data.To.User, data.To.Host, data.To.Tag, ENDL)
-		} else {
-			fmt.Fprintf(sb, "%s: \"%s\" <sip:%s@%s>;tag=%s", HEADER_TO, data.To.User, data.To.User, data.To.Host, ENDL)
-		}
-	} else {
-		fmt.Fprintf(sb, "%s: \"%s\" <sip:%s@%s>%s", HEADER_TO, data.To.User, data.To.User, data.To.Host, ENDL)
+// UnmarshalText implements encoding.TextUnmarshaler, the message keeps a
+// copy of text so the caller may reuse it
+func (data *SipMsg) UnmarshalText(text []byte) error {
+	if !IsSipStart(text) {
+		return errors.New("not a sip message")
 	}
+	*data = Parse(append([]byte(nil), text...))
+	return nil
 }
 
-// writeContactHeader writes the Contact header to the string builder
-func writeContactHeader(sb *strings.Builder, data *SipMsg) {
-	if string(data.Contact.Tran) != "" {
-		fmt.Fprintf(sb, "%s: \"%s\" <sip:%s@%s:%s;transport=%s", HEADER_CONTACT, data.Contact.User, data.Contact.User, data.Contact.Host, data.Contact.Port, data.Contact.Tran)
-	} else {
-		fmt.Fprintf(sb, "%s: \"%s\" <sip:%s@%s:%s", HEADER_CONTACT, data.Contact.User, data.Contact.User, data.Contact.Host, data.Contact.Port)
+func appendHeaders(dst []byte, data *SipMsg) []byte {
+	dst = appendRequestLine(dst, data, ENDL)
+	dst = appendViaHeaders(dst, data)
+	dst = appendRouteHeaders(dst, data)
+	dst = appendFromHeader(dst, data)
+	dst = appendToHeader(dst, data)
+	dst = appendContactHeader(dst, data)
+	dst = appendValHeader(dst, HEADER_CALL_ID, data.CallId.Value, true)
+	dst = appendCseqHeader(dst, data)
+	dst = appendValHeader(dst, HEADER_MAX_FORWARDS, data.MaxFwd.Value, false)
+	dst = appendValHeader(dst, HEADER_USER_AGENT, data.Ua.Value, false)
+	dst = appendValHeader(dst, HEADER_SERVER, data.Server.Value, false)
+	dst = appendValHeader(dst, HEADER_EXPIRES, data.Exp.Value, false)
+	if data.Auth.Digest != nil {
+		dst = appendSipAuth(dst, &data.Auth)
 	}
-	if len(data.Contact.Qval) > 0 {
-		sb.WriteString(";")
-		for _, qval := range data.Contact.Qval {
-			fmt.Fprintf(sb, "%c", qval)
-		}
+	if data.Allow.Methods != nil {
+		dst = appendSipAllow(dst, &data.Allow)
 	}
-	sb.WriteString(">" + ENDL)
-}
-
-// writeCallIdHeader writes the Call-ID header to the string builder
-func writeCallIdHeader(sb *strings.Builder, data *SipMsg) {
-	fmt.Fprintf(sb, "%s: %s%s", HEADER_CALL_ID, data.CallId.Value, ENDL)
+	dst = appendValHeader(dst, HEADER_CONTENT_TYPE, data.ContType.Value, false)
+	dst = appendValHeader(dst, HEADER_XGAMMA_PUBLIC, data.XGammaIP.Value, false)
+	dst = appendOtherHeaders(dst, data)
+	return appendContentLengthAndSdpBody(dst, data)
 }
 
-// writeCseqHeader writes the CSeq header to the string builder
-func writeCseqHeader(sb *strings.Builder, data *SipMsg) {
-	fmt.Fprintf(sb, "%s: %s %s%s", HEADER_CSEQ, data.Cseq.Id, data.Cseq.Method, ENDL)
-}
+// appendRequestLine appends the Status Line or Request Line ended by eol
+func appendRequestLine(dst []byte, data *SipMsg, eol string) []byte {
 
-// writeMaxForwardsHeader writes the Max-Forwards header to the string builder
-func writeMaxForwardsHeader(sb *strings.Builder, data *SipMsg) {
-	if data.MaxFwd.Value != nil {
-		fmt.Fprintf(sb, "%s: %s%s", HEADER_MAX_FORWARDS, data.MaxFwd.Value, ENDL)
+	// This is a response header write the Status Line
+	if len(data.Req.StatusCode) > 0 {
+		dst = append(dst, data.Req.SipVersion...)
+		dst = append(dst, ' ')
+		dst = append(dst, data.Req.StatusCode...)
+		dst = append(dst, ' ')
+		dst = append(dst, data.Req.StatusDesc...)
+		return append(dst, eol...)
 	}
+
+	// This is a request header write the Request Line
+	dst = append(dst, data.Req.Method...)
+	dst = append(dst, ' ')
+	dst = appendReqUri(dst, &data.Req)
+	dst = append(dst, " SIP/2.0"...)
+	return append(dst, eol...)
 }
 
-// writeUserAgentHeader writes the User-Agent header to the string builder
-func writeUserAgentHeader(sb *strings.Builder, data *SipMsg) {
-	if data.Ua.Value != nil {
-		fmt.Fprintf(sb, "%s: %s%s", HEADER_USER_AGENT, data.Ua.Value, ENDL)
+// appendUri appends a sip or sips URI, the user part and port are left out
+// when they are not set
+func appendUri(dst, uriType, user, host, port []byte) []byte {
+	if len(uriType) > 0 {
+		dst = append(dst, uriType...)
+	} else {
+		dst = append(dst, "sip"...)
+	}
+	dst = append(dst, ':')
+	if len(user) > 0 {
+		dst = append(dst, user...)
+		dst = append(dst, '@')
 	}
+	dst = append(dst, host...)
+	if len(port) > 0 {
+		dst = append(dst, ':')
+		dst = append(dst, port...)
+	}
+	return dst
 }
 
-// writeExpiresHeader writes the Expires header to the string builder
-func writeExpiresHeader(sb *strings.Builder, data *SipMsg) {
-	if data.Exp.Value != nil {
-		fmt.Fprintf(sb, "%s: %s%s", HEADER_EXPIRES, data.Exp.Value, ENDL)
+// appendNameAddr appends the header name, the display name and the URI
+// opened with < of a From, To or Contact header
+func appendNameAddr(dst []byte, hdr string, name, uriType, user, host, port []byte) []byte {
+	dst = append(dst, hdr...)
+	dst = append(dst, ": "...)
+	if len(name) > 0 {
+		dst = append(dst, '"')
+		dst = append(dst, name...)
+		dst = append(dst, "\" "...)
 	}
+	dst = append(dst, '<')
+	return appendUri(dst, uriType, user, host, port)
 }
 
-// writeAuthorizationHeader writes the Authorization header to the string builder
-func writeAuthorizationHeader(sb *strings.Builder, data *SipMsg) {
-	if data.Auth.Digest != nil {
-		sb.WriteString(MarshalSipAuth(&data.Auth))
+// appendViaHeaders appends the Via headers
+func appendViaHeaders(dst []byte, data *SipMsg) []byte {
+	for i := range data.Via {
+		dst = appendSipVia(dst, &data.Via[i])
 	}
+	return dst
 }
 
-// writeAllowHeader writes the Allow header to the string builder
-func writeAllowHeader(sb *strings.Builder, data *SipMsg) {
-	if data.Allow.Methods != nil {
-		sb.WriteString(MarshalSipAllow(&data.Allow))
+// appendRouteHeaders appends the Record-Route, Route and Path headers
+func appendRouteHeaders(dst []byte, data *SipMsg) []byte {
+	for i := range data.RecordRoute {
+		dst = appendSipRoute(dst, HEADER_RECORD_ROUTE, &data.RecordRoute[i])
+	}
+	for i := range data.Route {
+		dst = appendSipRoute(dst, HEADER_ROUTE, &data.Route[i])
 	}
+	for i := range data.Path {
+		dst = appendSipRoute(dst, HEADER_PATH, &data.Path[i])
+	}
+	return dst
 }
 
-// writeContentTypeHeader writes the Content-Type header to the string builder
-func writeContentTypeHeader(sb *strings.Builder, data *SipMsg) {
-	if data.ContType.Value != nil {
-		fmt.Fprintf(sb, "%s: %s%s", HEADER_CONTENT_TYPE, data.ContType.Value, ENDL)
+// appendFromHeader appends the From header
+func appendFromHeader(dst []byte, data *SipMsg) []byte {
+	dst = appendNameAddr(dst, HEADER_FROM, data.From.Name, data.From.UriType, data.From.User, data.From.Host, data.From.Port)
+	dst = append(dst, '>')
+	if data.From.Tag != nil {
+		dst = append(dst, ";tag="...)
+		dst = append(dst, data.From.Tag...)
 	}
+	return append(dst, ENDL...)
 }
 
-// writeXGammaIPHeader writes the X-Gamma-IP header to the string builder
-func writeXGammaIPHeader(sb *strings.Builder, data *SipMsg) {
-	if data.XGammaIP.Value != nil {
-		fmt.Fprintf(sb, "%s: %s%s", HEADER_XGAMMA_IP, data.XGammaIP.Value, ENDL)
+// appendToHeader appends the To header
+func appendToHeader(dst []byte, data *SipMsg) []byte {
+	dst = appendNameAddr(dst, HEADER_TO, data.To.Name, data.To.UriType, data.To.User, data.To.Host, data.To.Port)
+	dst = append(dst, '>')
+	if data.To.Tag != nil {
+		dst = append(dst, ";tag="...)
+		dst = append(dst, data.To.Tag...)
 	}
+	return append(dst, ENDL...)
 }
 
-// writeContentLengthAndSdpBody writes the Content-Length and SDP Body to the string builder
-func writeContentLengthAndSdpBody(sb *strings.Builder, data *SipMsg) {
-	if data.Sdp.MediaDesc.Proto == nil {
-		fmt.Fprintf(sb, "%s: %d%s%s", HEADER_CONTENT_LENGTH, 0, ENDL, ENDL)
-	} else {
-		sdpBody := writeSdpBody(&data.Sdp)
-		fmt.Fprintf(sb, "%s: %d%s%s", HEADER_CONTENT_LENGTH, len(sdpBody), ENDL, ENDL)
-		sb.WriteString(sdpBody)
+// appendContactHeader appends a Contact header for every entry of
+// Contacts or, when that is empty, for Contact. Nothing is written when the
+// message has no contact.
+func appendContactHeader(dst []byte, data *SipMsg) []byte {
+	if len(data.Contacts) == 0 {
+		return appendSipContact(dst, &data.Contact)
 	}
+	for i := range data.Contacts {
+		dst = appendSipContact(dst, &data.Contacts[i])
+	}
+	return dst
 }
 
-// writeSdpBody converts the SDP struct to a string body
-func writeSdpBody(sdp *SdpMsg) string {
-	var sb strings.Builder
-	sb.Grow(256) // Pre-allocate memory for the string builder
-
-	// Write Protocol Version
-	if sdp.Version != nil {
-		fmt.Fprintf(&sb, "v=%s%s", sdp.Version, ENDL)
+// appendSipContact appends a Contact header holding a single entry,
+// nothing is written for an empty entry. A parsed entry is written from
+// Src so it keeps the parameters it has no field for.
+func appendSipContact(dst []byte, c *SipContact) []byte {
+	if c.IsWildcard() {
+		return append(dst, HEADER_CONTACT+": *"+ENDL...)
 	}
-
-	// Write Origin
-	if sdp.Origin.UnicastAddr != nil {
-		o := sdp.Origin
-		fmt.Fprintf(&sb, "o=%s %s %s %s %s %s%s", o.Username, o.SessId, o.SessVer, o.NetType, o.AddrType, o.UnicastAddr, ENDL)
+	if len(c.Src) > 0 {
+		dst = append(dst, HEADER_CONTACT+": "...)
+		dst = append(dst, c.Src...)
+		return append(dst, ENDL...)
 	}
-
-	// Write Session Name
-	if sdp.Session != nil {
-		fmt.Fprintf(&sb, "s=%s%s", sdp.Session, ENDL)
+	if len(c.Host) == 0 && len(c.User) == 0 {
+		return dst
+	}
+	dst = appendNameAddr(dst, HEADER_CONTACT, c.Name, c.UriType, c.User, c.Host, c.Port)
+	if len(c.Tran) > 0 {
+		dst = append(dst, ";transport="...)
+		dst = append(dst, c.Tran...)
+	}
+	if len(c.Maddr) > 0 {
+		dst = append(dst, ";maddr="...)
+		dst = append(dst, c.Maddr...)
 	}
+	dst = append(dst, '>')
+	if len(c.Qval) > 0 {
+		dst = append(dst, ";q="...)
+		dst = append(dst, c.Qval...)
+	}
+	if len(c.Expires) > 0 {
+		dst = append(dst, ";expires="...)
+		dst = append(dst, c.Expires...)
+	}
+	return append(dst, ENDL...)
+}
+
+// appendCseqHeader appends the CSeq header
+func appendCseqHeader(dst []byte, data *SipMsg) []byte {
+	dst = append(dst, HEADER_CSEQ+": "...)
+	dst = append(dst, data.Cseq.Id...)
+	dst = append(dst, ' ')
+	dst = append(dst, data.Cseq.Method...)
+	return append(dst, ENDL...)
+}
 
-	if sdp.Timing != nil {
-		fmt.Fprintf(&sb, "t=%s%s", sdp.Timing, ENDL)
+// appendValHeader appends a header holding a single value, a nil value is
+// only written when always is set
+func appendValHeader(dst []byte, hdr string, val []byte, always bool) []byte {
+	if val == nil && !always {
+		return dst
 	}
+	dst = append(dst, hdr...)
+	dst = append(dst, ": "...)
+	dst = append(dst, val...)
+	return append(dst, ENDL...)
+}
 
-	// Write Bandwidth
-	for _, band := range sdp.Bandwidth {
-		if string(band.Val) == "" {
-			fmt.Fprintf(&sb, "b=%s%s", band.Cat, ENDL)
+// appendOtherHeaders appends the headers of Headers that have no typed
+// field, as they were found unless they are dirty
+func appendOtherHeaders(dst []byte, data *SipMsg) []byte {
+	for i := range data.Headers {
+		h := &data.Headers[i]
+		if h.Name == nil {
+			continue
+		}
+		key := HeaderKey(h.Name)
+		if isTypedHeader(key) || key == "content-length" {
 			continue
 		}
-		fmt.Fprintf(&sb, "b=%s:%s%s", band.Cat, band.Val, ENDL)
+		if !h.IsDirty() {
+			dst = append(dst, bytes.TrimRight(h.Src, ENDL)...)
+		} else {
+			dst = append(dst, h.Name...)
+			dst = append(dst, ": "...)
+			dst = append(dst, h.Value...)
+		}
+		dst = append(dst, ENDL...)
 	}
+	return dst
+}
 
-	// Write Media Description
-	if sdp.MediaDesc.MediaType != nil {
-		fmt.Fprintf(&sb, "m=%s %s %s %s%s", sdp.MediaDesc.MediaType, sdp.MediaDesc.Port, sdp.MediaDesc.Proto, sdp.MediaDesc.Fmt, ENDL)
-	}
+// appendContentLengthAndSdpBody appends the Content-Length and SDP Body, a
+// message without SDP has its raw Body written instead
+func appendContentLengthAndSdpBody(dst []byte, data *SipMsg) []byte {
 
-	// Write Connection Data
-	if sdp.ConnData.AddrType != nil {
-		fmt.Fprintf(&sb, "c=%s %s %s%s", sdp.ConnData.NetType, sdp.ConnData.AddrType, sdp.ConnData.ConnAddr, ENDL)
+	// The body is written first then moved behind the header once its
+	// length is known
+	start := len(dst)
+	dst = appendSdp(dst, &data.Sdp)
+	if len(dst) == start {
+		dst = append(dst, data.Body...)
 	}
+	n := len(dst) - start
 
-	// Write Attributes
-	for _, attr := range sdp.Attrib {
-		if string(attr.Val) == "" {
-			fmt.Fprintf(&sb, "a=%s%s", attr.Cat, ENDL)
-			continue
-		}
-		fmt.Fprintf(&sb, "a=%s:%s%s", attr.Cat, attr.Val, ENDL)
-	}
+	var buf [40]byte
+	hdr := append(buf[:0], HEADER_CONTENT_LENGTH+": "...)
+	hdr = strconv.AppendInt(hdr, int64(n), 10)
+	hdr = append(hdr, ENDL+ENDL...)
 
-	return sb.String()
+	dst = append(dst, hdr...)
+	copy(dst[start+len(hdr):], dst[start:start+n])
+	copy(dst[start:], hdr)
+	return dst
 }
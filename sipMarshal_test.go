@@ -1,6 +1,9 @@
 package siprocket
 
 import (
+	"bytes"
+	"io"
+	"reflect"
 	"strings"
 	"testing"
 )
@@ -278,7 +281,40 @@ Content-Length: 0
 }
 
 func BenchmarkMarshal(b *testing.B) {
-	msgData := SipMsg{
+	msgData := benchmarkSipMsg()
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		_ = Marshal(&msgData)
+	}
+}
+
+func BenchmarkAppendMarshal(b *testing.B) {
+	msgData := benchmarkSipMsg()
+	buf := make([]byte, 0, 1024)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		buf = AppendMarshal(buf[:0], &msgData)
+	}
+}
+
+func BenchmarkWriteTo(b *testing.B) {
+	msgData := benchmarkSipMsg()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		msgData.WriteTo(io.Discard)
+	}
+}
+
+func benchmarkSipMsg() SipMsg {
+	return SipMsg{
 		Req: SipReq{
 			Method:     []byte("REGISTER"),
 			UriType:    []byte("sip"),
@@ -396,10 +432,143 @@ func BenchmarkMarshal(b *testing.B) {
 			},
 		},
 	}
+}
 
-	b.ResetTimer()
+func Test_sipMarshal_AppendMarshal(t *testing.T) {
 
-	for i := 0; i < b.N; i++ {
-		_ = Marshal(&msgData)
+	msg := benchmarkSipMsg()
+	exp := Marshal(&msg)
+
+	// Appending keeps what is already in the buffer
+	out := AppendMarshal([]byte("prefix"), &msg)
+	if string(out) != "prefix"+exp {
+		t.Errorf("Mismatch:\nExpected:\n%q\nGot:\n%q", "prefix"+exp, out)
+	}
+
+	var buf bytes.Buffer
+	n, err := msg.WriteTo(&buf)
+	if err != nil || n != int64(len(exp)) || buf.String() != exp {
+		t.Errorf("Mismatch:\nExpected:\n%q\nGot:\n%q (%d, %v)", exp, buf.String(), n, err)
+	}
+
+	// A body is written after its Content-Length
+	msg.Sdp = SdpMsg{}
+	msg.Body = []byte("Signal=5\r\nDuration=160\r\n")
+	out = AppendMarshal(nil, &msg)
+	if !bytes.HasSuffix(out, []byte("Content-Length: 24\r\n\r\nSignal=5\r\nDuration=160\r\n")) {
+		t.Errorf("Bad body: %q", out)
+	}
+}
+
+func Test_sipMarshal_Text(t *testing.T) {
+
+	raw := []byte("OPTIONS sip:bob@biloxi.com SIP/2.0\r\n" +
+		"Via: SIP/2.0/UDP pc33.atlanta.com;rport;branch=z9hG4bK776asdhds\r\n" +
+		"From: <sip:alice@atlanta.com>;tag=1928301774\r\n" +
+		"To: <sip:bob@biloxi.com>\r\n" +
+		"Call-ID: a84b4c76e66710@pc33.atlanta.com\r\n" +
+		"CSeq: 63104 OPTIONS\r\n" +
+		"Max-Forwards: 70\r\n" +
+		"Content-Length: 0\r\n\r\n")
+
+	var msg SipMsg
+	if err := msg.UnmarshalText(raw); err != nil {
+		t.Fatal(err)
+	}
+
+	// The message must not share memory with the text
+	copy(raw, bytes.Repeat([]byte("x"), len(raw)))
+	if string(msg.CallId.Value) != "a84b4c76e66710@pc33.atlanta.com" {
+		t.Errorf("Message shares the text: %q", msg.CallId.Value)
+	}
+
+	out, err := msg.MarshalText()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var again SipMsg
+	if err := again.UnmarshalText(out); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"OPTIONS", "z9hG4bK776asdhds", "1928301774", "63104"}
+	result := []string{string(again.Req.Method), string(again.Via[0].Branch), string(again.From.Tag), string(again.Cseq.Id)}
+	if !reflect.DeepEqual(expected, result) {
+		t.Errorf("Mismatch:\nExpected:\n%q\nGot:\n%q", expected, result)
+	}
+
+	if err := msg.UnmarshalText([]byte("GET / HTTP/1.1\r\n\r\n")); err == nil {
+		t.Errorf("Expected an error for a non sip message")
+	}
+}
+
+func Test_sipMarshal_Contacts(t *testing.T) {
+
+	msg := Parse([]byte("SIP/2.0 302 Moved Temporarily\r\n" +
+		"Via: SIP/2.0/UDP pc33.atlanta.com;branch=z9hG4bK776asdhds\r\n" +
+		"From: <sip:alice@atlanta.com>;tag=1928301774\r\n" +
+		"To: <sip:bob@biloxi.com>;tag=a6c85cf\r\n" +
+		"Call-ID: a84b4c76e66710@pc33.atlanta.com\r\n" +
+		"CSeq: 314159 INVITE\r\n" +
+		"Contact: <sip:bob@192.0.2.4>\r\n" +
+		"Contact: <sip:bob@192.0.2.5>;+sip.instance=\"<urn:uuid:1>\";reg-id=1\r\n" +
+		"Content-Length: 0\r\n\r\n"))
+	if len(msg.Contacts) != 2 {
+		t.Fatalf("expected 2 contacts, got %d", len(msg.Contacts))
+	}
+
+	// Every contact is written back with the parameters it has no field for
+	out := Marshal(&msg)
+	if !strings.Contains(out, "Contact: <sip:bob@192.0.2.4>\r\nContact: <sip:bob@192.0.2.5>;+sip.instance=\"<urn:uuid:1>\";reg-id=1\r\n") {
+		t.Errorf("Bad contacts: %q", out)
+	}
+}
+
+func Test_sipMarshal_ContactQval(t *testing.T) {
+
+	msg := Parse([]byte("SIP/2.0 302 Moved Temporarily\r\n" +
+		"Via: SIP/2.0/UDP pc33.atlanta.com;branch=z9hG4bK776asdhds\r\n" +
+		"From: <sip:alice@atlanta.com>;tag=1928301774\r\n" +
+		"To: <sip:bob@biloxi.com>;tag=a6c85cf\r\n" +
+		"Call-ID: a84b4c76e66710@pc33.atlanta.com\r\n" +
+		"CSeq: 314159 INVITE\r\n" +
+		"Contact: <sip:b1@h1>;q=0.5, <sip:b2@h2>;q=0.1;expires=60\r\n" +
+		"Content-Length: 0\r\n\r\n"))
+
+	// The q-value is a header parameter, written after the URI
+	for i := range msg.Contacts {
+		msg.Contacts[i].Src = nil
+	}
+	out := Marshal(&msg)
+	if !strings.Contains(out, "Contact: <sip:b1@h1>;q=0.5\r\nContact: <sip:b2@h2>;q=0.1;expires=60\r\n") {
+		t.Errorf("Bad contacts: %q", out)
+	}
+	again := Parse([]byte(out))
+	if len(again.Contacts) != 2 || string(again.Contacts[0].Qval) != "0.5" || string(again.Contacts[1].Qval) != "0.1" {
+		t.Errorf("Mismatch: %+v", again.Contacts)
+	}
+}
+
+func Test_sipMarshal_ContactExpires(t *testing.T) {
+
+	msg := Parse([]byte("SIP/2.0 200 OK\r\n" +
+		"Via: SIP/2.0/UDP bobspc.biloxi.com:5060;branch=z9hG4bKnashds7\r\n" +
+		"From: <sip:bob@biloxi.com>;tag=456248\r\n" +
+		"To: <sip:bob@biloxi.com>;tag=2493k59kd\r\n" +
+		"Call-ID: 843817637684230@998sdasdh09\r\n" +
+		"CSeq: 1826 REGISTER\r\n" +
+		"Contact: <sip:bob@192.0.2.4>;expires=3600\r\n" +
+		"Content-Length: 0\r\n\r\n"))
+
+	// The expires header parameter is kept outside the URI
+	out := Marshal(&msg)
+	if !strings.Contains(out, "Contact: <sip:bob@192.0.2.4>;expires=3600\r\n") {
+		t.Errorf("Bad contact: %q", out)
+	}
+
+	// The wildcard of a REGISTER is written back as it is
+	msg.Contacts = []SipContact{{Src: []byte("*")}}
+	out = Marshal(&msg)
+	if !strings.Contains(out, "Contact: *\r\n") {
+		t.Errorf("Bad wildcard contact: %q", out)
 	}
 }
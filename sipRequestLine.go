@@ -15,16 +15,17 @@ import (
 )
 
 type SipReq struct {
-	Method     []byte // Sip Method eg INVITE etc
-	UriType    []byte // Type of URI sip, sips, tel etc
-	User       []byte // User part
-	Host       []byte // Host part
-	Port       []byte // Port number
-	UserType   []byte // User Type
-	SipVersion []byte // SIP Version SIP/2.0
-	StatusCode []byte // Status Code eg 100
-	StatusDesc []byte // Status Code Description eg trying
-	Src        []byte // Full source if needed
+	Method     []byte   // Sip Method eg INVITE etc
+	UriType    []byte   // Type of URI sip, sips, tel etc
+	User       []byte   // User part
+	Host       []byte   // Host part
+	Port       []byte   // Port number
+	UserType   []byte   // User Type
+	Params     [][]byte // URI parameters in order eg user=phone, transport=tcp
+	SipVersion []byte   // SIP Version SIP/2.0
+	StatusCode []byte   // Status Code eg 100
+	StatusDesc []byte   // Status Code Description eg trying
+	Src        []byte   // Full source if needed
 }
 
 func NewSipReq(method, uriType, user, host, port, userType, sipVersion, statusCode, statusDesc, src string) SipReq {
@@ -56,6 +57,7 @@ func parseSipReq(v []byte, out *SipReq) error {
 	out.Host = nil
 	out.Port = nil
 	out.UserType = nil
+	out.Params = nil
 
 	// Keep the source line if needed
 	out.Src = v
@@ -81,6 +83,7 @@ func parseSipReq(v []byte, out *SipReq) error {
 			v = v[idx+1:]
 		}
 	}
+	out.Params = parseSipReqUriParams(v)
 
 	// Check if our uri string uses <> encapsulation
 	// Although <> is not a reserved charactor so its possible we can go wrong
@@ -204,6 +207,9 @@ func parseSipReq(v []byte, out *SipReq) error {
 			// Parse header parameters
 			if idx = bytes.LastIndexByte(v, byte(';')); idx > -1 {
 				parseSipReqHeaderParams(v[idx:], out)
+			}
+			// The host and port end at the first parameter
+			if idx = bytes.IndexByte(v, byte(';')); idx > -1 {
 				v = v[:idx]
 			}
 		}
@@ -218,6 +224,15 @@ func parseSipReq(v []byte, out *SipReq) error {
 		out.Host = v
 	}
 
+	// The user parameter need not be the last one
+	if out.UserType == nil {
+		for _, param := range out.Params {
+			if bytes.HasPrefix(param, []byte("user=")) {
+				out.UserType = param[5:]
+			}
+		}
+	}
+
 	return nil
 }
 
@@ -267,3 +282,46 @@ func parseSipReqHeaderParams(v []byte, out *SipReq) {
 		v = v[:idx]
 	}
 }
+
+// parseSipReqUriParams returns the parameters of the Request-URI v in
+// order, those after the host and before any headers
+func parseSipReqUriParams(v []byte) [][]byte {
+	if idx := bytes.IndexByte(v, '<'); idx > -1 {
+		v = v[idx+1:]
+	}
+	if idx := bytes.IndexAny(v, "?>"); idx > -1 {
+		v = v[:idx]
+	}
+	if idx := bytes.IndexByte(v, '@'); idx > -1 {
+		v = v[idx+1:]
+	}
+	idx := bytes.IndexByte(v, ';')
+	if idx == -1 {
+		return nil
+	}
+	var params [][]byte
+	for _, param := range bytes.Split(v[idx+1:], []byte(";")) {
+		if len(param) > 0 {
+			params = append(params, param)
+		}
+	}
+	return params
+}
+
+// appendReqUri appends the Request-URI with its parameters, or only the
+// user parameter for a request built without Params
+func appendReqUri(dst []byte, req *SipReq) []byte {
+	dst = appendUri(dst, req.UriType, req.User, req.Host, req.Port)
+	if req.Params == nil {
+		if len(req.UserType) > 0 {
+			dst = append(dst, ";user="...)
+			dst = append(dst, req.UserType...)
+		}
+		return dst
+	}
+	for _, param := range req.Params {
+		dst = append(dst, ';')
+		dst = append(dst, param...)
+	}
+	return dst
+}
@@ -80,6 +80,7 @@ func Test_sipParse_RequestLine_INVITE(t *testing.T) {
 		Host:       []byte("10.0.0.1"),
 		Port:       []byte(nil),
 		UserType:   []byte("phone"),
+		Params:     [][]byte{[]byte("user=phone")},
 		Src:        []byte(msg),
 	}
 	if e := parseSipReq([]byte(msg), &out); e == nil {
@@ -114,3 +115,19 @@ func Test_sipParse_RequestLine_INVITE(t *testing.T) {
 		t.Errorf("example %s generated the error %s\n", msg, e)
 	}
 }
+
+func Test_sipParse_RequestLine_UriParams(t *testing.T) {
+
+	var out SipReq
+	msg := "REGISTER sip:bob@192.0.2.4:5080;user=phone;transport=tcp;lr SIP/2.0"
+	if e := parseSipReq([]byte(msg), &out); e != nil {
+		t.Fatalf("example %s generated the error %s\n", msg, e)
+	}
+	exp := [][]byte{[]byte("user=phone"), []byte("transport=tcp"), []byte("lr")}
+	if string(out.Host) != "192.0.2.4" || string(out.Port) != "5080" || string(out.UserType) != "phone" || !reflect.DeepEqual(out.Params, exp) {
+		t.Errorf("Mismatch: %q %q %q %q", out.Host, out.Port, out.UserType, out.Params)
+	}
+	if uri := string(appendReqUri(nil, &out)); uri != "sip:bob@192.0.2.4:5080;user=phone;transport=tcp;lr" {
+		t.Errorf("Mismatch: %q", uri)
+	}
+}
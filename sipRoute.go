@@ -0,0 +1,234 @@
+package siprocket
+
+/*
+ RFC 3261 - https://datatracker.ietf.org/doc/html/rfc3261#section-20.30
+
+ 20.30 Record-Route, 20.34 Route and RFC 3327 Path
+
+   Record-Route: <sip:server10.biloxi.com;lr>,
+    <sip:bigbox3.site3.atlanta.com;lr>
+   Route: <sip:bigbox3.site3.atlanta.com;lr>,
+    <sip:server10.biloxi.com;lr>
+
+ All three headers carry a comma separated list of name-addr values, which may
+ also be spread over several header lines. A URI with the lr parameter
+ belongs to a loose router, see section 16.12.
+
+*/
+
+import (
+	"bytes"
+	"errors"
+)
+
+const (
+	HEADER_RECORD_ROUTE = "Record-Route"
+	HEADER_ROUTE        = "Route"
+	HEADER_PATH         = "Path"
+)
+
+type SipRoute struct {
+	UriType []byte   // Type of URI sip, sips
+	Name    []byte   // Named portion of URI
+	User    []byte   // User part
+	Host    []byte   // Host part
+	Port    []byte   // Port number
+	Params  [][]byte // URI parameters in order eg lr, transport=tcp
+	Uri     []byte   // Full URI between < and >
+	Src     []byte   // Full source if needed
+}
+
+func NewSipRoute(uriType, name, user, host, port, uri, src string) SipRoute {
+	return SipRoute{
+		UriType: []byte(uriType),
+		Name:    []byte(name),
+		User:    []byte(user),
+		Host:    []byte(host),
+		Port:    []byte(port),
+		Uri:     []byte(uri),
+		Src:     []byte(src),
+	}
+}
+
+// parseSipRoutes parses the value of a Route or Record-Route header line
+// and appends each entry to out
+func parseSipRoutes(v []byte, out []SipRoute) ([]SipRoute, error) {
+	var err error
+	for _, entry := range splitSipList(v) {
+		var route SipRoute
+		if perr := parseSipRoute(entry, &route); perr != nil {
+			if err == nil {
+				err = perr
+			}
+			continue
+		}
+		out = append(out, route)
+	}
+	return out, err
+}
+
+// parseSipRoute parses a single name-addr entry of a route header
+func parseSipRoute(v []byte, out *SipRoute) error {
+
+	var idx int
+
+	// Keep the source if needed
+	if keep_src {
+		out.Src = v
+	}
+
+	// Route entries always use the <> encapsulation
+	start := bytes.IndexByte(v, '<')
+	end := bytes.LastIndexByte(v, '>')
+	if start == -1 || end < start {
+		return errors.New("route entry is not enclosed in <>")
+	}
+	out.Name = bytes.Trim(bytes.TrimSpace(v[:start]), `"`)
+	if len(out.Name) == 0 {
+		out.Name = nil
+	}
+	v = v[start+1 : end]
+	out.Uri = v
+
+	if idx = bytes.Index(v, []byte("sip:")); idx == 0 {
+		out.UriType = v[:3]
+		v = v[4:]
+	} else if idx = bytes.Index(v, []byte("sips:")); idx == 0 {
+		out.UriType = v[:4]
+		v = v[5:]
+	} else {
+		return errors.New("unsupport URI-Schema found")
+	}
+
+	// Headers of the URI are not used for routing
+	if idx = bytes.IndexByte(v, '?'); idx > -1 {
+		v = v[:idx]
+	}
+
+	// Extract the URI parameters
+	if idx = bytes.IndexByte(v, ';'); idx > -1 {
+		out.Params = bytes.Split(v[idx+1:], []byte(";"))
+		v = v[:idx]
+	}
+
+	if idx = bytes.IndexByte(v, '@'); idx > -1 {
+		out.User = v[:idx]
+		v = v[idx+1:]
+	}
+
+	// remove any port, taking care of IPv6 references
+	if idx = bytes.LastIndexByte(v, ':'); idx > -1 && idx > bytes.LastIndexByte(v, ']') {
+		out.Port = v[idx+1:]
+		v = v[:idx]
+	}
+
+	out.Host = v
+
+	return nil
+}
+
+// IsLoose tells if the route entry belongs to a loose router, that is
+// its URI has the lr parameter
+func (r *SipRoute) IsLoose() bool {
+	for _, param := range r.Params {
+		if bytes.EqualFold(param, []byte("lr")) || bytes.HasPrefix(bytes.ToLower(param), []byte("lr=")) {
+			return true
+		}
+	}
+	return false
+}
+
+// RouteUri returns the URI of a route entry, built from its parts when Uri
+// is not set
+func (r *SipRoute) RouteUri() []byte {
+	if len(r.Uri) > 0 {
+		return r.Uri
+	}
+	return r.appendUri(nil)
+}
+
+// appendUri appends the URI of the route entry to dst
+func (r *SipRoute) appendUri(dst []byte) []byte {
+	if len(r.Uri) > 0 {
+		return append(dst, r.Uri...)
+	}
+	if len(r.UriType) > 0 {
+		dst = append(dst, r.UriType...)
+	} else {
+		dst = append(dst, "sip"...)
+	}
+	dst = append(dst, ':')
+	if len(r.User) > 0 {
+		dst = append(dst, r.User...)
+		dst = append(dst, '@')
+	}
+	dst = append(dst, r.Host...)
+	if len(r.Port) > 0 {
+		dst = append(dst, ':')
+		dst = append(dst, r.Port...)
+	}
+	for _, param := range r.Params {
+		dst = append(dst, ';')
+		dst = append(dst, param...)
+	}
+	return dst
+}
+
+// MarshalSipRoute writes a route entry as a header line, hdr is one of
+// HEADER_ROUTE, HEADER_RECORD_ROUTE or HEADER_PATH
+func MarshalSipRoute(hdr string, route *SipRoute) string {
+	return string(appendSipRoute(make([]byte, 0, 128), hdr, route))
+}
+
+// appendSipRoute appends a route entry as a header line to dst
+func appendSipRoute(dst []byte, hdr string, route *SipRoute) []byte {
+	dst = append(dst, hdr...)
+	dst = append(dst, ": "...)
+	if len(route.Name) > 0 {
+		dst = append(dst, '"')
+		dst = append(dst, route.Name...)
+		dst = append(dst, "\" "...)
+	}
+	dst = append(dst, '<')
+	dst = route.appendUri(dst)
+	dst = append(dst, '>')
+	return append(dst, ENDL...)
+}
+
+// splitSipList splits a header value on the commas that separate its
+// entries, ignoring commas inside quotes and <>
+func splitSipList(v []byte) [][]byte {
+	var out [][]byte
+	quoted := false
+	angle := false
+	start := 0
+	for i := 0; i < len(v); i++ {
+		switch v[i] {
+		case '\\':
+			if quoted {
+				i++
+			}
+		case '"':
+			quoted = !quoted
+		case '<':
+			if !quoted {
+				angle = true
+			}
+		case '>':
+			if !quoted {
+				angle = false
+			}
+		case ',':
+			if !quoted && !angle {
+				if entry := bytes.TrimSpace(v[start:i]); len(entry) > 0 {
+					out = append(out, entry)
+				}
+				start = i + 1
+			}
+		}
+	}
+	if entry := bytes.TrimSpace(v[start:]); len(entry) > 0 {
+		out = append(out, entry)
+	}
+	return out
+}
@@ -0,0 +1,70 @@
+package siprocket
+
+import (
+	"reflect"
+	"testing"
+)
+
+func Test_sipParseRoute_List(t *testing.T) {
+
+	msg := `<sip:server10.biloxi.com;lr>, "Big Box" <sip:proxy@[2001:db8::1]:5070;transport=tcp;lr>`
+	out, err := parseSipRoutes([]byte(msg), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := []SipRoute{
+		{
+			UriType: []byte("sip"),
+			Host:    []byte("server10.biloxi.com"),
+			Params:  [][]byte{[]byte("lr")},
+			Uri:     []byte("sip:server10.biloxi.com;lr"),
+			Src:     []byte("<sip:server10.biloxi.com;lr>"),
+		},
+		{
+			UriType: []byte("sip"),
+			Name:    []byte("Big Box"),
+			User:    []byte("proxy"),
+			Host:    []byte("[2001:db8::1]"),
+			Port:    []byte("5070"),
+			Params:  [][]byte{[]byte("transport=tcp"), []byte("lr")},
+			Uri:     []byte("sip:proxy@[2001:db8::1]:5070;transport=tcp;lr"),
+			Src:     []byte(`"Big Box" <sip:proxy@[2001:db8::1]:5070;transport=tcp;lr>`),
+		},
+	}
+	if !reflect.DeepEqual(out, exp) {
+		t.Errorf("Mismatch:\nExpected:\n%s\nGot:\n%s", exp, out)
+	}
+	if !out[0].IsLoose() || !out[1].IsLoose() {
+		t.Errorf("Expected loose routes")
+	}
+
+	if _, err := parseSipRoutes([]byte("sip:no.brackets.com"), nil); err == nil {
+		t.Errorf("failed to generated an error")
+	}
+}
+
+func Test_sipParseRoute_Message(t *testing.T) {
+
+	msg := "INVITE sip:bob@biloxi.com SIP/2.0\r\n" +
+		"Record-Route: <sip:p2.example.com;lr>\r\n" +
+		"Record-Route: <sip:p1.example.com;lr>\r\n" +
+		"Route: <sip:10.0.0.1>\r\n" +
+		"\r\n"
+	out := Parse([]byte(msg))
+	if len(out.RecordRoute) != 2 || string(out.RecordRoute[1].Host) != "p1.example.com" {
+		t.Fatalf("Mismatch: %s", out.RecordRoute)
+	}
+	if len(out.Route) != 1 || out.Route[0].IsLoose() {
+		t.Fatalf("Mismatch: %s", out.Route)
+	}
+
+	exp := "Record-Route: <sip:p2.example.com;lr>\r\n"
+	if got := MarshalSipRoute(HEADER_RECORD_ROUTE, &out.RecordRoute[0]); got != exp {
+		t.Errorf("Mismatch:\nExpected:\n%q\nGot:\n%q", exp, got)
+	}
+	built := SipRoute{Host: []byte("p3.example.com"), Port: []byte("5080"), Params: [][]byte{[]byte("lr")}}
+	exp = "Route: <sip:p3.example.com:5080;lr>\r\n"
+	if got := MarshalSipRoute(HEADER_ROUTE, &built); got != exp {
+		t.Errorf("Mismatch:\nExpected:\n%q\nGot:\n%q", exp, got)
+	}
+}
@@ -1,7 +1,6 @@
 package siprocket
 
 import (
-	"fmt"
 	"strings"
 )
 
@@ -74,7 +73,6 @@ func parseSipVia(v []byte, out *SipVia) {
 					if strings.ToUpper(getString(v, pos, pos+3)) == "UDP" {
 						out.Trans = "udp"
 						pos = pos + 3
-						fmt.Printf("pos-upd:%d", pos)
 						continue
 					}
 					if strings.ToUpper(getString(v, pos, pos+3)) == "TCP" {
@@ -136,6 +134,14 @@ func parseSipVia(v []byte, out *SipVia) {
 			}
 
 		case FIELD_HOST:
+			// An IPv6 reference holds colons of its own
+			if v[pos] == '[' {
+				if end := strings.IndexByte(string(v[pos:]), ']'); end > -1 {
+					out.Host = append(out.Host, v[pos:pos+end+1]...)
+					pos += end + 1
+					continue
+				}
+			}
 			if v[pos] == ':' {
 				state = FIELD_PORT
 				pos++
@@ -205,47 +211,131 @@ func parseSipVia(v []byte, out *SipVia) {
 }
 
 func MarshalSipVia(via *SipVia) string {
-	var sb strings.Builder
+	return string(appendSipVia(make([]byte, 0, 128), via))
+}
 
-	sb.WriteString(HEADER_VIA + ": ")
+// appendSipVia appends the Via header line to dst
+func appendSipVia(dst []byte, via *SipVia) []byte {
+	dst = append(dst, HEADER_VIA+": "...)
 
 	// Append transport protocol
-	sb.WriteString("SIP/2.0/")
-	sb.WriteString(strings.ToUpper(via.Trans))
-	sb.WriteString(" ")
+	dst = append(dst, "SIP/2.0/"...)
+	for i := 0; i < len(via.Trans); i++ {
+		c := via.Trans[i]
+		if c >= 'a' && c <= 'z' {
+			c -= 'a' - 'A'
+		}
+		dst = append(dst, c)
+	}
+	dst = append(dst, ' ')
 
 	// Append host and port
-	sb.Write(via.Host)
+	dst = append(dst, via.Host...)
 	if len(via.Port) > 0 {
-		sb.WriteString(":")
-		sb.Write(via.Port)
+		dst = append(dst, ':')
+		dst = append(dst, via.Port...)
 	}
 
 	// Append parameters
 	if len(via.Rport) > 0 {
-		sb.WriteString(";rport=")
-		sb.Write(via.Rport)
+		dst = append(dst, ";rport="...)
+		dst = append(dst, via.Rport...)
 	} else {
-		sb.WriteString(";rport")
+		dst = append(dst, ";rport"...)
 	}
 	if len(via.Branch) > 0 {
-		sb.WriteString(";branch=")
-		sb.Write(via.Branch)
+		dst = append(dst, ";branch="...)
+		dst = append(dst, via.Branch...)
 	}
 	if len(via.Maddr) > 0 {
-		sb.WriteString(";maddr=")
-		sb.Write(via.Maddr)
+		dst = append(dst, ";maddr="...)
+		dst = append(dst, via.Maddr...)
 	}
 	if len(via.Ttl) > 0 {
-		sb.WriteString(";ttl=")
-		sb.Write(via.Ttl)
+		dst = append(dst, ";ttl="...)
+		dst = append(dst, via.Ttl...)
 	}
 	if len(via.Rcvd) > 0 {
-		sb.WriteString(";received=")
-		sb.Write(via.Rcvd)
+		dst = append(dst, ";received="...)
+		dst = append(dst, via.Rcvd...)
 	}
 
-	sb.WriteString(ENDL)
+	return append(dst, ENDL...)
+}
 
-	return sb.String()
+// SetParam sets the parameter name to value, a bare parameter when value is
+// empty. Src is changed in place so the parameters without a field of their
+// own are kept.
+func (via *SipVia) SetParam(name, value string) {
+	switch strings.ToLower(name) {
+	case "branch":
+		via.Branch = []byte(value)
+	case "rport":
+		via.Rport = []byte(value)
+	case "maddr":
+		via.Maddr = []byte(value)
+	case "ttl":
+		via.Ttl = []byte(value)
+	case "received":
+		via.Rcvd = []byte(value)
+	}
+	if len(via.Src) == 0 {
+		return
+	}
+
+	param := name
+	if value != "" {
+		param += "=" + value
+	}
+	src := string(via.Src)
+	idx := strings.IndexByte(src, ';')
+	if idx == -1 {
+		via.Src = []byte(src + ";" + param)
+		return
+	}
+	params := strings.Split(src[idx+1:], ";")
+	for i, p := range params {
+		key, _, _ := strings.Cut(p, "=")
+		if strings.EqualFold(strings.TrimSpace(key), name) {
+			params[i] = param
+			via.Src = []byte(src[:idx+1] + strings.Join(params, ";"))
+			return
+		}
+	}
+	via.Src = []byte(src + ";" + param)
+}
+
+// SetTransport sets the transport, Src is changed in place
+func (via *SipVia) SetTransport(trans string) {
+	via.Trans = strings.ToLower(trans)
+	src := string(via.Src)
+	idx := strings.Index(src, "SIP/2.0/")
+	if idx == -1 {
+		return
+	}
+	end := idx + 8
+	for end < len(src) && src[end] != ' ' && src[end] != '\t' {
+		end++
+	}
+	via.Src = []byte(src[:idx+8] + strings.ToUpper(trans) + src[end:])
+}
+
+// HasRport tells if the rport parameter is present, with or without a
+// value. RFC 3581 has a server fill in a bare rport with the source port.
+func (via *SipVia) HasRport() bool {
+	if len(via.Rport) > 0 {
+		return true
+	}
+	src := string(via.Src)
+	idx := strings.IndexByte(src, ';')
+	if idx == -1 {
+		return false
+	}
+	for _, param := range strings.Split(src[idx+1:], ";") {
+		param = strings.TrimSpace(param)
+		if param == "rport" || strings.HasPrefix(param, "rport=") {
+			return true
+		}
+	}
+	return false
 }
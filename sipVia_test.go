@@ -0,0 +1,44 @@
+package siprocket
+
+import (
+	"testing"
+)
+
+func Test_sipVia_Ipv6(t *testing.T) {
+
+	var via SipVia
+	parseSipVia([]byte("SIP/2.0/TCP [2001:db8::1]:5080;rport;branch=z9hG4bK1"), &via)
+	if string(via.Host) != "[2001:db8::1]" || string(via.Port) != "5080" || string(via.Branch) != "z9hG4bK1" {
+		t.Errorf("Mismatch:\nExpected:\n[2001:db8::1] 5080 z9hG4bK1\nGot:\n%s %s %s", via.Host, via.Port, via.Branch)
+	}
+}
+
+func Test_sipVia_HasRport(t *testing.T) {
+
+	tests := map[string]bool{
+		"SIP/2.0/UDP 10.0.0.1;rport;branch=z9hG4bK1":      true,
+		"SIP/2.0/UDP 10.0.0.1;branch=z9hG4bK1;rport=5060": true,
+		"SIP/2.0/UDP 10.0.0.1;branch=z9hG4bK1":            false,
+		"SIP/2.0/UDP rport.example.com;branch=z9hG4bK1":   false,
+	}
+	for src, exp := range tests {
+		var via SipVia
+		parseSipVia([]byte(src), &via)
+		if got := via.HasRport(); got != exp {
+			t.Errorf("HasRport(%q) = %v", src, got)
+		}
+	}
+}
+
+func Test_sipVia_SetParam(t *testing.T) {
+
+	var via SipVia
+	parseSipVia([]byte("SIP/2.0/UDP a.example.com;rport;branch=z9hG4bK1;alias;keep"), &via)
+	via.SetParam("rport", "5070")
+	via.SetParam("received", "9.9.9.9")
+	via.SetTransport("tcp")
+	exp := "SIP/2.0/TCP a.example.com;rport=5070;branch=z9hG4bK1;alias;keep;received=9.9.9.9"
+	if string(via.Src) != exp || string(via.Rport) != "5070" || string(via.Rcvd) != "9.9.9.9" || via.Trans != "tcp" {
+		t.Errorf("Mismatch:\nExpected:\n%s\nGot:\n%s %+v", exp, via.Src, via)
+	}
+}
@@ -3,6 +3,7 @@ package siprocket
 import (
 	"encoding/json"
 	"reflect"
+	"strconv"
 	"testing"
 )
 
@@ -274,8 +275,21 @@ a=rtpmap:9 G722/8000`
 				ConnAddr: []byte("127.0.0.1"),
 				Src:      []byte("IN IP4 127.0.0.1"),
 			},
+			Media: []SdpMedia{
+				{
+					MediaDesc: NewSdpMediaDesc("audio", "51268", "RTP/AVP", "111 9 8 101", "audio 51268 RTP/AVP 111 9 8 101"),
+					ConnData:  NewSdpConnData("IN", "IP4", "127.0.0.1", "IN IP4 127.0.0.1"),
+					Attrib: []SdpAttrib{
+						NewSdpAttrib("rtpmap", "111 opus/48000/2", "rtpmap:111 opus/48000/2"),
+						NewSdpAttrib("rtpmap", "9 G722/8000", "rtpmap:9 G722/8000"),
+					},
+				},
+			},
+			Eol: []byte("\n"),
 		},
+		Body: []byte("m=audio 51268 RTP/AVP 111 9 8 101\nc=IN IP4 127.0.0.1\na=rtpmap:111 opus/48000/2\na=rtpmap:9 G722/8000"),
 	}
+	exp.Contacts = []SipContact{exp.Contact}
 	out = Parse([]byte(msg))
 	eq := reflect.DeepEqual(out, exp)
 	if !eq {
@@ -326,6 +340,7 @@ a=ptime:20`
 			Host:       []byte("10.0.0.1"),
 			Port:       []byte(nil),
 			UserType:   []byte("phone"),
+			Params:     [][]byte{[]byte("user=phone")},
 			Src:        []byte("INVITE sip:8508000123456;phone-context=+44@10.0.0.1;user=phone SIP/2.0"),
 		},
 		From: SipFrom{
@@ -473,8 +488,25 @@ a=ptime:20`
 				ConnAddr: []byte("10.120.204.1"),
 				Src:      []byte("IN IP4 10.120.204.1"),
 			},
+			SessConnData: NewSdpConnData("IN", "IP4", "10.120.204.1", "IN IP4 10.120.204.1"),
+			Media: []SdpMedia{
+				{
+					MediaDesc: NewSdpMediaDesc("audio", "11484", "RTP/AVP", "0 8 18 101", "audio 11484 RTP/AVP 0 8 18 101"),
+					Attrib: []SdpAttrib{
+						NewSdpAttrib("rtpmap", "0 PCMU/8000", "rtpmap:0 PCMU/8000"),
+						NewSdpAttrib("rtpmap", "8 PCMA/8000", "rtpmap:8 PCMA/8000"),
+						NewSdpAttrib("fmtp", "18 annexb=no", "fmtp:18 annexb=no"),
+						NewSdpAttrib("rtpmap", "101 telephone-event/8000", "rtpmap:101 telephone-event/8000"),
+						NewSdpAttrib("fmtp", "101 0-15", "fmtp:101 0-15"),
+						NewSdpAttrib("ptime", "20", "ptime:20"),
+					},
+				},
+			},
+			Eol: []byte("\n"),
 		},
+		Body: []byte("v=0\no=server1 3487 929 IN IP4 10.0.0.2\ns=sip call\nc=IN IP4 10.120.204.1\nt=0 0\nm=audio 11484 RTP/AVP 0 8 18 101\na=rtpmap:0 PCMU/8000\na=rtpmap:8 PCMA/8000\na=fmtp:18 annexb=no\na=rtpmap:101 telephone-event/8000\na=fmtp:101 0-15\na=ptime:20"),
 	}
+	exp.Contacts = []SipContact{exp.Contact}
 	out = Parse([]byte(msg))
 	eq := reflect.DeepEqual(out, exp)
 	if !eq {
@@ -510,6 +542,7 @@ func Test_sipParse_GenericTest(t *testing.T) {
 			Host:       []byte("10.120.38.17"),
 			Port:       []byte("5060"),
 			UserType:   []byte("phone"),
+			Params:     [][]byte{[]byte("user=phone")},
 			Src:        []byte("INVITE sip:8660000101304799968;phone-context=+44@10.120.38.17:5060;user=phone SIP/2.0"),
 		},
 		From: SipFrom{
@@ -608,6 +641,7 @@ func Test_sipParse_GenericTest(t *testing.T) {
 			},
 		},
 	}
+	exp.Contacts = []SipContact{exp.Contact}
 	out = Parse([]byte(msg))
 	eq := reflect.DeepEqual(out, exp)
 	if !eq {
@@ -737,6 +771,7 @@ func Test_sipParse_302Test(t *testing.T) {
 			},
 		},
 	}
+	exp.Contacts = []SipContact{exp.Contact}
 	out = Parse([]byte(msg))
 	eq := reflect.DeepEqual(out, exp)
 	if !eq {
@@ -883,6 +918,7 @@ func Test_sipParse_AuthTest(t *testing.T) {
 		},
 	}
 
+	exp.Contacts = []SipContact{exp.Contact}
 	out = Parse([]byte(msg))
 	eq := reflect.DeepEqual(out, exp)
 	if !eq {
@@ -918,9 +954,10 @@ Content-Length: 0
 		Ua:      NewSipVal("Telephone 1.6", "Telephone 1.6"),
 		Exp:     NewSipVal("3600", "3600"),
 		ContLen: NewSipVal("0", "0"),
-		Sdp:     SdpMsg{nil, SdpOrigin{}, nil, nil, []SdpAttrib{}, SdpMediaDesc{}, []SdpAttrib{}, SdpConnData{}},
+		Sdp:     SdpMsg{nil, SdpOrigin{}, nil, nil, []SdpAttrib{}, SdpMediaDesc{}, []SdpAttrib{}, SdpConnData{}, SdpConnData{}, nil, nil, nil, nil, nil},
 	}
 
+	exp.Contacts = []SipContact{exp.Contact}
 	out = Parse([]byte(msg))
 	eq := reflect.DeepEqual(out, exp)
 	if !eq {
@@ -929,6 +966,29 @@ Content-Length: 0
 
 }
 
+func Test_sipParse_BodyNotSdp(t *testing.T) {
+
+	head := "MESSAGE sip:bob@biloxi.com SIP/2.0\r\n" +
+		"Via: SIP/2.0/TCP pc33.atlanta.com;branch=z9hG4bK776asdhds\r\n" +
+		"Call-ID: a84b4c76e66710@pc33.atlanta.com\r\n" +
+		"CSeq: 1 MESSAGE\r\n"
+
+	// A body that is not SDP is kept but not parsed
+	out := Parse([]byte(head + "Content-Type: text/plain\r\nContent-Length: 5\r\n\r\nv=0\r\n"))
+	if string(out.Body) != "v=0\r\n" || out.Sdp.Version != nil {
+		t.Errorf("Mismatch: body %q sdp version %q", out.Body, out.Sdp.Version)
+	}
+
+	// Bytes past Content-Length belong to the next message
+	sdp := "v=0\r\no=- 1 1 IN IP4 10.0.0.1\r\ns=-\r\nt=0 0\r\n"
+	next := "m=audio 49170 RTP/AVP 0\r\n"
+	out = Parse([]byte(head + "Content-Type: application/sdp; charset=utf-8\r\nContent-Length: " +
+		strconv.Itoa(len(sdp)) + "\r\n\r\n" + sdp + next))
+	if string(out.Sdp.Version) != "0" || len(out.Sdp.Media) != 0 {
+		t.Errorf("Mismatch: sdp version %q media %d", out.Sdp.Version, len(out.Sdp.Media))
+	}
+}
+
 func (s SipReq) MarshalJSON() ([]byte, error) {
 
 	return json.Marshal(&struct {
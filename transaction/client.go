@@ -0,0 +1,260 @@
+package transaction
+
+/*
+ RFC 3261 - https://datatracker.ietf.org/doc/html/rfc3261#section-17.1
+
+ 17.1.1 INVITE Client Transaction
+
+                               |INVITE from TU
+             Timer A fires     |INVITE sent
+             Reset A,          V                      Timer B fires
+             INVITE sent +-----------+                or Transport Err.
+               +---------|           |---------------+inform TU
+               |         |  Calling  |               |
+               +-------->|           |-------------->|
+                         +-----------+ 2xx           |
+                            |  |       2xx to TU     |
+                            |  |1xx                  |
+    300-699 +---------------+  |1xx to TU            |
+   ACK sent |                  |                     |
+resp. to TU |  1xx             V                     |
+            |  1xx to TU  -----------+               |
+            |  +---------|           |               |
+            |  |         |Proceeding |-------------->|
+            |  +-------->|           | 2xx           |
+            |            +-----------+ 2xx to TU     |
+            |       300-699    |                     |
+            |       ACK sent,  |                     |
+            |       resp. to TU|                     |
+            |                  |                     |      NOTE:
+            |  300-699         V                     |
+            |  ACK sent  +-----------+Transport Err. |  transitions
+            |  +---------|           |Inform TU      |  labeled with
+            |  |         | Completed |-------------->|  the event
+            |  +-------->|           |               |  over the action
+            |            +-----------+               |  to take
+            |              ^   |                     |
+            |              |   | Timer D fires       |
+            +--------------+   | -                   |
+                               |                     |
+                               V                     |
+                         +-----------+               |
+                         |           |               |
+                         | Terminated|<--------------+
+                         |           |
+                         +-----------+
+
+ 17.1.2 Non-INVITE Client Transaction
+
+   Trying     Timer E retransmits at T1 doubling up to T2, Timer F times out
+              the transaction, 1xx moves to Proceeding, 200-699 to Completed
+   Proceeding Timer E retransmits every T2, Timer F times out
+   Completed  Timer K absorbs response retransmissions
+
+*/
+
+import (
+	"time"
+
+	"github.com/nullboundary/siprocket"
+)
+
+// ClientHandler receives the events of a client transaction, any of the
+// callbacks may be nil
+type ClientHandler struct {
+	Response       func(resp *siprocket.SipMsg) // A response to pass to the TU
+	Timeout        func()                       // Timer B or F fired
+	TransportError func(err error)              // Send failed
+	Terminated     func()                       // The transaction ended
+}
+
+// Client is an INVITE or non-INVITE client transaction. It is safe for
+// concurrent use.
+type Client struct {
+	base
+	invite   bool
+	handler  ClientHandler
+	interval time.Duration // Current retransmit interval of timer A or E
+	ack      *siprocket.SipMsg
+}
+
+// NewClient creates a client transaction for a request, nothing is sent
+// until Start is called
+func NewClient(req *siprocket.SipMsg, cfg Config, h ClientHandler) (*Client, error) {
+	c := &Client{handler: h}
+	if err := c.init(req, cfg); err != nil {
+		return nil, err
+	}
+	c.invite = c.key.Method == "INVITE"
+	c.onTerminated = h.Terminated
+	return c, nil
+}
+
+// Start sends the request and starts the timers
+func (c *Client) Start() {
+	c.mu.Lock()
+	defer c.unlock()
+
+	if c.state != "" {
+		return
+	}
+	t := c.cfg.Timers
+	c.interval = t.T1
+	if c.invite {
+		c.state = STATE_CALLING
+		if c.send(c.req, c.handler.TransportError) != nil {
+			return
+		}
+		if !c.cfg.Reliable {
+			c.start(TIMER_A, c.interval, c.timerA)
+		}
+		c.start(TIMER_B, 64*t.T1, c.timeout)
+		return
+	}
+
+	c.state = STATE_TRYING
+	if c.send(c.req, c.handler.TransportError) != nil {
+		return
+	}
+	if !c.cfg.Reliable {
+		c.start(TIMER_E, c.interval, c.timerE)
+	}
+	c.start(TIMER_F, 64*t.T1, c.timeout)
+}
+
+// Receive passes a response matched to this transaction through the state
+// machine, responses the TU should see are given to the Response callback
+func (c *Client) Receive(resp *siprocket.SipMsg) {
+	c.mu.Lock()
+	defer c.unlock()
+
+	class := statusClass(resp)
+	if class == 0 {
+		return
+	}
+	if c.invite {
+		c.receiveInvite(resp, class)
+	} else {
+		c.receiveNonInvite(resp, class)
+	}
+}
+
+func (c *Client) receiveInvite(resp *siprocket.SipMsg, class int) {
+	switch c.state {
+	case STATE_CALLING, STATE_PROCEEDING:
+		switch {
+		case class == 1:
+			c.state = STATE_PROCEEDING
+			c.stop(TIMER_A)
+			c.stop(TIMER_B)
+			c.toTU(resp)
+		case class == 2:
+			// The TU acknowledges 2xx responses itself
+			c.toTU(resp)
+			c.terminate()
+		default:
+			c.state = STATE_COMPLETED
+			c.stop(TIMER_A)
+			c.stop(TIMER_B)
+			c.ack = nonSuccessAck(c.req, resp)
+			c.toTU(resp)
+			if c.send(c.ack, c.handler.TransportError) == nil {
+				c.linger(TIMER_D, c.cfg.Timers.D)
+			}
+		}
+	case STATE_COMPLETED:
+		// A retransmitted final response, acknowledge it again
+		if class >= 3 {
+			c.send(c.ack, c.handler.TransportError)
+		}
+	}
+}
+
+func (c *Client) receiveNonInvite(resp *siprocket.SipMsg, class int) {
+	switch c.state {
+	case STATE_TRYING, STATE_PROCEEDING:
+		if class == 1 {
+			c.state = STATE_PROCEEDING
+			c.toTU(resp)
+			return
+		}
+		c.state = STATE_COMPLETED
+		c.stop(TIMER_E)
+		c.stop(TIMER_F)
+		c.toTU(resp)
+		c.linger(TIMER_K, c.cfg.Timers.T4)
+	}
+}
+
+func (c *Client) toTU(resp *siprocket.SipMsg) {
+	if f := c.handler.Response; f != nil {
+		c.queue(func() { f(resp) })
+	}
+}
+
+// timerA retransmits the INVITE doubling the interval each time
+func (c *Client) timerA() {
+	if c.state != STATE_CALLING {
+		return
+	}
+	if c.send(c.req, c.handler.TransportError) != nil {
+		return
+	}
+	c.interval *= 2
+	c.start(TIMER_A, c.interval, c.timerA)
+}
+
+// timerE retransmits a non-INVITE request, doubling the interval up to T2
+// while Trying and every T2 once Proceeding
+func (c *Client) timerE() {
+	if c.state != STATE_TRYING && c.state != STATE_PROCEEDING {
+		return
+	}
+	if c.send(c.req, c.handler.TransportError) != nil {
+		return
+	}
+	c.interval *= 2
+	if c.state == STATE_PROCEEDING || c.interval > c.cfg.Timers.T2 {
+		c.interval = c.cfg.Timers.T2
+	}
+	c.start(TIMER_E, c.interval, c.timerE)
+}
+
+// timeout is timer B or F
+func (c *Client) timeout() {
+	if c.state == STATE_COMPLETED || c.state == STATE_TERMINATED {
+		return
+	}
+	c.queue(c.handler.Timeout)
+	c.terminate()
+}
+
+// Ack returns the ACK sent for a non 2xx final response, or nil
+func (c *Client) Ack() *siprocket.SipMsg {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ack
+}
+
+// nonSuccessAck builds the ACK for a non 2xx response as in section
+// 17.1.1.3, it has the Request-URI, Call-ID, From, Route and CSeq number
+// of the INVITE, the To of the response and only the top Via of the INVITE
+func nonSuccessAck(req, resp *siprocket.SipMsg) *siprocket.SipMsg {
+	ack := &siprocket.SipMsg{
+		Req:    req.Req,
+		From:   req.From,
+		To:     resp.To,
+		Via:    req.Via[:1:1],
+		Route:  req.Route,
+		CallId: req.CallId,
+		MaxFwd: req.MaxFwd,
+		Ua:     req.Ua,
+		Cseq: siprocket.SipCseq{
+			Id:     req.Cseq.Id,
+			Method: []byte("ACK"),
+		},
+	}
+	ack.Req.Method = []byte("ACK")
+	ack.Req.Src = nil
+	return ack
+}
@@ -0,0 +1,229 @@
+package transaction
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nullboundary/siprocket"
+)
+
+var testStart = time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+// recorder keeps what was sent and when
+type recorder struct {
+	clock *ManualClock
+	sent  []*siprocket.SipMsg
+	at    []time.Duration
+	err   error
+}
+
+func (r *recorder) send(msg *siprocket.SipMsg) error {
+	r.sent = append(r.sent, msg)
+	r.at = append(r.at, r.clock.Now().Sub(testStart))
+	return r.err
+}
+
+func newRecorder() (*recorder, Config) {
+	r := &recorder{clock: NewManualClock(testStart)}
+	return r, Config{Send: r.send, Clock: r.clock}
+}
+
+func Test_transactionClient_InviteTimeout(t *testing.T) {
+
+	r, cfg := newRecorder()
+	var timeout, terminated bool
+	c, err := NewClient(parse(testInvite), cfg, ClientHandler{
+		Timeout:    func() { timeout = true },
+		Terminated: func() { terminated = true },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Start()
+	if c.State() != STATE_CALLING {
+		t.Fatalf("State %s", c.State())
+	}
+
+	r.clock.Advance(40 * time.Second)
+
+	// Timer A doubles from T1 until timer B fires at 64*T1
+	exp := []time.Duration{0, 500 * time.Millisecond, 1500 * time.Millisecond, 3500 * time.Millisecond,
+		7500 * time.Millisecond, 15500 * time.Millisecond, 31500 * time.Millisecond}
+	if !reflect.DeepEqual(r.at, exp) {
+		t.Errorf("Mismatch:\nExpected:\n%v\nGot:\n%v", exp, r.at)
+	}
+	if !timeout || !terminated || c.State() != STATE_TERMINATED || r.clock.Pending() != 0 {
+		t.Errorf("Mismatch: timeout %v terminated %v state %s pending %d", timeout, terminated, c.State(), r.clock.Pending())
+	}
+}
+
+func Test_transactionClient_InviteRejected(t *testing.T) {
+
+	r, cfg := newRecorder()
+	var responses []string
+	invite := parse(strings.Replace(testInvite, "Call-ID:", "Route: <sip:p1.example.com;lr>\r\nCall-ID:", 1))
+	c, _ := NewClient(invite, cfg, ClientHandler{
+		Response: func(resp *siprocket.SipMsg) { responses = append(responses, string(resp.Req.StatusCode)) },
+	})
+	c.Start()
+
+	ringing := parse("SIP/2.0 180 Ringing\r\n" +
+		"Via: SIP/2.0/UDP 10.0.0.2:5060;branch=z9hG4bK776asdhds\r\n" +
+		"To: <sip:bob@10.0.0.1>;tag=a6c85cf\r\n" +
+		"CSeq: 314159 INVITE\r\n\r\n")
+	busy := parse("SIP/2.0 486 Busy Here\r\n" +
+		"Via: SIP/2.0/UDP 10.0.0.2:5060;branch=z9hG4bK776asdhds\r\n" +
+		"To: <sip:bob@10.0.0.1>;tag=a6c85cf\r\n" +
+		"CSeq: 314159 INVITE\r\n\r\n")
+
+	r.clock.Advance(100 * time.Millisecond)
+	c.Receive(ringing)
+	if c.State() != STATE_PROCEEDING {
+		t.Fatalf("State %s", c.State())
+	}
+	// No more retransmissions once Proceeding
+	r.clock.Advance(10 * time.Second)
+	c.Receive(busy)
+	c.Receive(busy)
+	if c.State() != STATE_COMPLETED || len(r.sent) != 3 {
+		t.Fatalf("State %s sent %d", c.State(), len(r.sent))
+	}
+
+	ack := r.sent[1]
+	if string(ack.Req.Method) != "ACK" || string(ack.Cseq.Method) != "ACK" || string(ack.Cseq.Id) != "314159" ||
+		string(ack.To.Tag) != "a6c85cf" || len(ack.Via) != 1 || r.sent[2] != ack || c.Ack() != ack {
+		t.Errorf("Mismatch: %+v", ack)
+	}
+	// The ACK takes the same path as the INVITE
+	if len(ack.Route) != 1 || string(ack.Route[0].Host) != "p1.example.com" {
+		t.Errorf("Mismatch: route %+v", ack.Route)
+	}
+	if !reflect.DeepEqual(responses, []string{"180", "486"}) {
+		t.Errorf("Mismatch: responses %v", responses)
+	}
+
+	// Timer D
+	r.clock.Advance(32 * time.Second)
+	if c.State() != STATE_TERMINATED {
+		t.Errorf("State %s", c.State())
+	}
+}
+
+func Test_transactionClient_TimerD(t *testing.T) {
+
+	r, cfg := newRecorder()
+	cfg.Timers = DefaultTimers
+	cfg.Timers.D = 5 * time.Second
+	c, _ := NewClient(parse(testInvite), cfg, ClientHandler{})
+	c.Start()
+
+	c.Receive(parse("SIP/2.0 486 Busy Here\r\n" +
+		"Via: SIP/2.0/UDP 10.0.0.2:5060;branch=z9hG4bK776asdhds\r\n" +
+		"To: <sip:bob@10.0.0.1>;tag=a6c85cf\r\n" +
+		"CSeq: 314159 INVITE\r\n\r\n"))
+	r.clock.Advance(4 * time.Second)
+	if c.State() != STATE_COMPLETED {
+		t.Fatalf("State %s", c.State())
+	}
+	r.clock.Advance(time.Second)
+	if c.State() != STATE_TERMINATED {
+		t.Errorf("State %s", c.State())
+	}
+}
+
+func Test_transactionClient_PartialTimers(t *testing.T) {
+
+	// Only T1 is set, timer D keeps its default of 32s
+	r, cfg := newRecorder()
+	cfg.Timers = Timers{T1: 100 * time.Millisecond}
+	c, _ := NewClient(parse(testInvite), cfg, ClientHandler{})
+	c.Start()
+
+	r.clock.Advance(100 * time.Millisecond)
+	if len(r.sent) != 2 {
+		t.Errorf("Expected a retransmit after T1, got %d sends", len(r.sent))
+	}
+	busy := parse("SIP/2.0 486 Busy Here\r\n" +
+		"Via: SIP/2.0/UDP 10.0.0.2:5060;branch=z9hG4bK776asdhds\r\n" +
+		"To: <sip:bob@10.0.0.1>;tag=a6c85cf\r\n" +
+		"CSeq: 314159 INVITE\r\n\r\n")
+	c.Receive(busy)
+	r.clock.Advance(31 * time.Second)
+	if c.State() != STATE_COMPLETED {
+		t.Fatalf("State %s", c.State())
+	}
+
+	// A retransmitted final response is acknowledged again
+	n := len(r.sent)
+	c.Receive(busy)
+	if len(r.sent) != n+1 || string(r.sent[n].Req.Method) != "ACK" {
+		t.Errorf("Retransmitted response not acknowledged")
+	}
+	r.clock.Advance(time.Second)
+	if c.State() != STATE_TERMINATED {
+		t.Errorf("State %s", c.State())
+	}
+}
+
+func Test_transactionClient_NonInvite(t *testing.T) {
+
+	r, cfg := newRecorder()
+	req := parse("OPTIONS sip:bob@10.0.0.1 SIP/2.0\r\n" +
+		"Via: SIP/2.0/UDP 10.0.0.2:5060;branch=z9hG4bKnashds7\r\n" +
+		"CSeq: 1 OPTIONS\r\n\r\n")
+	c, _ := NewClient(req, cfg, ClientHandler{})
+	c.Start()
+	if c.State() != STATE_TRYING {
+		t.Fatalf("State %s", c.State())
+	}
+
+	// Timer E doubles up to T2
+	r.clock.Advance(12 * time.Second)
+	exp := []time.Duration{0, 500 * time.Millisecond, 1500 * time.Millisecond, 3500 * time.Millisecond,
+		7500 * time.Millisecond, 11500 * time.Millisecond}
+	if !reflect.DeepEqual(r.at, exp) {
+		t.Errorf("Mismatch:\nExpected:\n%v\nGot:\n%v", exp, r.at)
+	}
+
+	c.Receive(parse("SIP/2.0 200 OK\r\n" +
+		"Via: SIP/2.0/UDP 10.0.0.2:5060;branch=z9hG4bKnashds7\r\n" +
+		"CSeq: 1 OPTIONS\r\n\r\n"))
+	if c.State() != STATE_COMPLETED {
+		t.Fatalf("State %s", c.State())
+	}
+	// Timer K
+	r.clock.Advance(5 * time.Second)
+	if c.State() != STATE_TERMINATED || len(r.sent) != 6 {
+		t.Errorf("State %s sent %d", c.State(), len(r.sent))
+	}
+}
+
+func Test_transactionClient_Reliable(t *testing.T) {
+
+	r, cfg := newRecorder()
+	cfg.Reliable = true
+	c, _ := NewClient(parse(testInvite), cfg, ClientHandler{})
+	c.Start()
+	r.clock.Advance(10 * time.Second)
+	if len(r.sent) != 1 {
+		t.Errorf("Retransmitted over a reliable transport: %d", len(r.sent))
+	}
+	c.Receive(parse("SIP/2.0 603 Decline\r\n" +
+		"Via: SIP/2.0/TCP 10.0.0.2:5060;branch=z9hG4bK776asdhds\r\n" +
+		"CSeq: 314159 INVITE\r\n\r\n"))
+	if c.State() != STATE_TERMINATED || r.clock.Pending() != 0 {
+		t.Errorf("State %s pending %d", c.State(), r.clock.Pending())
+	}
+
+	r, cfg = newRecorder()
+	r.err = errors.New("unreachable")
+	var got error
+	c, _ = NewClient(parse(testInvite), cfg, ClientHandler{TransportError: func(err error) { got = err }})
+	c.Start()
+	if got != r.err || c.State() != STATE_TERMINATED {
+		t.Errorf("Transport error %v state %s", got, c.State())
+	}
+}
@@ -0,0 +1,124 @@
+package transaction
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clock schedules the transaction timers, ManualClock allows the state
+// machines to be driven deterministically in tests
+type Clock interface {
+	Now() time.Time
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// Timer is a scheduled call that can be stopped
+type Timer interface {
+	Stop() bool
+}
+
+type systemClock struct{}
+
+// SystemClock uses the time package
+var SystemClock Clock = systemClock{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) AfterFunc(d time.Duration, f func()) Timer {
+	return time.AfterFunc(d, f)
+}
+
+// ManualClock only moves when Advance is called. It is safe for
+// concurrent use.
+type ManualClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	seq    uint64
+	timers map[uint64]*manualTimer
+}
+
+type manualTimer struct {
+	clock *ManualClock
+	id    uint64
+	at    time.Time
+	f     func()
+}
+
+func NewManualClock(start time.Time) *ManualClock {
+	return &ManualClock{now: start, timers: make(map[uint64]*manualTimer)}
+}
+
+func (c *ManualClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *ManualClock) AfterFunc(d time.Duration, f func()) Timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.seq++
+	t := &manualTimer{clock: c, id: c.seq, at: c.now.Add(d), f: f}
+	c.timers[t.id] = t
+	return t
+}
+
+func (t *manualTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	_, ok := t.clock.timers[t.id]
+	delete(t.clock.timers, t.id)
+	return ok
+}
+
+// Advance moves the clock forward, running every timer that falls due in
+// the order they are due. Timers scheduled by those calls run too when
+// they fall due before the new time.
+func (c *ManualClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	end := c.now.Add(d)
+	for {
+		next := c.due(end)
+		if next == nil {
+			break
+		}
+		delete(c.timers, next.id)
+		c.now = next.at
+		c.mu.Unlock()
+		next.f()
+		c.mu.Lock()
+	}
+	c.now = end
+	c.mu.Unlock()
+}
+
+// Pending returns the number of timers that have not run or been stopped
+func (c *ManualClock) Pending() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.timers)
+}
+
+// due returns the earliest timer due at or before end, ties in the order
+// they were scheduled
+func (c *ManualClock) due(end time.Time) *manualTimer {
+	var due []*manualTimer
+	for _, t := range c.timers {
+		if !t.at.After(end) {
+			due = append(due, t)
+		}
+	}
+	if len(due) == 0 {
+		return nil
+	}
+	sort.Slice(due, func(i, j int) bool {
+		if !due[i].at.Equal(due[j].at) {
+			return due[i].at.Before(due[j].at)
+		}
+		return due[i].id < due[j].id
+	})
+	return due[0]
+}
@@ -0,0 +1,106 @@
+// Package transaction groups SIP messages into transactions and runs the
+// client and server transaction state machines of RFC 3261 section 17.
+package transaction
+
+/*
+ RFC 3261 - https://datatracker.ietf.org/doc/html/rfc3261#section-17.2.3
+
+ 17.2.3 Matching Requests to Server Transactions
+
+   1. the branch parameter in the request is equal to the one in the
+      top Via header field of the request that created the transaction, and
+
+   2. the sent-by value in the top Via of the request is equal to the
+      one in the request that created the transaction, and
+
+   3. the method of the request matches the one that created the
+      transaction, except for ACK, where the method of the request
+      that created the transaction is INVITE.
+
+ The branch ID of RFC 3261 compliant elements always begins with the magic
+ cookie z9hG4bK. Requests from RFC 2543 elements are matched by the
+ Request-URI, To tag, From tag, Call-ID, CSeq and top Via instead, this
+ package leaves out the Request-URI and To tag so that responses and the
+ ACK for a non 2xx response, which gains the To tag, still match.
+
+ 17.1.3 Matching Responses to Client Transactions
+
+   A response matches a client transaction when its top Via branch and
+   CSeq method match the request that created the transaction.
+
+*/
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+
+	"github.com/nullboundary/siprocket"
+)
+
+// The magic cookie that starts every RFC 3261 branch
+const MAGIC_COOKIE = "z9hG4bK"
+
+var ErrNoVia = errors.New("transaction: message has no Via")
+
+// Key identifies a transaction, it is comparable and can be used in maps
+type Key struct {
+	Branch string // Top Via branch
+	SentBy string // Top Via host and port
+	Method string // Method of the request that created the transaction
+	Legacy string // RFC 2543 matching fields, empty for RFC 3261 branches
+}
+
+// IsRfc3261 tells if a branch starts with the magic cookie
+func IsRfc3261(branch []byte) bool {
+	return bytes.HasPrefix(branch, []byte(MAGIC_COOKIE))
+}
+
+// KeyOf returns the key of the transaction a request or response belongs
+// to. An ACK belongs to the INVITE transaction when it acknowledges a non
+// 2xx response, the ACK for a 2xx has a new branch and so its own key. A
+// CANCEL is a transaction of its own, see CancelledKey.
+func KeyOf(msg *siprocket.SipMsg) (Key, error) {
+	if len(msg.Via) == 0 {
+		return Key{}, ErrNoVia
+	}
+	via := &msg.Via[0]
+
+	method := strings.ToUpper(string(msg.Cseq.Method))
+	if method == "" {
+		method = strings.ToUpper(string(msg.Req.Method))
+	}
+	if method == "ACK" {
+		method = "INVITE"
+	}
+
+	key := Key{
+		Branch: string(via.Branch),
+		SentBy: sentBy(via),
+		Method: method,
+	}
+	if !IsRfc3261(via.Branch) {
+		key.Legacy = string(msg.CallId.Value) + "|" + string(msg.From.Tag) + "|" + string(msg.Cseq.Id)
+	}
+	return key, nil
+}
+
+// CancelledKey returns the key of the INVITE transaction a CANCEL request
+// cancels, it only differs from the key of the CANCEL in its method
+func CancelledKey(cancel *siprocket.SipMsg) (Key, error) {
+	key, err := KeyOf(cancel)
+	if err != nil {
+		return key, err
+	}
+	key.Method = "INVITE"
+	return key, nil
+}
+
+// sentBy returns the host and port of a Via, the host in lower case
+func sentBy(via *siprocket.SipVia) string {
+	host := strings.ToLower(string(via.Host))
+	if len(via.Port) == 0 {
+		return host
+	}
+	return host + ":" + string(via.Port)
+}
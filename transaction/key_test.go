@@ -0,0 +1,100 @@
+package transaction
+
+import (
+	"testing"
+
+	"github.com/nullboundary/siprocket"
+)
+
+const testInvite = "INVITE sip:bob@10.0.0.1 SIP/2.0\r\n" +
+	"Via: SIP/2.0/UDP 10.0.0.2:5060;branch=z9hG4bK776asdhds\r\n" +
+	"From: <sip:alice@10.0.0.2>;tag=1928301774\r\n" +
+	"To: <sip:bob@10.0.0.1>\r\n" +
+	"Call-ID: a84b4c76e66710\r\n" +
+	"CSeq: 314159 INVITE\r\n" +
+	"Content-Length: 0\r\n" +
+	"\r\n"
+
+func parse(msg string) *siprocket.SipMsg {
+	out := siprocket.Parse([]byte(msg))
+	return &out
+}
+
+func Test_transactionKeyOf_Matching(t *testing.T) {
+
+	invite := parse(testInvite)
+	key, err := KeyOf(invite)
+	exp := Key{Branch: "z9hG4bK776asdhds", SentBy: "10.0.0.2:5060", Method: "INVITE"}
+	if err != nil || key != exp {
+		t.Fatalf("Mismatch:\nExpected:\n%+v\nGot:\n%+v %v", exp, key, err)
+	}
+
+	resp := parse("SIP/2.0 486 Busy Here\r\n" +
+		"Via: SIP/2.0/UDP 10.0.0.2:5060;branch=z9hG4bK776asdhds;received=192.0.2.1\r\n" +
+		"From: <sip:alice@10.0.0.2>;tag=1928301774\r\n" +
+		"To: <sip:bob@10.0.0.1>;tag=a6c85cf\r\n" +
+		"Call-ID: a84b4c76e66710\r\n" +
+		"CSeq: 314159 INVITE\r\n" +
+		"\r\n")
+	ack := parse("ACK sip:bob@10.0.0.1 SIP/2.0\r\n" +
+		"Via: SIP/2.0/UDP 10.0.0.2:5060;branch=z9hG4bK776asdhds\r\n" +
+		"From: <sip:alice@10.0.0.2>;tag=1928301774\r\n" +
+		"To: <sip:bob@10.0.0.1>;tag=a6c85cf\r\n" +
+		"Call-ID: a84b4c76e66710\r\n" +
+		"CSeq: 314159 ACK\r\n" +
+		"\r\n")
+	cancel := parse("CANCEL sip:bob@10.0.0.1 SIP/2.0\r\n" +
+		"Via: SIP/2.0/UDP 10.0.0.2:5060;branch=z9hG4bK776asdhds\r\n" +
+		"From: <sip:alice@10.0.0.2>;tag=1928301774\r\n" +
+		"To: <sip:bob@10.0.0.1>\r\n" +
+		"Call-ID: a84b4c76e66710\r\n" +
+		"CSeq: 314159 CANCEL\r\n" +
+		"\r\n")
+
+	if k, _ := KeyOf(resp); k != key {
+		t.Errorf("Response key mismatch: %+v", k)
+	}
+	if k, _ := KeyOf(ack); k != key {
+		t.Errorf("ACK key mismatch: %+v", k)
+	}
+	if k, _ := KeyOf(cancel); k == key || k.Method != "CANCEL" {
+		t.Errorf("CANCEL key mismatch: %+v", k)
+	}
+	if k, _ := CancelledKey(cancel); k != key {
+		t.Errorf("Cancelled key mismatch: %+v", k)
+	}
+
+	groups := GroupMessages([]*siprocket.SipMsg{invite, cancel, resp, ack})
+	if len(groups) != 2 || len(groups[0].Messages) != 3 || groups[1].Messages[0] != cancel {
+		t.Errorf("Mismatch: %+v", groups)
+	}
+
+	if _, err := KeyOf(&siprocket.SipMsg{}); err != ErrNoVia {
+		t.Errorf("Expected ErrNoVia, got %v", err)
+	}
+}
+
+func Test_transactionKeyOf_Rfc2543(t *testing.T) {
+
+	req := parse("OPTIONS sip:bob@10.0.0.1 SIP/2.0\r\n" +
+		"Via: SIP/2.0/UDP host.example.com\r\n" +
+		"From: <sip:alice@10.0.0.2>;tag=77\r\n" +
+		"Call-ID: old-1\r\n" +
+		"CSeq: 9 OPTIONS\r\n" +
+		"\r\n")
+	next := parse("OPTIONS sip:bob@10.0.0.1 SIP/2.0\r\n" +
+		"Via: SIP/2.0/UDP host.example.com\r\n" +
+		"From: <sip:alice@10.0.0.2>;tag=77\r\n" +
+		"Call-ID: old-1\r\n" +
+		"CSeq: 10 OPTIONS\r\n" +
+		"\r\n")
+
+	key, _ := KeyOf(req)
+	exp := Key{SentBy: "host.example.com", Method: "OPTIONS", Legacy: "old-1|77|9"}
+	if key != exp {
+		t.Errorf("Mismatch:\nExpected:\n%+v\nGot:\n%+v", exp, key)
+	}
+	if k, _ := KeyOf(next); k == key {
+		t.Errorf("Requests with a new CSeq share a key")
+	}
+}
@@ -0,0 +1,227 @@
+package transaction
+
+/*
+ RFC 3261 - https://datatracker.ietf.org/doc/html/rfc3261#section-17.2
+
+ 17.2.1 INVITE Server Transaction
+
+                               |INVITE
+                               |pass INV to TU
+            INVITE             V send 100 if TU won't in 200ms
+            send response+-----------+
+                +--------|           |--------+101-199 from TU
+                |        | Proceeding|        |send response
+                +------->|           |<-------+
+                         |           |          Transport Err.
+                         |           |          Inform TU
+                         |           |--------------->+
+                         +-----------+                |
+            300-699 from TU |     |2xx from TU        |
+            send response   |     |send response      |
+                            |     +------------------>+
+                            |                         |
+            INVITE          V          Timer G fires  |
+            send response+-----------+ send response  |
+                +--------|           |--------+       |
+                |        | Completed |        |       |
+                +------->|           |<-------+       |
+                         +-----------+                |
+                            |     |                   |
+                        ACK |     |                   |
+                        -   |     +------------------>+
+                            |        Timer H fires    |
+                            V        or Transport Err.|
+                         +-----------+  Inform TU     |
+                         |           |                |
+                         | Confirmed |                |
+                         |           |                |
+                         +-----------+                |
+                               |                      |
+                               |Timer I fires         |
+                               |-                     |
+                               |                      |
+                               V                      |
+                         +-----------+                |
+                         |           |                |
+                         | Terminated|<---------------+
+                         |           |
+                         +-----------+
+
+ 17.2.2 Non-INVITE Server Transaction
+
+   Trying     retransmissions are absorbed, 1xx from the TU moves to
+              Proceeding and 200-699 to Completed
+   Proceeding retransmissions get the last provisional response again
+   Completed  retransmissions get the final response again until Timer J
+
+*/
+
+import (
+	"errors"
+	"time"
+
+	"github.com/nullboundary/siprocket"
+)
+
+var ErrState = errors.New("transaction: response not allowed in this state")
+
+// ServerHandler receives the events of a server transaction, any of the
+// callbacks may be nil
+type ServerHandler struct {
+	Timeout        func()          // Timer H fired before the ACK arrived
+	TransportError func(err error) // Send failed
+	Terminated     func()          // The transaction ended
+}
+
+// Server is an INVITE or non-INVITE server transaction. It is safe for
+// concurrent use.
+type Server struct {
+	base
+	invite   bool
+	handler  ServerHandler
+	last     *siprocket.SipMsg // Last response sent
+	interval time.Duration     // Current retransmit interval of timer G
+}
+
+// NewServer creates the server transaction for a received request. An
+// INVITE transaction sends 100 Trying itself if the TU has not responded
+// within 200ms.
+func NewServer(req *siprocket.SipMsg, cfg Config, h ServerHandler) (*Server, error) {
+	s := &Server{handler: h}
+	if err := s.init(req, cfg); err != nil {
+		return nil, err
+	}
+	s.invite = s.key.Method == "INVITE"
+	s.onTerminated = h.Terminated
+
+	s.mu.Lock()
+	defer s.unlock()
+	if s.invite {
+		s.state = STATE_PROCEEDING
+		s.start(timerTrying, 200*time.Millisecond, s.trying)
+	} else {
+		s.state = STATE_TRYING
+	}
+	return s, nil
+}
+
+// trying sends 100 Trying on behalf of a slow TU
+func (s *Server) trying() {
+	if s.state == STATE_PROCEEDING && s.last == nil {
+		s.last = tryingResponse(s.req)
+		s.send(s.last, s.handler.TransportError)
+	}
+}
+
+// Receive passes a request matched to this transaction through the state
+// machine, a retransmission of the request or the ACK for a non 2xx final
+// response. Neither needs to reach the TU.
+func (s *Server) Receive(req *siprocket.SipMsg) {
+	s.mu.Lock()
+	defer s.unlock()
+
+	if string(req.Req.Method) == "ACK" {
+		if s.invite && s.state == STATE_COMPLETED {
+			s.state = STATE_CONFIRMED
+			s.stop(TIMER_G)
+			s.stop(TIMER_H)
+			s.linger(TIMER_I, s.cfg.Timers.T4)
+		}
+		return
+	}
+
+	switch s.state {
+	case STATE_PROCEEDING, STATE_COMPLETED:
+		if s.last != nil {
+			s.send(s.last, s.handler.TransportError)
+		}
+	}
+}
+
+// Respond sends a response from the TU
+func (s *Server) Respond(resp *siprocket.SipMsg) error {
+	s.mu.Lock()
+	defer s.unlock()
+
+	class := statusClass(resp)
+	if class == 0 {
+		return errors.New("transaction: invalid status code")
+	}
+	if s.state != STATE_TRYING && s.state != STATE_PROCEEDING {
+		return ErrState
+	}
+
+	s.stop(timerTrying)
+	s.last = resp
+	if err := s.send(resp, s.handler.TransportError); err != nil {
+		return err
+	}
+
+	t := s.cfg.Timers
+	switch {
+	case class == 1:
+		s.state = STATE_PROCEEDING
+	case !s.invite:
+		s.state = STATE_COMPLETED
+		s.linger(TIMER_J, 64*t.T1)
+	case class == 2:
+		// The TU retransmits 2xx responses itself
+		s.terminate()
+	default:
+		s.state = STATE_COMPLETED
+		s.interval = t.T1
+		if !s.cfg.Reliable {
+			s.start(TIMER_G, s.interval, s.timerG)
+		}
+		s.start(TIMER_H, 64*t.T1, s.timerH)
+	}
+	return nil
+}
+
+// timerG retransmits the final response doubling the interval up to T2
+func (s *Server) timerG() {
+	if s.state != STATE_COMPLETED {
+		return
+	}
+	if s.send(s.last, s.handler.TransportError) != nil {
+		return
+	}
+	s.interval *= 2
+	if s.interval > s.cfg.Timers.T2 {
+		s.interval = s.cfg.Timers.T2
+	}
+	s.start(TIMER_G, s.interval, s.timerG)
+}
+
+// timerH gives up waiting for the ACK
+func (s *Server) timerH() {
+	if s.state != STATE_COMPLETED {
+		return
+	}
+	s.queue(s.handler.Timeout)
+	s.terminate()
+}
+
+// LastResponse returns the last response sent, or nil
+func (s *Server) LastResponse() *siprocket.SipMsg {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.last
+}
+
+// tryingResponse builds a 100 Trying for a request as in section 8.2.6.1,
+// the To tag is not added to a 100
+func tryingResponse(req *siprocket.SipMsg) *siprocket.SipMsg {
+	return &siprocket.SipMsg{
+		Req: siprocket.SipReq{
+			SipVersion: []byte("SIP/2.0"),
+			StatusCode: []byte("100"),
+			StatusDesc: []byte("Trying"),
+		},
+		Via:    req.Via,
+		From:   req.From,
+		To:     req.To,
+		CallId: req.CallId,
+		Cseq:   req.Cseq,
+	}
+}
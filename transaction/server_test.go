@@ -0,0 +1,161 @@
+package transaction
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/nullboundary/siprocket"
+)
+
+func response(req *siprocket.SipMsg, code, reason string) *siprocket.SipMsg {
+	resp := tryingResponse(req)
+	resp.Req.StatusCode = []byte(code)
+	resp.Req.StatusDesc = []byte(reason)
+	resp.To.Tag = []byte("a6c85cf")
+	return resp
+}
+
+func Test_transactionServer_InviteRejected(t *testing.T) {
+
+	r, cfg := newRecorder()
+	invite := parse(testInvite)
+	table := NewTable()
+	s, err := NewServer(invite, cfg, ServerHandler{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	table.AddServer(s)
+
+	// 100 Trying after 200ms, then sent again for a retransmitted INVITE
+	r.clock.Advance(300 * time.Millisecond)
+	if len(r.sent) != 1 || string(r.sent[0].Req.StatusCode) != "100" {
+		t.Fatalf("Mismatch: %d sent", len(r.sent))
+	}
+	if m, ok := table.MatchRequest(parse(testInvite)); !ok || m != s {
+		t.Fatalf("Retransmission not matched")
+	}
+	s.Receive(invite)
+
+	busy := response(invite, "486", "Busy Here")
+	if err := s.Respond(busy); err != nil || s.State() != STATE_COMPLETED {
+		t.Fatalf("State %s %v", s.State(), err)
+	}
+	if err := s.Respond(response(invite, "200", "OK")); err != ErrState {
+		t.Errorf("Expected ErrState, got %v", err)
+	}
+
+	// Timer G retransmits the final response until the ACK
+	r.clock.Advance(2 * time.Second)
+	ack := parse("ACK sip:bob@10.0.0.1 SIP/2.0\r\n" +
+		"Via: SIP/2.0/UDP 10.0.0.2:5060;branch=z9hG4bK776asdhds\r\n" +
+		"CSeq: 314159 ACK\r\n\r\n")
+	m, ok := table.MatchRequest(ack)
+	if !ok {
+		t.Fatalf("ACK not matched")
+	}
+	m.Receive(ack)
+	if s.State() != STATE_CONFIRMED {
+		t.Fatalf("State %s", s.State())
+	}
+	exp := []time.Duration{200 * time.Millisecond, 300 * time.Millisecond, 300 * time.Millisecond,
+		800 * time.Millisecond, 1800 * time.Millisecond}
+	if !reflect.DeepEqual(r.at, exp) {
+		t.Errorf("Mismatch:\nExpected:\n%v\nGot:\n%v", exp, r.at)
+	}
+
+	// Timer I
+	r.clock.Advance(5 * time.Second)
+	if s.State() != STATE_TERMINATED || table.Purge() != 1 || table.Len() != 0 {
+		t.Errorf("State %s", s.State())
+	}
+}
+
+func Test_transactionServer_InviteNoAck(t *testing.T) {
+
+	r, cfg := newRecorder()
+	var timeout bool
+	invite := parse(testInvite)
+	s, _ := NewServer(invite, cfg, ServerHandler{Timeout: func() { timeout = true }})
+
+	// A 2xx from the TU ends the transaction at once, a new one waits for ACK
+	s.Respond(response(invite, "180", "Ringing"))
+	s.Respond(response(invite, "500", "Server Internal Error"))
+	r.clock.Advance(32 * time.Second)
+	if !timeout || s.State() != STATE_TERMINATED {
+		t.Errorf("Timeout %v state %s", timeout, s.State())
+	}
+	// 180, 500 and retransmissions at 0.5, 1.5, 3.5, 7.5, 11.5 ... 31.5
+	if len(r.sent) != 2+10 {
+		t.Errorf("Sent %d", len(r.sent))
+	}
+
+	s, _ = NewServer(invite, cfg, ServerHandler{})
+	s.Respond(response(invite, "200", "OK"))
+	if s.State() != STATE_TERMINATED {
+		t.Errorf("State %s", s.State())
+	}
+}
+
+func Test_transactionServer_NonInvite(t *testing.T) {
+
+	r, cfg := newRecorder()
+	req := parse("BYE sip:bob@10.0.0.1 SIP/2.0\r\n" +
+		"Via: SIP/2.0/UDP 10.0.0.2:5060;branch=z9hG4bKbye1\r\n" +
+		"CSeq: 2 BYE\r\n\r\n")
+	s, _ := NewServer(req, cfg, ServerHandler{})
+	if s.State() != STATE_TRYING {
+		t.Fatalf("State %s", s.State())
+	}
+
+	// Absorbed while Trying, answered again once Completed
+	s.Receive(req)
+	r.clock.Advance(time.Second)
+	if len(r.sent) != 0 {
+		t.Fatalf("Sent %d", len(r.sent))
+	}
+	ok := response(req, "200", "OK")
+	s.Respond(ok)
+	s.Receive(req)
+	if len(r.sent) != 2 || r.sent[1] != ok || s.LastResponse() != ok {
+		t.Fatalf("Sent %d", len(r.sent))
+	}
+
+	// Timer J
+	r.clock.Advance(32 * time.Second)
+	if s.State() != STATE_TERMINATED {
+		t.Errorf("State %s", s.State())
+	}
+
+	cfg.Reliable = true
+	s, _ = NewServer(req, cfg, ServerHandler{})
+	s.Respond(ok)
+	if s.State() != STATE_TERMINATED {
+		t.Errorf("State %s", s.State())
+	}
+}
+
+func Test_transactionTable_Cancel(t *testing.T) {
+
+	_, cfg := newRecorder()
+	table := NewTable()
+	invite, _ := NewServer(parse(testInvite), cfg, ServerHandler{})
+	table.AddServer(invite)
+
+	cancel := parse("CANCEL sip:bob@10.0.0.1 SIP/2.0\r\n" +
+		"Via: SIP/2.0/UDP 10.0.0.2:5060;branch=z9hG4bK776asdhds\r\n" +
+		"CSeq: 314159 CANCEL\r\n\r\n")
+	if _, ok := table.MatchRequest(cancel); ok {
+		t.Errorf("CANCEL matched as a retransmission")
+	}
+	if s, ok := table.MatchCancel(cancel); !ok || s != invite {
+		t.Errorf("CANCEL not matched to the INVITE")
+	}
+
+	client, _ := NewClient(parse(testInvite), cfg, ClientHandler{})
+	table.AddClient(client)
+	resp := response(parse(testInvite), "180", "Ringing")
+	if c, ok := table.MatchResponse(resp); !ok || c != client {
+		t.Errorf("Response not matched")
+	}
+}
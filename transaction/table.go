@@ -0,0 +1,128 @@
+package transaction
+
+import (
+	"sync"
+
+	"github.com/nullboundary/siprocket"
+)
+
+// Table finds the transaction a received message belongs to. It is safe
+// for concurrent use.
+type Table struct {
+	mu      sync.Mutex
+	clients map[Key]*Client
+	servers map[Key]*Server
+}
+
+func NewTable() *Table {
+	return &Table{
+		clients: make(map[Key]*Client),
+		servers: make(map[Key]*Server),
+	}
+}
+
+// AddClient adds a client transaction, replacing one with the same key
+func (t *Table) AddClient(c *Client) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.clients[c.Key()] = c
+}
+
+// AddServer adds a server transaction, replacing one with the same key
+func (t *Table) AddServer(s *Server) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.servers[s.Key()] = s
+}
+
+// MatchResponse finds the client transaction of a response
+func (t *Table) MatchResponse(resp *siprocket.SipMsg) (*Client, bool) {
+	key, err := KeyOf(resp)
+	if err != nil {
+		return nil, false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	c, ok := t.clients[key]
+	return c, ok
+}
+
+// MatchRequest finds the server transaction of a retransmitted request or
+// of the ACK for a non 2xx response
+func (t *Table) MatchRequest(req *siprocket.SipMsg) (*Server, bool) {
+	key, err := KeyOf(req)
+	if err != nil {
+		return nil, false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s, ok := t.servers[key]
+	return s, ok
+}
+
+// MatchCancel finds the INVITE server transaction a CANCEL cancels
+func (t *Table) MatchCancel(cancel *siprocket.SipMsg) (*Server, bool) {
+	key, err := CancelledKey(cancel)
+	if err != nil {
+		return nil, false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s, ok := t.servers[key]
+	return s, ok
+}
+
+// Purge removes the terminated transactions and returns how many there were
+func (t *Table) Purge() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	n := 0
+	for key, c := range t.clients {
+		if c.State() == STATE_TERMINATED {
+			delete(t.clients, key)
+			n++
+		}
+	}
+	for key, s := range t.servers {
+		if s.State() == STATE_TERMINATED {
+			delete(t.servers, key)
+			n++
+		}
+	}
+	return n
+}
+
+// Len returns the number of client and server transactions held
+func (t *Table) Len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.clients) + len(t.servers)
+}
+
+// Group is the messages of one transaction seen in a capture
+type Group struct {
+	Key      Key
+	Messages []*siprocket.SipMsg
+}
+
+// GroupMessages sorts captured messages into transactions, in the order
+// each transaction was first seen. Messages without a Via are skipped.
+func GroupMessages(msgs []*siprocket.SipMsg) []Group {
+	var groups []Group
+	index := make(map[Key]int)
+	for _, msg := range msgs {
+		key, err := KeyOf(msg)
+		if err != nil {
+			continue
+		}
+		i, ok := index[key]
+		if !ok {
+			i = len(groups)
+			index[key] = i
+			groups = append(groups, Group{Key: key})
+		}
+		groups[i].Messages = append(groups[i].Messages, msg)
+	}
+	return groups
+}
@@ -0,0 +1,252 @@
+package transaction
+
+/*
+ RFC 3261 - https://datatracker.ietf.org/doc/html/rfc3261#appendix-A
+
+ Appendix A: Table of Timer Values
+
+   T1       500ms default    RTT Estimate
+   T2       4s               The maximum retransmit interval for
+                             non-INVITE requests and INVITE responses
+   T4       5s               Maximum duration a message will remain
+                             in the network
+   Timer A  initially T1     INVITE request retransmit interval, UDP only
+   Timer B  64*T1            INVITE transaction timeout timer
+   Timer C  > 3min           proxy INVITE transaction timeout
+   Timer D  > 32s for UDP    Wait time for response retransmits
+            0s for TCP/SCTP
+   Timer E  initially T1     non-INVITE request retransmit interval, UDP only
+   Timer F  64*T1            non-INVITE transaction timeout timer
+   Timer G  initially T1     INVITE response retransmit interval
+   Timer H  64*T1            Wait time for ACK receipt
+   Timer I  T4 for UDP       Wait time for ACK retransmits
+            0s for TCP/SCTP
+   Timer J  64*T1 for UDP    Wait time for non-INVITE request retransmits
+            0s for TCP/SCTP
+   Timer K  T4 for UDP       Wait time for response retransmits
+            0s for TCP/SCTP
+
+ Timer C belongs to proxies and is not run by the transactions here.
+
+*/
+
+import (
+	"sync"
+	"time"
+
+	"github.com/nullboundary/siprocket"
+)
+
+// Transaction states
+const (
+	STATE_CALLING    = "Calling"
+	STATE_TRYING     = "Trying"
+	STATE_PROCEEDING = "Proceeding"
+	STATE_COMPLETED  = "Completed"
+	STATE_CONFIRMED  = "Confirmed"
+	STATE_TERMINATED = "Terminated"
+)
+
+// Timer names as used in RFC 3261
+const (
+	TIMER_A = "A"
+	TIMER_B = "B"
+	TIMER_D = "D"
+	TIMER_E = "E"
+	TIMER_F = "F"
+	TIMER_G = "G"
+	TIMER_H = "H"
+	TIMER_I = "I"
+	TIMER_J = "J"
+	TIMER_K = "K"
+
+	// Not an RFC timer, sends 100 Trying when the TU is slow to respond
+	timerTrying = "100"
+)
+
+// Timers are the base timer values all other timers derive from
+type Timers struct {
+	T1 time.Duration // Round trip time estimate
+	T2 time.Duration // Longest retransmit interval
+	T4 time.Duration // Longest time a message stays in the network
+	D  time.Duration // Timer D, at least 32s for unreliable transports
+}
+
+var DefaultTimers = Timers{
+	T1: 500 * time.Millisecond,
+	T2: 4 * time.Second,
+	T4: 5 * time.Second,
+	D:  32 * time.Second,
+}
+
+// WithDefaults returns the timers with every zero field taken from
+// DefaultTimers
+func (t Timers) WithDefaults() Timers {
+	if t.T1 == 0 {
+		t.T1 = DefaultTimers.T1
+	}
+	if t.T2 == 0 {
+		t.T2 = DefaultTimers.T2
+	}
+	if t.T4 == 0 {
+		t.T4 = DefaultTimers.T4
+	}
+	if t.D == 0 {
+		t.D = DefaultTimers.D
+	}
+	return t
+}
+
+// Config holds what a transaction needs from its surroundings
+type Config struct {
+	Send     func(msg *siprocket.SipMsg) error // Hands a message to the transport
+	Reliable bool                              // The transport is TCP, TLS, SCTP or WebSocket
+	Clock    Clock                             // Defaults to SystemClock
+	Timers   Timers                            // Zero fields default to DefaultTimers
+}
+
+// Transaction is the part common to client and server transactions
+type Transaction interface {
+	Key() Key
+	State() string
+	Request() *siprocket.SipMsg
+}
+
+// base holds the state shared by both kinds of transaction. Every change
+// is made with mu held while callbacks into the TU are queued in pending
+// and run once mu is released, so the TU may call back into the
+// transaction.
+type base struct {
+	mu      sync.Mutex
+	cfg     Config
+	key     Key
+	req     *siprocket.SipMsg
+	state   string
+	timers  map[string]*timerSlot
+	seq     uint64
+	pending []func()
+
+	onTerminated func()
+}
+
+type timerSlot struct {
+	timer Timer
+	id    uint64
+}
+
+func (b *base) init(req *siprocket.SipMsg, cfg Config) error {
+	key, err := KeyOf(req)
+	if err != nil {
+		return err
+	}
+	if cfg.Clock == nil {
+		cfg.Clock = SystemClock
+	}
+	cfg.Timers = cfg.Timers.WithDefaults()
+	b.cfg = cfg
+	b.key = key
+	b.req = req
+	b.timers = make(map[string]*timerSlot)
+	return nil
+}
+
+func (b *base) Key() Key {
+	return b.key
+}
+
+func (b *base) Request() *siprocket.SipMsg {
+	return b.req
+}
+
+func (b *base) State() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// unlock releases mu and runs the queued TU callbacks
+func (b *base) unlock() {
+	pending := b.pending
+	b.pending = nil
+	b.mu.Unlock()
+	for _, f := range pending {
+		f()
+	}
+}
+
+// queue adds a TU callback, nil callbacks are skipped
+func (b *base) queue(f func()) {
+	if f != nil {
+		b.pending = append(b.pending, f)
+	}
+}
+
+// start schedules a timer, replacing one of the same name. A timer that
+// fires after being replaced or stopped does nothing.
+func (b *base) start(name string, d time.Duration, f func()) {
+	b.stop(name)
+	b.seq++
+	slot := &timerSlot{id: b.seq}
+	slot.timer = b.cfg.Clock.AfterFunc(d, func() {
+		b.mu.Lock()
+		if b.timers[name] != slot {
+			b.mu.Unlock()
+			return
+		}
+		delete(b.timers, name)
+		f()
+		b.unlock()
+	})
+	b.timers[name] = slot
+}
+
+func (b *base) stop(name string) {
+	if slot, ok := b.timers[name]; ok {
+		slot.timer.Stop()
+		delete(b.timers, name)
+	}
+}
+
+// send hands a message to the transport, a failure terminates the
+// transaction
+func (b *base) send(msg *siprocket.SipMsg, onError func(error)) error {
+	err := b.cfg.Send(msg)
+	if err != nil {
+		if onError != nil {
+			b.queue(func() { onError(err) })
+		}
+		b.terminate()
+	}
+	return err
+}
+
+// terminate stops every timer and moves to the Terminated state
+func (b *base) terminate() {
+	if b.state == STATE_TERMINATED {
+		return
+	}
+	for name := range b.timers {
+		b.stop(name)
+	}
+	b.state = STATE_TERMINATED
+	b.queue(b.onTerminated)
+}
+
+// linger keeps a finished transaction around to absorb retransmissions
+// over unreliable transports, on reliable ones it terminates at once
+func (b *base) linger(name string, d time.Duration) {
+	if b.cfg.Reliable {
+		b.terminate()
+		return
+	}
+	b.start(name, d, b.terminate)
+}
+
+// statusClass returns the hundreds of a response code, eg 2 for 200 OK
+func statusClass(msg *siprocket.SipMsg) int {
+	code := msg.Req.StatusCode
+	if len(code) != 3 || code[0] < '1' || code[0] > '6' {
+		return 0
+	}
+	return int(code[0] - '0')
+}
@@ -0,0 +1,289 @@
+package transport
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nullboundary/siprocket"
+)
+
+type connKey struct {
+	proto  string
+	remote netip.AddrPort
+}
+
+// streamConn is a TCP or TLS connection, accepted or dialed
+type streamConn struct {
+	key   connKey
+	local netip.AddrPort
+	conn  net.Conn
+	ws    *wsConn // Set for WebSocket connections
+	wmu   sync.Mutex
+	last  atomic.Int64 // Time of the last read or write in Unix nanoseconds
+}
+
+func (c *streamConn) touch() {
+	c.last.Store(time.Now().UnixNano())
+}
+
+func (c *streamConn) write(b []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	c.touch()
+	if c.ws != nil {
+		return c.ws.writeFrame(wsText, b)
+	}
+	_, err := c.conn.Write(b)
+	return err
+}
+
+// Requests are remembered for longer than any transaction lasts
+const branchTimeout = 5 * time.Minute
+
+type branchConn struct {
+	conn *streamConn
+	at   time.Time
+}
+
+// setBranchConn remembers the connection a request came in on so that its
+// responses are sent back over it
+func (t *Transport) setBranchConn(branch string, c *streamConn, at time.Time) {
+	if branch == "" {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.branches[branch] = branchConn{c, at}
+	if at.Sub(t.pruned) < time.Minute {
+		return
+	}
+	t.pruned = at
+	for b, bc := range t.branches {
+		if at.Sub(bc.at) > branchTimeout {
+			delete(t.branches, b)
+		}
+	}
+}
+
+func (t *Transport) branchConn(branch string) *streamConn {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.branches[branch].conn
+}
+
+// Conns returns the number of open TCP and TLS connections
+func (t *Transport) Conns() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.conns)
+}
+
+// add registers a connection and starts reading from it, ws is set for
+// WebSocket connections once upgraded
+func (t *Transport) add(conn net.Conn, proto string, ws *wsConn) *streamConn {
+	c := &streamConn{
+		key:   connKey{proto, addrPort(conn.RemoteAddr())},
+		local: addrPort(conn.LocalAddr()),
+		conn:  conn,
+		ws:    ws,
+	}
+	c.touch()
+
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		conn.Close()
+		return nil
+	}
+	// The newest connection to an address is the one used to send
+	t.conns[c.key] = c
+	t.wg.Add(1)
+	t.mu.Unlock()
+
+	go t.read(c)
+	return c
+}
+
+func (t *Transport) remove(c *streamConn) {
+	t.mu.Lock()
+	if t.conns[c.key] == c {
+		delete(t.conns, c.key)
+	}
+	for branch, bc := range t.branches {
+		if bc.conn == c {
+			delete(t.branches, branch)
+		}
+	}
+	for host, ac := range t.aliases {
+		if ac == c {
+			delete(t.aliases, host)
+		}
+	}
+	t.mu.Unlock()
+	c.conn.Close()
+}
+
+// read frames the messages of a connection until it is closed or idle
+func (t *Transport) read(c *streamConn) {
+	defer t.wg.Done()
+	defer t.remove(c)
+
+	tuple := siprocket.FiveTuple{Proto: c.key.proto, Src: c.key.remote, Dst: c.local}
+	if c.ws != nil {
+		t.readWS(c, tuple)
+		return
+	}
+	framer := siprocket.NewSipFramer()
+	buf := make([]byte, 16384)
+	for {
+		c.conn.SetReadDeadline(time.Now().Add(t.IdleTimeout))
+		n, err := c.conn.Read(buf)
+		if n > 0 {
+			c.touch()
+			framer.Write(time.Now(), buf[:n])
+			for {
+				raw, at, ok := framer.Next()
+				if !ok {
+					break
+				}
+				t.deliver(c, raw, tuple, at)
+			}
+		}
+		if err == nil {
+			continue
+		}
+
+		if !t.active(c, err) {
+			return
+		}
+	}
+}
+
+// readWS reads one SIP message from each WebSocket message
+func (t *Transport) readWS(c *streamConn, tuple siprocket.FiveTuple) {
+	for {
+		// Only wait for idleness between messages, a timeout part way
+		// through a frame would lose its place
+		c.conn.SetReadDeadline(time.Now().Add(t.IdleTimeout))
+		if _, err := c.ws.br.Peek(1); err != nil {
+			if t.active(c, err) {
+				continue
+			}
+			return
+		}
+		raw, err := c.ws.readMessage()
+		if err != nil {
+			return
+		}
+		c.touch()
+		if len(bytes.TrimSpace(raw)) == 0 {
+			continue
+		}
+		t.deliver(c, raw, tuple, time.Now())
+	}
+}
+
+// active tells if a read error is a timeout on a connection that has
+// still been written to recently
+func (t *Transport) active(c *streamConn, err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout() && time.Since(time.Unix(0, c.last.Load())) < t.IdleTimeout
+}
+
+// setAliases remembers the .invalid hosts a WebSocket client uses
+func (t *Transport) setAliases(req *siprocket.SipMsg, c *streamConn) {
+	var hosts []string
+	if len(req.Via) > 0 {
+		hosts = append(hosts, string(req.Via[0].Host))
+	}
+	for i := range req.Contacts {
+		hosts = append(hosts, string(req.Contacts[i].Host))
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, host := range hosts {
+		if strings.HasSuffix(strings.ToLower(host), ".invalid") {
+			t.aliases[strings.ToLower(host)] = c
+		}
+	}
+}
+
+// sendStream writes to the open connection to addr or dials a new one
+func (t *Transport) sendStream(proto, addr string, b []byte) error {
+	host := addr
+	if h, _, err := net.SplitHostPort(addr); err == nil {
+		host = h
+	}
+	if host = strings.ToLower(host); strings.HasSuffix(host, ".invalid") {
+		t.mu.Lock()
+		c := t.aliases[host]
+		t.mu.Unlock()
+		if c == nil {
+			return ErrNoConn
+		}
+		return c.write(b)
+	}
+
+	dst, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return err
+	}
+	key := connKey{proto, unmap(dst.AddrPort())}
+
+	t.mu.Lock()
+	c := t.conns[key]
+	t.mu.Unlock()
+	if c != nil {
+		if err := c.write(b); err == nil {
+			return nil
+		}
+		// Closed by the other end, try a new connection
+		t.remove(c)
+	}
+
+	c, err = t.dial(proto, dst)
+	if err != nil {
+		return err
+	}
+	return c.write(b)
+}
+
+func (t *Transport) dial(proto string, dst *net.TCPAddr) (*streamConn, error) {
+	dialer := &net.Dialer{Timeout: t.DialTimeout}
+	var conn net.Conn
+	var err error
+	if proto == PROTO_TLS || proto == PROTO_WSS {
+		if t.TLSConfig == nil {
+			return nil, ErrNoTLS
+		}
+		conn, err = tls.DialWithDialer(dialer, "tcp", dst.String(), t.TLSConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", dst.String())
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var ws *wsConn
+	if proto == PROTO_WS || proto == PROTO_WSS {
+		conn.SetDeadline(time.Now().Add(t.DialTimeout))
+		ws, err = t.dialWS(conn, dst.String())
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn.SetDeadline(time.Time{})
+	}
+	c := t.add(conn, proto, ws)
+	if c == nil {
+		return nil, ErrClosed
+	}
+	return c, nil
+}
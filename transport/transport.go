@@ -0,0 +1,375 @@
+// Package transport sends and receives SIP messages over UDP, TCP, TLS and
+// WebSocket.
+//
+// Inbound requests have their top Via completed with received and rport
+// as in RFC 3581, responses are sent back using the top Via as in RFC
+// 3261 section 18.2.2 and stream connections are reused in both
+// directions.
+package transport
+
+/*
+ RFC 3261 - https://www.ietf.org/rfc/rfc3261.txt - 18.1.1 Sending Requests
+
+   If a request is within 200 bytes of the path MTU, or if it is larger
+   than 1300 bytes and the path MTU is unknown, the request MUST be sent
+   using an RFC 2914 [43] congestion controlled transport protocol, such
+   as TCP. If this causes a change in the transport protocol from the
+   one indicated in the top Via, the value in the top Via MUST be changed.
+
+   If an element sends a request over TCP because of these message size
+   constraints, and that request would have otherwise been sent over
+   UDP, if the attempt to establish the connection generates either an
+   ICMP Protocol Not Supported, or results in a TCP reset, the element
+   SHOULD retry the request, using UDP.
+
+*/
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/nullboundary/siprocket"
+)
+
+// Transport protocols, the same names as SipVia.Trans
+const (
+	PROTO_UDP = "udp"
+	PROTO_TCP = "tcp"
+	PROTO_TLS = "tls"
+	PROTO_WS  = "ws"
+	PROTO_WSS = "wss"
+)
+
+// Defaults for a Transport
+const (
+	DEFAULT_MTU          = 1500
+	DEFAULT_IDLE_TIMEOUT = 5 * time.Minute
+	DEFAULT_DIAL_TIMEOUT = 10 * time.Second
+)
+
+var (
+	ErrClosed   = errors.New("transport: closed")
+	ErrProto    = errors.New("transport: unsupported protocol")
+	ErrNoVia    = errors.New("transport: response without a Via")
+	ErrNoTLS    = errors.New("transport: TLS needs a TLSConfig")
+	ErrTooLarge = errors.New("transport: message too large for UDP")
+	ErrNoConn   = errors.New("transport: no connection to an .invalid host")
+)
+
+// Message is a message read from the network
+type Message struct {
+	Msg   siprocket.SipMsg
+	Raw   []byte              // The message as received
+	Tuple siprocket.FiveTuple // Src is the remote end and Dst the local one
+	Time  time.Time
+}
+
+// Transport holds the listening sockets and connections of an element
+type Transport struct {
+	Handler     func(m *Message) // Called for each message, from the reading goroutines
+	OnError     func(err error)  // Called for read errors, optional
+	TLSConfig   *tls.Config      // Certificates for ListenTLS and settings for dialing TLS
+	MTU         int              // Path MTU used for the size rule of requests over UDP
+	IdleTimeout time.Duration    // Stream connections idle for this long are closed
+	DialTimeout time.Duration
+
+	mu        sync.Mutex
+	udp       []*net.UDPConn
+	listeners []net.Listener
+	conns     map[connKey]*streamConn
+	branches  map[string]branchConn  // Connection each request came in on by Via branch
+	aliases   map[string]*streamConn // WebSocket connections by the .invalid host of the client
+	pruned    time.Time
+	closed    bool
+	wg        sync.WaitGroup
+}
+
+func New() *Transport {
+	return &Transport{
+		MTU:         DEFAULT_MTU,
+		IdleTimeout: DEFAULT_IDLE_TIMEOUT,
+		DialTimeout: DEFAULT_DIAL_TIMEOUT,
+		conns:       make(map[connKey]*streamConn),
+		branches:    make(map[string]branchConn),
+		aliases:     make(map[string]*streamConn),
+	}
+}
+
+// ListenUDP reads datagrams sent to addr, eg "0.0.0.0:5060". It returns
+// the address bound, which gives the port chosen for port 0. The socket is
+// also used to send requests and responses over UDP.
+func (t *Transport) ListenUDP(addr string) (netip.AddrPort, error) {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	udp := conn.(*net.UDPConn)
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		udp.Close()
+		return netip.AddrPort{}, ErrClosed
+	}
+	t.udp = append(t.udp, udp)
+	t.wg.Add(1)
+	t.mu.Unlock()
+
+	go t.readUDP(udp)
+	return addrPort(udp.LocalAddr()), nil
+}
+
+// ListenTCP accepts connections on addr
+func (t *Transport) ListenTCP(addr string) (netip.AddrPort, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	return t.listen(l, PROTO_TCP)
+}
+
+// ListenTLS accepts TLS connections on addr using TLSConfig
+func (t *Transport) ListenTLS(addr string) (netip.AddrPort, error) {
+	if t.TLSConfig == nil {
+		return netip.AddrPort{}, ErrNoTLS
+	}
+	l, err := tls.Listen("tcp", addr, t.TLSConfig)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	return t.listen(l, PROTO_TLS)
+}
+
+func (t *Transport) listen(l net.Listener, proto string) (netip.AddrPort, error) {
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		l.Close()
+		return netip.AddrPort{}, ErrClosed
+	}
+	t.listeners = append(t.listeners, l)
+	t.wg.Add(1)
+	t.mu.Unlock()
+
+	go t.accept(l, proto)
+	return addrPort(l.Addr()), nil
+}
+
+func (t *Transport) accept(l net.Listener, proto string) {
+	defer t.wg.Done()
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			if !t.isClosed() {
+				t.error(err)
+			}
+			return
+		}
+		t.add(c, proto, nil)
+	}
+}
+
+// SendRequest sends a request to addr, a host and port. A request over
+// UDP that is too large for the MTU is sent over TCP instead with the
+// transport of its top Via changed to match, unless the connection is
+// refused in which case UDP is used after all.
+func (t *Transport) SendRequest(proto, addr string, req *siprocket.SipMsg) error {
+	proto = strings.ToLower(proto)
+	b := siprocket.AppendMarshalLossless(nil, req)
+	if proto != PROTO_UDP || len(b) <= t.MTU-200 {
+		return t.SendRaw(proto, addr, b)
+	}
+
+	setViaTransport(req, PROTO_TCP)
+	err := t.SendRaw(PROTO_TCP, addr, siprocket.AppendMarshalLossless(nil, req))
+	if err == nil || !isRefused(err) {
+		return err
+	}
+	setViaTransport(req, PROTO_UDP)
+	return t.SendRaw(PROTO_UDP, addr, b)
+}
+
+// Respond sends a response to where the top Via says, over the connection
+// the request came in on when it is still open
+func (t *Transport) Respond(resp *siprocket.SipMsg) error {
+	proto, addr, err := ResponseAddr(resp)
+	if err != nil {
+		return err
+	}
+	b := siprocket.AppendMarshalLossless(nil, resp)
+	if c := t.branchConn(string(resp.Via[0].Branch)); c != nil && c.key.proto == proto {
+		if c.write(b) == nil {
+			return nil
+		}
+		t.remove(c)
+	}
+	return t.SendRaw(proto, addr, b)
+}
+
+// SendRaw sends bytes to addr, an open connection to it is reused. A
+// WebSocket client known by the .invalid host of its Contact or Via is
+// reached over the connection it opened, addr may then have no port.
+func (t *Transport) SendRaw(proto, addr string, b []byte) error {
+	if t.isClosed() {
+		return ErrClosed
+	}
+	proto = strings.ToLower(proto)
+	switch proto {
+	case PROTO_UDP:
+		return t.sendUDP(addr, b)
+	case PROTO_TCP, PROTO_TLS, PROTO_WS, PROTO_WSS:
+		return t.sendStream(proto, addr, b)
+	}
+	return ErrProto
+}
+
+func (t *Transport) sendUDP(addr string, b []byte) error {
+	if len(b) > 65507 {
+		return ErrTooLarge
+	}
+	dst, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return err
+	}
+	conn, err := t.udpFor(dst)
+	if err != nil {
+		return err
+	}
+	_, err = conn.WriteToUDP(b, dst)
+	return err
+}
+
+// udpFor picks a listening socket of the same family as dst so that
+// replies come back to a known port, one is opened if there is none
+func (t *Transport) udpFor(dst *net.UDPAddr) (*net.UDPConn, error) {
+	is4 := dst.IP.To4() != nil
+	t.mu.Lock()
+	for _, conn := range t.udp {
+		local := addrPort(conn.LocalAddr()).Addr()
+		if local.Is4() == is4 || local.IsUnspecified() && local.Is6() {
+			t.mu.Unlock()
+			return conn, nil
+		}
+	}
+	t.mu.Unlock()
+
+	local := "0.0.0.0:0"
+	if !is4 {
+		local = "[::]:0"
+	}
+	if _, err := t.ListenUDP(local); err != nil {
+		return nil, err
+	}
+	return t.udpFor(dst)
+}
+
+func (t *Transport) readUDP(conn *net.UDPConn) {
+	defer t.wg.Done()
+	local := addrPort(conn.LocalAddr())
+	buf := make([]byte, 65535)
+	for {
+		n, from, err := conn.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			if !t.isClosed() {
+				t.error(err)
+			}
+			return
+		}
+		// Keepalives
+		raw := buf[:n]
+		if len(strings.TrimSpace(string(raw))) == 0 {
+			continue
+		}
+		raw = append([]byte(nil), raw...)
+		t.deliver(nil, raw, siprocket.FiveTuple{Proto: PROTO_UDP, Src: unmap(from), Dst: local}, time.Now())
+	}
+}
+
+// deliver parses a message and completes the Via of a request, c is the
+// connection it was read from or nil for UDP
+func (t *Transport) deliver(c *streamConn, raw []byte, tuple siprocket.FiveTuple, at time.Time) {
+	m := &Message{Msg: siprocket.Parse(raw), Raw: raw, Tuple: tuple, Time: at}
+	if len(m.Msg.Req.Method) > 0 {
+		SetReceived(&m.Msg, tuple.Src)
+		if c != nil && len(m.Msg.Via) > 0 {
+			t.setBranchConn(string(m.Msg.Via[0].Branch), c, at)
+		}
+		if c != nil && c.ws != nil {
+			t.setAliases(&m.Msg, c)
+		}
+	}
+	if t.Handler != nil {
+		t.Handler(m)
+	}
+}
+
+// Close stops every listener and connection and waits for the reading
+// goroutines to finish
+func (t *Transport) Close() error {
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		return nil
+	}
+	t.closed = true
+	for _, conn := range t.udp {
+		conn.Close()
+	}
+	for _, l := range t.listeners {
+		l.Close()
+	}
+	for _, c := range t.conns {
+		c.conn.Close()
+	}
+	t.mu.Unlock()
+
+	t.wg.Wait()
+	return nil
+}
+
+func (t *Transport) isClosed() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.closed
+}
+
+func (t *Transport) error(err error) {
+	if t.OnError != nil {
+		t.OnError(err)
+	}
+}
+
+func setViaTransport(msg *siprocket.SipMsg, proto string) {
+	if len(msg.Via) > 0 {
+		via := msg.Via[0]
+		via.SetTransport(proto)
+		msg.SetTopVia(via)
+	}
+}
+
+func isRefused(err error) bool {
+	return errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET)
+}
+
+// addrPort converts a net address, IPv4 mapped addresses are unmapped
+func addrPort(a net.Addr) netip.AddrPort {
+	var ap netip.AddrPort
+	switch a := a.(type) {
+	case *net.UDPAddr:
+		ap = a.AddrPort()
+	case *net.TCPAddr:
+		ap = a.AddrPort()
+	default:
+		ap, _ = netip.ParseAddrPort(a.String())
+	}
+	return unmap(ap)
+}
+
+func unmap(ap netip.AddrPort) netip.AddrPort {
+	return netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port())
+}
@@ -0,0 +1,288 @@
+package transport
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nullboundary/siprocket"
+)
+
+func request(trans, sentBy, branch string, body int) siprocket.SipMsg {
+	raw := "OPTIONS sip:bob@127.0.0.1 SIP/2.0\r\n" +
+		"Via: SIP/2.0/" + trans + " " + sentBy + ";rport;branch=" + branch + "\r\n" +
+		"From: <sip:alice@example.com>;tag=a1\r\n" +
+		"To: <sip:bob@example.com>\r\n" +
+		"Call-ID: " + branch + "\r\n" +
+		"CSeq: 1 OPTIONS\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"Content-Length: " + strconv.Itoa(body) + "\r\n\r\n" +
+		strings.Repeat("x", body)
+	return siprocket.Parse([]byte(raw))
+}
+
+// response answers a request with its Via as completed by the transport
+func response(req *siprocket.SipMsg) siprocket.SipMsg {
+	raw := "SIP/2.0 200 OK\r\n" +
+		siprocket.MarshalSipVia(&req.Via[0]) +
+		"Call-ID: " + string(req.CallId.Value) + "\r\n" +
+		"CSeq: 1 OPTIONS\r\n" +
+		"Content-Length: 0\r\n\r\n"
+	return siprocket.Parse([]byte(raw))
+}
+
+// echo starts a transport that answers every request
+func echo(t *testing.T, tr *Transport) chan *Message {
+	received := make(chan *Message, 8)
+	tr.Handler = func(m *Message) {
+		received <- m
+		if len(m.Msg.Req.Method) > 0 {
+			resp := response(&m.Msg)
+			if err := tr.Respond(&resp); err != nil {
+				t.Errorf("Respond: %v", err)
+			}
+		}
+	}
+	return received
+}
+
+func wait(t *testing.T, ch chan *Message) *Message {
+	t.Helper()
+	select {
+	case m := <-ch:
+		return m
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Nothing received")
+	}
+	return nil
+}
+
+func Test_transport_Udp(t *testing.T) {
+
+	server, client := New(), New()
+	defer server.Close()
+	defer client.Close()
+	requests := echo(t, server)
+	responses := make(chan *Message, 8)
+	client.Handler = func(m *Message) { responses <- m }
+
+	saddr, err := server.ListenUDP("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenUDP: %v", err)
+	}
+	caddr, _ := client.ListenUDP("127.0.0.1:0")
+
+	// The sent-by is wrong, as it would be behind a NAT
+	req := request("UDP", "192.0.2.1:5999", "z9hG4bKudp", 0)
+	if err := client.SendRequest("udp", saddr.String(), &req); err != nil {
+		t.Fatalf("SendRequest: %v", err)
+	}
+
+	got := wait(t, requests)
+	via := got.Msg.Via[0]
+	if string(via.Rcvd) != "127.0.0.1" || string(via.Rport) != strconv.Itoa(int(caddr.Port())) {
+		t.Errorf("Via received %q rport %q", via.Rcvd, via.Rport)
+	}
+	if got.Tuple.Src != caddr || got.Tuple.Proto != "udp" {
+		t.Errorf("Tuple %v", got.Tuple)
+	}
+
+	resp := wait(t, responses)
+	if string(resp.Msg.Req.StatusCode) != "200" || string(resp.Msg.CallId.Value) != "z9hG4bKudp" {
+		t.Errorf("Response %q %q", resp.Msg.Req.StatusCode, resp.Msg.CallId.Value)
+	}
+}
+
+func testStream(t *testing.T, proto string, server, client *Transport) {
+	requests := echo(t, server)
+	responses := make(chan *Message, 8)
+	client.Handler = func(m *Message) { responses <- m }
+
+	listen := server.ListenTCP
+	if proto == PROTO_TLS {
+		listen = server.ListenTLS
+	}
+	saddr, err := listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+
+	for i, branch := range []string{"z9hG4bK1", "z9hG4bK2"} {
+		// No rport, the response must use the connection regardless
+		req := request(strings.ToUpper(proto), "client.invalid:5999", branch, 0)
+		req.Via[0].Src = []byte("SIP/2.0/" + proto + " client.invalid:5999;branch=" + branch)
+		if err := client.SendRequest(proto, saddr.String(), &req); err != nil {
+			t.Fatalf("SendRequest: %v", err)
+		}
+		got := wait(t, requests)
+		if got.Tuple.Proto != proto || string(got.Msg.Via[0].Rcvd) != "127.0.0.1" {
+			t.Errorf("Request %d tuple %v received %q", i, got.Tuple, got.Msg.Via[0].Rcvd)
+		}
+		resp := wait(t, responses)
+		if string(resp.Msg.CallId.Value) != branch {
+			t.Errorf("Response Call-ID %q", resp.Msg.CallId.Value)
+		}
+	}
+
+	// A single connection is used both ways
+	if client.Conns() != 1 || server.Conns() != 1 {
+		t.Errorf("Connections client %d server %d", client.Conns(), server.Conns())
+	}
+}
+
+func Test_transport_Tcp(t *testing.T) {
+
+	server, client := New(), New()
+	defer server.Close()
+	defer client.Close()
+	testStream(t, PROTO_TCP, server, client)
+}
+
+func Test_transport_Tls(t *testing.T) {
+
+	cert, pool := testCert(t)
+	server, client := New(), New()
+	defer server.Close()
+	defer client.Close()
+	server.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	client.TLSConfig = &tls.Config{RootCAs: pool, ServerName: "sip.test"}
+	testStream(t, PROTO_TLS, server, client)
+}
+
+func Test_transport_Mtu(t *testing.T) {
+
+	server, client := New(), New()
+	defer server.Close()
+	defer client.Close()
+	requests := echo(t, server)
+	client.Handler = func(m *Message) {}
+
+	// TCP and UDP on the same port
+	taddr, err := server.ListenTCP("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenTCP: %v", err)
+	}
+	if _, err := server.ListenUDP(taddr.String()); err != nil {
+		t.Skipf("Port taken: %v", err)
+	}
+
+	// Small enough for UDP
+	req := request("UDP", "127.0.0.1:5999", "z9hG4bKsmall", 100)
+	client.SendRequest("udp", taddr.String(), &req)
+	if got := wait(t, requests); got.Tuple.Proto != "udp" {
+		t.Errorf("Small request sent over %s", got.Tuple.Proto)
+	}
+
+	// Over 1300 bytes goes over TCP with the Via changed
+	req = request("UDP", "127.0.0.1:5999", "z9hG4bKlarge", 1400)
+	if err := client.SendRequest("udp", taddr.String(), &req); err != nil {
+		t.Fatalf("SendRequest: %v", err)
+	}
+	got := wait(t, requests)
+	if got.Tuple.Proto != "tcp" || got.Msg.Via[0].Trans != "tcp" || len(got.Msg.Body) != 1400 {
+		t.Errorf("Large request sent over %s with Via %s and %d bytes", got.Tuple.Proto, got.Msg.Via[0].Trans, len(got.Msg.Body))
+	}
+
+	// Without a TCP listener UDP is used after all
+	udpOnly := New()
+	defer udpOnly.Close()
+	udpRequests := echo(t, udpOnly)
+	uaddr, _ := udpOnly.ListenUDP("127.0.0.1:0")
+	req = request("UDP", "127.0.0.1:5999", "z9hG4bKretry", 1400)
+	if err := client.SendRequest("udp", uaddr.String(), &req); err != nil {
+		t.Fatalf("SendRequest: %v", err)
+	}
+	if got := wait(t, udpRequests); got.Tuple.Proto != "udp" || got.Msg.Via[0].Trans != "udp" {
+		t.Errorf("Retry sent over %s with Via %s", got.Tuple.Proto, got.Msg.Via[0].Trans)
+	}
+}
+
+func Test_transport_ResponseAddr(t *testing.T) {
+
+	tests := []struct {
+		via   string
+		proto string
+		addr  string
+	}{
+		{"SIP/2.0/UDP 10.0.0.1:5070;branch=z9hG4bK1", "udp", "10.0.0.1:5070"},
+		{"SIP/2.0/UDP host.example.com;received=192.0.2.1;rport=4000;branch=z9hG4bK1", "udp", "192.0.2.1:4000"},
+		{"SIP/2.0/UDP 10.0.0.1;maddr=239.1.1.1;ttl=1;branch=z9hG4bK1", "udp", "239.1.1.1:5060"},
+		{"SIP/2.0/TLS host.example.com;branch=z9hG4bK1", "tls", "host.example.com:5061"},
+		{"SIP/2.0/TCP [2001:db8::1]:5080;received=2001:db8::2;branch=z9hG4bK1", "tcp", "[2001:db8::2]:5080"},
+	}
+	for _, tc := range tests {
+		msg := siprocket.Parse([]byte("SIP/2.0 200 OK\r\nVia: " + tc.via + "\r\n\r\n"))
+		proto, addr, err := ResponseAddr(&msg)
+		if err != nil || proto != tc.proto || addr != tc.addr {
+			t.Errorf("Mismatch %s:\nExpected:\n%s %s\nGot:\n%s %s %v", tc.via, tc.proto, tc.addr, proto, addr, err)
+		}
+	}
+
+	// A built response has the transport in lower case too
+	req, _ := siprocket.NewRequest("OPTIONS", "sip:bob@biloxi.com").Via("UDP", "10.0.0.1", "5070").From("<sip:alice@atlanta.com>").Build()
+	resp, _ := siprocket.NewResponse(&req, 200, "").Build()
+	if proto, addr, err := ResponseAddr(&resp); err != nil || proto != PROTO_UDP || addr != "10.0.0.1:5070" {
+		t.Errorf("Mismatch:\nExpected:\nudp 10.0.0.1:5070\nGot:\n%s %s %v", proto, addr, err)
+	}
+}
+
+// testCert makes a self signed certificate for sip.test
+func testCert(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "sip.test"},
+		DNSNames:              []string{"sip.test"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("CreateCertificate: %v", err)
+	}
+	leaf, _ := x509.ParseCertificate(der)
+	pool := x509.NewCertPool()
+	pool.AddCert(leaf)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, pool
+}
+
+func Test_transport_SetReceived(t *testing.T) {
+
+	// Only the received parameter is added, the others stay as they were
+	msg := siprocket.ParseLossless([]byte("OPTIONS sip:bob@10.0.0.1 SIP/2.0\r\n" +
+		"Via: SIP/2.0/UDP a.example.com;branch=z9hG4bK1;alias;keep\r\n" +
+		"Via: SIP/2.0/UDP b.example.com;branch=z9hG4bK2\r\n" +
+		"Content-Length: 0\r\n\r\n"))
+	SetReceived(&msg, netip.MustParseAddrPort("9.9.9.9:5060"))
+	exp := "OPTIONS sip:bob@10.0.0.1 SIP/2.0\r\n" +
+		"Via: SIP/2.0/UDP a.example.com;branch=z9hG4bK1;alias;keep;received=9.9.9.9\r\n" +
+		"Via: SIP/2.0/UDP b.example.com;branch=z9hG4bK2\r\n" +
+		"Content-Length: 0\r\n\r\n"
+	if out := siprocket.MarshalLossless(&msg); out != exp {
+		t.Errorf("Mismatch:\nExpected:\n%q\nGot:\n%q", exp, out)
+	}
+
+	setViaTransport(&msg, PROTO_TCP)
+	exp = strings.Replace(exp, "SIP/2.0/UDP a.example.com", "SIP/2.0/TCP a.example.com", 1)
+	if out := siprocket.MarshalLossless(&msg); out != exp {
+		t.Errorf("Mismatch:\nExpected:\n%q\nGot:\n%q", exp, out)
+	}
+}
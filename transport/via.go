@@ -0,0 +1,97 @@
+package transport
+
+import (
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"github.com/nullboundary/siprocket"
+)
+
+/*
+ RFC 3581 - https://www.ietf.org/rfc/rfc3581.txt - 4. Server Behavior
+
+   When a server compliant to this specification (which can be a proxy
+   or UAS) receives a request, it examines the topmost Via header field
+   value.  If this Via header field value contains an "rport" parameter
+   with no value, it MUST set the value of the parameter to the source
+   port of the request.  This is analogous to the way in which a server
+   will insert the "received" parameter into the topmost Via header
+   field value.  In fact, the server MUST insert a "received" parameter
+   containing the source IP address that the request came from, even if
+   it is identical to the value of the "sent-by" component.
+
+ RFC 3261 - https://www.ietf.org/rfc/rfc3261.txt - 18.2.2 Sending Responses
+
+   If the "sent-protocol" is a reliable transport protocol such as TCP or
+   SCTP, or TLS over those, the response MUST be sent using the existing
+   connection to the source of the original request that created the
+   transaction, if that connection is still open. Otherwise, if the Via
+   header field value contains a "maddr" parameter, the response MUST be
+   forwarded to the address listed there. Otherwise, if it is a receiver-
+   tagged field, the response MUST be sent to the address in the
+   "received" parameter. Otherwise the response MUST be sent to the
+   address indicated by the "sent-by" value.
+
+*/
+
+// SetReceived completes the top Via of a request received from src
+func SetReceived(req *siprocket.SipMsg, src netip.AddrPort) {
+	if len(req.Via) == 0 {
+		return
+	}
+	via := req.Via[0]
+	ip := src.Addr().String()
+	if via.HasRport() {
+		via.SetParam("rport", strconv.Itoa(int(src.Port())))
+		via.SetParam("received", ip)
+		req.SetTopVia(via)
+		return
+	}
+	if host, err := netip.ParseAddr(strings.Trim(string(via.Host), "[]")); err != nil || host.Unmap() != src.Addr() {
+		via.SetParam("received", ip)
+		req.SetTopVia(via)
+	}
+}
+
+// ResponseAddr gives the transport and the address, as host and port, a
+// response is sent to according to its top Via
+func ResponseAddr(resp *siprocket.SipMsg) (string, string, error) {
+	if len(resp.Via) == 0 {
+		return "", "", ErrNoVia
+	}
+	via := &resp.Via[0]
+	proto := via.Trans
+	if proto == "" {
+		proto = PROTO_UDP
+	}
+
+	port := string(via.Port)
+	if port == "" {
+		switch proto {
+		case PROTO_TLS:
+			port = "5061"
+		case PROTO_WS:
+			port = "80"
+		case PROTO_WSS:
+			port = "443"
+		default:
+			port = "5060"
+		}
+	}
+	host := strings.Trim(string(via.Host), "[]")
+	reliable := proto != PROTO_UDP
+	switch {
+	case !reliable && len(via.Maddr) > 0:
+		host = string(via.Maddr)
+	case len(via.Rcvd) > 0:
+		host = strings.Trim(string(via.Rcvd), "[]")
+	}
+	// The port the request came from is used for a connection too, it
+	// finds the connection still open
+	if len(via.Rport) > 0 && (len(via.Maddr) == 0 || reliable) {
+		port = string(via.Rport)
+	}
+	return proto, net.JoinHostPort(host, port), nil
+}
@@ -0,0 +1,336 @@
+package transport
+
+/*
+ RFC 6455 - https://www.ietf.org/rfc/rfc6455.txt - 5.2 Base Framing Protocol
+
+    0                   1                   2                   3
+    0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1
+   +-+-+-+-+-------+-+-------------+-------------------------------+
+   |F|R|R|R| opcode|M| Payload len |    Extended payload length    |
+   |I|S|S|S|  (4)  |A|     (7)     |             (16/64)           |
+   |N|V|V|V|       |S|             |   (if payload len==126/127)   |
+   | |1|2|3|       |K|             |                               |
+   +-+-+-+-+-------+-+-------------+ - - - - - - - - - - - - - - - +
+   |     Extended payload length continued, if payload len == 127  |
+   + - - - - - - - - - - - - - - - +-------------------------------+
+   |                               |Masking-key, if MASK set to 1  |
+   +-------------------------------+-------------------------------+
+
+ RFC 7118 - https://www.ietf.org/rfc/rfc7118.txt - 4. The WebSocket SIP Subprotocol
+
+   The WebSocket client and server negotiate the "sip" subprotocol in
+   the handshake. Each SIP message is carried whole in one WebSocket
+   message, text or binary, so no Content-Length framing is needed.
+
+   A client that cannot be reached directly uses a random host in the
+   ".invalid" domain in its Via and Contact, requests for it are sent
+   over the connection it opened.
+
+*/
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+)
+
+// WebSocket opcodes
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xa
+)
+
+const (
+	wsGuid        = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+	wsSubprotocol = "sip"
+	wsMaxMessage  = 1 << 20
+)
+
+var (
+	ErrHandshake = errors.New("transport: WebSocket handshake failed")
+	errWsFrame   = errors.New("transport: invalid WebSocket frame")
+	errWsClosed  = errors.New("transport: WebSocket closed")
+)
+
+// wsConn frames messages over an upgraded connection
+type wsConn struct {
+	conn   net.Conn
+	br     *bufio.Reader
+	client bool // Clients mask what they send, servers expect it
+	mu     sync.Mutex
+}
+
+// readMessage returns the next text or binary message, answering pings
+// on the way
+func (w *wsConn) readMessage() ([]byte, error) {
+	var msg []byte
+	started := false
+	for {
+		fin, op, payload, err := w.readFrame()
+		if err != nil {
+			return nil, err
+		}
+		switch op {
+		case wsPing:
+			if err := w.writeFrame(wsPong, payload); err != nil {
+				return nil, err
+			}
+			continue
+		case wsPong:
+			continue
+		case wsClose:
+			w.writeFrame(wsClose, payload)
+			return nil, errWsClosed
+		case wsText, wsBinary:
+			if started {
+				return nil, errWsFrame
+			}
+			started = true
+		case wsContinuation:
+			if !started {
+				return nil, errWsFrame
+			}
+		default:
+			return nil, errWsFrame
+		}
+		if len(msg)+len(payload) > wsMaxMessage {
+			return nil, errWsFrame
+		}
+		msg = append(msg, payload...)
+		if fin {
+			return msg, nil
+		}
+	}
+}
+
+func (w *wsConn) readFrame() (bool, byte, []byte, error) {
+	var hdr [14]byte
+	if _, err := io.ReadFull(w.br, hdr[:2]); err != nil {
+		return false, 0, nil, err
+	}
+	fin := hdr[0]&0x80 != 0
+	op := hdr[0] & 0x0f
+	masked := hdr[1]&0x80 != 0
+	if hdr[0]&0x70 != 0 || masked == w.client {
+		// No extensions are negotiated and only clients mask
+		return false, 0, nil, errWsFrame
+	}
+
+	size := uint64(hdr[1] & 0x7f)
+	switch size {
+	case 126:
+		if _, err := io.ReadFull(w.br, hdr[2:4]); err != nil {
+			return false, 0, nil, err
+		}
+		size = uint64(binary.BigEndian.Uint16(hdr[2:4]))
+	case 127:
+		if _, err := io.ReadFull(w.br, hdr[2:10]); err != nil {
+			return false, 0, nil, err
+		}
+		size = binary.BigEndian.Uint64(hdr[2:10])
+	}
+	if size > wsMaxMessage || op >= wsClose && (size > 125 || !fin) {
+		return false, 0, nil, errWsFrame
+	}
+
+	var mask [4]byte
+	if masked {
+		if _, err := io.ReadFull(w.br, mask[:]); err != nil {
+			return false, 0, nil, err
+		}
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(w.br, payload); err != nil {
+		return false, 0, nil, err
+	}
+	if masked {
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+	}
+	return fin, op, payload, nil
+}
+
+// writeFrame sends a single frame, safe for concurrent use
+func (w *wsConn) writeFrame(op byte, payload []byte) error {
+	b := make([]byte, 0, 14+len(payload))
+	b = append(b, 0x80|op)
+	maskBit := byte(0)
+	if w.client {
+		maskBit = 0x80
+	}
+	switch {
+	case len(payload) < 126:
+		b = append(b, maskBit|byte(len(payload)))
+	case len(payload) <= 0xffff:
+		b = append(b, maskBit|126)
+		b = binary.BigEndian.AppendUint16(b, uint16(len(payload)))
+	default:
+		b = append(b, maskBit|127)
+		b = binary.BigEndian.AppendUint64(b, uint64(len(payload)))
+	}
+	if w.client {
+		var mask [4]byte
+		rand.Read(mask[:])
+		b = append(b, mask[:]...)
+		for i, c := range payload {
+			b = append(b, c^mask[i%4])
+		}
+	} else {
+		b = append(b, payload...)
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	_, err := w.conn.Write(b)
+	return err
+}
+
+func wsAccept(key string) string {
+	h := sha1.Sum([]byte(key + wsGuid))
+	return base64.StdEncoding.EncodeToString(h[:])
+}
+
+// headerHas tells if a comma separated header holds the token
+func headerHas(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// WebSocketHandler upgrades HTTP requests to SIP over WebSocket, it can
+// be mounted on any path of an http.Server. Connections that came over
+// TLS are WSS.
+func (t *Transport) WebSocketHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Sec-WebSocket-Key")
+		if r.Method != http.MethodGet || !headerHas(r.Header, "Connection", "upgrade") ||
+			!headerHas(r.Header, "Upgrade", "websocket") || key == "" {
+			http.Error(w, "WebSocket upgrade expected", http.StatusBadRequest)
+			return
+		}
+		if r.Header.Get("Sec-WebSocket-Version") != "13" {
+			w.Header().Set("Sec-WebSocket-Version", "13")
+			http.Error(w, "Unsupported WebSocket version", http.StatusUpgradeRequired)
+			return
+		}
+		if !headerHas(r.Header, "Sec-WebSocket-Protocol", wsSubprotocol) {
+			http.Error(w, "The sip subprotocol is required", http.StatusBadRequest)
+			return
+		}
+		hj, ok := w.(http.Hijacker)
+		if !ok {
+			http.Error(w, "Cannot upgrade", http.StatusInternalServerError)
+			return
+		}
+		conn, brw, err := hj.Hijack()
+		if err != nil {
+			return
+		}
+
+		resp := "HTTP/1.1 101 Switching Protocols\r\n" +
+			"Upgrade: websocket\r\n" +
+			"Connection: Upgrade\r\n" +
+			"Sec-WebSocket-Accept: " + wsAccept(key) + "\r\n" +
+			"Sec-WebSocket-Protocol: " + wsSubprotocol + "\r\n\r\n"
+		if _, err := conn.Write([]byte(resp)); err != nil {
+			conn.Close()
+			return
+		}
+		proto := PROTO_WS
+		if r.TLS != nil {
+			proto = PROTO_WSS
+		}
+		t.add(conn, proto, &wsConn{conn: conn, br: brw.Reader})
+	})
+}
+
+// ListenWS serves WebSocket upgrades on addr
+func (t *Transport) ListenWS(addr string) (netip.AddrPort, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	return t.serveHttp(l)
+}
+
+// ListenWSS serves WebSocket upgrades over TLS on addr using TLSConfig
+func (t *Transport) ListenWSS(addr string) (netip.AddrPort, error) {
+	if t.TLSConfig == nil {
+		return netip.AddrPort{}, ErrNoTLS
+	}
+	l, err := tls.Listen("tcp", addr, t.TLSConfig)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	return t.serveHttp(l)
+}
+
+func (t *Transport) serveHttp(l net.Listener) (netip.AddrPort, error) {
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		l.Close()
+		return netip.AddrPort{}, ErrClosed
+	}
+	t.listeners = append(t.listeners, l)
+	t.wg.Add(1)
+	t.mu.Unlock()
+
+	go func() {
+		defer t.wg.Done()
+		srv := &http.Server{Handler: t.WebSocketHandler()}
+		srv.Serve(l)
+	}()
+	return addrPort(l.Addr()), nil
+}
+
+// dialWS opens a connection and performs the client handshake
+func (t *Transport) dialWS(conn net.Conn, host string) (*wsConn, error) {
+	var key [16]byte
+	rand.Read(key[:])
+	k := base64.StdEncoding.EncodeToString(key[:])
+
+	req := "GET / HTTP/1.1\r\n" +
+		"Host: " + host + "\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: " + k + "\r\n" +
+		"Sec-WebSocket-Version: 13\r\n" +
+		"Sec-WebSocket-Protocol: " + wsSubprotocol + "\r\n\r\n"
+	if _, err := conn.Write([]byte(req)); err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, &http.Request{Method: http.MethodGet})
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols ||
+		resp.Header.Get("Sec-WebSocket-Accept") != wsAccept(k) ||
+		!strings.EqualFold(resp.Header.Get("Sec-WebSocket-Protocol"), wsSubprotocol) {
+		return nil, ErrHandshake
+	}
+	return &wsConn{conn: conn, br: br, client: true}, nil
+}
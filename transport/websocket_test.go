@@ -0,0 +1,168 @@
+package transport
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nullboundary/siprocket"
+)
+
+func wsRequest(trans, branch string) siprocket.SipMsg {
+	raw := "REGISTER sip:example.com SIP/2.0\r\n" +
+		"Via: SIP/2.0/" + trans + " df7jal23ls0d.invalid;branch=" + branch + "\r\n" +
+		"From: <sip:alice@example.com>;tag=a1\r\n" +
+		"To: <sip:alice@example.com>\r\n" +
+		"Contact: <sip:alice@df7jal23ls0d.invalid;transport=ws>\r\n" +
+		"Call-ID: " + branch + "\r\n" +
+		"CSeq: 1 REGISTER\r\n" +
+		"Content-Length: 0\r\n\r\n"
+	return siprocket.Parse([]byte(raw))
+}
+
+func testWebSocket(t *testing.T, proto string, srv *httptest.Server, server, client *Transport) {
+	requests := echo(t, server)
+	received := make(chan *Message, 8)
+	client.Handler = func(m *Message) { received <- m }
+	addr := srv.Listener.Addr().String()
+
+	req := wsRequest(strings.ToUpper(proto), "z9hG4bKws1")
+	if err := client.SendRequest(proto, addr, &req); err != nil {
+		t.Fatalf("SendRequest: %v", err)
+	}
+	got := wait(t, requests)
+	if got.Tuple.Proto != proto || string(got.Msg.Via[0].Rcvd) != "127.0.0.1" {
+		t.Errorf("Tuple %v received %q", got.Tuple, got.Msg.Via[0].Rcvd)
+	}
+	resp := wait(t, received)
+	if string(resp.Msg.Req.StatusCode) != "200" || resp.Tuple.Proto != proto {
+		t.Errorf("Response %q over %s", resp.Msg.Req.StatusCode, resp.Tuple.Proto)
+	}
+
+	// A request to the client by the .invalid host of its Contact
+	notify := "OPTIONS sip:alice@df7jal23ls0d.invalid;transport=ws SIP/2.0\r\n" +
+		"Call-ID: from-server\r\nContent-Length: 0\r\n\r\n"
+	if err := server.SendRaw(proto, "df7jal23ls0d.invalid", []byte(notify)); err != nil {
+		t.Fatalf("SendRaw: %v", err)
+	}
+	if got := wait(t, received); string(got.Msg.CallId.Value) != "from-server" {
+		t.Errorf("Call-ID %q", got.Msg.CallId.Value)
+	}
+	if err := server.SendRaw(proto, "unknown.invalid", []byte(notify)); err != ErrNoConn {
+		t.Errorf("Expected ErrNoConn, got %v", err)
+	}
+	if client.Conns() != 1 || server.Conns() != 1 {
+		t.Errorf("Connections client %d server %d", client.Conns(), server.Conns())
+	}
+}
+
+func Test_websocket_Ws(t *testing.T) {
+
+	server, client := New(), New()
+	defer server.Close()
+	defer client.Close()
+	srv := httptest.NewServer(server.WebSocketHandler())
+	defer srv.Close()
+	testWebSocket(t, PROTO_WS, srv, server, client)
+}
+
+func Test_websocket_Wss(t *testing.T) {
+
+	server, client := New(), New()
+	defer server.Close()
+	defer client.Close()
+	srv := httptest.NewTLSServer(server.WebSocketHandler())
+	defer srv.Close()
+	client.TLSConfig = srv.Client().Transport.(*http.Transport).TLSClientConfig
+	testWebSocket(t, PROTO_WSS, srv, server, client)
+}
+
+func Test_websocket_Subprotocol(t *testing.T) {
+
+	server := New()
+	defer server.Close()
+	srv := httptest.NewServer(server.WebSocketHandler())
+	defer srv.Close()
+
+	req, _ := http.NewRequest("GET", srv.URL, nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Protocol", "chat")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Do: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Status %d", resp.StatusCode)
+	}
+
+	if got := wsAccept("dGhlIHNhbXBsZSBub25jZQ=="); got != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Errorf("Accept %q", got)
+	}
+}
+
+func Test_websocket_Frames(t *testing.T) {
+
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	client := &wsConn{conn: a, br: bufio.NewReader(a), client: true}
+	server := &wsConn{conn: b, br: bufio.NewReader(b)}
+
+	// A message in two fragments with a ping between them
+	go func() {
+		frames := [][]byte{
+			maskedFrame(wsText, false, "OPTIONS sip:a@b "),
+			maskedFrame(wsPing, true, "hi"),
+			maskedFrame(wsContinuation, true, "SIP/2.0\r\n\r\n"),
+		}
+		for _, f := range frames {
+			a.Write(f)
+		}
+	}()
+
+	pong := make(chan []byte, 1)
+	go func() {
+		_, op, payload, err := client.readFrame()
+		if err == nil && op == wsPong {
+			pong <- payload
+		}
+	}()
+
+	msg, err := server.readMessage()
+	if err != nil || string(msg) != "OPTIONS sip:a@b SIP/2.0\r\n\r\n" {
+		t.Errorf("Message %q: %v", msg, err)
+	}
+	select {
+	case p := <-pong:
+		if string(p) != "hi" {
+			t.Errorf("Pong %q", p)
+		}
+	case <-time.After(2 * time.Second):
+		t.Errorf("No pong")
+	}
+
+	// An unmasked frame from a client is refused
+	go a.Write([]byte{0x81, 0x01, 'x'})
+	if _, err := server.readMessage(); err != errWsFrame {
+		t.Errorf("Expected errWsFrame, got %v", err)
+	}
+}
+
+func maskedFrame(op byte, fin bool, payload string) []byte {
+	b := []byte{op, 0x80 | byte(len(payload)), 1, 2, 3, 4}
+	if fin {
+		b[0] |= 0x80
+	}
+	for i := 0; i < len(payload); i++ {
+		b = append(b, payload[i]^b[2+i%4])
+	}
+	return b
+}
@@ -0,0 +1,653 @@
+package ua
+
+/*
+ RFC 3261 - https://www.ietf.org/rfc/rfc3261.txt - 13.3.1.4 The INVITE is Accepted
+
+   The 2xx response is passed to the transport with an interval that
+   starts at T1 seconds and doubles for each retransmission until it
+   reaches T2 seconds.  Response retransmissions cease when an ACK
+   request for the response is received.
+
+   If the server retransmits the 2xx response for 64*T1 seconds without
+   receiving an ACK, the dialog is confirmed, but the session SHOULD be
+   terminated.  This is accomplished with a BYE, as described in Section
+   15.
+
+ 12.2.1.1 Generating the Request
+
+   The URI in the To field of the request MUST be set to the remote URI
+   from the dialog state.  The tag in the To header field of the request
+   MUST be set to the remote tag of the dialog ID.  The From URI of the
+   request MUST be set to the local URI from the dialog state.  The tag
+   in the From header field of the request MUST be set to the local tag
+   of the dialog ID.
+
+ A re-INVITE or UPDATE received with an offer is answered with the
+ session description the UA last sent. A REFER is accepted with 202 and
+ given on Events, acting on it is left to the caller.
+
+*/
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nullboundary/siprocket"
+	"github.com/nullboundary/siprocket/transaction"
+)
+
+// Call states
+const (
+	CALL_EARLY      = "early"      // The INVITE has no final response yet
+	CALL_ANSWERED   = "answered"   // A 2xx was sent and awaits its ACK
+	CALL_CONFIRMED  = "confirmed"  // The dialog is established
+	CALL_TERMINATED = "terminated" // The call is over
+)
+
+// Event types
+const (
+	EVENT_PROGRESS   = "progress"   // Provisional response to the INVITE
+	EVENT_ANSWERED   = "answered"   // 2xx to the INVITE, the ACK is sent
+	EVENT_CONFIRMED  = "confirmed"  // ACK of the 2xx sent by the UA
+	EVENT_CANCELLED  = "cancelled"  // CANCEL of the INVITE received
+	EVENT_REINVITE   = "reinvite"   // re-INVITE received and answered
+	EVENT_UPDATE     = "update"     // UPDATE received and answered
+	EVENT_INFO       = "info"       // INFO received
+	EVENT_REFER      = "refer"      // REFER received and accepted
+	EVENT_NOTIFY     = "notify"     // NOTIFY received
+	EVENT_BYE        = "bye"        // BYE received
+	EVENT_TERMINATED = "terminated" // The call ended, always the last event
+)
+
+// CONTENT_SDP is the content type of session descriptions
+const CONTENT_SDP = "application/sdp"
+
+// allowMethods are the methods the UA handles within a dialog
+var allowMethods = []string{"INVITE", "ACK", "CANCEL", "BYE", "UPDATE", "INFO", "REFER", "NOTIFY", "OPTIONS"}
+
+// Event is something that happened to a call, Msg is the message behind it
+type Event struct {
+	Type string
+	Msg  *siprocket.SipMsg
+}
+
+// dialogKey finds the call of a message, section 12
+type dialogKey struct {
+	callId   string
+	localTag string
+}
+
+// Call is a call placed or answered by a UA, with its dialog once it has
+// one. It is safe for concurrent use.
+type Call struct {
+	Events chan Event // Events of the call, read them or they are dropped
+
+	ua       *UA
+	key      dialogKey
+	incoming bool
+
+	mu        sync.Mutex
+	state     string
+	invite    *siprocket.SipMsg // Initial INVITE
+	srv       *transaction.Server
+	local     siprocket.SipFrom
+	remote    siprocket.SipTo
+	localSeq  int
+	remoteSeq int
+	target    siprocket.SipContact // Remote target
+	routes    []siprocket.SipRoute
+	localSdp  []byte
+	remoteSdp []byte
+
+	answer   *siprocket.SipMsg // 2xx sent and retransmitted until ACK
+	resend   transaction.Timer
+	interval time.Duration
+	sent     time.Time
+	lastAck  *siprocket.SipMsg // ACK sent for the last 2xx received
+}
+
+// newCall creates the call of an INVITE sent by u, or received in the
+// server transaction srv
+func newCall(u *UA, invite *siprocket.SipMsg, srv *transaction.Server) *Call {
+	c := &Call{
+		Events:   make(chan Event, CALL_BUFFER),
+		ua:       u,
+		incoming: srv != nil,
+		state:    CALL_EARLY,
+		invite:   invite,
+		srv:      srv,
+	}
+	seq, _ := strconv.Atoi(string(invite.Cseq.Id))
+
+	if c.incoming {
+		c.local = siprocket.SipFrom(invite.To)
+		c.local.Tag = []byte(siprocket.NewTag())
+		c.remote = siprocket.SipTo(invite.From)
+		c.remoteSeq = seq
+		c.target = invite.Contact
+		c.routes = append([]siprocket.SipRoute(nil), invite.RecordRoute...)
+		c.remoteSdp = sdpBody(invite)
+	} else {
+		c.local = invite.From
+		c.remote = invite.To
+		c.localSeq = seq
+	}
+	c.local.Src = nil
+	c.remote.Src = nil
+	c.key = dialogKey{callId: string(invite.CallId.Value), localTag: string(c.local.Tag)}
+	u.addCall(c)
+	return c
+}
+
+// State returns one of the CALL_ constants
+func (c *Call) State() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.state
+}
+
+// Invite returns the initial INVITE of the call
+func (c *Call) Invite() *siprocket.SipMsg {
+	return c.invite
+}
+
+// LocalSdp returns the session description the UA last sent
+func (c *Call) LocalSdp() []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.localSdp
+}
+
+// RemoteSdp returns the session description the UA last received
+func (c *Call) RemoteSdp() []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.remoteSdp
+}
+
+// Progress sends a provisional response to an incoming call, with an
+// early session description when sdp is not nil
+func (c *Call) Progress(code int, sdp []byte) error {
+	if code < 101 || code > 199 {
+		return ErrState
+	}
+	return c.respondInvite(code, sdp)
+}
+
+// Answer accepts an incoming call with a session description. The 2xx is
+// sent again until its ACK arrives, which gives EVENT_CONFIRMED.
+func (c *Call) Answer(sdp []byte) error {
+	return c.respondInvite(200, sdp)
+}
+
+// Reject ends an incoming call with a final response other than 2xx
+func (c *Call) Reject(code int) error {
+	if code < 300 || code > 699 {
+		return ErrState
+	}
+	return c.respondInvite(code, nil)
+}
+
+// respondInvite sends a response to the initial INVITE of an incoming call
+func (c *Call) respondInvite(code int, sdp []byte) error {
+	c.mu.Lock()
+	if !c.incoming || c.state != CALL_EARLY {
+		c.mu.Unlock()
+		return ErrState
+	}
+	resp, err := c.response(c.invite, code, sdp)
+	if err != nil {
+		c.mu.Unlock()
+		return err
+	}
+	switch {
+	case code >= 300:
+		c.state = CALL_TERMINATED
+	case code >= 200:
+		c.state = CALL_ANSWERED
+		c.localSdp = sdp
+		c.retransmit(resp)
+	}
+	c.mu.Unlock()
+
+	err = c.srv.Respond(resp)
+	if code >= 300 {
+		c.ua.removeCall(c)
+		c.emit(EVENT_TERMINATED, resp)
+	}
+	return err
+}
+
+// Reinvite sends a re-INVITE with a new offer and takes the answer
+func (c *Call) Reinvite(sdp []byte) error {
+	req, err := c.newRequest("INVITE", CONTENT_SDP, sdp)
+	if err != nil {
+		return err
+	}
+	resp, err := c.send(req)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	c.localSdp = sdp
+	c.refresh(resp)
+	ack, err := siprocket.NewAck(req, resp).Build()
+	if err == nil {
+		// The route set is that of the dialog, not of the 2xx
+		ack.Route = append([]siprocket.SipRoute(nil), c.routes...)
+		c.lastAck = &ack
+	}
+	c.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return c.ua.sendAck(&ack)
+}
+
+// Update sends an UPDATE with a new offer and takes the answer, RFC 3311
+func (c *Call) Update(sdp []byte) error {
+	req, err := c.newRequest("UPDATE", CONTENT_SDP, sdp)
+	if err != nil {
+		return err
+	}
+	resp, err := c.send(req)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.localSdp = sdp
+	c.refresh(resp)
+	c.mu.Unlock()
+	return nil
+}
+
+// Info sends an INFO with a body, eg application/dtmf-relay
+func (c *Call) Info(contentType string, body []byte) error {
+	req, err := c.newRequest("INFO", contentType, body)
+	if err != nil {
+		return err
+	}
+	_, err = c.send(req)
+	return err
+}
+
+// Refer asks the remote party to call target, RFC 3515
+func (c *Call) Refer(target string) error {
+	req, err := c.newRequest("REFER", "", nil)
+	if err != nil {
+		return err
+	}
+	req.AddHeader("Refer-To", "<"+target+">")
+	_, err = c.send(req)
+	return err
+}
+
+// Bye ends the call, it is terminated whatever the response
+func (c *Call) Bye() error {
+	req, err := c.newRequest("BYE", "", nil)
+	if err != nil {
+		return err
+	}
+	_, err = c.send(req)
+	c.terminate(nil)
+	return err
+}
+
+// newRequest builds a request within the dialog, section 12.2.1.1
+func (c *Call) newRequest(method, contentType string, body []byte) (*siprocket.SipMsg, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.state != CALL_CONFIRMED && c.state != CALL_ANSWERED {
+		return nil, ErrState
+	}
+	c.localSeq++
+
+	u := c.ua
+	l, r := &c.local, &c.remote
+	b := siprocket.NewRequest(method, uri(c.target.UriType, c.target.User, c.target.Host, c.target.Port)).
+		From("<"+uri(l.UriType, l.User, l.Host, l.Port)+">").
+		FromTag(string(l.Tag)).
+		To("<"+uri(r.UriType, r.User, r.Host, r.Port)+">").
+		ToTag(string(r.Tag)).
+		CallId(c.key.callId).
+		Cseq(c.localSeq).
+		Via(u.proto(), u.Host, u.port()).
+		Contact(u.contact())
+	if body != nil {
+		b.Body(contentType, body)
+	}
+	req, err := b.Build()
+	if err != nil {
+		return nil, err
+	}
+	req.Route = append([]siprocket.SipRoute(nil), c.routes...)
+	return &req, nil
+}
+
+// send runs the client transaction of a request within the dialog
+func (c *Call) send(req *siprocket.SipMsg) (*siprocket.SipMsg, error) {
+	resp, err := c.ua.transact(req, nil)
+
+	// A retry with credentials used up a CSeq number
+	if seq, _ := strconv.Atoi(string(req.Cseq.Id)); seq > 0 {
+		c.mu.Lock()
+		if seq > c.localSeq {
+			c.localSeq = seq
+		}
+		c.mu.Unlock()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := responseError(resp); err != nil {
+		return resp, err
+	}
+	return resp, nil
+}
+
+// provisional handles a provisional response to the initial INVITE
+func (c *Call) provisional(resp *siprocket.SipMsg) {
+	if sdp := sdpBody(resp); sdp != nil {
+		c.mu.Lock()
+		c.remoteSdp = sdp
+		c.mu.Unlock()
+	}
+	c.emit(EVENT_PROGRESS, resp)
+}
+
+// answered handles the final response to the initial INVITE, a 2xx
+// establishes the dialog and is acknowledged
+func (c *Call) answered(resp *siprocket.SipMsg) error {
+	if err := responseError(resp); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	c.state = CALL_CONFIRMED
+	c.remote = resp.To
+	c.remote.Src = nil
+	c.routes = nil
+	for i := len(resp.RecordRoute) - 1; i >= 0; i-- {
+		c.routes = append(c.routes, resp.RecordRoute[i])
+	}
+	c.refresh(resp)
+	ack, err := siprocket.NewAck(c.invite, resp).Build()
+	if err == nil {
+		c.lastAck = &ack
+	}
+	c.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	c.emit(EVENT_ANSWERED, resp)
+	return c.ua.sendAck(&ack)
+}
+
+// resendAck acknowledges a retransmitted 2xx to an INVITE again
+func (c *Call) resendAck(resp *siprocket.SipMsg) {
+	code := statusCode(resp)
+	if code < 200 || code >= 300 || string(resp.Cseq.Method) != "INVITE" {
+		return
+	}
+	c.mu.Lock()
+	ack := c.lastAck
+	c.mu.Unlock()
+	if ack != nil && string(ack.Cseq.Id) == string(resp.Cseq.Id) {
+		c.ua.error(c.ua.sendAck(ack))
+	}
+}
+
+// ack handles the ACK of a 2xx sent by the UA
+func (c *Call) ack(req *siprocket.SipMsg) {
+	c.mu.Lock()
+	if c.answer == nil || string(c.answer.Cseq.Id) != string(req.Cseq.Id) {
+		c.mu.Unlock()
+		return
+	}
+	c.stopRetransmit()
+	if c.state == CALL_ANSWERED {
+		c.state = CALL_CONFIRMED
+	}
+	c.mu.Unlock()
+	c.emit(EVENT_CONFIRMED, req)
+}
+
+// cancelled ends an incoming call that has not been answered yet
+func (c *Call) cancelled(cancel *siprocket.SipMsg) {
+	c.mu.Lock()
+	if c.state != CALL_EARLY {
+		c.mu.Unlock()
+		return
+	}
+	c.state = CALL_TERMINATED
+	resp, err := c.response(c.invite, 487, nil)
+	c.mu.Unlock()
+
+	if err == nil {
+		c.ua.error(c.srv.Respond(resp))
+	}
+	c.ua.removeCall(c)
+	c.emit(EVENT_CANCELLED, cancel)
+	c.emit(EVENT_TERMINATED, cancel)
+}
+
+// request handles a request received within the dialog
+func (c *Call) request(req *siprocket.SipMsg, proto string) {
+	u := c.ua
+	method := string(req.Req.Method)
+	seq, _ := strconv.Atoi(string(req.Cseq.Id))
+
+	c.mu.Lock()
+	if c.state == CALL_TERMINATED {
+		c.mu.Unlock()
+		u.reply(req, proto, 481)
+		return
+	}
+	if c.remoteSeq > 0 && seq <= c.remoteSeq {
+		c.mu.Unlock()
+		u.reply(req, proto, 500)
+		return
+	}
+	c.remoteSeq = seq
+
+	code := 200
+	var sdp []byte
+	event := ""
+	switch method {
+	case "BYE":
+		event = EVENT_BYE
+	case "INVITE", "UPDATE":
+		if offer := sdpBody(req); offer != nil {
+			c.remoteSdp = offer
+			sdp = c.localSdp
+		}
+		c.refresh(req)
+		event = EVENT_UPDATE
+		if method == "INVITE" {
+			event = EVENT_REINVITE
+		}
+	case "INFO":
+		event = EVENT_INFO
+	case "REFER":
+		code = 202
+		event = EVENT_REFER
+	case "NOTIFY":
+		event = EVENT_NOTIFY
+	case "OPTIONS":
+	default:
+		code = 405
+	}
+	resp, err := c.response(req, code, sdp)
+	if err == nil && method == "INVITE" {
+		c.retransmit(resp)
+	}
+	c.mu.Unlock()
+	if err != nil {
+		u.error(err)
+		return
+	}
+
+	srv, err := u.server(req, proto)
+	if err != nil {
+		u.error(err)
+		return
+	}
+	u.error(srv.Respond(resp))
+	if event != "" {
+		c.emit(event, req)
+	}
+	if method == "BYE" {
+		c.terminate(req)
+	}
+}
+
+// response builds a response of the UA within the dialog, a 2xx to an
+// INVITE or UPDATE carries the Contact and sdp when it is not nil
+func (c *Call) response(req *siprocket.SipMsg, code int, sdp []byte) (*siprocket.SipMsg, error) {
+	b := siprocket.NewResponse(req, code, "")
+	if len(req.To.Tag) == 0 && code > 100 {
+		b.ToTag(string(c.local.Tag))
+	}
+	method := string(req.Req.Method)
+	if code < 300 && (method == "INVITE" || method == "UPDATE") {
+		b.Contact(c.ua.contact())
+		if method == "INVITE" {
+			b.Allow(allowMethods...)
+		}
+	}
+	if sdp != nil {
+		b.Body(CONTENT_SDP, sdp)
+	}
+	resp, err := b.Build()
+	if err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// refresh takes the remote target and answer of a message that may
+// update them, section 12.2.1.2
+func (c *Call) refresh(msg *siprocket.SipMsg) {
+	if len(msg.Contact.Host) > 0 {
+		c.target = msg.Contact
+	}
+	if len(msg.Req.StatusCode) > 0 {
+		if sdp := sdpBody(msg); sdp != nil {
+			c.remoteSdp = sdp
+		}
+	}
+}
+
+// retransmit starts sending a 2xx to an INVITE again until its ACK
+// arrives, section 13.3.1.4
+func (c *Call) retransmit(resp *siprocket.SipMsg) {
+	c.stopRetransmit()
+	c.answer = resp
+	c.interval = c.timers().T1
+	c.sent = c.clock().Now()
+	c.resend = c.clock().AfterFunc(c.interval, func() { c.retransmitted(resp) })
+}
+
+// retransmitted is the timer of the 2xx retransmissions
+func (c *Call) retransmitted(resp *siprocket.SipMsg) {
+	c.mu.Lock()
+	if c.answer != resp {
+		c.mu.Unlock()
+		return
+	}
+	t := c.timers()
+	if c.clock().Now().Sub(c.sent) >= 64*t.T1 {
+		// No ACK came, the session is ended
+		c.stopRetransmit()
+		if c.state == CALL_ANSWERED {
+			c.state = CALL_CONFIRMED
+		}
+		c.mu.Unlock()
+		go c.Bye()
+		return
+	}
+	c.interval *= 2
+	if c.interval > t.T2 {
+		c.interval = t.T2
+	}
+	c.resend = c.clock().AfterFunc(c.interval, func() { c.retransmitted(resp) })
+	c.mu.Unlock()
+
+	c.ua.error(c.ua.Transport.Respond(resp))
+}
+
+func (c *Call) stopRetransmit() {
+	if c.resend != nil {
+		c.resend.Stop()
+		c.resend = nil
+	}
+	c.answer = nil
+}
+
+// terminate ends the call, msg is the message that ended it or nil
+func (c *Call) terminate(msg *siprocket.SipMsg) {
+	c.mu.Lock()
+	if c.state == CALL_TERMINATED {
+		c.mu.Unlock()
+		return
+	}
+	c.state = CALL_TERMINATED
+	c.stopRetransmit()
+	c.mu.Unlock()
+
+	c.ua.removeCall(c)
+	c.emit(EVENT_TERMINATED, msg)
+}
+
+// emit gives an event on Events without waiting for a reader
+func (c *Call) emit(typ string, msg *siprocket.SipMsg) {
+	select {
+	case c.Events <- Event{Type: typ, Msg: msg}:
+	default:
+		c.ua.error(ErrOverflow)
+	}
+}
+
+func (c *Call) clock() transaction.Clock {
+	if c.ua.Clock == nil {
+		return transaction.SystemClock
+	}
+	return c.ua.Clock
+}
+
+func (c *Call) timers() transaction.Timers {
+	return c.ua.Timers.WithDefaults()
+}
+
+// uri renders a SIP URI from its parts
+func uri(uriType, user, host, port []byte) string {
+	var b strings.Builder
+	if len(uriType) > 0 {
+		b.Write(uriType)
+	} else {
+		b.WriteString("sip")
+	}
+	b.WriteByte(':')
+	if len(user) > 0 {
+		b.Write(user)
+		b.WriteByte('@')
+	}
+	b.Write(host)
+	if len(port) > 0 {
+		b.WriteByte(':')
+		b.Write(port)
+	}
+	return b.String()
+}
+
+// sdpBody returns the session description of a message, or nil
+func sdpBody(msg *siprocket.SipMsg) []byte {
+	if len(msg.Body) == 0 || !strings.EqualFold(strings.TrimSpace(string(msg.ContType.Value)), CONTENT_SDP) {
+		return nil
+	}
+	return msg.Body
+}
@@ -0,0 +1,193 @@
+package ua
+
+/*
+ RFC 2617 - https://www.ietf.org/rfc/rfc2617.txt - 3.2.2.1 Request-Digest
+
+   If the "qop" value is "auth" or "auth-int":
+
+      request-digest  = <"> < KD ( H(A1),     unq(nonce-value)
+                                          ":" nc-value
+                                          ":" unq(cnonce-value)
+                                          ":" unq(qop-value)
+                                          ":" H(A2)
+                                  ) <">
+
+   If the "qop" directive is not present (this construction is for
+   compatibility with RFC 2069):
+
+      request-digest  =
+                 <"> < KD ( H(A1), unq(nonce-value) ":" H(A2) ) >
+   <">
+
+      A1       = unq(username-value) ":" unq(realm-value) ":" passwd
+      A2       = Method ":" digest-uri-value
+
+ RFC 3261 - 22.3 Proxy-to-User Authentication
+
+   The Proxy-Authenticate and Proxy-Authorization header fields work
+   like WWW-Authenticate and Authorization, a 407 challenge is answered
+   with Proxy-Authorization.
+
+ MD5 and the SHA-256 of RFC 8760 are supported, with qop auth or none.
+
+*/
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"strings"
+
+	"github.com/nullboundary/siprocket"
+)
+
+// challenge is a parsed WWW-Authenticate or Proxy-Authenticate value
+type challenge struct {
+	realm     string
+	nonce     string
+	opaque    string
+	algorithm string
+	qop       string // auth when offered, empty otherwise
+}
+
+// authorize adds the credentials of the UA for the challenges of resp to
+// req. False is returned when no challenge could be answered.
+func (u *UA) authorize(req, resp *siprocket.SipMsg) bool {
+	username := u.Username
+	if username == "" {
+		username = u.User
+	}
+	uri := req.RequestUri()
+	method := string(req.Req.Method)
+
+	var creds []siprocket.SipAuth
+	challengeName := "WWW-Authenticate"
+	if statusCode(resp) == 407 {
+		challengeName = "Proxy-Authenticate"
+	}
+	for _, v := range resp.HeaderValues(challengeName) {
+		if ch, ok := parseChallenge(string(v)); ok {
+			creds = append(creds, credentials(ch, username, u.Password, method, uri, randomCnonce()))
+		}
+	}
+	if len(creds) == 0 {
+		return false
+	}
+
+	// Authorization has a typed field that holds one value
+	if statusCode(resp) == 401 {
+		req.Auth = creds[0]
+		req.MarkDirty(siprocket.HEADER_AUTHORIZATION)
+		return true
+	}
+	req.RemoveHeader("Proxy-Authorization")
+	for i := range creds {
+		line := siprocket.MarshalSipAuth(&creds[i])
+		line = strings.TrimPrefix(strings.TrimSuffix(line, siprocket.ENDL), siprocket.HEADER_AUTHORIZATION+": ")
+		req.AddHeader("Proxy-Authorization", line)
+	}
+	return true
+}
+
+// parseChallenge parses a Digest challenge with an algorithm this package
+// supports
+func parseChallenge(v string) (challenge, bool) {
+	scheme, rest, _ := strings.Cut(strings.TrimSpace(v), " ")
+	if !strings.EqualFold(scheme, "Digest") {
+		return challenge{}, false
+	}
+
+	var ch challenge
+	for _, param := range splitParams(rest) {
+		key, val, _ := strings.Cut(param, "=")
+		val = strings.Trim(strings.TrimSpace(val), `"`)
+		switch strings.ToLower(strings.TrimSpace(key)) {
+		case "realm":
+			ch.realm = val
+		case "nonce":
+			ch.nonce = val
+		case "opaque":
+			ch.opaque = val
+		case "algorithm":
+			ch.algorithm = val
+		case "qop":
+			for _, q := range strings.Split(val, ",") {
+				if strings.EqualFold(strings.TrimSpace(q), "auth") {
+					ch.qop = "auth"
+				}
+			}
+		}
+	}
+	if ch.nonce == "" || digestHash(ch.algorithm) == nil {
+		return challenge{}, false
+	}
+	return ch, true
+}
+
+// splitParams splits auth params on the commas outside of quotes
+func splitParams(v string) []string {
+	var params []string
+	quoted := false
+	start := 0
+	for i := 0; i < len(v); i++ {
+		switch v[i] {
+		case '"':
+			quoted = !quoted
+		case ',':
+			if !quoted {
+				params = append(params, v[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(params, v[start:])
+}
+
+// credentials answers a challenge
+func credentials(ch challenge, username, password, method, uri, cnonce string) siprocket.SipAuth {
+	h := func(s string) string {
+		d := digestHash(ch.algorithm)
+		d.Write([]byte(s))
+		return hex.EncodeToString(d.Sum(nil))
+	}
+
+	ha1 := h(username + ":" + ch.realm + ":" + password)
+	ha2 := h(method + ":" + uri)
+	auth := siprocket.SipAuth{
+		Digest:   []byte("Digest"),
+		Username: []byte(username),
+		Realm:    []byte(ch.realm),
+		Nonce:    []byte(ch.nonce),
+		Uri:      []byte(uri),
+		Response: []byte(h(ha1 + ":" + ch.nonce + ":" + ha2)),
+	}
+	if ch.qop != "" {
+		auth.Qop = []byte(ch.qop)
+		auth.Nc = []byte("00000001")
+		auth.Cnonce = []byte(cnonce)
+		auth.Response = []byte(h(ha1 + ":" + ch.nonce + ":00000001:" + cnonce + ":" + ch.qop + ":" + ha2))
+	}
+	if ch.algorithm != "" {
+		auth.Algorithm = []byte(ch.algorithm)
+	}
+	if ch.opaque != "" {
+		auth.Opaque = []byte(ch.opaque)
+	}
+	return auth
+}
+
+// digestHash returns the hash of an algorithm, or nil when unsupported
+func digestHash(algorithm string) hash.Hash {
+	switch strings.ToUpper(algorithm) {
+	case "", "MD5":
+		return md5.New()
+	case "SHA-256":
+		return sha256.New()
+	}
+	return nil
+}
+
+func randomCnonce() string {
+	return strings.TrimPrefix(siprocket.NewBranch(), siprocket.BRANCH_MAGIC)
+}
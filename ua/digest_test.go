@@ -0,0 +1,46 @@
+package ua
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/nullboundary/siprocket"
+)
+
+func Test_digest_Credentials(t *testing.T) {
+
+	// The example of RFC 2617 section 3.5
+	ch, ok := parseChallenge(`Digest realm="testrealm@host.com", qop="auth,auth-int", nonce="dcd98b7102dd2f0e8b11d0f600bfb0c093", opaque="5ccc069c403ebaf9f0171e9517f40e41"`)
+	if !ok {
+		t.Fatalf("Challenge not parsed")
+	}
+	exp := challenge{
+		realm:  "testrealm@host.com",
+		nonce:  "dcd98b7102dd2f0e8b11d0f600bfb0c093",
+		opaque: "5ccc069c403ebaf9f0171e9517f40e41",
+		qop:    "auth",
+	}
+	if ch != exp {
+		t.Errorf("Mismatch:\nExpected:\n%+v\nGot:\n%+v", exp, ch)
+	}
+
+	auth := credentials(ch, "Mufasa", "Circle Of Life", "GET", "/dir/index.html", "0a4f113b")
+	got := siprocket.MarshalSipAuth(&auth)
+	if !strings.Contains(got, `response="6629fae49393a05397450978507c4ef1"`) || !strings.Contains(got, `nc=00000001, cnonce="0a4f113b"`) {
+		t.Errorf("Bad credentials: %s", got)
+	}
+
+	// Without qop, RFC 2069
+	ch.qop = ""
+	auth = credentials(ch, "Mufasa", "Circle Of Life", "GET", "/dir/index.html", "0a4f113b")
+	if auth.Qop != nil || string(auth.Response) != "670fd8c2df070c60b045671b8b24ff02" {
+		t.Errorf("Bad credentials: %s", siprocket.MarshalSipAuth(&auth))
+	}
+
+	if _, ok := parseChallenge(`Digest realm="x", nonce="y", algorithm=AKAv1-MD5`); ok {
+		t.Errorf("Unsupported algorithm accepted")
+	}
+	if _, ok := parseChallenge(`Basic realm="x"`); ok {
+		t.Errorf("Basic accepted")
+	}
+}
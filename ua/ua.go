@@ -0,0 +1,476 @@
+// Package ua is a SIP user agent on top of the transport and transaction
+// packages. It registers, places and answers calls and sends the requests
+// of a dialog, which makes it suited to scripted call flows in tests.
+package ua
+
+/*
+ RFC 3261 - https://www.ietf.org/rfc/rfc3261.txt - 8 General User Agent Behavior
+
+   User agents represent an end system.  It contains a user agent client
+   (UAC), which generates requests, and a user agent server (UAS), which
+   responds to them.  A UAC is capable of generating a request based on
+   some external stimulus (the user clicking a button, or a signal on a
+   PSTN line) and processing a response.  A UAS is capable of receiving a
+   request and generating a response based on user input, external
+   stimulus, the result of a program execution, or some other mechanism.
+
+ 10.2 Constructing the REGISTER Request
+
+   Call-ID: All registrations from a UAC SHOULD use the same Call-ID
+        header field value for registrations sent to a particular
+        registrar.
+
+   CSeq: The CSeq value guarantees proper ordering of REGISTER
+        requests.  A UA MUST increment the CSeq value by one for each
+        REGISTER request with the same Call-ID.
+
+ Requests are sent to the Outbound address when one is set and the
+ request has no Route, otherwise to the next hop given by proxy.NextHop.
+ A request challenged with 401 or 407 is sent once more with the
+ credentials of the UA.
+
+*/
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/nullboundary/siprocket"
+	"github.com/nullboundary/siprocket/proxy"
+	"github.com/nullboundary/siprocket/transaction"
+	"github.com/nullboundary/siprocket/transport"
+)
+
+// CALL_BUFFER is the number of incoming calls and events held until they
+// are read
+const CALL_BUFFER = 32
+
+var (
+	ErrTimeout  = errors.New("ua: no final response")
+	ErrState    = errors.New("ua: not allowed in the state of the call")
+	ErrOverflow = errors.New("ua: event dropped as nobody reads the channel")
+)
+
+// ResponseError is a final response other than 2xx to a request of the UA
+type ResponseError struct {
+	Code   int
+	Reason string
+	Msg    *siprocket.SipMsg
+}
+
+func (e *ResponseError) Error() string {
+	return "ua: " + strconv.Itoa(e.Code) + " " + e.Reason
+}
+
+// UA is a user agent client and server. Set Handle as the Handler of its
+// Transport, incoming calls are given on Calls.
+type UA struct {
+	Transport *transport.Transport
+	Proto     string             // Transport of the requests, udp when empty
+	Host      string             // Host of the UA in Via and Contact
+	Port      int                // Port of the UA, 5060 when zero
+	User      string             // User part of the address of record
+	Domain    string             // Domain of the address of record, the registrar
+	Name      string             // Display name, optional
+	Username  string             // Digest username, User when empty
+	Password  string             // Digest password, no retry on 401 and 407 when empty
+	Outbound  string             // Host and port requests without a Route go to, optional
+	Clock     transaction.Clock  // Defaults to transaction.SystemClock
+	Timers    transaction.Timers // Zero fields default to transaction.DefaultTimers
+	OnError   func(error)        // Called for messages that are dropped, optional
+
+	Calls chan *Call // Incoming calls, answer or reject each of them
+
+	table  *transaction.Table
+	mu     sync.Mutex
+	calls  map[dialogKey]*Call
+	regId  string // Call-ID of the registrations
+	regSeq int
+}
+
+func New(t *transport.Transport, user, domain, host string, port int) *UA {
+	return &UA{
+		Transport: t,
+		Host:      host,
+		Port:      port,
+		User:      user,
+		Domain:    domain,
+		Calls:     make(chan *Call, CALL_BUFFER),
+		table:     transaction.NewTable(),
+		calls:     make(map[dialogKey]*Call),
+		regId:     siprocket.NewCallId(),
+	}
+}
+
+// Handle passes a message received by the transport to its transaction or
+// its call
+func (u *UA) Handle(m *transport.Message) {
+	msg := siprocket.ParseLossless(m.Raw)
+
+	if len(msg.Req.StatusCode) > 0 {
+		if c, ok := u.table.MatchResponse(&msg); ok {
+			c.Receive(&msg)
+			return
+		}
+		// A 2xx retransmitted as our ACK was lost
+		if call := u.call(&msg, false); call != nil {
+			call.resendAck(&msg)
+		}
+		return
+	}
+
+	transport.SetReceived(&msg, m.Tuple.Src)
+	if srv, ok := u.table.MatchRequest(&msg); ok {
+		srv.Receive(&msg)
+		return
+	}
+
+	switch {
+	case string(msg.Req.Method) == "ACK":
+		if call := u.call(&msg, true); call != nil {
+			call.ack(&msg)
+		}
+	case string(msg.Req.Method) == "CANCEL":
+		u.cancel(&msg, m.Tuple.Proto)
+	case len(msg.To.Tag) == 0 && string(msg.Req.Method) == "INVITE":
+		u.incoming(&msg, m.Tuple.Proto)
+	case len(msg.To.Tag) == 0:
+		u.outOfDialog(&msg, m.Tuple.Proto)
+	default:
+		call := u.call(&msg, true)
+		if call == nil {
+			u.reply(&msg, m.Tuple.Proto, 481)
+			return
+		}
+		call.request(&msg, m.Tuple.Proto)
+	}
+}
+
+// Register binds the Contact of the UA to its address of record for
+// expires seconds, zero removes the binding
+func (u *UA) Register(expires int) error {
+	aor := u.aor()
+	u.mu.Lock()
+	u.regSeq++
+	seq := u.regSeq
+	u.mu.Unlock()
+
+	req, err := siprocket.NewRequest("REGISTER", "sip:"+u.Domain).
+		From(aor).
+		To(aor).
+		CallId(u.regId).
+		Cseq(seq).
+		Via(u.proto(), u.Host, u.port()).
+		Contact(u.contact()).
+		Expires(expires).
+		Build()
+	if err != nil {
+		return err
+	}
+
+	resp, err := u.transact(&req, nil)
+	if n, err := strconv.Atoi(string(req.Cseq.Id)); err == nil {
+		u.mu.Lock()
+		if n > u.regSeq {
+			u.regSeq = n
+		}
+		u.mu.Unlock()
+	}
+	if err != nil {
+		return err
+	}
+	return responseError(resp)
+}
+
+// Invite places a call to uri with an SDP offer, it returns once the call
+// is answered or with a *ResponseError once it failed. The provisional
+// responses are given on the Events of the call, which is also returned
+// along with an error.
+func (u *UA) Invite(uri string, offer []byte) (*Call, error) {
+	b := siprocket.NewRequest("INVITE", uri).
+		From(u.aor()).
+		Via(u.proto(), u.Host, u.port()).
+		Contact(u.contact()).
+		Allow(allowMethods...)
+	if offer != nil {
+		b.Body(CONTENT_SDP, offer)
+	}
+	req, err := b.Build()
+	if err != nil {
+		return nil, err
+	}
+
+	call := newCall(u, &req, nil)
+	call.localSdp = offer
+	resp, err := u.transact(&req, call.provisional)
+	if err == nil {
+		err = call.answered(resp)
+	}
+	if err != nil {
+		call.terminate(nil)
+	}
+	return call, err
+}
+
+// transact sends a request in a client transaction and waits for its final
+// response. A 401 or 407 is answered once with the credentials of the UA,
+// the request is then sent again with its CSeq number one higher.
+// Provisional responses are passed to provisional, which may be nil.
+func (u *UA) transact(req *siprocket.SipMsg, provisional func(*siprocket.SipMsg)) (*siprocket.SipMsg, error) {
+	resp, err := u.send(req, provisional)
+	if err != nil || u.Password == "" {
+		return resp, err
+	}
+	code := statusCode(resp)
+	if code != 401 && code != 407 {
+		return resp, nil
+	}
+	if !u.authorize(req, resp) {
+		return resp, nil
+	}
+
+	n, _ := strconv.Atoi(string(req.Cseq.Id))
+	req.Cseq.Id = []byte(strconv.Itoa(n + 1))
+	req.Cseq.Src = nil
+	req.MarkDirty(siprocket.HEADER_CSEQ)
+	via := req.Via[0]
+	via.SetParam("branch", siprocket.NewBranch())
+	req.SetTopVia(via)
+	return u.send(req, provisional)
+}
+
+// send runs one client transaction for req
+func (u *UA) send(req *siprocket.SipMsg, provisional func(*siprocket.SipMsg)) (*siprocket.SipMsg, error) {
+	final := make(chan *siprocket.SipMsg, 1)
+	failed := make(chan error, 1)
+	c, err := transaction.NewClient(req, u.config(u.hop(req)), transaction.ClientHandler{
+		Response: func(resp *siprocket.SipMsg) {
+			if statusCode(resp) < 200 {
+				if provisional != nil {
+					provisional(resp)
+				}
+				return
+			}
+			select {
+			case final <- resp:
+			default:
+			}
+		},
+		Timeout: func() {
+			select {
+			case failed <- ErrTimeout:
+			default:
+			}
+		},
+		TransportError: func(err error) {
+			select {
+			case failed <- err:
+			default:
+			}
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	u.table.AddClient(c)
+	c.Start()
+
+	select {
+	case resp := <-final:
+		return resp, nil
+	case err := <-failed:
+		return nil, err
+	}
+}
+
+// sendAck sends the ACK of a 2xx, which is not part of a transaction
+func (u *UA) sendAck(ack *siprocket.SipMsg) error {
+	hop := u.hop(ack)
+	return u.Transport.SendRequest(hop.Proto, hop.Addr, ack)
+}
+
+// hop gives where a request of the UA is sent
+func (u *UA) hop(req *siprocket.SipMsg) proxy.Hop {
+	if u.Outbound != "" && len(req.Route) == 0 {
+		return proxy.Hop{Proto: u.proto(), Addr: u.Outbound}
+	}
+	hop, err := proxy.NextHop(req)
+	if err != nil {
+		return proxy.Hop{Proto: u.proto()}
+	}
+	return hop
+}
+
+// config returns the transaction settings for messages sent to hop
+func (u *UA) config(hop proxy.Hop) transaction.Config {
+	return transaction.Config{
+		Send: func(msg *siprocket.SipMsg) error {
+			if len(msg.Req.StatusCode) > 0 {
+				return u.Transport.Respond(msg)
+			}
+			return u.Transport.SendRequest(hop.Proto, hop.Addr, msg)
+		},
+		Reliable: hop.Proto != transport.PROTO_UDP,
+		Clock:    u.Clock,
+		Timers:   u.Timers,
+	}
+}
+
+// server creates the server transaction of a received request
+func (u *UA) server(req *siprocket.SipMsg, proto string) (*transaction.Server, error) {
+	srv, err := transaction.NewServer(req, u.config(proxy.Hop{Proto: proto}), transaction.ServerHandler{
+		TransportError: u.error,
+	})
+	if err != nil {
+		return nil, err
+	}
+	u.table.AddServer(srv)
+	return srv, nil
+}
+
+// reply answers a request in a server transaction of its own
+func (u *UA) reply(req *siprocket.SipMsg, proto string, code int) {
+	srv, err := u.server(req, proto)
+	if err != nil {
+		u.error(err)
+		return
+	}
+	resp, err := siprocket.NewResponse(req, code, "").Build()
+	if err != nil {
+		u.error(err)
+		return
+	}
+	u.error(srv.Respond(&resp))
+}
+
+// incoming starts a call for an INVITE outside of a dialog
+func (u *UA) incoming(req *siprocket.SipMsg, proto string) {
+	u.table.Purge()
+	srv, err := u.server(req, proto)
+	if err != nil {
+		u.error(err)
+		return
+	}
+	call := newCall(u, req, srv)
+
+	select {
+	case u.Calls <- call:
+	default:
+		u.error(ErrOverflow)
+		call.Reject(486)
+	}
+}
+
+// cancel answers a CANCEL and ends the call it cancels when it has not
+// been answered yet
+func (u *UA) cancel(req *siprocket.SipMsg, proto string) {
+	srv, ok := u.table.MatchCancel(req)
+	if !ok {
+		u.reply(req, proto, 481)
+		return
+	}
+	u.reply(req, proto, 200)
+
+	u.mu.Lock()
+	var call *Call
+	for _, c := range u.calls {
+		if c.srv == srv {
+			call = c
+		}
+	}
+	u.mu.Unlock()
+	if call != nil {
+		call.cancelled(req)
+	}
+}
+
+// outOfDialog answers the requests that need no dialog
+func (u *UA) outOfDialog(req *siprocket.SipMsg, proto string) {
+	switch string(req.Req.Method) {
+	case "OPTIONS":
+		u.reply(req, proto, 200)
+	default:
+		u.reply(req, proto, 405)
+	}
+}
+
+// call finds the call of an in dialog message, local tells if the local
+// tag of the dialog is in the To header as for requests
+func (u *UA) call(msg *siprocket.SipMsg, local bool) *Call {
+	key := dialogKey{callId: string(msg.CallId.Value), localTag: string(msg.From.Tag)}
+	if local {
+		key.localTag = string(msg.To.Tag)
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.calls[key]
+}
+
+func (u *UA) addCall(c *Call) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.calls[c.key] = c
+}
+
+func (u *UA) removeCall(c *Call) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.calls[c.key] == c {
+		delete(u.calls, c.key)
+	}
+}
+
+// aor returns the address of record of the UA as a name-addr
+func (u *UA) aor() string {
+	addr := "<sip:" + u.User + "@" + u.Domain + ">"
+	if u.Name != "" {
+		addr = strconv.Quote(u.Name) + " " + addr
+	}
+	return addr
+}
+
+// contact returns the Contact of the UA as a name-addr
+func (u *UA) contact() string {
+	addr := "sip:" + u.User + "@" + u.Host + ":" + u.port()
+	if u.proto() != transport.PROTO_UDP {
+		addr += ";transport=" + u.proto()
+	}
+	return "<" + addr + ">"
+}
+
+func (u *UA) proto() string {
+	if u.Proto == "" {
+		return transport.PROTO_UDP
+	}
+	return strings.ToLower(u.Proto)
+}
+
+func (u *UA) port() string {
+	if u.Port == 0 {
+		return "5060"
+	}
+	return strconv.Itoa(u.Port)
+}
+
+func (u *UA) error(err error) {
+	if err != nil && u.OnError != nil {
+		u.OnError(err)
+	}
+}
+
+// responseError returns a *ResponseError for a final response other than
+// 2xx, nil otherwise
+func responseError(resp *siprocket.SipMsg) error {
+	code := statusCode(resp)
+	if code >= 200 && code < 300 {
+		return nil
+	}
+	return &ResponseError{Code: code, Reason: string(resp.Req.StatusDesc), Msg: resp}
+}
+
+func statusCode(resp *siprocket.SipMsg) int {
+	code, _ := strconv.Atoi(string(resp.Req.StatusCode))
+	return code
+}
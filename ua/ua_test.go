@@ -0,0 +1,272 @@
+package ua
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nullboundary/siprocket"
+	"github.com/nullboundary/siprocket/transport"
+)
+
+func sdp(user string, port int) []byte {
+	return []byte("v=0\r\n" +
+		"o=" + user + " 1 1 IN IP4 127.0.0.1\r\n" +
+		"s=-\r\n" +
+		"c=IN IP4 127.0.0.1\r\n" +
+		"t=0 0\r\n" +
+		"m=audio " + strconv.Itoa(port) + " RTP/AVP 0\r\n" +
+		"a=rtpmap:0 PCMU/8000\r\n")
+}
+
+// agent is a UA on loopback UDP whose domain is domain, its own address
+// when empty
+func agent(t *testing.T, user, domain string) *UA {
+	var u *UA
+	ready := make(chan struct{})
+	tr := transport.New()
+	t.Cleanup(func() { tr.Close() })
+	tr.Handler = func(m *transport.Message) {
+		<-ready
+		u.Handle(m)
+	}
+	addr, err := tr.ListenUDP("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenUDP: %v", err)
+	}
+	if domain == "" {
+		domain = addr.String()
+	}
+	u = New(tr, user, domain, "127.0.0.1", int(addr.Port()))
+	u.OnError = func(err error) {
+		// Retransmissions may outlive the test
+		if !errors.Is(err, transport.ErrClosed) {
+			t.Errorf("%s: %v", user, err)
+		}
+	}
+	close(ready)
+	return u
+}
+
+func next(t *testing.T, c *Call, typ string) Event {
+	t.Helper()
+	select {
+	case e := <-c.Events:
+		if e.Type != typ {
+			t.Fatalf("Mismatch:\nExpected:\n%+v\nGot:\n%+v", typ, e.Type)
+		}
+		return e
+	case <-time.After(5 * time.Second):
+		t.Fatalf("No %s event", typ)
+	}
+	return Event{}
+}
+
+func incoming(t *testing.T, u *UA) *Call {
+	t.Helper()
+	select {
+	case c := <-u.Calls:
+		return c
+	case <-time.After(5 * time.Second):
+		t.Fatalf("No incoming call")
+	}
+	return nil
+}
+
+type result struct {
+	call *Call
+	err  error
+}
+
+func Test_ua_Register(t *testing.T) {
+
+	// The registrar is a bare transport
+	reg := transport.New()
+	defer reg.Close()
+	regIn := make(chan *transport.Message, 8)
+	reg.Handler = func(m *transport.Message) { regIn <- m }
+	regAddr, err := reg.ListenUDP("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	alice := agent(t, "alice", regAddr.String())
+	alice.Password = "secret"
+	done := make(chan error, 1)
+	go func() { done <- alice.Register(300) }()
+
+	var first siprocket.SipMsg
+	select {
+	case m := <-regIn:
+		first = siprocket.ParseLossless(m.Raw)
+	case <-time.After(5 * time.Second):
+		t.Fatal("No REGISTER")
+	}
+	challenge, _ := siprocket.NewResponse(&first, 401, "").Build()
+	challenge.AddHeader("WWW-Authenticate", `Digest realm="atlanta.com", nonce="84a4cc6f3082121f32b42a2187831a9e", qop="auth"`)
+	if err := reg.Respond(&challenge); err != nil {
+		t.Fatal(err)
+	}
+
+	var second siprocket.SipMsg
+	select {
+	case m := <-regIn:
+		second = siprocket.ParseLossless(m.Raw)
+	case <-time.After(5 * time.Second):
+		t.Fatal("No REGISTER with credentials")
+	}
+	if string(second.CallId.Value) != string(first.CallId.Value) || string(second.Cseq.Id) == string(first.Cseq.Id) {
+		t.Errorf("Bad retry: %q %q", second.CallId.Value, second.Cseq.Id)
+	}
+
+	// Only the branch of the Via changes
+	via := strings.Replace(string(first.HeaderValues("Via")[0]), string(first.Via[0].Branch), string(second.Via[0].Branch), 1)
+	if string(second.Via[0].Branch) == string(first.Via[0].Branch) || string(second.HeaderValues("Via")[0]) != via {
+		t.Errorf("Bad retry Via: %q %q", first.HeaderValues("Via"), second.HeaderValues("Via"))
+	}
+
+	// The registrar checks the response to its challenge
+	auth := second.HeaderValues("Authorization")
+	if len(auth) != 1 {
+		t.Fatalf("Bad Authorization: %q", auth)
+	}
+	cnonce := ""
+	for _, param := range splitParams(string(auth[0])) {
+		if key, val, _ := strings.Cut(strings.TrimSpace(param), "="); key == "cnonce" {
+			cnonce = strings.Trim(val, `"`)
+		}
+	}
+	ch, _ := parseChallenge(string(challenge.HeaderValues("WWW-Authenticate")[0]))
+	exp := credentials(ch, "alice", "secret", "REGISTER", "sip:"+regAddr.String(), cnonce)
+	if !strings.Contains(string(auth[0]), `response="`+string(exp.Response)+`"`) {
+		t.Errorf("Mismatch:\nExpected:\n%+v\nGot:\n%+v", string(exp.Response), string(auth[0]))
+	}
+
+	ok, _ := siprocket.NewResponse(&second, 200, "").Build()
+	if err := reg.Respond(&ok); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Register: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Register did not return")
+	}
+}
+
+func Test_ua_CallFlow(t *testing.T) {
+
+	alice := agent(t, "alice", "")
+	bob := agent(t, "bob", "")
+
+	results := make(chan result, 1)
+	go func() {
+		call, err := alice.Invite("sip:bob@"+bob.Domain, sdp("alice", 4000))
+		results <- result{call, err}
+	}()
+
+	in := incoming(t, bob)
+	if !strings.Contains(string(in.RemoteSdp()), "m=audio 4000") {
+		t.Errorf("Bad offer: %q", in.RemoteSdp())
+	}
+	if err := in.Progress(180, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := in.Answer(sdp("bob", 5000)); err != nil {
+		t.Fatal(err)
+	}
+
+	res := <-results
+	if res.err != nil {
+		t.Fatalf("Invite: %v", res.err)
+	}
+	out := res.call
+	next(t, out, EVENT_PROGRESS)
+	next(t, out, EVENT_ANSWERED)
+	next(t, in, EVENT_CONFIRMED)
+	if out.State() != CALL_CONFIRMED || in.State() != CALL_CONFIRMED {
+		t.Errorf("Bad states: %s %s", out.State(), in.State())
+	}
+	if !strings.Contains(string(out.RemoteSdp()), "m=audio 5000") {
+		t.Errorf("Bad answer: %q", out.RemoteSdp())
+	}
+
+	// A re-INVITE is answered with the last session description
+	if err := out.Reinvite(sdp("alice", 4002)); err != nil {
+		t.Fatalf("Reinvite: %v", err)
+	}
+	next(t, in, EVENT_REINVITE)
+	next(t, in, EVENT_CONFIRMED)
+	if !strings.Contains(string(in.RemoteSdp()), "m=audio 4002") || !strings.Contains(string(out.RemoteSdp()), "m=audio 5000") {
+		t.Errorf("Bad offer and answer: %q %q", in.RemoteSdp(), out.RemoteSdp())
+	}
+
+	if err := out.Update(sdp("alice", 4004)); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	next(t, in, EVENT_UPDATE)
+	if !strings.Contains(string(in.RemoteSdp()), "m=audio 4004") {
+		t.Errorf("Bad offer: %q", in.RemoteSdp())
+	}
+
+	if err := out.Info("application/dtmf-relay", []byte("Signal=5\r\nDuration=160\r\n")); err != nil {
+		t.Fatalf("Info: %v", err)
+	}
+	if e := next(t, in, EVENT_INFO); !strings.Contains(string(e.Msg.Body), "Signal=5") {
+		t.Errorf("Bad INFO: %q", e.Msg.Body)
+	}
+
+	// Requests go both ways
+	if err := in.Refer("sip:carol@chicago.com"); err != nil {
+		t.Fatalf("Refer: %v", err)
+	}
+	e := next(t, out, EVENT_REFER)
+	if to := e.Msg.HeaderValues("Refer-To"); len(to) != 1 || string(to[0]) != "<sip:carol@chicago.com>" {
+		t.Errorf("Bad Refer-To: %q", to)
+	}
+
+	if err := in.Bye(); err != nil {
+		t.Fatalf("Bye: %v", err)
+	}
+	next(t, out, EVENT_BYE)
+	next(t, out, EVENT_TERMINATED)
+	next(t, in, EVENT_TERMINATED)
+	if out.State() != CALL_TERMINATED || in.State() != CALL_TERMINATED {
+		t.Errorf("Bad states: %s %s", out.State(), in.State())
+	}
+	if err := out.Bye(); !errors.Is(err, ErrState) {
+		t.Errorf("Bye after the call: %v", err)
+	}
+}
+
+func Test_ua_Reject(t *testing.T) {
+
+	alice := agent(t, "alice", "")
+	bob := agent(t, "bob", "")
+
+	results := make(chan result, 1)
+	go func() {
+		call, err := alice.Invite("sip:bob@"+bob.Domain, sdp("alice", 4000))
+		results <- result{call, err}
+	}()
+
+	in := incoming(t, bob)
+	if err := in.Reject(486); err != nil {
+		t.Fatal(err)
+	}
+	next(t, in, EVENT_TERMINATED)
+
+	res := <-results
+	var status *ResponseError
+	if !errors.As(res.err, &status) || status.Code != 486 {
+		t.Fatalf("Bad error: %v", res.err)
+	}
+	next(t, res.call, EVENT_TERMINATED)
+	if err := in.Answer(nil); !errors.Is(err, ErrState) {
+		t.Errorf("Answer after Reject: %v", err)
+	}
+}